@@ -0,0 +1,361 @@
+// Package admin implements Vortice's administrative HTTP API, used to inspect
+// and change pools and backends at runtime. It is meant to be served on its
+// own listener, separate from proxied traffic.
+//
+// Pools are addressed by name ("_" is the unnamed pool) and backends by URL
+// (path-escaped) or by host:port:
+//
+//	GET    /pools                                   list pools and backends
+//	GET    /pools/{pool}                            one pool
+//	POST   /pools/{pool}/backends                   add {"url", "weight", "rate_limit": {"rps", "burst"}}
+//	GET    /pools/{pool}/backends/{backend}         one backend
+//	DELETE /pools/{pool}/backends/{backend}         remove
+//	POST   /pools/{pool}/backends/{backend}/drain   stop new sessions
+//	POST   /pools/{pool}/backends/{backend}/disable stop all traffic
+//	POST   /pools/{pool}/backends/{backend}/enable  back in rotation
+//	PUT    /pools/{pool}/backends/{backend}/weight      {"weight": n}
+//	PUT    /pools/{pool}/backends/{backend}/rate_limit  {"rps": n, "burst": n}
+//	POST   /pools/{pool}/backends/{backend}/health  run the health check now
+//	POST   /pools/{pool}/health                     health check every backend now
+//
+// Changes last until the next configuration reload, which rebuilds the pools
+// from the configuration (backends kept by the reload keep their state).
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/domain"
+)
+
+// UnnamedPool is the path segment addressing the pool without a name.
+const UnnamedPool = "_"
+
+// RouterFunc returns the router currently in effect.
+type RouterFunc func() *domain.Router
+
+// BackendState is the JSON view of a backend.
+type BackendState struct {
+	URL       string     `json:"url"`
+	Alive     bool       `json:"alive"`
+	State     string     `json:"state"`
+	Weight    int        `json:"weight"`
+	Conns     int64      `json:"active_conns"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+	LatencyMs float64    `json:"latency_ewma_ms"`
+	// EjectedUntil is set while outlier detection keeps the backend out
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	// Circuit is the circuit breaker state, empty when the pool has none
+	Circuit string `json:"circuit,omitempty"`
+}
+
+// RateLimit is a backend rate limit; RPS 0 removes it.
+type RateLimit struct {
+	RPS   int `json:"rps"`
+	Burst int `json:"burst"`
+}
+
+// PoolState is the JSON view of a pool.
+type PoolState struct {
+	Name      string         `json:"name"`
+	Algorithm string         `json:"algorithm"`
+	Backends  []BackendState `json:"backends"`
+}
+
+type api struct {
+	router RouterFunc
+	token  string
+	// mu serializes mutations so concurrent adds of the same URL cannot
+	// both succeed
+	mu sync.Mutex
+}
+
+// Handler returns the admin API. When token is not empty every request must
+// carry "Authorization: Bearer <token>".
+func Handler(router RouterFunc, token string) http.Handler {
+	a := &api{router: router, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /pools", a.listPools)
+	mux.HandleFunc("GET /pools/{pool}", a.getPool)
+	mux.HandleFunc("POST /pools/{pool}/health", a.checkPool)
+	mux.HandleFunc("POST /pools/{pool}/backends", a.addBackend)
+	mux.HandleFunc("GET /pools/{pool}/backends/{backend}", a.getBackend)
+	mux.HandleFunc("DELETE /pools/{pool}/backends/{backend}", a.removeBackend)
+	mux.HandleFunc("POST /pools/{pool}/backends/{backend}/drain", a.setState(domain.StateDraining))
+	mux.HandleFunc("POST /pools/{pool}/backends/{backend}/disable", a.setState(domain.StateDisabled))
+	mux.HandleFunc("POST /pools/{pool}/backends/{backend}/enable", a.setState(domain.StateEnabled))
+	mux.HandleFunc("PUT /pools/{pool}/backends/{backend}/weight", a.setWeight)
+	mux.HandleFunc("PUT /pools/{pool}/backends/{backend}/rate_limit", a.setRateLimit)
+	mux.HandleFunc("POST /pools/{pool}/backends/{backend}/health", a.checkBackend)
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Bearer " + token
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			writeError(w, http.StatusUnauthorized, "token inválido")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("JSON inválido: %v", err))
+		return false
+	}
+	return true
+}
+
+func backendState(p *domain.ServerPool, b *domain.Backend) BackendState {
+	s := BackendState{
+		URL:       b.URL.String(),
+		Alive:     b.IsAlive(),
+		State:     b.State().String(),
+		Weight:    b.Weight(),
+		Conns:     atomic.LoadInt64(&b.ConnCount),
+		LatencyMs: float64(b.EWMALatency().Microseconds()) / 1000,
+	}
+	if l := b.RateLimiter(); l != nil {
+		s.RateLimit = &RateLimit{RPS: int(l.Limit()), Burst: l.Burst()}
+	}
+	if until := b.EjectedUntil(); !until.IsZero() {
+		s.EjectedUntil = &until
+	}
+	if p.Breaker != nil {
+		s.Circuit = b.Circuit().String()
+	}
+	return s
+}
+
+func poolState(p *domain.ServerPool) PoolState {
+	s := PoolState{Name: p.Name, Algorithm: p.Algorithm, Backends: []BackendState{}}
+	for _, b := range p.Backends() {
+		s.Backends = append(s.Backends, backendState(p, b))
+	}
+	return s
+}
+
+// pool resolves the {pool} path segment, writing a 404 when it is unknown.
+func (a *api) pool(w http.ResponseWriter, r *http.Request) *domain.ServerPool {
+	name := r.PathValue("pool")
+	if name == UnnamedPool {
+		name = ""
+	}
+	for _, p := range a.router().Pools() {
+		if p.Name == name {
+			return p
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("pool %q não encontrado", r.PathValue("pool")))
+	return nil
+}
+
+// backend resolves the {pool} and {backend} path segments, writing a 404
+// when either is unknown.
+func (a *api) backend(w http.ResponseWriter, r *http.Request) (*domain.ServerPool, *domain.Backend) {
+	p := a.pool(w, r)
+	if p == nil {
+		return nil, nil
+	}
+	id := r.PathValue("backend")
+	if b := p.GetBackend(id); b != nil {
+		return p, b
+	}
+	var found *domain.Backend
+	for _, b := range p.Backends() {
+		if b.URL.Host == id {
+			if found != nil {
+				writeError(w, http.StatusConflict, fmt.Sprintf("%q é ambíguo; use a URL completa", id))
+				return nil, nil
+			}
+			found = b
+		}
+	}
+	if found == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backend %q não encontrado", id))
+		return nil, nil
+	}
+	return p, found
+}
+
+func (a *api) listPools(w http.ResponseWriter, r *http.Request) {
+	out := []PoolState{}
+	for _, p := range a.router().Pools() {
+		out = append(out, poolState(p))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *api) getPool(w http.ResponseWriter, r *http.Request) {
+	if p := a.pool(w, r); p != nil {
+		writeJSON(w, http.StatusOK, poolState(p))
+	}
+}
+
+func (a *api) checkPool(w http.ResponseWriter, r *http.Request) {
+	p := a.pool(w, r)
+	if p == nil {
+		return
+	}
+	for _, b := range p.Backends() {
+		p.CheckBackend(b)
+	}
+	writeJSON(w, http.StatusOK, poolState(p))
+}
+
+func (a *api) addBackend(w http.ResponseWriter, r *http.Request) {
+	p := a.pool(w, r)
+	if p == nil {
+		return
+	}
+	var req struct {
+		URL       string     `json:"url"`
+		Weight    *int       `json:"weight"`
+		RateLimit *RateLimit `json:"rate_limit"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("URL inválida %q", req.URL))
+		return
+	}
+	if req.Weight != nil && *req.Weight < 0 {
+		writeError(w, http.StatusBadRequest, "weight não pode ser negativo")
+		return
+	}
+
+	if p.GetBackend(req.URL) != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("backend %q já existe no pool", req.URL))
+		return
+	}
+	rl := RateLimit{Burst: 1}
+	if req.RateLimit != nil {
+		rl = *req.RateLimit
+	}
+	if rl.RPS < 0 || rl.Burst < 0 {
+		writeError(w, http.StatusBadRequest, "rps e burst não podem ser negativos")
+		return
+	}
+	if rl.RPS > 0 && rl.Burst == 0 {
+		rl.Burst = 1
+	}
+	b := domain.NewBackend(req.URL, rl.RPS, rl.Burst)
+	if req.Weight != nil {
+		b.SetWeight(*req.Weight)
+	}
+	// timeouts, upstream TLS and protocol come from the pool, as for the
+	// backends of the config file
+	if err := p.ConfigureBackend(b); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("backend %q: %v", req.URL, err))
+		return
+	}
+	// new backends only get traffic once they pass a health check, run
+	// without the lock so a slow probe does not hold up other calls
+	p.CheckBackend(b)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p.GetBackend(req.URL) != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("backend %q já existe no pool", req.URL))
+		return
+	}
+	p.AddBackend(b)
+	writeJSON(w, http.StatusCreated, backendState(p, b))
+}
+
+func (a *api) getBackend(w http.ResponseWriter, r *http.Request) {
+	if p, b := a.backend(w, r); b != nil {
+		writeJSON(w, http.StatusOK, backendState(p, b))
+	}
+}
+
+func (a *api) removeBackend(w http.ResponseWriter, r *http.Request) {
+	p, b := a.backend(w, r)
+	if b == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if p.RemoveBackend(b.URL.String()) == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backend %q não encontrado", b.URL))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) setState(s domain.BackendState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p, b := a.backend(w, r); b != nil {
+			b.SetState(s)
+			writeJSON(w, http.StatusOK, backendState(p, b))
+		}
+	}
+}
+
+func (a *api) setWeight(w http.ResponseWriter, r *http.Request) {
+	p, b := a.backend(w, r)
+	if b == nil {
+		return
+	}
+	var req struct {
+		Weight *int `json:"weight"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Weight == nil || *req.Weight < 0 {
+		writeError(w, http.StatusBadRequest, "weight deve ser um número >= 0")
+		return
+	}
+	b.SetWeight(*req.Weight)
+	writeJSON(w, http.StatusOK, backendState(p, b))
+}
+
+func (a *api) setRateLimit(w http.ResponseWriter, r *http.Request) {
+	p, b := a.backend(w, r)
+	if b == nil {
+		return
+	}
+	var req RateLimit
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.RPS < 0 || req.Burst < 0 {
+		writeError(w, http.StatusBadRequest, "rps e burst não podem ser negativos")
+		return
+	}
+	if req.RPS > 0 && req.Burst == 0 {
+		req.Burst = 1
+	}
+	b.SetRateLimit(req.RPS, req.Burst)
+	writeJSON(w, http.StatusOK, backendState(p, b))
+}
+
+func (a *api) checkBackend(w http.ResponseWriter, r *http.Request) {
+	if p, b := a.backend(w, r); b != nil {
+		p.CheckBackend(b)
+		writeJSON(w, http.StatusOK, backendState(p, b))
+	}
+}
@@ -0,0 +1,220 @@
+package admin
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/domain"
+)
+
+func newTestAPI(t *testing.T, token string) (http.Handler, *domain.ServerPool, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	pool := &domain.ServerPool{Name: "api", Algorithm: "round_robin"}
+	pool.AddBackend(domain.NewBackend(srv.URL, 0, 1))
+	router := &domain.Router{}
+	router.AddPool(pool)
+	return Handler(func() *domain.Router { return router }, token), pool, srv
+}
+
+func do(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestListPools(t *testing.T) {
+	h, _, srv := newTestAPI(t, "")
+	rr := do(t, h, "GET", "/pools", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var pools []PoolState
+	if err := json.NewDecoder(rr.Body).Decode(&pools); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(pools) != 1 || pools[0].Name != "api" || len(pools[0].Backends) != 1 {
+		t.Fatalf("unexpected pools: %+v", pools)
+	}
+	b := pools[0].Backends[0]
+	if b.URL != srv.URL || b.State != "enabled" || b.Weight != 1 || !b.Alive {
+		t.Fatalf("unexpected backend state: %+v", b)
+	}
+	if rr := do(t, h, "GET", "/pools/web", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown pool, got %d", rr.Code)
+	}
+}
+
+func TestAddAndRemoveBackend(t *testing.T) {
+	h, pool, _ := newTestAPI(t, "")
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	body := `{"url": "` + other.URL + `", "weight": 3, "rate_limit": {"rps": 10, "burst": 5}}`
+	rr := do(t, h, "POST", "/pools/api/backends", body)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+	b := pool.GetBackend(other.URL)
+	if b == nil || b.Weight() != 3 || b.RateLimiter() == nil || !b.IsAlive() {
+		t.Fatalf("backend not added as requested")
+	}
+	if rr := do(t, h, "POST", "/pools/api/backends", body); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for duplicate, got %d", rr.Code)
+	}
+	if rr := do(t, h, "POST", "/pools/api/backends", `{"url": "nope"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid url, got %d", rr.Code)
+	}
+
+	host := strings.TrimPrefix(other.URL, "http://")
+	if rr := do(t, h, "DELETE", "/pools/api/backends/"+host, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if pool.GetBackend(other.URL) != nil {
+		t.Fatalf("backend not removed")
+	}
+	if rr := do(t, h, "DELETE", "/pools/api/backends/"+host, ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after removal, got %d", rr.Code)
+	}
+}
+
+func TestAddBackend_RateLimit(t *testing.T) {
+	h, pool, _ := newTestAPI(t, "")
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	if rr := do(t, h, "POST", "/pools/api/backends", `{"url": "`+other.URL+`", "rate_limit": {"rps": -1}}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative rps, got %d", rr.Code)
+	}
+	if rr := do(t, h, "POST", "/pools/api/backends", `{"url": "`+other.URL+`", "rate_limit": {"rps": 10}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+	l := pool.GetBackend(other.URL).RateLimiter()
+	if l == nil || l.Burst() != 1 || !l.Allow() {
+		t.Fatalf("expected burst 1 when only rps is given, got %+v", l)
+	}
+}
+
+func TestAddBackend_SlowCheckDoesNotBlock(t *testing.T) {
+	h, pool, _ := newTestAPI(t, "")
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	go do(t, h, "POST", "/pools/api/backends", `{"url": "`+slow.URL+`"}`)
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan int, 1)
+	go func() {
+		done <- do(t, h, "POST", "/pools/api/backends", `{"url": "`+fast.URL+`"}`).Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusCreated || pool.GetBackend(fast.URL) == nil {
+			t.Fatalf("expected 201, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a slow health check blocked another admin call")
+	}
+}
+
+func TestAddBackend_PoolDefaults(t *testing.T) {
+	h, pool, _ := newTestAPI(t, "")
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw})
+	pool.Timeouts = &domain.Timeouts{Connect: time.Second}
+	pool.UpstreamTLS = &domain.UpstreamTLS{CA: ca}
+	pool.Protocol = domain.ProtocolH2
+
+	if rr := do(t, h, "POST", "/pools/api/backends", `{"url": "`+tlsSrv.URL+`"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+	b := pool.GetBackend(tlsSrv.URL)
+	// the health check only passes with the pool's CA
+	if !b.IsAlive() || b.UpstreamTLS() != pool.UpstreamTLS {
+		t.Fatal("expected the pool's upstream TLS on the new backend")
+	}
+	if b.Protocol() != domain.ProtocolH2 || b.Timeouts() != pool.Timeouts {
+		t.Fatalf("expected the pool's protocol and timeouts, got %q %+v", b.Protocol(), b.Timeouts())
+	}
+
+	// h2 needs TLS: the http backend is rejected
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	if rr := do(t, h, "POST", "/pools/api/backends", `{"url": "`+plain.URL+`"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a protocol the backend cannot use, got %d", rr.Code)
+	}
+	if pool.GetBackend(plain.URL) != nil {
+		t.Fatal("rejected backend added to the pool")
+	}
+}
+
+func TestBackendActions(t *testing.T) {
+	h, pool, srv := newTestAPI(t, "")
+	b := pool.GetBackend(srv.URL)
+	// backends can be addressed by their escaped URL as well as host:port
+	path := "/pools/api/backends/" + url.PathEscape(srv.URL)
+
+	for action, want := range map[string]domain.BackendState{
+		"drain":   domain.StateDraining,
+		"disable": domain.StateDisabled,
+		"enable":  domain.StateEnabled,
+	} {
+		if rr := do(t, h, "POST", path+"/"+action, ""); rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", action, rr.Code, rr.Body)
+		}
+		if b.State() != want {
+			t.Fatalf("%s: expected state %s, got %s", action, want, b.State())
+		}
+	}
+
+	if rr := do(t, h, "PUT", path+"/weight", `{"weight": 7}`); rr.Code != http.StatusOK || b.Weight() != 7 {
+		t.Fatalf("weight not changed: %d %s", rr.Code, rr.Body)
+	}
+	if rr := do(t, h, "PUT", path+"/weight", `{"weight": -1}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative weight, got %d", rr.Code)
+	}
+	if rr := do(t, h, "PUT", path+"/rate_limit", `{"rps": 20, "burst": 4}`); rr.Code != http.StatusOK {
+		t.Fatalf("rate limit not changed: %d %s", rr.Code, rr.Body)
+	}
+	if l := b.RateLimiter(); l == nil || l.Limit() != 20 || l.Burst() != 4 {
+		t.Fatalf("unexpected limiter %+v", l)
+	}
+
+	b.SetAlive(false)
+	if rr := do(t, h, "POST", path+"/health", ""); rr.Code != http.StatusOK || !b.IsAlive() {
+		t.Fatalf("forced health check should mark backend alive: %d", rr.Code)
+	}
+}
+
+func TestToken(t *testing.T) {
+	h, _, _ := newTestAPI(t, "s3cret")
+	if rr := do(t, h, "GET", "/pools", ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rr.Code)
+	}
+	req := httptest.NewRequest("GET", "/pools", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 with token, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Vime-Sistemas/vortice/config"
+)
+
+// ACME defaults and pacing: the certificates are checked every
+// acmeCheckInterval and, after a failure, again after acmeRetryInterval;
+// each issuance must finish within acmeTimeout.
+const (
+	defaultACMECacheDir    = "acme-cache"
+	defaultACMERenewBefore = 30 * 24 * time.Hour
+	acmeChallengePath      = "/.well-known/acme-challenge/"
+	acmeTimeout            = 5 * time.Minute
+)
+
+var (
+	acmeCheckInterval = 12 * time.Hour
+	acmeRetryInterval = 10 * time.Minute
+)
+
+// acmeChallenges holds the HTTP-01 key authorizations being validated by
+// the CA, shared by every ACME manager and served by the plain listeners.
+type acmeChallenges struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func newACMEChallenges() *acmeChallenges {
+	return &acmeChallenges{tokens: map[string]string{}}
+}
+
+func (c *acmeChallenges) set(token, keyAuth string) {
+	c.mu.Lock()
+	c.tokens[token] = keyAuth
+	c.mu.Unlock()
+}
+
+func (c *acmeChallenges) remove(token string) {
+	c.mu.Lock()
+	delete(c.tokens, token)
+	c.mu.Unlock()
+}
+
+// handler answers the HTTP-01 challenges in progress and passes every other
+// request, including unknown tokens, on to next.
+func (c *acmeChallenges) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePath)
+		if ok {
+			c.mu.RLock()
+			keyAuth, found := c.tokens[token]
+			c.mu.RUnlock()
+			if found {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acmeCertificates returns the cache files of the certificates obtained for
+// spec, one pair per domain.
+func acmeCertificates(spec *config.ACMESpec) []config.CertificateSpec {
+	if spec == nil {
+		return nil
+	}
+	dir := acmeCacheDir(spec)
+	out := make([]config.CertificateSpec, 0, len(spec.Domains))
+	for _, d := range spec.Domains {
+		d = strings.ToLower(d)
+		out = append(out, config.CertificateSpec{Cert: filepath.Join(dir, d+".crt"), Key: filepath.Join(dir, d+".key")})
+	}
+	return out
+}
+
+func acmeCacheDir(spec *config.ACMESpec) string {
+	if spec.CacheDir != "" {
+		return spec.CacheDir
+	}
+	return defaultACMECacheDir
+}
+
+// acmeManager obtains the certificates of spec from an ACME CA, writes them
+// to the cache directory and renews them before they expire. The TLS
+// listener serves them through store.
+type acmeManager struct {
+	spec        *config.ACMESpec
+	client      *acme.Client
+	challenges  *acmeChallenges
+	store       *certStore
+	renewBefore time.Duration
+	registered  bool
+}
+
+func newACMEManager(spec *config.ACMESpec, store *certStore, challenges *acmeChallenges) (*acmeManager, error) {
+	m := &acmeManager{
+		spec:        spec,
+		challenges:  challenges,
+		store:       store,
+		renewBefore: spec.RenewBefore,
+		client: &acme.Client{
+			DirectoryURL: spec.DirectoryURL,
+			UserAgent:    "vortice",
+		},
+	}
+	if m.client.DirectoryURL == "" {
+		m.client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if m.renewBefore == 0 {
+		m.renewBefore = defaultACMERenewBefore
+	}
+	if spec.DirectoryCA != "" {
+		pemCerts, err := os.ReadFile(spec.DirectoryCA)
+		if err != nil {
+			return nil, fmt.Errorf("acme.directory_ca: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("acme.directory_ca: nenhum certificado em %s", spec.DirectoryCA)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+		m.client.HTTPClient = &http.Client{Transport: tr}
+	}
+	if err := os.MkdirAll(acmeCacheDir(spec), 0o700); err != nil {
+		return nil, fmt.Errorf("acme.cache_dir: %v", err)
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, fmt.Errorf("acme: chave da conta: %v", err)
+	}
+	m.client.Key = key
+	return m, nil
+}
+
+// accountKey loads the account key from the cache, creating it on first use.
+func (m *acmeManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(acmeCacheDir(m.spec), "account.key")
+	if b, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: PEM inválido", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// run keeps the certificates up to date until ctx is done.
+func (m *acmeManager) run(ctx context.Context) {
+	for {
+		wait := acmeCheckInterval
+		if err := m.renew(ctx); err != nil {
+			log.Printf("acme: %v (nova tentativa em %s)", err, acmeRetryInterval)
+			wait = acmeRetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renew obtains the certificates that are missing or expire within
+// renewBefore, reloading the store when any changed.
+func (m *acmeManager) renew(ctx context.Context) error {
+	var errs []error
+	obtained := 0
+	for i, files := range acmeCertificates(m.spec) {
+		domain := m.spec.Domains[i]
+		if !m.due(files) {
+			continue
+		}
+		if err := m.obtain(ctx, domain, files); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", domain, err))
+			continue
+		}
+		log.Printf("acme: certificado obtido para %s", domain)
+		obtained++
+	}
+	if obtained > 0 {
+		m.store.reload("acme")
+	}
+	return errors.Join(errs...)
+}
+
+// due reports whether the cached certificate is missing, unreadable or
+// expires within renewBefore.
+func (m *acmeManager) due(files config.CertificateSpec) bool {
+	cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	return err != nil || time.Until(leaf.NotAfter) < m.renewBefore
+}
+
+// obtain runs an order for domain, answering its HTTP-01 challenges, and
+// writes the issued certificate and its new key to files.
+func (m *acmeManager) obtain(ctx context.Context, domain string, files config.CertificateSpec) error {
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+	if !m.registered {
+		acct := &acme.Account{}
+		if m.spec.Email != "" {
+			acct.Contact = []string{"mailto:" + m.spec.Email}
+		}
+		if _, err := m.client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+			return fmt.Errorf("registro da conta: %v", err)
+		}
+		m.registered = true
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return fmt.Errorf("pedido: %v", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+	if _, err := m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("pedido: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("emissão: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("certificado emitido inválido: %v", err)
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return fmt.Errorf("certificado emitido inválido: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	// the key goes first: a certificate without its key is skipped by the
+	// store, the other way round it would be rejected
+	if err := writeFileAtomic(files.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return err
+	}
+	return writeFileAtomic(files.Cert, certPEM)
+}
+
+// authorize answers the HTTP-01 challenge of the authorization at u, if it
+// is still pending, and waits for the CA to validate it.
+func (m *acmeManager) authorize(ctx context.Context, u string) error {
+	z, err := m.client.GetAuthorization(ctx, u)
+	if err != nil {
+		return fmt.Errorf("autorização: %v", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("autorização de %s: a CA não ofereceu o desafio http-01", z.Identifier.Value)
+	}
+	keyAuth, err := m.client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	m.challenges.set(chal.Token, keyAuth)
+	defer m.challenges.remove(chal.Token)
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("desafio http-01: %v", err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("desafio http-01 de %s: %v", z.Identifier.Value, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data, readable only by the owner, so a
+// reader never sees a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o600); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
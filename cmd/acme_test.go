@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/config"
+)
+
+// acmeStandIn is a minimal RFC 8555 CA for tests, in the manner of Pebble:
+// it does not check the JWS signatures, validates HTTP-01 challenges by
+// fetching them from validate (instead of the domain) and issues 90-day
+// certificates.
+type acmeStandIn struct {
+	t        *testing.T
+	srv      *httptest.Server
+	validate string
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	nonce       int
+	accounts    map[string]bool
+	orders      []*standInOrder
+	validations int
+}
+
+type standInOrder struct {
+	domain  string
+	account string
+	token   string
+	status  string
+	authz   string
+	chain   []byte
+}
+
+func newACMEStandIn(t *testing.T, validate string) *acmeStandIn {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stand-in CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	s := &acmeStandIn{t: t, validate: validate, caCert: ca, caKey: key, accounts: map[string]bool{}}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+func (s *acmeStandIn) url(path string) string { return s.srv.URL + path }
+
+func (s *acmeStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce++
+	w.Header().Set("Replay-Nonce", "n"+strconv.Itoa(s.nonce))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Path == "/dir" {
+		writeJSON(w, 200, map[string]string{"newNonce": s.url("/nonce"), "newAccount": s.url("/account"), "newOrder": s.url("/order")})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(200)
+		return
+	}
+	protected, payload := s.decodeJWS(r)
+	kind, idx, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if kind == "account" {
+		s.newAccount(w, protected, payload)
+		return
+	}
+	account := strings.TrimPrefix(fmt.Sprint(protected["kid"]), s.url("/acct/"))
+	if !s.accounts[account] {
+		problem(w, 400, "accountDoesNotExist", "unknown account")
+		return
+	}
+	if kind == "order" {
+		var req struct {
+			Identifiers []struct{ Type, Value string }
+		}
+		json.Unmarshal(payload, &req)
+		if len(req.Identifiers) != 1 || req.Identifiers[0].Type != "dns" {
+			problem(w, 400, "rejectedIdentifier", "one dns identifier per order")
+			return
+		}
+		o := &standInOrder{domain: req.Identifiers[0].Value, account: account, token: fmt.Sprintf("token%d", len(s.orders)), status: "pending", authz: "pending"}
+		s.orders = append(s.orders, o)
+		w.Header().Set("Location", s.url(fmt.Sprintf("/orders/%d", len(s.orders)-1)))
+		writeJSON(w, 201, s.orderJSON(len(s.orders)-1))
+		return
+	}
+	i, err := strconv.Atoi(idx)
+	if err != nil || i >= len(s.orders) {
+		problem(w, 404, "malformed", "not found")
+		return
+	}
+	o := s.orders[i]
+	switch kind {
+	case "orders":
+		writeJSON(w, 200, s.orderJSON(i))
+	case "authz":
+		writeJSON(w, 200, map[string]any{
+			"status":     o.authz,
+			"identifier": map[string]string{"type": "dns", "value": o.domain},
+			"challenges": []any{s.challengeJSON(i)},
+		})
+	case "chal":
+		s.validations++
+		if s.fetchChallenge(o) == o.token+"."+o.account {
+			o.authz, o.status = "valid", "ready"
+		} else {
+			o.authz, o.status = "invalid", "invalid"
+		}
+		writeJSON(w, 200, s.challengeJSON(i))
+	case "finalize":
+		if o.status != "ready" {
+			problem(w, 403, "orderNotReady", "order not ready")
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != o.domain {
+			problem(w, 400, "badCSR", "unexpected CSR")
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(100 + i)),
+			Subject:      pkix.Name{CommonName: o.domain},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+		if err != nil {
+			s.t.Errorf("stand-in: sign: %v", err)
+		}
+		o.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+		o.status = "valid"
+		w.Header().Set("Location", s.url(fmt.Sprintf("/orders/%d", i)))
+		writeJSON(w, 200, s.orderJSON(i))
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(o.chain)
+	default:
+		problem(w, 404, "malformed", "not found")
+	}
+}
+
+// decodeJWS returns the protected header and the payload of a JWS request.
+func (s *acmeStandIn) decodeJWS(r *http.Request) (map[string]any, []byte) {
+	var jws struct{ Protected, Payload string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	protected := map[string]any{}
+	json.Unmarshal(header, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return protected, payload
+}
+
+// newAccount registers the key of the request, identified by its RFC 7638
+// thumbprint.
+func (s *acmeStandIn) newAccount(w http.ResponseWriter, protected map[string]any, payload []byte) {
+	jwk, _ := protected["jwk"].(map[string]any)
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(canonical))
+	thumb := base64.RawURLEncoding.EncodeToString(sum[:])
+	var req struct{ OnlyReturnExisting bool }
+	json.Unmarshal(payload, &req)
+	status := 201
+	if s.accounts[thumb] {
+		status = 200
+	} else if req.OnlyReturnExisting {
+		problem(w, 400, "accountDoesNotExist", "no account for this key")
+		return
+	}
+	s.accounts[thumb] = true
+	w.Header().Set("Location", s.url("/acct/"+thumb))
+	writeJSON(w, status, map[string]string{"status": "valid"})
+}
+
+// fetchChallenge fetches the HTTP-01 response the way a CA would, with the
+// domain as host.
+func (s *acmeStandIn) fetchChallenge(o *standInOrder) string {
+	req, _ := http.NewRequest("GET", s.validate+acmeChallengePath+o.token, nil)
+	req.Host = o.domain
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return ""
+	}
+	return string(b)
+}
+
+func (s *acmeStandIn) orderJSON(i int) map[string]any {
+	o := s.orders[i]
+	v := map[string]any{
+		"status":         o.status,
+		"identifiers":    []any{map[string]string{"type": "dns", "value": o.domain}},
+		"authorizations": []string{s.url(fmt.Sprintf("/authz/%d", i))},
+		"finalize":       s.url(fmt.Sprintf("/finalize/%d", i)),
+	}
+	if o.status == "valid" {
+		v["certificate"] = s.url(fmt.Sprintf("/cert/%d", i))
+	}
+	return v
+}
+
+func (s *acmeStandIn) challengeJSON(i int) map[string]any {
+	o := s.orders[i]
+	status := o.authz
+	return map[string]any{"type": "http-01", "url": s.url(fmt.Sprintf("/chal/%d", i)), "token": o.token, "status": status}
+}
+
+func (s *acmeStandIn) counts() (orders, validations int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.orders), s.validations
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+func TestACMEManager_ObtainsAndRenews(t *testing.T) {
+	challenges := newACMEChallenges()
+	plain := httptest.NewServer(challenges.handler(http.NotFoundHandler()))
+	defer plain.Close()
+	ca := newACMEStandIn(t, plain.URL)
+
+	spec := &config.ACMESpec{
+		Domains:      []string{"a.test", "b.test"},
+		Email:        "ops@example.test",
+		DirectoryURL: ca.url("/dir"),
+		CacheDir:     t.TempDir(),
+	}
+	store, err := newCertStore(nil, acmeCertificates(spec))
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+	m, err := newACMEManager(spec, store, challenges)
+	if err != nil {
+		t.Fatalf("newACMEManager: %v", err)
+	}
+	if err := m.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if orders, validations := ca.counts(); orders != 2 || validations != 2 {
+		t.Fatalf("expected 2 orders validated over HTTP-01, got %d orders and %d validations", orders, validations)
+	}
+	if got := servedName(t, store, "b.test"); got != "b.test" {
+		t.Fatalf("expected the certificate of b.test, got %s", got)
+	}
+	if len(challenges.tokens) != 0 {
+		t.Fatalf("expected the challenges to be removed, got %v", challenges.tokens)
+	}
+
+	// fresh certificates are not ordered again
+	if err := m.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if orders, _ := ca.counts(); orders != 2 {
+		t.Fatalf("expected no new orders, got %d", orders)
+	}
+
+	// a restart reuses the account and the cached certificates; certificates
+	// within renew_before are renewed
+	before, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+	spec.RenewBefore = 100 * 24 * time.Hour
+	m, err = newACMEManager(spec, store, challenges)
+	if err != nil {
+		t.Fatalf("newACMEManager: %v", err)
+	}
+	if err := m.renew(context.Background()); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if orders, _ := ca.counts(); orders != 4 || len(ca.accounts) != 1 {
+		t.Fatalf("expected 2 renewals on the same account, got %d orders and %d accounts", orders, len(ca.accounts))
+	}
+	after, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+	if after.Leaf.SerialNumber.Cmp(before.Leaf.SerialNumber) == 0 {
+		t.Fatal("expected the renewed certificate to be served")
+	}
+}
+
+func TestACMEManager_FailedChallengeKeepsCertificate(t *testing.T) {
+	challenges := newACMEChallenges()
+	// the challenges of this manager are never served
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	ca := newACMEStandIn(t, plain.URL)
+
+	dir := t.TempDir()
+	spec := &config.ACMESpec{Domains: []string{"a.test"}, DirectoryURL: ca.url("/dir"), CacheDir: dir}
+	files := acmeCertificates(spec)[0]
+	old := writeTestCert(t, dir, "a.test", "a.test")
+	if old != files {
+		t.Fatalf("unexpected cache files %+v", files)
+	}
+	store, err := newCertStore(nil, acmeCertificates(spec))
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+	spec.RenewBefore = 2 * time.Hour // the test certificate expires in 1h
+	m, err := newACMEManager(spec, store, challenges)
+	if err != nil {
+		t.Fatalf("newACMEManager: %v", err)
+	}
+	before, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+	err = m.renew(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "a.test") {
+		t.Fatalf("expected the invalid challenge to fail the renewal, got %v", err)
+	}
+	after, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+	if after != before {
+		t.Fatal("expected the cached certificate to stay in use")
+	}
+	if _, err := os.Stat(files.Cert); err != nil {
+		t.Fatalf("expected the cached certificate to stay on disk: %v", err)
+	}
+}
+
+func TestACMEChallenges_Handler(t *testing.T) {
+	challenges := newACMEChallenges()
+	challenges.set("tok", "tok.thumb")
+	h := challenges.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", acmeChallengePath+"tok", nil))
+	if rr.Code != 200 || rr.Body.String() != "tok.thumb" {
+		t.Fatalf("expected the key authorization, got %d %q", rr.Code, rr.Body.String())
+	}
+	// unknown tokens go on to the proxy
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", acmeChallengePath+"other", nil))
+	if rr.Code != http.StatusTeapot {
+		t.Fatalf("expected unknown tokens to be passed on, got %d", rr.Code)
+	}
+}
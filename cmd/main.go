@@ -2,16 +2,27 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
+	"github.com/Vime-Sistemas/vortice/admin"
 	"github.com/Vime-Sistemas/vortice/config"
 	"github.com/Vime-Sistemas/vortice/domain"
 	"github.com/Vime-Sistemas/vortice/stats"
@@ -45,8 +56,8 @@ func (rw replWriter) Write(p []byte) (int, error) {
 }
 
 // NewProxyPool creates a ServerPool configured with the provided backend URLs,
-// algorithm, per-backend rate limits and optional ip-hash header.
-func NewProxyPool(serverList []string, algo string, per [][2]int, ipHashHeader string) *domain.ServerPool {
+// algorithm, per-backend rate limits, per-backend weights and optional ip-hash header.
+func NewProxyPool(serverList []string, algo string, per [][2]int, weights []int, ipHashHeader string) *domain.ServerPool {
 	pool := &domain.ServerPool{Algorithm: algo, IPHashHeader: ipHashHeader}
 	for i, u := range serverList {
 		// validate URL
@@ -60,92 +71,715 @@ func NewProxyPool(serverList []string, algo string, per [][2]int, ipHashHeader s
 			burst = per[i][1]
 		}
 		be := domain.NewBackend(u, rps, burst)
+		if i < len(weights) {
+			be.SetWeight(weights[i])
+		}
 		pool.AddBackend(be)
 	}
 	return pool
 }
 
+// NewPool creates the ServerPool described by spec.
+func NewPool(spec config.PoolSpec) (*domain.ServerPool, error) {
+	pool, _, err := newPool(spec, nil)
+	return pool, err
+}
+
+// newPool creates the ServerPool described by spec, reusing the backends of
+// prev with the same URL so they keep their state (health, connection count,
+// latency, rate limiter) across reloads. Reused backends are only updated by
+// the returned apply function, so a failed reload leaves them untouched.
+func newPool(spec config.PoolSpec, prev *domain.ServerPool) (*domain.ServerPool, func(), error) {
+	if _, ok := domain.LookupBalancer(spec.Algorithm); !ok {
+		return nil, nil, fmt.Errorf("pool %q: algoritmo %q desconhecido (disponíveis: %s)", spec.Name, spec.Algorithm, strings.Join(domain.BalancerNames(), ", "))
+	}
+	if _, err := domain.ParseHashKey(spec.HashKey); err != nil {
+		return nil, nil, fmt.Errorf("pool %q: %v", spec.Name, err)
+	}
+	health, err := healthConfig(spec.HealthCheck)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pool %q: health_check: %v", spec.Name, err)
+	}
+	retry, err := retryPolicy(spec.Retry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pool %q: retry: %v", spec.Name, err)
+	}
+	poolTimeouts := timeouts(spec.Timeouts)
+	poolTLS, err := upstreamTLS(spec.UpstreamTLS)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pool %q: upstream_tls: %v", spec.Name, err)
+	}
+	poolProtocol := spec.Protocol
+	if poolProtocol == domain.ProtocolAuto {
+		poolProtocol = ""
+	}
+	pool := &domain.ServerPool{
+		Name:         spec.Name,
+		Algorithm:    spec.Algorithm,
+		IPHashHeader: spec.IPHashHeader,
+		HashKey:      spec.HashKey,
+		Sticky:       stickySession(spec.Sticky),
+		Health:       health,
+		Outlier:      outlierDetection(spec.OutlierDetection),
+		Breaker:      circuitBreaker(spec.CircuitBreaker),
+		Retry:        retry,
+		Timeouts:     poolTimeouts,
+		UpstreamTLS:  poolTLS,
+		Protocol:     poolProtocol,
+	}
+	var updates []func()
+	for _, bs := range spec.Backends {
+		bs := bs
+		health, err := healthConfig(bs.HealthCheck)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pool %q: backend %s: health_check: %v", spec.Name, bs.URL, err)
+		}
+		backendTimeouts := poolTimeouts.Merge(timeouts(bs.Timeouts))
+		backendTLS, err := upstreamTLS(bs.UpstreamTLS)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pool %q: backend %s: upstream_tls: %v", spec.Name, bs.URL, err)
+		}
+		backendTLS = poolTLS.Merge(backendTLS)
+		protocol := poolProtocol
+		if bs.Protocol != "" {
+			protocol = bs.Protocol
+		}
+		if protocol == domain.ProtocolAuto {
+			protocol = ""
+		}
+		if backendTLS != nil {
+			if _, err := backendTLS.Config(); err != nil {
+				return nil, nil, fmt.Errorf("pool %q: backend %s: upstream_tls.%v", spec.Name, bs.URL, err)
+			}
+		}
+		var be *domain.Backend
+		if prev != nil {
+			be = prev.GetBackend(bs.URL)
+		}
+		if be == nil {
+			be = domain.NewBackend(bs.URL, bs.RateLimit.RPS, bs.RateLimit.Burst)
+			be.SetWeight(*bs.Weight)
+			be.Health = health
+			be.SetTimeouts(backendTimeouts)
+			be.SetUpstreamTLS(backendTLS)
+			if err := be.SetProtocol(protocol); err != nil {
+				return nil, nil, fmt.Errorf("pool %q: backend %s: protocol: %v", spec.Name, bs.URL, err)
+			}
+		} else {
+			// check now what apply would set, so an invalid reload changes nothing
+			if err := domain.ValidateProtocol(protocol, be.URL.Scheme); err != nil {
+				return nil, nil, fmt.Errorf("pool %q: backend %s: protocol: %v", spec.Name, bs.URL, err)
+			}
+			reused := be
+			updates = append(updates, func() {
+				reused.SetRateLimit(bs.RateLimit.RPS, bs.RateLimit.Burst)
+				reused.SetWeight(*bs.Weight)
+				reused.SetHealth(health)
+				if !reflect.DeepEqual(reused.Timeouts(), backendTimeouts) {
+					reused.SetTimeouts(backendTimeouts)
+				}
+				// upstream TLS and protocol were validated above and cannot fail
+				if !reflect.DeepEqual(reused.UpstreamTLS(), backendTLS) {
+					_ = reused.SetUpstreamTLS(backendTLS)
+				}
+				if reused.Protocol() != protocol {
+					_ = reused.SetProtocol(protocol)
+				}
+			})
+		}
+		pool.AddBackend(be)
+	}
+	apply := func() {
+		for _, u := range updates {
+			u()
+		}
+		if prev != nil {
+			pool.InheritState(prev)
+		}
+	}
+	return pool, apply, nil
+}
+
+func stickySession(spec *config.StickySpec) *domain.StickySession {
+	if spec == nil || spec.Cookie == "" {
+		return nil
+	}
+	ss := &domain.StickySession{
+		CookieName: spec.Cookie,
+		TTL:        spec.TTL,
+		Path:       spec.Path,
+		Secure:     spec.Secure,
+		HttpOnly:   spec.HTTPOnly == nil || *spec.HTTPOnly,
+		SameSite:   domain.ParseSameSite(spec.SameSite),
+	}
+	if spec.Secret != "" {
+		ss.Secret = []byte(spec.Secret)
+	}
+	return ss
+}
+
+func outlierDetection(spec *config.OutlierSpec) *domain.OutlierDetection {
+	if spec == nil {
+		return nil
+	}
+	return &domain.OutlierDetection{
+		Consecutive5xx:           spec.Consecutive5xx,
+		ConsecutiveGatewayErrors: spec.ConsecutiveGatewayErrors,
+		FailureRatePct:           spec.FailureRatePct,
+		MinRequests:              spec.MinRequests,
+		Window:                   spec.Window,
+		BaseEjectionTime:         spec.BaseEjectionTime,
+		MaxEjectionTime:          spec.MaxEjectionTime,
+		MaxEjectionPercent:       spec.MaxEjectionPercent,
+	}
+}
+
+func circuitBreaker(spec *config.CircuitBreakerSpec) *domain.CircuitBreakerConfig {
+	if spec == nil {
+		return nil
+	}
+	return &domain.CircuitBreakerConfig{
+		FailureRatePct:   spec.FailureRatePct,
+		SlowCallRatePct:  spec.SlowCallRatePct,
+		SlowCallDuration: spec.SlowCallDuration,
+		MinRequests:      spec.MinRequests,
+		Window:           spec.Window,
+		OpenDuration:     spec.OpenDuration,
+		HalfOpenRequests: spec.HalfOpenRequests,
+	}
+}
+
+func retryPolicy(spec *config.RetrySpec) (*domain.RetryPolicy, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	statuses, err := domain.ParseStatusSet(spec.RetryOn)
+	if err != nil {
+		return nil, fmt.Errorf("retry_on: %v", err)
+	}
+	return &domain.RetryPolicy{
+		Attempts:     spec.Attempts,
+		Methods:      spec.Methods,
+		Statuses:     statuses,
+		MaxBodyBytes: spec.MaxBodyBytes,
+		BudgetPct:    spec.BudgetPct,
+		MinRetries:   spec.MinRetries,
+		BudgetWindow: spec.BudgetWindow,
+	}, nil
+}
+
+func timeouts(spec *config.TimeoutSpec) *domain.Timeouts {
+	if spec == nil {
+		return nil
+	}
+	return &domain.Timeouts{
+		Connect:        spec.Connect,
+		TLSHandshake:   spec.TLSHandshake,
+		ResponseHeader: spec.ResponseHeader,
+		Request:        spec.Request,
+		Idle:           spec.Idle,
+	}
+}
+
+// upstreamTLS reads the files of spec.
+func upstreamTLS(spec *config.UpstreamTLSSpec) (*domain.UpstreamTLS, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	t := &domain.UpstreamTLS{InsecureSkipVerify: spec.InsecureSkipVerify, ServerName: spec.ServerName}
+	for _, f := range []struct {
+		path string
+		dst  *[]byte
+	}{{spec.CA, &t.CA}, {spec.Cert, &t.Cert}, {spec.Key, &t.Key}} {
+		if f.path == "" {
+			continue
+		}
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		*f.dst = b
+	}
+	return t, nil
+}
+
+// newServer creates an http.Server for addr with the listener limits of spec.
+func newServer(addr string, handler http.Handler, spec config.ServerSpec) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       spec.ReadTimeout,
+		ReadHeaderTimeout: spec.ReadHeaderTimeout,
+		WriteTimeout:      spec.WriteTimeout,
+		IdleTimeout:       spec.IdleTimeout,
+		MaxHeaderBytes:    spec.MaxHeaderBytes,
+	}
+}
+
+// listenerProtocols returns the protocols served by l: HTTP/1.1 plus HTTP/2
+// over TLS (unless disabled) or, with h2c, cleartext HTTP/2.
+func listenerProtocols(l config.ListenerSpec) *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	switch {
+	case l.TLS != nil:
+		p.SetHTTP2(l.HTTP2 == nil || *l.HTTP2)
+	case l.H2C:
+		p.SetUnencryptedHTTP2(true)
+	}
+	return p
+}
+
+func hedgePolicy(spec *config.HedgeSpec) *domain.HedgePolicy {
+	if spec == nil {
+		return nil
+	}
+	return &domain.HedgePolicy{
+		Delay:        spec.Delay,
+		Percentile:   spec.Percentile,
+		Methods:      spec.Methods,
+		BudgetPct:    spec.BudgetPct,
+		BudgetWindow: spec.BudgetWindow,
+	}
+}
+
+func clientCertRule(spec *config.ClientCertSpec) *domain.ClientCertRule {
+	if spec == nil {
+		return nil
+	}
+	return &domain.ClientCertRule{
+		CommonNames:  spec.CommonNames,
+		SANs:         spec.SANs,
+		SubjectRegex: spec.SubjectRegex,
+	}
+}
+
+func healthConfig(spec *config.HealthCheckSpec) (*domain.HealthCheckConfig, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	expected, err := domain.ParseStatusSet(spec.ExpectedStatus)
+	if err != nil {
+		return nil, fmt.Errorf("expected_status: %v", err)
+	}
+	var bodyRe *regexp.Regexp
+	if spec.BodyRegex != "" {
+		if bodyRe, err = regexp.Compile(spec.BodyRegex); err != nil {
+			return nil, fmt.Errorf("body_regex: %v", err)
+		}
+	}
+	return &domain.HealthCheckConfig{
+		Path:           spec.Path,
+		Method:         strings.ToUpper(spec.Method),
+		Headers:        spec.Headers,
+		ExpectedStatus: expected,
+		BodyContains:   spec.BodyContains,
+		BodyRegex:      bodyRe,
+		Interval:       spec.Interval,
+		Jitter:         spec.Jitter,
+		Timeout:        spec.Timeout,
+		Rise:           spec.Rise,
+		Fall:           spec.Fall,
+	}, nil
+}
+
+// BuildRouter creates the pools and routes described by cfg. Unmatched
+// requests go to cfg.DefaultPool (or the unnamed pool), unless routes exist
+// and that pool has no backends, in which case they get a 404.
+func BuildRouter(cfg *config.File) (*domain.Router, error) {
+	router, apply, err := buildRouter(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	apply()
+	return router, nil
+}
+
+// buildRouter is BuildRouter reusing the backends of the pools of prev with
+// the same name (see newPool). The returned apply function updates the
+// reused backends and must be called once the new router is accepted.
+func buildRouter(cfg *config.File, prev *domain.Router) (*domain.Router, func(), error) {
+	previous := map[string]*domain.ServerPool{}
+	previousRoutes := map[string]*domain.Route{}
+	if prev != nil {
+		for _, p := range prev.Pools() {
+			previous[p.Name] = p
+		}
+		for _, r := range prev.Routes() {
+			previousRoutes[routeKey(r)] = r
+		}
+	}
+	router := &domain.Router{Order: cfg.RouteOrder}
+	byName := map[string]*domain.ServerPool{}
+	var updates []func()
+	for _, spec := range cfg.Pools {
+		pool, apply, err := newPool(spec, previous[spec.Name])
+		if err != nil {
+			return nil, nil, err
+		}
+		byName[spec.Name] = pool
+		updates = append(updates, apply)
+	}
+	if def, ok := byName[cfg.DefaultPool]; ok && (len(cfg.Routes) == 0 || len(def.Backends()) > 0) {
+		router.Default = def
+	}
+	for _, spec := range cfg.Routes {
+		pool, ok := byName[spec.Pool]
+		if !ok {
+			return nil, nil, fmt.Errorf("rota %q: pool %q não declarado", spec.Name, spec.Pool)
+		}
+		route := &domain.Route{
+			Name:       spec.Name,
+			Host:       spec.Host,
+			Path:       spec.Path,
+			PathPrefix: spec.PathPrefix,
+			PathRegex:  spec.PathRegex,
+			Methods:    spec.Methods,
+			Headers:    spec.Headers,
+			Pool:       pool,
+			Hedge:      hedgePolicy(spec.Hedge),
+			ClientCert: clientCertRule(spec.ClientCert),
+		}
+		if err := router.AddRoute(route); err != nil {
+			return nil, nil, err
+		}
+		if old := previousRoutes[routeKey(route)]; old != nil {
+			updates = append(updates, func() { route.InheritState(old) })
+		}
+	}
+	// keep pools without routes (and not default) reachable for health checks
+	// and the REPL
+	for _, spec := range cfg.Pools {
+		router.AddPool(byName[spec.Name])
+	}
+	apply := func() {
+		for _, u := range updates {
+			u()
+		}
+	}
+	return router, apply, nil
+}
+
+// routeKey identifies a route across reloads: by its name or, for unnamed
+// routes, by what it matches.
+func routeKey(r *domain.Route) string {
+	if r.Name != "" {
+		return "name " + r.Name
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%v|%v", r.Host, r.Path, r.PathPrefix, r.PathRegex, r.Methods, r.Headers)
+}
+
+// configFile returns the config file given by -config or VORTICE_CONFIG, or
+// "" when the configuration comes from environment variables.
+func configFile(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv("VORTICE_CONFIG")
+}
+
+// loadConfig reads the config file at path or, when path is empty, builds the
+// configuration from environment variables.
+func loadConfig(path string) (*config.File, error) {
+	if path != "" {
+		cfg, err := config.Load(path)
+		if err == nil {
+			log.Printf("Configuração carregada de %s", path)
+		}
+		return cfg, err
+	}
+	cfg, err := config.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// startLocalBackends starts the development backend servers enabled by
+// START_LOCAL_BACKENDS.
+func startLocalBackends() {
+	cnt := config.GetLocalBackendCount()
+	startPort := config.GetLocalBackendStartPort()
+	for i := 0; i < cnt; i++ {
+		// start a tiny HTTP server that responds on / and can be health-checked
+		go func(port int) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+				_, _ = w.Write([]byte(fmt.Sprintf("ok-backend-%d", port)))
+			})
+			mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(200)
+				_, _ = w.Write([]byte("ok"))
+			})
+			srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+			if err := srv.ListenAndServe(); err != nil {
+				log.Printf("backend local em %d parado: %v", port, err)
+			}
+		}(startPort + i)
+	}
+}
+
+// addLocalBackends adds the development backends started by
+// startLocalBackends to the default pool of cfg and returns how many were
+// added. It runs on every (re)load so reloads keep them in the pool.
+func addLocalBackends(cfg *config.File) int {
+	def := cfg.Pool(cfg.DefaultPool)
+	if def == nil {
+		cfg.Pools = append(cfg.Pools, config.PoolSpec{Name: cfg.DefaultPool, Algorithm: config.GetLBAlgorithm()})
+		def = &cfg.Pools[len(cfg.Pools)-1]
+	}
+	// If forced, ignore configured BACKEND_URLS and use only local backends
+	if config.GetLocalBackendForce() {
+		def.Backends = nil
+	}
+
+	// build a set of already configured urls to avoid duplicates
+	seen := make(map[string]bool)
+	for _, b := range def.Backends {
+		seen[b.URL] = true
+	}
+
+	added := 0
+	startPort := config.GetLocalBackendStartPort()
+	for i := 0; i < config.GetLocalBackendCount(); i++ {
+		url := fmt.Sprintf("http://localhost:%d", startPort+i)
+		// only append if not already present
+		if !seen[url] {
+			weight := 1
+			def.Backends = append(def.Backends, config.BackendSpec{
+				URL:       url,
+				Weight:    &weight,
+				RateLimit: &config.RateLimitSpec{RPS: config.GetRateLimitRPS(), Burst: config.GetRateLimitBurst()},
+				// the local servers answer health checks on /health
+				HealthCheck: &config.HealthCheckSpec{Path: "/health"},
+			})
+			seen[url] = true
+			added++
+		}
+	}
+	return added
+}
+
 func main() {
+	configPath := flag.String("config", "", "arquivo de configuração YAML ou JSON (padrão: $VORTICE_CONFIG ou variáveis de ambiente)")
+	flag.Parse()
+
 	// Load .env files (if present) so GetBackends reads configured values
-	if loaded := config.LoadEnv(); loaded != "" {
-		log.Printf("Loaded env file: %s", loaded)
+	envFile := config.LoadEnv()
+	if envFile != "" {
+		log.Printf("Loaded env file: %s", envFile)
 	}
 
-	serverList := config.GetBackends()
+	// sockets handed over by a previous process on a binary upgrade
+	ls, err := inheritListeners()
+	if err != nil {
+		log.Fatalf("upgrade: %v", err)
+	}
+
+	path := configFile(*configPath)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Fatalf("configuração inválida: %v", err)
+	}
 
 	// If configured, start a set of local backend servers for development/testing
-	if config.StartLocalBackendsEnabled() {
-		cnt := config.GetLocalBackendCount()
-		startPort := config.GetLocalBackendStartPort()
-		// If forced, ignore configured BACKEND_URLS and use only local backends
+	localBackends := config.StartLocalBackendsEnabled()
+	if localBackends {
+		startLocalBackends()
 		if config.GetLocalBackendForce() {
 			log.Println("LOCAL_BACKEND_FORCE=true: backend local irá substituir BACKEND_URLS configurado")
-			serverList = []string{}
-		}
-
-		// build a set of already configured urls to avoid duplicates
-		seen := make(map[string]bool)
-		for _, u := range serverList {
-			seen[u] = true
-		}
-
-		started := 0
-		for i := 0; i < cnt; i++ {
-			p := startPort + i
-			url := fmt.Sprintf("http://localhost:%d", p)
-			// start a tiny HTTP server that responds on / and can be health-checked
-			go func(port int) {
-				mux := http.NewServeMux()
-				mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-					w.WriteHeader(200)
-					_, _ = w.Write([]byte(fmt.Sprintf("ok-backend-%d", port)))
-				})
-				mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-					w.WriteHeader(200)
-					_, _ = w.Write([]byte("ok"))
-				})
-				srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
-				if err := srv.ListenAndServe(); err != nil {
-					log.Printf("backend local em %d parado: %v", port, err)
-				}
-			}(p)
-
-			// only append if not already present
-			if !seen[url] {
-				serverList = append(serverList, url)
-				seen[url] = true
-				started++
-			}
 		}
-		log.Printf("Backend local iniciados: %d, porta inicial: %d, tentados: %d", started, startPort, cnt)
+		added := addLocalBackends(cfg)
+		log.Printf("Backend local iniciados: %d, porta inicial: %d, tentados: %d", added, config.GetLocalBackendStartPort(), config.GetLocalBackendCount())
 	}
 
 	rand.Seed(time.Now().UnixNano())
+	stats.SetBuckets(cfg.Metrics.Buckets)
+
+	// ctx stops the health checks once the process shuts down
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
 
-	// create a ServerPool via helper so callers/tests can reuse it
-	per := config.GetPerBackendRateLimits(len(serverList))
-	serverPool := NewProxyPool(serverList, config.GetLBAlgorithm(), per, config.GetIPHashHeader())
-	log.Printf("Backends: %v", serverList)
-	// run an initial health check so we know status immediately
-	serverPool.HealthCheck()
-	if len(serverList) == 0 {
+	router, err := BuildRouter(cfg)
+	if err != nil {
+		log.Fatalf("configuração inválida: %v", err)
+	}
+	if st, err := readState(); err != nil {
+		log.Printf("upgrade: estado anterior ignorado: %v", err)
+	} else if st != nil {
+		st.restore(router)
+		log.Println("upgrade: estatísticas e saúde dos backends restauradas")
+	}
+	pools := router.Pools()
+	backendCount := 0
+	for _, p := range pools {
+		log.Printf("Pool %s (%s): %v", poolName(p), p.Algorithm, p.BackendURLs())
+		backendCount += len(p.Backends())
+		// run an initial health check so we know status immediately
+		p.HealthCheck()
+		go p.StartHealthCheck(ctx)
+	}
+	for _, p := range pools {
+		if p.Sticky != nil {
+			log.Printf("Sessões sticky habilitadas em %s (cookie %s)", poolName(p), p.Sticky.CookieName)
+		}
+	}
+	if backendCount == 0 {
 		log.Println("Aviso: nenhum backend configurado; o proxy responderá 503 até que backends sejam adicionados.")
 	}
 
-	go serverPool.StartHealthCheck()
+	// TLS listeners pick their certificate by SNI and reload it from disk;
+	// with acme, the certificates are obtained and renewed once serving
+	tlsConfigs := make([]*tls.Config, len(cfg.Listeners))
+	var certs []*certStore
+	var managers []*acmeManager
+	challenges := newACMEChallenges()
+	for i, l := range cfg.Listeners {
+		if l.TLS == nil {
+			continue
+		}
+		tc, store, err := tlsConfig(l.TLS)
+		if err != nil {
+			log.Fatalf("configuração inválida: listener %s: %v", l.Address, err)
+		}
+		tlsConfigs[i] = tc
+		certs = append(certs, store)
+		interval := l.TLS.ReloadInterval
+		if interval == 0 {
+			interval = defaultCertReload
+		}
+		go store.watch(ctx, interval)
+		if l.TLS.ACME != nil {
+			m, err := newACMEManager(l.TLS.ACME, store, challenges)
+			if err != nil {
+				log.Fatalf("configuração inválida: listener %s: %v", l.Address, err)
+			}
+			managers = append(managers, m)
+		}
+	}
+
+	live := newLiveRouter(router)
+	rl := &reloader{path: path, live: live, localBackends: localBackends, cfg: cfg, ctx: ctx, certs: certs}
+	go rl.watchSignals()
+	watched := path
+	if watched == "" {
+		watched = envFile
+	}
+	if interval := config.GetConfigWatchInterval(); watched != "" && interval > 0 {
+		log.Printf("Recarregando a configuração ao alterar %s (ou com SIGHUP)", watched)
+		go rl.watchFile(watched, interval)
+	}
 
-	port := ":" + config.GetAppPort()
-	// create a mux to expose stats endpoint and the proxy
+	// create a mux to expose stats endpoint, readiness and the proxy
+	ready := &readiness{}
 	mux := http.NewServeMux()
-	mux.Handle("/", serverPool)
-	mux.Handle("/stats", stats.Handler())
+	mux.Handle("/", live)
+	mux.Handle(cfg.Server.ReadyPath, ready)
+	if *cfg.Stats.Enabled {
+		mux.Handle(cfg.Stats.Path, stats.Handler())
+		mux.Handle(strings.TrimSuffix(cfg.Stats.Path, "/")+"/health", stats.HealthHandler())
+	}
+	if *cfg.Metrics.Enabled {
+		mux.Handle(cfg.Metrics.Path, stats.MetricsHandler(func() []stats.BackendGauge { return backendGauges(live.Router()) }))
+	}
+
+	// plain listeners with redirect_https only answer readiness (and the
+	// ACME challenges)
+	redirect := http.NewServeMux()
+	redirect.Handle("/", httpsRedirect(httpsPort(cfg.Listeners)))
+	redirect.Handle(cfg.Server.ReadyPath, ready)
+	if len(managers) > 0 {
+		mux.Handle(acmeChallengePath, challenges.handler(live))
+		redirect.Handle(acmeChallengePath, challenges.handler(httpsRedirect(httpsPort(cfg.Listeners))))
+	}
+
+	// the client certificate headers are dropped on every listener and set
+	// from the verified certificate on the listeners with client_auth
+	certHeaders := clientCertHeaderNames(cfg.Listeners)
+	sd := &shutdown{ready: ready, live: live, timeout: cfg.Server.DrainTimeout}
+	for i, l := range cfg.Listeners {
+		ln, err := ls.listen(l.Address)
+		if err != nil {
+			log.Fatalf("server error: %v", err)
+		}
+		handler := http.Handler(mux)
+		if len(certHeaders) > 0 {
+			var fields map[string]string
+			if l.TLS != nil && l.TLS.ClientAuth != nil {
+				fields = l.TLS.ClientAuth.Headers
+			}
+			handler = clientCertHeaders(mux, certHeaders, fields)
+		}
+		if l.RedirectHTTPS {
+			handler = redirect
+		}
+		srv := newServer(l.Address, handler, cfg.Server)
+		srv.Protocols = listenerProtocols(l)
+		srv.TLSConfig = tlsConfigs[i]
+		sd.listeners = append(sd.listeners, ln)
+		sd.servers = append(sd.servers, srv)
+	}
+
+	if cfg.Admin.Address != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/", admin.Handler(live.Router, cfg.Admin.Token))
+		adminMux.Handle(cfg.Server.ReadyPath, ready)
+		sd.admin = newServer(cfg.Admin.Address, adminMux, cfg.Server)
+		ln, err := ls.listen(cfg.Admin.Address)
+		if err != nil {
+			log.Fatalf("admin server error: %v", err)
+		}
+		sd.adminListener = ln
+		go func() {
+			log.Printf("API administrativa em %s", cfg.Admin.Address)
+			if cfg.Admin.Token == "" {
+				log.Println("Aviso: API administrativa sem token (defina ADMIN_TOKEN ou admin.token)")
+			}
+			if err := sd.admin.Serve(ln); err != nil && err != http.ErrServerClosed && !ready.draining.Load() {
+				log.Fatalf("admin server error: %v", err)
+			}
+		}()
+	}
 
-	server := http.Server{
-		Addr:    port,
-		Handler: mux,
+	for i, srv := range sd.servers {
+		switch l := cfg.Listeners[i]; {
+		case l.TLS != nil && l.TLS.ACME != nil:
+			log.Printf("HTTPS em %s (%d certificados, ACME: %s)", srv.Addr, len(l.TLS.Certificates), strings.Join(l.TLS.ACME.Domains, ", "))
+		case l.TLS != nil:
+			log.Printf("HTTPS em %s (%d certificados)", srv.Addr, len(l.TLS.Certificates))
+		case l.H2C:
+			log.Printf("Escutando em %s com h2c", srv.Addr)
+		case l.RedirectHTTPS:
+			log.Printf("Redirecionando %s para HTTPS", srv.Addr)
+		case i > 0:
+			log.Printf("Escutando também em %s", srv.Addr)
+		}
+		if l := cfg.Listeners[i]; l.TLS != nil && l.TLS.ClientAuth != nil {
+			mode := l.TLS.ClientAuth.Mode
+			if mode == "" {
+				mode = "require"
+			}
+			log.Printf("Certificados de cliente em %s: %s, CA %s", srv.Addr, mode, l.TLS.ClientAuth.CA)
+		}
+		go func(srv *http.Server, ln net.Listener) {
+			serve := srv.Serve
+			if srv.TLSConfig != nil {
+				// the certificates come from TLSConfig.GetCertificate
+				serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+			}
+			// closing the listener while draining is expected
+			if err := serve(ln); err != nil && err != http.ErrServerClosed && !ready.draining.Load() {
+				log.Fatalf("server error: %v", err)
+			}
+		}(srv, sd.listeners[i])
 	}
 
-	log.Printf("🌀 Vortice iniciado na porta %s", port)
+	ls.serving()
+	for _, m := range managers {
+		go m.run(ctx)
+	}
+	log.Printf("🌀 Vortice iniciado na porta %s", cfg.Listeners[0].Address)
 	interactive := strings.ToLower(os.Getenv("INTERACTIVE")) == "true"
 	// if interactive, replace the default logger output so log lines don't
 	// clobber the REPL prompt: the custom writer will reprint the prompt
@@ -154,28 +788,59 @@ func main() {
 		replEnabled = true
 		log.SetOutput(replWriter{})
 	}
+
+	// shut down on SIGTERM/SIGINT, when the REPL exits or once a new process
+	// took over the listeners; a second signal skips the drain
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
 	if interactive {
-		// run HTTP server in background and keep REPL in foreground
 		go func() {
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				log.Fatalf("server error: %v", err)
+			runInteractive(live)
+			close(done)
+		}()
+	}
+	upgraded := make(chan struct{})
+	if upgradeSignal != nil {
+		go func() {
+			usr := make(chan os.Signal, 1)
+			signal.Notify(usr, upgradeSignal)
+			for range usr {
+				log.Printf("upgrade: repassando os listeners para um novo processo (%s)", upgradeSignal)
+				if err := ls.upgrade(captureState(live.Router())); err != nil {
+					log.Printf("upgrade falhou, mantendo o processo atual: %v", err)
+					continue
+				}
+				close(upgraded)
+				return
 			}
 		}()
-		runInteractive(serverPool)
-		return
 	}
-
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	select {
+	case s := <-sig:
+		log.Printf("Recebido %s, drenando conexões (até %s)", s, cfg.Server.DrainTimeout)
+	case <-done:
+		log.Printf("Encerrando, drenando conexões (até %s)", cfg.Server.DrainTimeout)
+	case <-upgraded:
+		log.Printf("upgrade: novo processo pronto, drenando conexões (até %s)", cfg.Server.DrainTimeout)
+		sd.handoff = true
 	}
+	go func() {
+		<-sig
+		log.Println("Desligamento forçado")
+		os.Exit(1)
+	}()
+	sd.run()
+	stop()
+	log.Println("Vortice encerrado")
 }
 
 // runInteractive runs a simple REPL allowing commands to inspect stats/backends.
-func runInteractive(serverPool *domain.ServerPool) {
+func runInteractive(live *liveRouter) {
 	// ASCII header
 	fmt.Println("========================================")
 	fmt.Println(" Vortice - console interativo")
-	fmt.Println(" Comandos: stats | backends | watch <s> | help | exit")
+	fmt.Println(" Comandos: stats | health | backends | weight <n> <w> | watch <s> | help | exit")
 	fmt.Println("========================================")
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -195,20 +860,53 @@ func runInteractive(serverPool *domain.ServerPool) {
 		case "help":
 			fmt.Println("Comandos:")
 			fmt.Println("  stats         - mostrar snapshot de estatísticas como tabela")
+			fmt.Println("  health        - saúde dos backends e histórico de transições")
 			fmt.Println("  backends      - listar backends configurados")
+			fmt.Println("  weight <n> <w> - alterar o peso do backend n (0 drena)")
 			fmt.Println("  watch <secs>  - atualizar estatísticas a cada <secs> segundos (ctrl+C para parar)")
 			fmt.Println("  exit          - sair da console interativa")
 		case "backends":
-			urls := serverPool.BackendURLs()
-			if len(urls) == 0 {
+			backends := allBackends(live.Router())
+			if len(backends) == 0 {
 				fmt.Println("(no backends configured)")
 				continue
 			}
-			for i, u := range urls {
-				fmt.Printf("%d. %s\n", i+1, u)
+			for i, pb := range backends {
+				state := ""
+				if st := pb.State(); st != domain.StateEnabled {
+					state = ", " + st.String()
+				}
+				if pb.pool.Breaker != nil {
+					if c := pb.Circuit(); c != domain.CircuitClosed {
+						state += ", circuito " + c.String()
+					}
+				}
+				if until := pb.EjectedUntil(); !until.IsZero() {
+					state += fmt.Sprintf(", ejetado por %s", time.Until(until).Round(time.Second))
+				}
+				fmt.Printf("%d. %s%s (peso %d%s)\n", i+1, poolLabel(pb.pool), pb.URL, pb.Weight(), state)
+			}
+		case "weight":
+			var n, w int
+			if len(parts) != 3 {
+				fmt.Println("uso: weight <n> <peso>")
+				continue
+			}
+			if _, err := fmt.Sscanf(parts[1]+" "+parts[2], "%d %d", &n, &w); err != nil || w < 0 {
+				fmt.Println("uso: weight <n> <peso>")
+				continue
 			}
+			backends := allBackends(live.Router())
+			if n < 1 || n > len(backends) {
+				fmt.Printf("backend %d não existe\n", n)
+				continue
+			}
+			backends[n-1].SetWeight(w)
+			fmt.Printf("%s agora com peso %d\n", backends[n-1].URL, w)
 		case "stats":
 			printStatsTable()
+		case "health":
+			printHealth()
 		case "watch":
 			secs := 2
 			if len(parts) > 1 {
@@ -229,6 +927,97 @@ func runInteractive(serverPool *domain.ServerPool) {
 	}
 }
 
+// poolBackend is a backend listed by the REPL along with its pool.
+type poolBackend struct {
+	*domain.Backend
+	pool *domain.ServerPool
+}
+
+// allBackends lists the backends of every pool, in the numbering used by the
+// REPL commands.
+func allBackends(router *domain.Router) []poolBackend {
+	var out []poolBackend
+	for _, p := range router.Pools() {
+		for _, b := range p.Backends() {
+			out = append(out, poolBackend{Backend: b, pool: p})
+		}
+	}
+	return out
+}
+
+// backendGauges reports the requests in flight and the health of the
+// backends of router for the metrics.
+func backendGauges(router *domain.Router) []stats.BackendGauge {
+	var out []stats.BackendGauge
+	for _, pb := range allBackends(router) {
+		out = append(out, stats.BackendGauge{
+			Pool:     pb.pool.Name,
+			URL:      pb.URL.String(),
+			InFlight: atomic.LoadInt64(&pb.ConnCount),
+			Up:       pb.IsAlive(),
+		})
+	}
+	return out
+}
+
+func poolName(p *domain.ServerPool) string {
+	if p.Name == "" {
+		return "padrão"
+	}
+	return p.Name
+}
+
+func poolLabel(p *domain.ServerPool) string {
+	if p.Name == "" {
+		return ""
+	}
+	return "[" + p.Name + "] "
+}
+
+// replTransitions is how many health transitions the REPL shows per backend.
+const replTransitions = 5
+
+// printHealth lists the health check state and latest transitions of every
+// backend.
+func printHealth() {
+	snap := stats.SnapshotHealth()
+	if len(snap) == 0 {
+		fmt.Println("(nenhum health check executado)")
+		return
+	}
+	keys := make([]string, 0, len(snap))
+	for k := range snap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := snap[k]
+		status := "ativo"
+		if !h.Up {
+			status = "inativo"
+		}
+		check := fmt.Sprintf("%.1fms", h.LastCheckLatencyMs)
+		if h.LastCheckError != "" {
+			check += ", " + h.LastCheckError
+		}
+		pool := h.Pool
+		if pool != "" {
+			pool += "/"
+		}
+		fmt.Printf("%s%s: %s, uptime %.2f%%, última verificação há %s (%s)\n", pool, h.URL, status, h.UptimePct, time.Since(h.LastCheck).Round(time.Second), check)
+		for _, t := range h.Transitions[max(len(h.Transitions)-replTransitions, 0):] {
+			line := "inativo"
+			if t.Up {
+				line = "ativo"
+			}
+			if t.Reason != "" {
+				line += ": " + t.Reason
+			}
+			fmt.Printf("    %s  %s\n", t.At.Format("2006-01-02 15:04:05"), line)
+		}
+	}
+}
+
 func printStatsTable() {
 	snap := stats.SnapshotAll()
 	if len(snap) == 0 {
@@ -236,7 +1025,7 @@ func printStatsTable() {
 		return
 	}
 	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
-	fmt.Fprintln(w, "URL\tREQS\tAVG_MS\tFAIL%\tUPTIME%\tSTATUS_COUNTS")
+	fmt.Fprintln(w, "POOL\tURL\tREQS\tAVG_MS\tP50/P90/P99/MAX_MS\tRPS_1M/5M/15M\tFAIL%_1M/5M/15M\tFAIL%\tUPTIME%\tSTATUS_COUNTS")
 	// deterministic order
 	urls := make([]string, 0, len(snap))
 	for u := range snap {
@@ -263,7 +1052,16 @@ func printStatsTable() {
 			scs += fmt.Sprintf("%d=%d", k, v)
 			first = false
 		}
-		fmt.Fprintf(w, "%s\t%d\t%.2f\t%.2f\t%.2f\t%s\n", s.URL, s.Requests, s.AvgLatencyMs, s.FailureRatePct, s.UptimePct, scs)
+		pool := s.Pool
+		if pool == "" {
+			pool = "-"
+		}
+		m1, m5, m15 := s.Windows["1m"], s.Windows["5m"], s.Windows["15m"]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\t%.1f/%.1f/%.1f/%.1f\t%.2f/%.2f/%.2f\t%.1f/%.1f/%.1f\t%.2f\t%.2f\t%s\n", pool, s.URL, s.Requests, s.AvgLatencyMs,
+			s.P50LatencyMs, s.P90LatencyMs, s.P99LatencyMs, s.MaxLatencyMs,
+			m1.RatePerSec, m5.RatePerSec, m15.RatePerSec,
+			m1.FailureRatePct, m5.FailureRatePct, m15.FailureRatePct,
+			s.FailureRatePct, s.UptimePct, scs)
 	}
 	_ = w.Flush()
 }
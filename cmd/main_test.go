@@ -5,8 +5,11 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/Vime-Sistemas/vortice/config"
 )
 
 func TestNewProxyPool_Routes(t *testing.T) {
@@ -20,7 +23,7 @@ func TestNewProxyPool_Routes(t *testing.T) {
 	}))
 	defer b2.Close()
 
-	pool := NewProxyPool([]string{b1.URL, b2.URL}, "round_robin", [][2]int{{0, 1}, {0, 1}}, "")
+	pool := NewProxyPool([]string{b1.URL, b2.URL}, "round_robin", [][2]int{{0, 1}, {0, 1}}, []int{1, 1}, "")
 
 	// create listener on ephemeral port
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -47,3 +50,207 @@ func TestNewProxyPool_Routes(t *testing.T) {
 		t.Fatalf("unexpected body: %s", string(body))
 	}
 }
+
+func TestBuildRouter_RoutesToNamedPools(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("api"))
+	}))
+	defer api.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("web"))
+	}))
+	defer web.Close()
+
+	one := 1
+	limit := &config.RateLimitSpec{Burst: 1}
+	cfg := &config.File{
+		RouteOrder: "first_match",
+		Pools: []config.PoolSpec{
+			{Algorithm: "round_robin", Backends: []config.BackendSpec{{URL: web.URL, Weight: &one, RateLimit: limit}}},
+			{Name: "api", Algorithm: "least_conn", Backends: []config.BackendSpec{{URL: api.URL, Weight: &one, RateLimit: limit}}},
+		},
+		Routes: []config.RouteSpec{{Name: "api", PathPrefix: "/api/", Pool: "api"}},
+	}
+	router, err := BuildRouter(cfg)
+	if err != nil {
+		t.Fatalf("BuildRouter: %v", err)
+	}
+	if len(router.Pools()) != 2 {
+		t.Fatalf("expected 2 pools, got %d", len(router.Pools()))
+	}
+
+	for path, want := range map[string]string{"/api/users": "api", "/index.html": "web"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Body.String() != want {
+			t.Errorf("%s: expected %q, got %q", path, want, rr.Body.String())
+		}
+	}
+
+	cfg.Routes[0].Pool = "missing"
+	if _, err := BuildRouter(cfg); err == nil {
+		t.Fatal("expected error for route referencing an undeclared pool")
+	}
+	cfg.Routes[0].Pool = "api"
+	cfg.Pools[1].Algorithm = "nope"
+	if _, err := BuildRouter(cfg); err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
+
+func TestNewPool_HealthCheck(t *testing.T) {
+	one := 1
+	spec := config.PoolSpec{
+		Name:      "api",
+		Algorithm: "round_robin",
+		HealthCheck: &config.HealthCheckSpec{
+			Path: "/health", Method: "head", ExpectedStatus: "2xx,304", BodyRegex: "ok", Rise: 2, Fall: 3,
+		},
+		Backends: []config.BackendSpec{{URL: "http://a:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}}},
+	}
+	pool, err := NewPool(spec)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	h := pool.Health
+	if h.Method != "HEAD" || !h.ExpectedStatus.Contains(304) || h.ExpectedStatus.Contains(301) || h.BodyRegex == nil || h.Rise != 2 || h.Fall != 3 {
+		t.Fatalf("unexpected health config %+v", h)
+	}
+
+	spec.HealthCheck.ExpectedStatus = "2xx,abc"
+	if _, err := NewPool(spec); err == nil || !strings.Contains(err.Error(), "expected_status") {
+		t.Fatalf("expected expected_status error, got %v", err)
+	}
+}
+
+func TestNewPool_Timeouts(t *testing.T) {
+	one := 1
+	spec := config.PoolSpec{
+		Name:      "api",
+		Algorithm: "round_robin",
+		Timeouts:  &config.TimeoutSpec{Connect: time.Second, Request: 10 * time.Second},
+		Backends: []config.BackendSpec{
+			{URL: "http://a:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}},
+			{URL: "http://b:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}, Timeouts: &config.TimeoutSpec{Request: time.Minute}},
+		},
+	}
+	pool, err := NewPool(spec)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	a, b := pool.GetBackend("http://a:1").Timeouts(), pool.GetBackend("http://b:1").Timeouts()
+	if a.Connect != time.Second || a.Request != 10*time.Second {
+		t.Fatalf("unexpected pool timeouts %+v", a)
+	}
+	if b.Connect != time.Second || b.Request != time.Minute {
+		t.Fatalf("expected backend override on top of the pool timeouts, got %+v", b)
+	}
+}
+
+func TestNewPool_UpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeTestCert(t, dir, "ca", "ca.test")
+	client := writeTestCert(t, dir, "client", "client.test")
+	one := 1
+	spec := config.PoolSpec{
+		Name:        "api",
+		Algorithm:   "round_robin",
+		UpstreamTLS: &config.UpstreamTLSSpec{CA: ca.Cert, ServerName: "api.internal"},
+		Backends: []config.BackendSpec{
+			{URL: "https://a:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}},
+			{URL: "https://b:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}, UpstreamTLS: &config.UpstreamTLSSpec{Cert: client.Cert, Key: client.Key}},
+		},
+	}
+	pool, err := NewPool(spec)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	a, b := pool.GetBackend("https://a:1").UpstreamTLS(), pool.GetBackend("https://b:1").UpstreamTLS()
+	if a == nil || len(a.CA) == 0 || a.ServerName != "api.internal" || len(a.Cert) != 0 {
+		t.Fatalf("unexpected pool upstream TLS %+v", a)
+	}
+	if b == nil || len(b.CA) == 0 || len(b.Cert) == 0 || len(b.Key) == 0 {
+		t.Fatalf("expected the client certificate on top of the pool settings, got %+v", b)
+	}
+
+	spec.UpstreamTLS.CA = client.Key
+	if _, err := NewPool(spec); err == nil || !strings.Contains(err.Error(), "upstream_tls") {
+		t.Fatalf("expected upstream_tls error, got %v", err)
+	}
+}
+
+func TestListenerProtocols(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), config.ServerSpec{})
+	srv.Protocols = listenerProtocols(config.ListenerSpec{Address: ln.Addr().String(), H2C: true})
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	for _, c := range []struct {
+		name string
+		set  func(*http.Protocols)
+		want string
+	}{
+		{"http1", func(p *http.Protocols) { p.SetHTTP1(true) }, "HTTP/1.1"},
+		{"h2c", func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) }, "HTTP/2.0"},
+	} {
+		tr := &http.Transport{Protocols: new(http.Protocols)}
+		c.set(tr.Protocols)
+		resp, err := (&http.Client{Transport: tr}).Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.want {
+			t.Errorf("%s: expected %s, got %s", c.name, c.want, body)
+		}
+	}
+
+	off := false
+	if p := listenerProtocols(config.ListenerSpec{TLS: &config.TLSSpec{}, HTTP2: &off}); p.HTTP2() || !p.HTTP1() {
+		t.Fatalf("expected HTTP/1.1 only with http2: false, got %v", p)
+	}
+	if p := listenerProtocols(config.ListenerSpec{TLS: &config.TLSSpec{}}); !p.HTTP2() || p.UnencryptedHTTP2() {
+		t.Fatalf("expected HTTP/2 over TLS by default, got %v", p)
+	}
+	if p := listenerProtocols(config.ListenerSpec{}); p.UnencryptedHTTP2() || p.HTTP2() {
+		t.Fatalf("expected HTTP/1.1 only on a plain listener, got %v", p)
+	}
+}
+
+func TestNewPool_Protocol(t *testing.T) {
+	one := 1
+	spec := config.PoolSpec{
+		Name:      "api",
+		Algorithm: "round_robin",
+		Protocol:  "h2c",
+		Backends: []config.BackendSpec{
+			{URL: "http://a:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}},
+			{URL: "http://b:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}, Protocol: "auto"},
+		},
+	}
+	pool, err := NewPool(spec)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	if a, b := pool.GetBackend("http://a:1").Protocol(), pool.GetBackend("http://b:1").Protocol(); a != "h2c" || b != "" {
+		t.Fatalf("unexpected protocols %q, %q", a, b)
+	}
+	spec.Protocol = "h2"
+	if _, err := NewPool(spec); err == nil || !strings.Contains(err.Error(), "protocol") {
+		t.Fatalf("expected protocol error, got %v", err)
+	}
+	// a reload that reuses the backends fails the same way and changes nothing
+	if _, _, err := newPool(spec, pool); err == nil || !strings.Contains(err.Error(), "protocol") {
+		t.Fatalf("expected protocol error for reused backends, got %v", err)
+	}
+	if p := pool.GetBackend("http://a:1").Protocol(); p != "h2c" {
+		t.Fatalf("rejected reload changed the protocol to %q", p)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/config"
+	"github.com/Vime-Sistemas/vortice/domain"
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+// liveRouter serves requests with the router currently in effect; reloads
+// swap it atomically, so in-flight requests finish on the router they
+// started on.
+type liveRouter struct {
+	cur atomic.Pointer[domain.Router]
+}
+
+func newLiveRouter(r *domain.Router) *liveRouter {
+	lr := &liveRouter{}
+	lr.cur.Store(r)
+	return lr
+}
+
+// Router returns the router currently in effect.
+func (lr *liveRouter) Router() *domain.Router { return lr.cur.Load() }
+
+func (lr *liveRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lr.cur.Load().ServeHTTP(w, r)
+}
+
+// reloader re-reads the configuration and applies it to a liveRouter.
+type reloader struct {
+	// path is the config file, or "" when the configuration comes from
+	// environment variables (re-read from the .env file, if any)
+	path string
+	live *liveRouter
+	// localBackends re-adds the development backends to every reload
+	localBackends bool
+	// ctx bounds the health checks of the pools started by reloads
+	ctx context.Context
+	// certs are the certificates of the TLS listeners, also reloaded on
+	// SIGHUP
+	certs []*certStore
+
+	mu  sync.Mutex
+	cfg *config.File
+}
+
+// Reload loads the configuration again and, when it is valid, swaps in a
+// router built from it. Backends present in both configurations keep their
+// state (health, connections, latency, rate limiter) and new ones are checked
+// before the swap; pools and backends that disappear stop being
+// health-checked and leave the stats. An invalid configuration is rejected
+// and the current one stays in effect.
+func (rl *reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.path == "" {
+		config.LoadEnv()
+	}
+	cfg, err := loadConfig(rl.path)
+	if err != nil {
+		return err
+	}
+	if rl.localBackends {
+		addLocalBackends(cfg)
+	}
+	old := rl.live.Router()
+	router, apply, err := buildRouter(cfg, old)
+	if err != nil {
+		return err
+	}
+	checkNewBackends(router)
+	apply()
+
+	for _, p := range router.Pools() {
+		go func(p *domain.ServerPool) {
+			p.HealthCheck()
+			p.StartHealthCheck(rl.ctx)
+		}(p)
+	}
+	rl.live.cur.Store(router)
+	for _, p := range old.Pools() {
+		p.StopHealthCheck()
+	}
+	unregisterRemoved(old, router)
+
+	for _, line := range diffRouters(old, router) {
+		log.Printf("reload: %s", line)
+	}
+	if rl.cfg != nil {
+		if !reflect.DeepEqual(rl.cfg.Listeners, cfg.Listeners) || !reflect.DeepEqual(rl.cfg.Stats, cfg.Stats) || !reflect.DeepEqual(rl.cfg.Metrics, cfg.Metrics) || rl.cfg.Admin != cfg.Admin || rl.cfg.Server != cfg.Server {
+			log.Println("reload: mudanças em listeners, stats, metrics, admin e server só valem após reiniciar o processo")
+		}
+	}
+	rl.cfg = cfg
+	return nil
+}
+
+func (rl *reloader) reload(reason string) {
+	log.Printf("Recarregando configuração (%s)", reason)
+	if err := rl.Reload(); err != nil {
+		log.Printf("reload rejeitado, mantendo a configuração atual: %v", err)
+		return
+	}
+	log.Println("Configuração recarregada")
+}
+
+// watchSignals reloads the configuration and the certificates on every
+// SIGHUP.
+func (rl *reloader) watchSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		rl.reload("SIGHUP")
+		for _, c := range rl.certs {
+			c.reload("SIGHUP")
+		}
+	}
+}
+
+// watchFile polls file every interval and reloads when its modification time
+// or size changes.
+func (rl *reloader) watchFile(file string, interval time.Duration) {
+	last, _ := os.Stat(file)
+	for range time.Tick(interval) {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		rl.reload(file + " alterado")
+	}
+}
+
+// diffRouters describes the pool, backend and algorithm changes from old to
+// cur.
+func diffRouters(old, cur *domain.Router) []string {
+	var out []string
+	before := map[string]*domain.ServerPool{}
+	for _, p := range old.Pools() {
+		before[p.Name] = p
+	}
+	for _, p := range cur.Pools() {
+		prev, ok := before[p.Name]
+		delete(before, p.Name)
+		if !ok {
+			out = append(out, fmt.Sprintf("pool %s adicionado: %v", poolName(p), p.BackendURLs()))
+			continue
+		}
+		if prev.Algorithm != p.Algorithm {
+			out = append(out, fmt.Sprintf("pool %s: algoritmo %s -> %s", poolName(p), prev.Algorithm, p.Algorithm))
+		}
+		urls := map[string]bool{}
+		for _, u := range prev.BackendURLs() {
+			urls[u] = true
+		}
+		for _, u := range p.BackendURLs() {
+			if !urls[u] {
+				out = append(out, fmt.Sprintf("pool %s: backend %s adicionado", poolName(p), u))
+			}
+			delete(urls, u)
+		}
+		for _, u := range prev.BackendURLs() {
+			if urls[u] {
+				out = append(out, fmt.Sprintf("pool %s: backend %s removido", poolName(p), u))
+			}
+		}
+	}
+	for _, p := range old.Pools() {
+		if _, ok := before[p.Name]; ok {
+			out = append(out, fmt.Sprintf("pool %s removido", poolName(p)))
+		}
+	}
+	if len(old.Routes()) != len(cur.Routes()) {
+		out = append(out, fmt.Sprintf("rotas: %d -> %d", len(old.Routes()), len(cur.Routes())))
+	}
+	return out
+}
+
+// unregisterRemoved drops the stats of the backends of old that cur no longer
+// has, so they stop being exported.
+func unregisterRemoved(old, cur *domain.Router) {
+	kept := map[string]bool{}
+	for _, p := range cur.Pools() {
+		for _, u := range p.BackendURLs() {
+			kept[stats.Key(p.Name, u)] = true
+		}
+	}
+	for _, p := range old.Pools() {
+		for _, u := range p.BackendURLs() {
+			if !kept[stats.Key(p.Name, u)] {
+				stats.UnregisterPoolBackend(p.Name, u)
+			}
+		}
+	}
+}
+
+// checkNewBackends runs the first health check of the backends that were
+// never checked, in parallel, so those that are down get no traffic once the
+// router is published.
+func checkNewBackends(router *domain.Router) {
+	var wg sync.WaitGroup
+	for _, p := range router.Pools() {
+		for _, b := range p.Backends() {
+			if b.Checked() {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.CheckBackend(b)
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Vime-Sistemas/vortice/domain"
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func TestReload_KeepsBackendState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vortice.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: api
+    algorithm: round_robin
+    backends:
+      - url: http://127.0.0.1:9001
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	router, err := BuildRouter(cfg)
+	if err != nil {
+		t.Fatalf("BuildRouter: %v", err)
+	}
+	rl := &reloader{path: path, live: newLiveRouter(router), cfg: cfg, ctx: context.Background()}
+	kept := router.Pools()[0].GetBackend("http://127.0.0.1:9001")
+	kept.ConnCount = 3
+	kept.SetAlive(true)
+
+	writeConfig(t, path, `
+pools:
+  - name: api
+    algorithm: least_conn
+    backends:
+      - url: http://127.0.0.1:9001
+        weight: 4
+      - url: http://127.0.0.1:9002
+`)
+	if err := rl.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	pool := rl.live.Router().Pools()[0]
+	t.Cleanup(pool.StopHealthCheck)
+	if pool.Algorithm != "least_conn" {
+		t.Fatalf("expected least_conn, got %s", pool.Algorithm)
+	}
+	if got := pool.GetBackend("http://127.0.0.1:9001"); got != kept {
+		t.Fatalf("expected backend to be reused across reload")
+	}
+	if kept.ConnCount != 3 || !kept.IsAlive() || kept.Weight() != 4 {
+		t.Fatalf("backend state not kept: conns=%d alive=%v weight=%d", kept.ConnCount, kept.IsAlive(), kept.Weight())
+	}
+	if len(pool.Backends()) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(pool.Backends()))
+	}
+	// nothing listens on 9002: the first check runs before the swap
+	if pool.GetBackend("http://127.0.0.1:9002").IsAlive() {
+		t.Fatal("expected the new backend, which is down, to get no traffic")
+	}
+}
+
+func TestReload_RejectsInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vortice.yaml")
+	writeConfig(t, path, `
+pools:
+  - name: api
+    backends:
+      - url: http://127.0.0.1:9001
+routes:
+  - path_prefix: /api/
+    pool: api
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	router, err := BuildRouter(cfg)
+	if err != nil {
+		t.Fatalf("BuildRouter: %v", err)
+	}
+	rl := &reloader{path: path, live: newLiveRouter(router), cfg: cfg, ctx: context.Background()}
+
+	for _, broken := range []string{
+		// syntax error
+		"pools:\n  - name: api\n\tbackends: []\n",
+		// route to an undeclared pool
+		"pools:\n  - name: api\n    backends:\n      - url: http://127.0.0.1:9001\n        weight: 9\nroutes:\n  - pool: web\n",
+		// invalid regex, detected only when building the router
+		"pools:\n  - name: api\n    backends:\n      - url: http://127.0.0.1:9001\n        weight: 9\nroutes:\n  - path_regex: \"(\"\n    pool: api\n",
+	} {
+		writeConfig(t, path, broken)
+		if err := rl.Reload(); err == nil {
+			t.Fatalf("expected reload of %q to fail", broken)
+		}
+		if rl.live.Router() != router {
+			t.Fatalf("router replaced by a rejected reload")
+		}
+		if w := router.Pools()[0].GetBackend("http://127.0.0.1:9001").Weight(); w != 1 {
+			t.Fatalf("rejected reload changed backend weight to %d", w)
+		}
+	}
+}
+
+func TestDiffRouters(t *testing.T) {
+	old := &domain.Router{}
+	p := &domain.ServerPool{Name: "api", Algorithm: "round_robin"}
+	p.AddBackend(domain.NewBackend("http://a:1", 0, 1))
+	old.AddPool(p)
+
+	cur := &domain.Router{}
+	q := &domain.ServerPool{Name: "api", Algorithm: "random"}
+	q.AddBackend(domain.NewBackend("http://b:1", 0, 1))
+	cur.AddPool(q)
+
+	got := diffRouters(old, cur)
+	want := []string{
+		"pool api: algoritmo round_robin -> random",
+		"pool api: backend http://b:1 adicionado",
+		"pool api: backend http://a:1 removido",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("diff = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("diff[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	unregisterRemoved(old, cur)
+	snap := stats.SnapshotAll()
+	if _, ok := snap[stats.Key("api", "http://a:1")]; ok {
+		t.Fatal("expected the removed backend to leave the stats")
+	}
+	if _, ok := snap[stats.Key("api", "http://b:1")]; !ok {
+		t.Fatal("expected the new backend to keep its stats")
+	}
+}
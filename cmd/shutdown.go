@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// drainPoll is how often the drain checks for requests still in flight.
+const drainPoll = 100 * time.Millisecond
+
+// readiness answers the readiness endpoint: 200 while the instance takes
+// traffic, 503 once it started draining.
+type readiness struct {
+	draining atomic.Bool
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if rd.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// activeRequests sums the requests in flight to the backends of the router.
+func activeRequests(live *liveRouter) int64 {
+	var n int64
+	for _, p := range live.Router().Pools() {
+		for _, b := range p.Backends() {
+			n += atomic.LoadInt64(&b.ConnCount)
+		}
+	}
+	return n
+}
+
+// shutdown stops the instance gracefully.
+type shutdown struct {
+	ready   *readiness
+	live    *liveRouter
+	timeout time.Duration
+	// servers[i] serves the proxy on listeners[i]
+	listeners []net.Listener
+	servers   []*http.Server
+	// admin, when set, keeps answering (readiness included) while draining,
+	// unless handoff is set: then a new process took over the sockets and
+	// adminListener is closed right away as well
+	admin         *http.Server
+	adminListener net.Listener
+	handoff       bool
+}
+
+// run drains the instance: it reports not ready, stops accepting connections
+// on the proxy listeners, waits up to timeout for the proxied requests in
+// flight to finish and then shuts the servers down, closing whatever is left
+// once the deadline is over.
+func (sd *shutdown) run() {
+	deadline := time.Now().Add(sd.timeout)
+	sd.ready.draining.Store(true)
+	for i, ln := range sd.listeners {
+		sd.servers[i].SetKeepAlivesEnabled(false)
+		ln.Close()
+	}
+	if sd.handoff && sd.admin != nil {
+		sd.admin.SetKeepAlivesEnabled(false)
+		sd.adminListener.Close()
+	}
+
+	for n := activeRequests(sd.live); n > 0; n = activeRequests(sd.live) {
+		if time.Now().After(deadline) {
+			log.Printf("shutdown: prazo de drenagem esgotado com %d requisições em andamento", n)
+			break
+		}
+		time.Sleep(drainPoll)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	servers := sd.servers
+	if sd.admin != nil {
+		servers = append(servers[:len(servers):len(servers)], sd.admin)
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}
+}
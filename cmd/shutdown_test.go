@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/domain"
+)
+
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	live := newLiveRouter(&domain.Router{Default: NewProxyPool([]string{backend.URL}, "round_robin", [][2]int{{0, 1}}, []int{1}, "")})
+	ready := &readiness{}
+	mux := http.NewServeMux()
+	mux.Handle("/", live)
+	mux.Handle("/ready", ready)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	addr := "http://" + ln.Addr().String()
+
+	if resp, err := http.Get(addr + "/ready"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected ready before shutdown, got %v %v", resp, err)
+	}
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(addr + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	for activeRequests(live) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sd := &shutdown{ready: ready, live: live, timeout: 5 * time.Second, listeners: []net.Listener{ln}, servers: []*http.Server{srv}}
+	finished := make(chan struct{})
+	go func() {
+		sd.run()
+		close(finished)
+	}()
+
+	rr := httptest.NewRecorder()
+	for !ready.draining.Load() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	ready.ServeHTTP(rr, httptest.NewRequest("GET", "/ready", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while draining, got %d", rr.Code)
+	}
+	select {
+	case <-finished:
+		t.Fatal("shutdown finished with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if got := <-body; got != "done" {
+		t.Fatalf("in-flight request was not completed: %q", got)
+	}
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not finish after the requests drained")
+	}
+}
+
+func TestShutdown_DrainDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	pool := NewProxyPool([]string{backend.URL}, "round_robin", [][2]int{{0, 1}}, []int{1}, "")
+	live := newLiveRouter(&domain.Router{Default: pool})
+	pool.Backends()[0].ConnCount = 1 // a request that never ends
+
+	start := time.Now()
+	(&shutdown{ready: &readiness{}, live: live, timeout: 200 * time.Millisecond}).run()
+	if d := time.Since(start); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("expected shutdown to give up at the drain deadline, took %v", d)
+	}
+}
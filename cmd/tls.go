@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/config"
+	"github.com/Vime-Sistemas/vortice/domain"
+)
+
+// defaultCertReload is how often the certificate files are checked for
+// changes when the listener does not set reload_interval.
+const defaultCertReload = time.Minute
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certStore holds the certificates of a TLS listener and picks one for each
+// connection by SNI. The files are read again when they change, so renewed
+// certificates are served without a restart.
+type certStore struct {
+	specs []config.CertificateSpec
+	// managed are the files written by the ACME manager, skipped while they
+	// do not exist
+	managed []config.CertificateSpec
+	// loading serializes the loads
+	loading sync.Mutex
+
+	mu sync.RWMutex
+	// certs follow the order of specs, then managed; the first one is the
+	// default
+	certs []*tls.Certificate
+	// byName maps the lowercase names of the certificates, including
+	// wildcards such as "*.example.com", to the first certificate declaring
+	// them
+	byName map[string]*tls.Certificate
+	// stamp identifies the version of the files last loaded
+	stamp string
+}
+
+func newCertStore(specs, managed []config.CertificateSpec) (*certStore, error) {
+	s := &certStore{specs: specs, managed: managed}
+	return s, s.load()
+}
+
+// load reads every certificate again. On error the certificates in use are
+// kept, and the files are read again at the next check even if they do not
+// change.
+func (s *certStore) load() error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	// taken before reading, so files written during the load count as a change
+	stamp := s.fileStamp()
+
+	certs := make([]*tls.Certificate, 0, len(s.specs)+len(s.managed))
+	byName := map[string]*tls.Certificate{}
+	for i, spec := range s.files() {
+		cert, err := tls.LoadX509KeyPair(spec.Cert, spec.Key)
+		if errors.Is(err, fs.ErrNotExist) && i >= len(s.specs) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("certificado %s: %v", spec.Cert, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("certificado %s: %v", spec.Cert, err)
+			}
+		}
+		c := &cert
+		for _, name := range certNames(cert.Leaf) {
+			if _, ok := byName[name]; !ok {
+				byName[name] = c
+			}
+		}
+		certs = append(certs, c)
+	}
+	s.mu.Lock()
+	s.certs, s.byName, s.stamp = certs, byName, stamp
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *certStore) files() []config.CertificateSpec {
+	return append(s.specs[:len(s.specs):len(s.specs)], s.managed...)
+}
+
+// certNames returns the DNS names of cert, or its common name when it has
+// none.
+func certNames(cert *x509.Certificate) []string {
+	names := cert.DNSNames
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = []string{cert.Subject.CommonName}
+	}
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		out = append(out, strings.ToLower(n))
+	}
+	return out
+}
+
+// GetCertificate picks the certificate for the server name of hello: an
+// exact name, then a wildcard covering its first label, then the default.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.byName[name]; ok {
+		return c, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if c, ok := s.byName["*"+name[i:]]; ok {
+			return c, nil
+		}
+	}
+	if len(s.certs) == 0 {
+		return nil, fmt.Errorf("nenhum certificado disponível para %q", hello.ServerName)
+	}
+	return s.certs[0], nil
+}
+
+// fileStamp describes the modification time and size of every file, so a
+// change to any of them is noticed.
+func (s *certStore) fileStamp() string {
+	var b strings.Builder
+	for _, spec := range s.files() {
+		for _, file := range []string{spec.Cert, spec.Key} {
+			if fi, err := os.Stat(file); err == nil {
+				fmt.Fprintf(&b, "%s:%d:%d;", file, fi.ModTime().UnixNano(), fi.Size())
+			} else {
+				fmt.Fprintf(&b, "%s:-;", file)
+			}
+		}
+	}
+	return b.String()
+}
+
+// changed reports whether the files differ from the ones last loaded.
+func (s *certStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fileStamp() != s.stamp
+}
+
+// reload loads the certificates again, logging the outcome.
+func (s *certStore) reload(reason string) {
+	if err := s.load(); err != nil {
+		log.Printf("tls: recarga dos certificados rejeitada (%s), mantendo os atuais: %v", reason, err)
+		return
+	}
+	log.Printf("tls: certificados recarregados (%s)", reason)
+}
+
+// watch polls the files every interval and reloads them when they change,
+// until ctx is done.
+func (s *certStore) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if s.changed() {
+			s.reload("arquivos alterados")
+		}
+	}
+}
+
+// tlsConfig creates the server TLS configuration described by spec and the
+// certificate store behind it.
+func tlsConfig(spec *config.TLSSpec) (*tls.Config, *certStore, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if spec.MinVersion != "" {
+		minVersion = tlsVersions[spec.MinVersion]
+	}
+	suites, err := cipherSuites(spec.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := newCertStore(spec.Certificates, acmeCertificates(spec.ACME))
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: store.GetCertificate,
+	}
+	if ca := spec.ClientAuth; ca != nil {
+		pemCerts, err := os.ReadFile(ca.CA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("client_auth.ca: %v", err)
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, nil, fmt.Errorf("client_auth.ca: nenhum certificado em %s", ca.CA)
+		}
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+		if ca.Mode == "request" {
+			tc.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tc, store, nil
+}
+
+// cipherSuites converts crypto/tls cipher suite names to their IDs.
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+	out := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(n))]
+		if !ok {
+			return nil, fmt.Errorf("cipher_suites: suíte desconhecida %q", n)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+// httpsPort returns the port of the first TLS listener, the target of the
+// HTTP to HTTPS redirects.
+func httpsPort(listeners []config.ListenerSpec) string {
+	for _, l := range listeners {
+		if l.TLS != nil {
+			_, port, _ := net.SplitHostPort(l.Address)
+			return port
+		}
+	}
+	return ""
+}
+
+// httpsRedirect permanently redirects every request to the same host, path
+// and query on HTTPS at port (left out when it is 443).
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// clientCertHeaderNames returns the headers that carry client certificate
+// fields on any listener; clients must not be able to set them.
+func clientCertHeaderNames(listeners []config.ListenerSpec) []string {
+	var out []string
+	for _, l := range listeners {
+		if l.TLS == nil || l.TLS.ClientAuth == nil {
+			continue
+		}
+		for _, h := range l.TLS.ClientAuth.Headers {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// clientCertHeaders removes the strip headers from every request and, when
+// the client presented a verified certificate, sets the headers of fields
+// (field name to header) from it before calling next.
+func clientCertHeaders(next http.Handler, strip []string, fields map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range strip {
+			r.Header.Del(h)
+		}
+		if cert := domain.ClientCert(r); cert != nil {
+			for field, h := range fields {
+				if v := clientCertField(cert, field); v != "" {
+					r.Header.Set(h, v)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertField formats a field of cert (see config.ClientCertFields) as
+// a header value.
+func clientCertField(cert *x509.Certificate, field string) string {
+	var v string
+	switch field {
+	case "subject":
+		v = cert.Subject.String()
+	case "issuer":
+		v = cert.Issuer.String()
+	case "serial":
+		v = cert.SerialNumber.Text(16)
+	case "fingerprint":
+		sum := sha256.Sum256(cert.Raw)
+		v = hex.EncodeToString(sum[:])
+	case "dns":
+		v = strings.Join(cert.DNSNames, ",")
+	case "email":
+		v = strings.Join(cert.EmailAddresses, ",")
+	case "uri":
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		v = strings.Join(uris, ",")
+	case "not_after":
+		v = cert.NotAfter.UTC().Format(time.RFC3339)
+	case "cert":
+		v = url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+	// names in a certificate may hold characters not allowed in a header
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
+}
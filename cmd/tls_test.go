@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/config"
+)
+
+// writeTestCert writes a self-signed certificate for names to dir and
+// returns its files.
+func writeTestCert(t *testing.T, dir, file string, names ...string) config.CertificateSpec {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := config.CertificateSpec{Cert: filepath.Join(dir, file+".crt"), Key: filepath.Join(dir, file+".key")}
+	if err := os.WriteFile(spec.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(spec.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func servedName(t *testing.T, s *certStore, sni string) string {
+	t.Helper()
+	c, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q): %v", sni, err)
+	}
+	return c.Leaf.DNSNames[0]
+}
+
+func TestCertStore_SNI(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newCertStore([]config.CertificateSpec{
+		writeTestCert(t, dir, "default", "default.test"),
+		writeTestCert(t, dir, "wildcard", "*.example.test"),
+		writeTestCert(t, dir, "api", "api.example.test"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+	cases := map[string]string{
+		"api.example.test":     "api.example.test",
+		"API.Example.Test.":    "api.example.test",
+		"www.example.test":     "*.example.test",
+		"a.b.example.test":     "default.test",
+		"example.test":         "default.test",
+		"":                     "default.test",
+		"default.test":         "default.test",
+		"unknown.invalid.test": "default.test",
+	}
+	for sni, want := range cases {
+		if got := servedName(t, store, sni); got != want {
+			t.Errorf("SNI %q: expected %s, got %s", sni, want, got)
+		}
+	}
+}
+
+func TestCertStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	spec := writeTestCert(t, dir, "site", "old.test")
+	store, err := newCertStore([]config.CertificateSpec{spec}, nil)
+	if err != nil {
+		t.Fatalf("newCertStore: %v", err)
+	}
+	if store.changed() {
+		t.Fatal("expected no change right after loading")
+	}
+
+	// a broken file keeps the certificate in use
+	os.WriteFile(spec.Cert, []byte("not a certificate"), 0o600)
+	if !store.changed() {
+		t.Fatal("expected the rewritten file to be noticed")
+	}
+	store.reload("test")
+	if got := servedName(t, store, ""); got != "old.test" {
+		t.Fatalf("expected the old certificate after a failed reload, got %s", got)
+	}
+	if !store.changed() {
+		t.Fatal("expected a failed reload to be retried at the next check")
+	}
+
+	writeTestCert(t, dir, "site", "new.test")
+	store.reload("test")
+	if got := servedName(t, store, ""); got != "new.test" {
+		t.Fatalf("expected the new certificate, got %s", got)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certs := []config.CertificateSpec{writeTestCert(t, dir, "site", "site.test")}
+
+	tc, _, err := tlsConfig(&config.TLSSpec{Certificates: certs, MinVersion: "1.3"})
+	if err != nil || tc.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3 minimum, got %+v (%v)", tc, err)
+	}
+	tc, _, err = tlsConfig(&config.TLSSpec{Certificates: certs, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}})
+	if err != nil || tc.MinVersion != tls.VersionTLS12 || len(tc.CipherSuites) != 1 || tc.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected config %+v (%v)", tc, err)
+	}
+	if _, _, err := tlsConfig(&config.TLSSpec{Certificates: certs, CipherSuites: []string{"TLS_NOPE"}}); err == nil {
+		t.Fatal("expected an error for an unknown cipher suite")
+	}
+	if _, _, err := tlsConfig(&config.TLSSpec{Certificates: []config.CertificateSpec{{Cert: filepath.Join(dir, "missing.crt"), Key: certs[0].Key}}}); err == nil {
+		t.Fatal("expected an error for a missing certificate")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		port, host, uri, want string
+	}{
+		{"443", "example.test:8080", "/a/b?x=1", "https://example.test/a/b?x=1"},
+		{"8443", "example.test", "/", "https://example.test:8443/"},
+		{"", "[::1]:8080", "/p", "https://[::1]/p"},
+		{"8443", "[::1]", "/p", "https://[::1]:8443/p"},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", c.uri, nil)
+		req.Host = c.host
+		httpsRedirect(c.port).ServeHTTP(rr, req)
+		if rr.Code != 308 || rr.Header().Get("Location") != c.want {
+			t.Errorf("%s%s: expected 308 to %s, got %d %s", c.host, c.uri, c.want, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	site := writeTestCert(t, dir, "site", "site.test")
+	client := writeTestCert(t, dir, "client", "client.test")
+	stranger := writeTestCert(t, dir, "stranger", "stranger.test")
+	fields := map[string]string{"subject": "X-Client-Cert-Subject", "dns": "X-Client-Cert-DNS"}
+
+	get := func(mode string, cert *config.CertificateSpec) (*http.Response, error) {
+		t.Helper()
+		tc, _, err := tlsConfig(&config.TLSSpec{
+			Certificates: []config.CertificateSpec{site},
+			ClientAuth:   &config.ClientAuthSpec{Mode: mode, CA: client.Cert, Headers: fields},
+		})
+		if err != nil {
+			t.Fatalf("tlsConfig: %v", err)
+		}
+		echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Got-Subject", r.Header.Get("X-Client-Cert-Subject"))
+			w.Header().Set("X-Got-DNS", r.Header.Get("X-Client-Cert-DNS"))
+		})
+		srv := httptest.NewUnstartedServer(clientCertHeaders(echo, []string{"X-Client-Cert-Subject", "X-Client-Cert-DNS"}, fields))
+		srv.TLS = tc
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+
+		clientTLS := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			pair, err := tls.LoadX509KeyPair(cert.Cert, cert.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// sent even when its CA is not among the ones the server accepts
+			clientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &pair, nil }
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}).Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := get("", nil); err == nil {
+		t.Fatal("require: expected the handshake to fail without a client certificate")
+	}
+	if _, err := get("require", &stranger); err == nil {
+		t.Fatal("require: expected a certificate from another CA to be rejected")
+	}
+	resp, err := get("require", &client)
+	if err != nil {
+		t.Fatalf("require: %v", err)
+	}
+	if got := resp.Header.Get("X-Got-Subject"); got != "CN=client.test" {
+		t.Fatalf("expected the verified subject in the header, got %q", got)
+	}
+	if got := resp.Header.Get("X-Got-DNS"); got != "client.test" {
+		t.Fatalf("expected the verified SANs in the header, got %q", got)
+	}
+
+	resp, err = get("request", nil)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if got := resp.Header.Get("X-Got-Subject"); got != "" {
+		t.Fatalf("expected the spoofed header to be dropped, got %q", got)
+	}
+	if _, err := get("request", &stranger); err == nil {
+		t.Fatal("request: expected a certificate from another CA to be rejected")
+	}
+
+	if _, _, err := tlsConfig(&config.TLSSpec{
+		Certificates: []config.CertificateSpec{site},
+		ClientAuth:   &config.ClientAuthSpec{CA: client.Key},
+	}); err == nil {
+		t.Fatal("expected an error for a CA file without certificates")
+	}
+}
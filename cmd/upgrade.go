@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/domain"
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+// Binary upgrades: the running process execs a new copy of the binary, which
+// inherits the listening sockets as extra files (starting at fd 3, in the
+// order of VORTICE_LISTENERS) followed by a pipe it writes to once it is
+// serving. VORTICE_STATE_FILE carries the stats and backend health over.
+const (
+	envListeners   = "VORTICE_LISTENERS"
+	envStateFile   = "VORTICE_STATE_FILE"
+	upgradeTimeout = 30 * time.Second
+)
+
+// listeners opens the sockets of the process, reusing the ones inherited from
+// the parent on an upgrade.
+type listeners struct {
+	inherited map[string]net.Listener
+	// addrs[i] is the address open[i] listens on
+	addrs []string
+	open  []net.Listener
+	// ready tells the parent that this process is serving
+	ready *os.File
+}
+
+// inheritListeners picks up the sockets handed over by the parent process,
+// if any.
+func inheritListeners() (*listeners, error) {
+	ls := &listeners{inherited: map[string]net.Listener{}}
+	v := os.Getenv(envListeners)
+	if v == "" {
+		return ls, nil
+	}
+	os.Unsetenv(envListeners)
+	addrs := strings.Split(v, ",")
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listener herdado %s: %v", addr, err)
+		}
+		ls.inherited[addr] = ln
+	}
+	ls.ready = os.NewFile(uintptr(3+len(addrs)), "ready")
+	return ls, nil
+}
+
+// listen returns the inherited socket for addr, or a new one.
+func (ls *listeners) listen(addr string) (net.Listener, error) {
+	ln, ok := ls.inherited[addr]
+	if ok {
+		delete(ls.inherited, addr)
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	ls.addrs = append(ls.addrs, addr)
+	ls.open = append(ls.open, ln)
+	return ln, nil
+}
+
+// serving closes the inherited sockets the configuration no longer uses and
+// tells the parent, if any, that this process took over.
+func (ls *listeners) serving() {
+	for _, ln := range ls.inherited {
+		ln.Close()
+	}
+	ls.inherited = nil
+	if ls.ready != nil {
+		ls.ready.Write([]byte{1})
+		ls.ready.Close()
+		ls.ready = nil
+	}
+}
+
+// upgrade starts a new copy of the binary with the same arguments, handing
+// it the open sockets and st. It returns once the child is serving; on error
+// the child is gone and the current process keeps serving.
+func (ls *listeners) upgrade(st *upgradeState) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, ln := range ls.open {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s não pode ser repassado", ls.addrs[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", ls.addrs[i], err)
+		}
+		files = append(files, f)
+	}
+
+	state, err := writeState(st)
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		os.Remove(state)
+		return err
+	}
+	defer r.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		w.Close()
+		os.Remove(state)
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), envListeners+"="+strings.Join(ls.addrs, ","), envStateFile+"="+state)
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		os.Remove(state)
+		return err
+	}
+	log.Printf("upgrade: novo processo iniciado (pid %d)", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err == nil {
+			return nil
+		}
+		err = <-exited
+		os.Remove(state)
+		return fmt.Errorf("novo processo terminou sem assumir os listeners: %v", err)
+	case err := <-exited:
+		os.Remove(state)
+		return fmt.Errorf("novo processo terminou sem assumir os listeners: %v", err)
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		os.Remove(state)
+		return fmt.Errorf("novo processo não ficou pronto em %s", upgradeTimeout)
+	}
+}
+
+// upgradeState is what a process hands over to the next one on an upgrade.
+type upgradeState struct {
+	Stats    []stats.Counters `json:"stats"`
+	Backends []backendHealth  `json:"backends"`
+}
+
+// backendHealth is the health and administrative state of a backend.
+type backendHealth struct {
+	Pool  string `json:"pool,omitempty"`
+	URL   string `json:"url"`
+	Alive bool   `json:"alive"`
+	State string `json:"state"`
+}
+
+// captureState collects the stats and the state of the backends of router.
+func captureState(router *domain.Router) *upgradeState {
+	st := &upgradeState{Stats: stats.Export()}
+	for _, pb := range allBackends(router) {
+		st.Backends = append(st.Backends, backendHealth{
+			Pool:  pb.pool.Name,
+			URL:   pb.URL.String(),
+			Alive: pb.IsAlive(),
+			State: pb.State().String(),
+		})
+	}
+	return st
+}
+
+// restore applies st to the backends of router found in it and imports the
+// stats.
+func (st *upgradeState) restore(router *domain.Router) {
+	stats.Import(st.Stats)
+	byPool := map[string]*domain.ServerPool{}
+	for _, p := range router.Pools() {
+		byPool[p.Name] = p
+	}
+	for _, bh := range st.Backends {
+		p := byPool[bh.Pool]
+		if p == nil {
+			continue
+		}
+		b := p.GetBackend(bh.URL)
+		if b == nil {
+			continue
+		}
+		b.SetAlive(bh.Alive)
+		if s, err := domain.ParseBackendState(bh.State); err == nil {
+			b.SetState(s)
+		}
+	}
+}
+
+func writeState(st *upgradeState) (string, error) {
+	f, err := os.CreateTemp("", "vortice-state-*.json")
+	if err != nil {
+		return "", err
+	}
+	if err := json.NewEncoder(f).Encode(st); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// readState loads the state handed over by the parent process, if any, and
+// removes the file.
+func readState() (*upgradeState, error) {
+	path := os.Getenv(envStateFile)
+	if path == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envStateFile)
+	defer os.Remove(path)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	st := &upgradeState{}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, fmt.Errorf("arquivo de estado inválido: %v", err)
+	}
+	return st, nil
+}
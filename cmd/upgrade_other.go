@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignal is nil where there is no SIGUSR2: binary upgrades are not
+// available.
+var upgradeSignal os.Signal
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Vime-Sistemas/vortice/config"
+	"github.com/Vime-Sistemas/vortice/domain"
+)
+
+func TestUpgradeState_RoundTrip(t *testing.T) {
+	one := 1
+	cfg := &config.File{
+		RouteOrder: "first_match",
+		Pools: []config.PoolSpec{{
+			Name:      "api",
+			Algorithm: "round_robin",
+			Backends: []config.BackendSpec{
+				{URL: "http://a:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}},
+				{URL: "http://b:1", Weight: &one, RateLimit: &config.RateLimitSpec{Burst: 1}},
+			},
+		}},
+	}
+	old, err := BuildRouter(cfg)
+	if err != nil {
+		t.Fatalf("BuildRouter: %v", err)
+	}
+	pool := old.Pools()[0]
+	pool.GetBackend("http://b:1").SetAlive(false)
+	pool.GetBackend("http://b:1").SetState(domain.StateDraining)
+
+	path, err := writeState(captureState(old))
+	if err != nil {
+		t.Fatalf("writeState: %v", err)
+	}
+	os.Setenv(envStateFile, path)
+	defer os.Unsetenv(envStateFile)
+	st, err := readState()
+	if err != nil || st == nil {
+		t.Fatalf("readState: %v %v", st, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the state file to be removed, got %v", err)
+	}
+
+	cur, err := BuildRouter(cfg)
+	if err != nil {
+		t.Fatalf("BuildRouter: %v", err)
+	}
+	st.restore(cur)
+	a, b := cur.Pools()[0].GetBackend("http://a:1"), cur.Pools()[0].GetBackend("http://b:1")
+	if !a.IsAlive() || b.IsAlive() || b.State() != domain.StateDraining {
+		t.Fatalf("backend state not restored: a alive=%v, b alive=%v state=%v", a.IsAlive(), b.IsAlive(), b.State())
+	}
+}
+
+func TestListeners_ReusesInherited(t *testing.T) {
+	ls := &listeners{inherited: map[string]net.Listener{}}
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ls.inherited["127.0.0.1:8080"] = inherited
+	ls.inherited["127.0.0.1:8081"] = unused
+
+	ln, err := ls.listen("127.0.0.1:8080")
+	if err != nil || ln != inherited {
+		t.Fatalf("expected the inherited listener, got %v %v", ln, err)
+	}
+	fresh, err := ls.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer fresh.Close()
+	defer ln.Close()
+	ls.serving()
+	if _, err := unused.Accept(); err == nil {
+		t.Fatal("expected the unused inherited listener to be closed")
+	}
+	if len(ls.open) != 2 || ls.addrs[0] != "127.0.0.1:8080" {
+		t.Fatalf("unexpected open listeners %v", ls.addrs)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // GetBackends retorna a lista de backends a partir da variável BACKEND_URLS (vírgula separada)
@@ -123,7 +125,8 @@ func GetLocalBackendForce() bool {
 	return strings.EqualFold(v, "true")
 }
 
-// GetLBAlgorithm retorna o algoritmo de balanceamento. Valores suportados: "round_robin", "least_conn", "random", "ip_hash".
+// GetLBAlgorithm retorna o algoritmo de balanceamento. Valores embutidos: "round_robin", "least_conn", "random", "ip_hash";
+// estratégias adicionais podem ser registradas com domain.RegisterBalancer.
 func GetLBAlgorithm() string {
 	if s := os.Getenv("LOAD_BALANCER_ALGO"); s != "" {
 		return strings.ToLower(s)
@@ -157,14 +160,23 @@ func GetIPHashHeader() string {
 	return os.Getenv("IP_HASH_HEADER")
 }
 
+// GetHashKey retorna a chave usada por ring_hash e maglev (HASH_KEY), ex: "ip", "header:X-User-Id",
+// "cookie:session", "path" ou "query:tenant". Vazio equivale a "ip".
+func GetHashKey() string {
+	return strings.TrimSpace(os.Getenv("HASH_KEY"))
+}
+
 // GetPerBackendRateLimits parses BACKEND_RATE_LIMITS no formato "rps/burst,rps/burst,...".
 // Retorna um slice de pares [][2]int com (rps, burst) para cada backend; se fewer entries,
 // preenche com os valores globais de RATE_LIMIT_RPS e RATE_LIMIT_BURST.
 func GetPerBackendRateLimits(n int) [][2]int {
+	return parseRateLimits(os.Getenv("BACKEND_RATE_LIMITS"), n)
+}
+
+func parseRateLimits(s string, n int) [][2]int {
 	out := make([][2]int, 0, n)
 	globalRPS := GetRateLimitRPS()
 	globalBurst := GetRateLimitBurst()
-	s := os.Getenv("BACKEND_RATE_LIMITS")
 	if s == "" {
 		for i := 0; i < n; i++ {
 			out = append(out, [2]int{globalRPS, globalBurst})
@@ -203,3 +215,369 @@ func GetPerBackendRateLimits(n int) [][2]int {
 	}
 	return out
 }
+
+// GetPerBackendWeights parses BACKEND_WEIGHTS no formato "w,w,..." na mesma ordem de BACKEND_URLS.
+// Entradas ausentes, vazias, inválidas ou negativas usam peso 1; 0 é válido e drena o backend.
+func GetPerBackendWeights(n int) []int {
+	return parseWeights(os.Getenv("BACKEND_WEIGHTS"), n)
+}
+
+func parseWeights(s string, n int) []int {
+	out := make([]int, n)
+	parts := strings.Split(s, ",")
+	for i := 0; i < n; i++ {
+		out[i] = 1
+		if i < len(parts) {
+			if w, err := strconv.Atoi(strings.TrimSpace(parts[i])); err == nil && w >= 0 {
+				out[i] = w
+			}
+		}
+	}
+	return out
+}
+
+// GetStickyCookie retorna o nome do cookie de afinidade (STICKY_COOKIE). Vazio desabilita sessões sticky.
+func GetStickyCookie() string {
+	return strings.TrimSpace(os.Getenv("STICKY_COOKIE"))
+}
+
+// GetStickyTTL retorna a duração do cookie de afinidade (STICKY_TTL, ex: "30m"); 0 = cookie de sessão.
+func GetStickyTTL() time.Duration {
+	if s := os.Getenv("STICKY_TTL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// GetStickySecure retorna true se STICKY_SECURE estiver definida como "true".
+func GetStickySecure() bool {
+	return strings.EqualFold(os.Getenv("STICKY_SECURE"), "true")
+}
+
+// GetStickyHTTPOnly retorna false apenas se STICKY_HTTPONLY estiver definida como "false" (padrão true).
+func GetStickyHTTPOnly() bool {
+	return !strings.EqualFold(os.Getenv("STICKY_HTTPONLY"), "false")
+}
+
+// GetStickySameSite retorna o atributo SameSite do cookie (STICKY_SAMESITE): "lax", "strict", "none" ou vazio.
+func GetStickySameSite() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("STICKY_SAMESITE")))
+}
+
+// GetStickySecret retorna a chave usada para assinar o cookie de afinidade (STICKY_SECRET); vazio = sem assinatura.
+func GetStickySecret() string {
+	return os.Getenv("STICKY_SECRET")
+}
+
+// GetConfigWatchInterval retorna o intervalo de verificação do arquivo de configuração para o
+// reload automático (CONFIG_WATCH_INTERVAL, ex: "2s"; padrão 2s). "0" desativa a verificação.
+func GetConfigWatchInterval() time.Duration {
+	s := strings.TrimSpace(os.Getenv("CONFIG_WATCH_INTERVAL"))
+	if s == "" {
+		return 2 * time.Second
+	}
+	if s == "0" {
+		return 0
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return 2 * time.Second
+}
+
+// GetAdminAddr retorna o endereço da API administrativa (ADMIN_ADDR, ex: "127.0.0.1:9090");
+// vazio desativa a API.
+func GetAdminAddr() string {
+	return strings.TrimSpace(os.Getenv("ADMIN_ADDR"))
+}
+
+// GetAdminToken retorna o token exigido pela API administrativa (ADMIN_TOKEN); vazio = sem autenticação.
+func GetAdminToken() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// GetHealthCheck retorna o health check padrão dos pools, lido de HEALTH_CHECK_PATH,
+// HEALTH_CHECK_METHOD, HEALTH_CHECK_EXPECTED_STATUS, HEALTH_CHECK_BODY, HEALTH_CHECK_BODY_REGEX,
+// HEALTH_CHECK_INTERVAL, HEALTH_CHECK_JITTER, HEALTH_CHECK_TIMEOUT, HEALTH_CHECK_RISE e
+// HEALTH_CHECK_FALL; nil se nenhuma estiver definida. Durações e números inválidos são ignorados.
+func GetHealthCheck() *HealthCheckSpec {
+	h := &HealthCheckSpec{
+		Path:           strings.TrimSpace(os.Getenv("HEALTH_CHECK_PATH")),
+		Method:         strings.ToUpper(strings.TrimSpace(os.Getenv("HEALTH_CHECK_METHOD"))),
+		ExpectedStatus: strings.TrimSpace(os.Getenv("HEALTH_CHECK_EXPECTED_STATUS")),
+		BodyContains:   os.Getenv("HEALTH_CHECK_BODY"),
+		BodyRegex:      os.Getenv("HEALTH_CHECK_BODY_REGEX"),
+		Interval:       envDuration("HEALTH_CHECK_INTERVAL"),
+		Jitter:         envDuration("HEALTH_CHECK_JITTER"),
+		Timeout:        envDuration("HEALTH_CHECK_TIMEOUT"),
+		Rise:           envInt("HEALTH_CHECK_RISE"),
+		Fall:           envInt("HEALTH_CHECK_FALL"),
+	}
+	if reflect.DeepEqual(h, &HealthCheckSpec{}) {
+		return nil
+	}
+	return h
+}
+
+func envDuration(key string) time.Duration {
+	if d, err := time.ParseDuration(strings.TrimSpace(os.Getenv(key))); err == nil && d > 0 {
+		return d
+	}
+	return 0
+}
+
+func envInt(key string) int {
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key))); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// GetOutlierDetection retorna a ejeção por erros no tráfego padrão dos pools, lida de
+// OUTLIER_CONSECUTIVE_5XX, OUTLIER_CONSECUTIVE_GATEWAY_ERRORS, OUTLIER_FAILURE_RATE_PCT,
+// OUTLIER_MIN_REQUESTS, OUTLIER_WINDOW, OUTLIER_BASE_EJECTION_TIME, OUTLIER_MAX_EJECTION_TIME e
+// OUTLIER_MAX_EJECTION_PERCENT; nil (desabilitada) se nenhuma estiver definida.
+func GetOutlierDetection() *OutlierSpec {
+	o := &OutlierSpec{
+		Consecutive5xx:           envInt("OUTLIER_CONSECUTIVE_5XX"),
+		ConsecutiveGatewayErrors: envInt("OUTLIER_CONSECUTIVE_GATEWAY_ERRORS"),
+		MinRequests:              envInt("OUTLIER_MIN_REQUESTS"),
+		Window:                   envDuration("OUTLIER_WINDOW"),
+		BaseEjectionTime:         envDuration("OUTLIER_BASE_EJECTION_TIME"),
+		MaxEjectionTime:          envDuration("OUTLIER_MAX_EJECTION_TIME"),
+		MaxEjectionPercent:       envInt("OUTLIER_MAX_EJECTION_PERCENT"),
+		FailureRatePct:           envFloat("OUTLIER_FAILURE_RATE_PCT"),
+	}
+	if reflect.DeepEqual(o, &OutlierSpec{}) {
+		return nil
+	}
+	return o
+}
+
+// GetCircuitBreaker retorna o circuit breaker padrão dos pools, lido de CIRCUIT_FAILURE_RATE_PCT,
+// CIRCUIT_SLOW_CALL_RATE_PCT, CIRCUIT_SLOW_CALL_DURATION, CIRCUIT_MIN_REQUESTS, CIRCUIT_WINDOW,
+// CIRCUIT_OPEN_DURATION e CIRCUIT_HALF_OPEN_REQUESTS; nil (desabilitado) se nenhuma estiver definida.
+func GetCircuitBreaker() *CircuitBreakerSpec {
+	c := &CircuitBreakerSpec{
+		FailureRatePct:   envFloat("CIRCUIT_FAILURE_RATE_PCT"),
+		SlowCallRatePct:  envFloat("CIRCUIT_SLOW_CALL_RATE_PCT"),
+		SlowCallDuration: envDuration("CIRCUIT_SLOW_CALL_DURATION"),
+		MinRequests:      envInt("CIRCUIT_MIN_REQUESTS"),
+		Window:           envDuration("CIRCUIT_WINDOW"),
+		OpenDuration:     envDuration("CIRCUIT_OPEN_DURATION"),
+		HalfOpenRequests: envInt("CIRCUIT_HALF_OPEN_REQUESTS"),
+	}
+	if reflect.DeepEqual(c, &CircuitBreakerSpec{}) {
+		return nil
+	}
+	return c
+}
+
+// GetRetry retorna as novas tentativas padrão dos pools, lidas de RETRY_ATTEMPTS, RETRY_METHODS
+// (vírgula separada), RETRY_ON, RETRY_MAX_BODY_BYTES, RETRY_BUDGET_PCT, RETRY_MIN_RETRIES e
+// RETRY_BUDGET_WINDOW; nil (desabilitadas) se nenhuma estiver definida.
+func GetRetry() *RetrySpec {
+	r := &RetrySpec{
+		Attempts:     envInt("RETRY_ATTEMPTS"),
+		RetryOn:      strings.TrimSpace(os.Getenv("RETRY_ON")),
+		MaxBodyBytes: int64(envInt("RETRY_MAX_BODY_BYTES")),
+		BudgetPct:    envFloat("RETRY_BUDGET_PCT"),
+		MinRetries:   envInt("RETRY_MIN_RETRIES"),
+		BudgetWindow: envDuration("RETRY_BUDGET_WINDOW"),
+	}
+	for _, m := range strings.Split(os.Getenv("RETRY_METHODS"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			r.Methods = append(r.Methods, strings.ToUpper(m))
+		}
+	}
+	if reflect.DeepEqual(r, &RetrySpec{}) {
+		return nil
+	}
+	return r
+}
+
+// GetTimeouts retorna os timeouts padrão das requisições aos backends, lidos de
+// UPSTREAM_CONNECT_TIMEOUT, UPSTREAM_TLS_HANDSHAKE_TIMEOUT, UPSTREAM_RESPONSE_HEADER_TIMEOUT,
+// UPSTREAM_REQUEST_TIMEOUT e UPSTREAM_IDLE_TIMEOUT; nil (padrões do transporte) se nenhuma estiver
+// definida.
+func GetTimeouts() *TimeoutSpec {
+	t := &TimeoutSpec{
+		Connect:        envDuration("UPSTREAM_CONNECT_TIMEOUT"),
+		TLSHandshake:   envDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT"),
+		ResponseHeader: envDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT"),
+		Request:        envDuration("UPSTREAM_REQUEST_TIMEOUT"),
+		Idle:           envDuration("UPSTREAM_IDLE_TIMEOUT"),
+	}
+	if reflect.DeepEqual(t, &TimeoutSpec{}) {
+		return nil
+	}
+	return t
+}
+
+// GetUpstreamTLS retorna o TLS padrão das conexões aos backends https, lido de UPSTREAM_TLS_CA,
+// UPSTREAM_TLS_INSECURE_SKIP_VERIFY, UPSTREAM_TLS_SERVER_NAME, UPSTREAM_TLS_CERT e UPSTREAM_TLS_KEY;
+// nil (padrões do Go) se nenhuma estiver definida.
+func GetUpstreamTLS() *UpstreamTLSSpec {
+	u := &UpstreamTLSSpec{
+		CA:                 strings.TrimSpace(os.Getenv("UPSTREAM_TLS_CA")),
+		InsecureSkipVerify: strings.EqualFold(strings.TrimSpace(os.Getenv("UPSTREAM_TLS_INSECURE_SKIP_VERIFY")), "true"),
+		ServerName:         strings.TrimSpace(os.Getenv("UPSTREAM_TLS_SERVER_NAME")),
+		Cert:               strings.TrimSpace(os.Getenv("UPSTREAM_TLS_CERT")),
+		Key:                strings.TrimSpace(os.Getenv("UPSTREAM_TLS_KEY")),
+	}
+	if *u == (UpstreamTLSSpec{}) {
+		return nil
+	}
+	return u
+}
+
+// GetUpstreamProtocol retorna o protocolo usado com os backends, lido de UPSTREAM_PROTOCOL (auto,
+// http1, h2 ou h2c); vazio = auto.
+func GetUpstreamProtocol() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("UPSTREAM_PROTOCOL")))
+}
+
+// GetH2C indica se o listener de APP_PORT aceita HTTP/2 sem TLS (APP_H2C=true).
+func GetH2C() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("APP_H2C")), "true")
+}
+
+// GetTLSHTTP2 indica se o listener de TLS_PORT oferece HTTP/2; TLS_HTTP2=false o desabilita.
+func GetTLSHTTP2() bool {
+	return !strings.EqualFold(strings.TrimSpace(os.Getenv("TLS_HTTP2")), "false")
+}
+
+// GetMetrics retorna o endpoint de métricas, lido de METRICS_ENABLED (padrão true), METRICS_PATH
+// (padrão /metrics) e METRICS_BUCKETS (durações separadas por vírgula, ex.: "10ms,50ms,250ms,1s");
+// sem METRICS_BUCKETS valem os buckets padrão do Prometheus (5ms a 10s).
+func GetMetrics() MetricsSpec {
+	enabled := !strings.EqualFold(strings.TrimSpace(os.Getenv("METRICS_ENABLED")), "false")
+	m := MetricsSpec{Enabled: &enabled, Path: strings.TrimSpace(os.Getenv("METRICS_PATH"))}
+	if m.Path == "" {
+		m.Path = "/metrics"
+	}
+	for _, part := range strings.Split(os.Getenv("METRICS_BUCKETS"), ",") {
+		if d, err := time.ParseDuration(strings.TrimSpace(part)); err == nil && d > 0 {
+			m.Buckets = append(m.Buckets, d)
+		}
+	}
+	return m
+}
+
+// GetServer retorna os limites dos listeners, lidos de SERVER_READ_TIMEOUT,
+// SERVER_READ_HEADER_TIMEOUT (padrão 10s), SERVER_WRITE_TIMEOUT, SERVER_IDLE_TIMEOUT (padrão 120s),
+// SERVER_MAX_HEADER_BYTES (padrão 1 MiB), SERVER_READY_PATH (padrão /ready) e SERVER_DRAIN_TIMEOUT
+// (padrão 30s).
+func GetServer() ServerSpec {
+	s := ServerSpec{
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT"),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT"),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT"),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT"),
+		MaxHeaderBytes:    envInt("SERVER_MAX_HEADER_BYTES"),
+		ReadyPath:         strings.TrimSpace(os.Getenv("SERVER_READY_PATH")),
+		DrainTimeout:      envDuration("SERVER_DRAIN_TIMEOUT"),
+	}
+	if s.ReadHeaderTimeout == 0 {
+		s.ReadHeaderTimeout = 10 * time.Second
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = 120 * time.Second
+	}
+	if s.MaxHeaderBytes == 0 {
+		s.MaxHeaderBytes = 1 << 20
+	}
+	if s.ReadyPath == "" {
+		s.ReadyPath = "/ready"
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = 30 * time.Second
+	}
+	return s
+}
+
+// GetTLSPort retorna a porta do listener HTTPS (TLS_PORT); vazio = sem HTTPS.
+func GetTLSPort() string {
+	return strings.TrimSpace(os.Getenv("TLS_PORT"))
+}
+
+// GetTLS retorna a terminação TLS do listener de TLS_PORT: certificados de TLS_CERT_FILES e
+// TLS_KEY_FILES (listas na mesma ordem, separadas por vírgula), TLS_MIN_VERSION, TLS_CIPHER_SUITES
+// (separadas por vírgula), TLS_RELOAD_INTERVAL e TLS_ACME_* (veja GetACME); nil se TLS_PORT não
+// estiver definida.
+func GetTLS() *TLSSpec {
+	if GetTLSPort() == "" {
+		return nil
+	}
+	t := &TLSSpec{
+		MinVersion:     strings.TrimSpace(os.Getenv("TLS_MIN_VERSION")),
+		CipherSuites:   splitList(os.Getenv("TLS_CIPHER_SUITES")),
+		ReloadInterval: envDuration("TLS_RELOAD_INTERVAL"),
+	}
+	certs, keys := splitList(os.Getenv("TLS_CERT_FILES")), splitList(os.Getenv("TLS_KEY_FILES"))
+	for i, c := range certs {
+		spec := CertificateSpec{Cert: c}
+		if i < len(keys) {
+			spec.Key = keys[i]
+		}
+		t.Certificates = append(t.Certificates, spec)
+	}
+	t.ACME = GetACME()
+	t.ClientAuth = GetClientAuth()
+	return t
+}
+
+// GetClientAuth retorna a autenticação por certificado de cliente do listener de TLS_PORT, lida
+// de TLS_CLIENT_CA (arquivo PEM), TLS_CLIENT_AUTH (require ou request) e TLS_CLIENT_CERT_HEADERS
+// (pares campo=cabeçalho separados por vírgula, ex.: "subject=X-Client-Cert-Subject,dns=X-Client-Cert-DNS");
+// nil sem TLS_CLIENT_CA e TLS_CLIENT_AUTH.
+func GetClientAuth() *ClientAuthSpec {
+	c := &ClientAuthSpec{
+		Mode: strings.ToLower(strings.TrimSpace(os.Getenv("TLS_CLIENT_AUTH"))),
+		CA:   strings.TrimSpace(os.Getenv("TLS_CLIENT_CA")),
+	}
+	if c.Mode == "" && c.CA == "" {
+		return nil
+	}
+	for _, pair := range splitList(os.Getenv("TLS_CLIENT_CERT_HEADERS")) {
+		field, header, _ := strings.Cut(pair, "=")
+		if c.Headers == nil {
+			c.Headers = map[string]string{}
+		}
+		c.Headers[strings.TrimSpace(field)] = strings.TrimSpace(header)
+	}
+	return c
+}
+
+// GetACME retorna a emissão automática de certificados do listener de TLS_PORT, lida de
+// TLS_ACME_DOMAINS (separados por vírgula), TLS_ACME_EMAIL, TLS_ACME_DIRECTORY_URL,
+// TLS_ACME_DIRECTORY_CA, TLS_ACME_CACHE_DIR e TLS_ACME_RENEW_BEFORE; nil sem TLS_ACME_DOMAINS.
+func GetACME() *ACMESpec {
+	domains := splitList(os.Getenv("TLS_ACME_DOMAINS"))
+	if len(domains) == 0 {
+		return nil
+	}
+	return &ACMESpec{
+		Domains:      domains,
+		Email:        strings.TrimSpace(os.Getenv("TLS_ACME_EMAIL")),
+		DirectoryURL: strings.TrimSpace(os.Getenv("TLS_ACME_DIRECTORY_URL")),
+		DirectoryCA:  strings.TrimSpace(os.Getenv("TLS_ACME_DIRECTORY_CA")),
+		CacheDir:     strings.TrimSpace(os.Getenv("TLS_ACME_CACHE_DIR")),
+		RenewBefore:  envDuration("TLS_ACME_RENEW_BEFORE"),
+	}
+}
+
+// GetTLSRedirect indica se o listener de APP_PORT apenas redireciona para o HTTPS de TLS_PORT
+// (TLS_REDIRECT_HTTP=true).
+func GetTLSRedirect() bool {
+	return strings.EqualFold(strings.TrimSpace(os.Getenv("TLS_REDIRECT_HTTP")), "true")
+}
+
+func envFloat(key string) float64 {
+	if f, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv(key)), 64); err == nil && f > 0 {
+		return f
+	}
+	return 0
+}
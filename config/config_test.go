@@ -4,6 +4,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGetLBAlgorithm(t *testing.T) {
@@ -22,6 +23,14 @@ func TestGetIPHashHeader(t *testing.T) {
 	}
 }
 
+func TestGetHashKey(t *testing.T) {
+	os.Setenv("HASH_KEY", " cookie:session ")
+	defer os.Unsetenv("HASH_KEY")
+	if GetHashKey() != "cookie:session" {
+		t.Fatalf("expected cookie:session, got %q", GetHashKey())
+	}
+}
+
 func TestGetPerBackendRateLimits(t *testing.T) {
 	os.Setenv("RATE_LIMIT_RPS", "5")
 	os.Setenv("RATE_LIMIT_BURST", "2")
@@ -44,3 +53,35 @@ func TestGetPerBackendRateLimits(t *testing.T) {
 		t.Fatalf("expected %v got %v", expected2, out2)
 	}
 }
+
+func TestGetPerBackendWeights(t *testing.T) {
+	os.Unsetenv("BACKEND_WEIGHTS")
+	if out := GetPerBackendWeights(2); !reflect.DeepEqual(out, []int{1, 1}) {
+		t.Fatalf("expected default weights [1 1], got %v", out)
+	}
+
+	os.Setenv("BACKEND_WEIGHTS", "5, 0,abc,-2")
+	defer os.Unsetenv("BACKEND_WEIGHTS")
+	out := GetPerBackendWeights(5)
+	expected := []int{5, 0, 1, 1, 1}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("expected %v got %v", expected, out)
+	}
+}
+
+func TestStickySettings(t *testing.T) {
+	if GetStickyCookie() != "" || GetStickyTTL() != 0 || !GetStickyHTTPOnly() {
+		t.Fatalf("unexpected sticky defaults")
+	}
+	os.Setenv("STICKY_COOKIE", "lb")
+	os.Setenv("STICKY_TTL", "30m")
+	os.Setenv("STICKY_HTTPONLY", "false")
+	os.Setenv("STICKY_SAMESITE", "Strict")
+	defer os.Unsetenv("STICKY_COOKIE")
+	defer os.Unsetenv("STICKY_TTL")
+	defer os.Unsetenv("STICKY_HTTPONLY")
+	defer os.Unsetenv("STICKY_SAMESITE")
+	if GetStickyCookie() != "lb" || GetStickyTTL() != 30*time.Minute || GetStickyHTTPOnly() || GetStickySameSite() != "strict" {
+		t.Fatalf("sticky settings not read from env")
+	}
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseJSON reads a JSON document into the same node tree produced by the
+// YAML parser, keeping the line of every value.
+func parseJSON(src []byte) (*node, error) {
+	// newline offsets let us turn decoder offsets into line numbers
+	var newlines []int
+	for i, c := range src {
+		if c == '\n' {
+			newlines = append(newlines, i)
+		}
+	}
+	lineAt := func(off int64) int {
+		return sort.SearchInts(newlines, int(off)) + 1
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	var read func() (*node, error)
+	read = func() (*node, error) {
+		start := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, jsonError(err, lineAt(dec.InputOffset()))
+		}
+		// the token starts after any whitespace following start
+		line := lineAt(start + int64(len(src[start:])-len(bytes.TrimLeft(src[start:], " \t\r\n,:"))))
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				m := &node{kind: mapNode, line: line}
+				for dec.More() {
+					keyNode, err := read()
+					if err != nil {
+						return nil, err
+					}
+					if m.get(keyNode.value) != nil {
+						return nil, errorf(keyNode.line, "chave %q duplicada", keyNode.value)
+					}
+					val, err := read()
+					if err != nil {
+						return nil, err
+					}
+					m.keys = append(m.keys, keyNode.value)
+					m.vals = append(m.vals, val)
+				}
+				if _, err := dec.Token(); err != nil {
+					return nil, jsonError(err, lineAt(dec.InputOffset()))
+				}
+				return m, nil
+			case '[':
+				seq := &node{kind: seqNode, line: line}
+				for dec.More() {
+					item, err := read()
+					if err != nil {
+						return nil, err
+					}
+					seq.items = append(seq.items, item)
+				}
+				if _, err := dec.Token(); err != nil {
+					return nil, jsonError(err, lineAt(dec.InputOffset()))
+				}
+				return seq, nil
+			}
+			return nil, errorf(line, "delimitador inesperado %q", t)
+		case string:
+			return &node{kind: scalarNode, line: line, value: t, quoted: true}, nil
+		case json.Number:
+			return &node{kind: scalarNode, line: line, value: t.String()}, nil
+		case bool:
+			return &node{kind: scalarNode, line: line, value: strconv.FormatBool(t)}, nil
+		default:
+			return &node{kind: scalarNode, line: line, null: true}, nil
+		}
+	}
+	root, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errorf(lineAt(dec.InputOffset()), "conteúdo após o fim do documento JSON")
+	}
+	return root, nil
+}
+
+func jsonError(err error, line int) error {
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		return errorf(line, "JSON inválido: %v", se)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errorf(line, "fim inesperado do JSON")
+	}
+	return errorf(line, "%v", err)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeNode stores n into v using the `json` tag names of struct fields.
+// Unknown keys and type mismatches are errors carrying the node's line.
+func decodeNode(n *node, v reflect.Value, path string) error {
+	if n.null {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeNode(n, v.Elem(), path)
+	}
+	if v.Type() == durationType {
+		if n.kind != scalarNode {
+			return errorf(n.line, "%s: esperado duração (ex: \"5s\")", path)
+		}
+		d, err := time.ParseDuration(n.value)
+		if err != nil {
+			return errorf(n.line, "%s: duração inválida %q", path, n.value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if n.kind != mapNode {
+			return errorf(n.line, "%s: esperado um mapa", path)
+		}
+		fields := structFields(v.Type())
+		for i, key := range n.keys {
+			idx, ok := fields[key]
+			if !ok {
+				return errorf(n.vals[i].line, "%s: campo desconhecido %q", path, key)
+			}
+			if err := decodeNode(n.vals[i], v.Field(idx), joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if n.kind != mapNode {
+			return errorf(n.line, "%s: esperado um mapa", path)
+		}
+		m := reflect.MakeMap(v.Type())
+		for i, key := range n.keys {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeNode(n.vals[i], elem, joinPath(path, key)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+	case reflect.Slice:
+		if n.kind != seqNode {
+			return errorf(n.line, "%s: esperado uma lista", path)
+		}
+		s := reflect.MakeSlice(v.Type(), len(n.items), len(n.items))
+		for i, item := range n.items {
+			if err := decodeNode(item, s.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.String:
+		if n.kind != scalarNode {
+			return errorf(n.line, "%s: esperado um texto", path)
+		}
+		v.SetString(n.value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.ToLower(n.value))
+		if n.kind != scalarNode || err != nil {
+			return errorf(n.line, "%s: esperado true ou false, encontrado %q", path, n.value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(n.value, 10, v.Type().Bits())
+		if n.kind != scalarNode || err != nil {
+			return errorf(n.line, "%s: esperado um número inteiro, encontrado %q", path, n.value)
+		}
+		v.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(n.value, v.Type().Bits())
+		if n.kind != scalarNode || err != nil {
+			return errorf(n.line, "%s: esperado um número, encontrado %q", path, n.value)
+		}
+		v.SetFloat(f)
+	default:
+		return errorf(n.line, "%s: tipo %s não suportado", path, v.Type())
+	}
+	return nil
+}
+
+// structFields maps the `json` names of t's exported fields to their index.
+func structFields(t reflect.Type) map[string]int {
+	out := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		out[name] = i
+	}
+	return out
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// nodeAt returns the node of root at path, written like the paths of the
+// decode errors ("pools[0].sticky.same_site"), or nil when the file does not
+// set that field.
+func nodeAt(root *node, path string) *node {
+	n := root
+	for _, part := range strings.Split(path, ".") {
+		key, index, _ := strings.Cut(part, "[")
+		if n = n.get(key); n == nil {
+			return nil
+		}
+		for index != "" {
+			i, rest, ok := strings.Cut(index, "]")
+			pos, err := strconv.Atoi(i)
+			if !ok || err != nil || pos < 0 || pos >= len(n.items) {
+				return nil
+			}
+			n, index = n.items[pos], strings.TrimPrefix(rest, "[")
+		}
+	}
+	return n
+}
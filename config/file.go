@@ -0,0 +1,1041 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// File é a configuração declarativa do Vortice, lida de um arquivo YAML ou JSON (veja Load)
+// ou montada a partir das variáveis de ambiente (veja FromEnv).
+type File struct {
+	Listeners []ListenerSpec `json:"listeners"`
+	// RouteOrder é "first_match" ou "most_specific"
+	RouteOrder string `json:"route_order"`
+	// DefaultPool é o nome do pool que recebe as requisições sem rota; vazio = pool sem nome
+	DefaultPool string      `json:"default_pool"`
+	Stats       StatsSpec   `json:"stats"`
+	Metrics     MetricsSpec `json:"metrics"`
+	Admin       AdminSpec   `json:"admin"`
+	Server      ServerSpec  `json:"server"`
+	Pools       []PoolSpec  `json:"pools"`
+	Routes      []RouteSpec `json:"routes"`
+}
+
+// ListenerSpec descreve um endereço onde o proxy escuta.
+type ListenerSpec struct {
+	Address string `json:"address"`
+	// TLS, se definido, faz o listener atender HTTPS
+	TLS *TLSSpec `json:"tls"`
+	// RedirectHTTPS faz um listener sem TLS apenas redirecionar para o primeiro listener com TLS
+	RedirectHTTPS bool `json:"redirect_https"`
+	// HTTP2 ausente ou true oferece HTTP/2 (ALPN) nos listeners com TLS; false mantém só HTTP/1.1
+	HTTP2 *bool `json:"http2"`
+	// H2C aceita HTTP/2 sem TLS (com conhecimento prévio) em um listener sem TLS
+	H2C bool `json:"h2c"`
+}
+
+// TLSSpec configura a terminação TLS de um listener. O certificado de cada conexão é escolhido
+// pelo SNI entre os nomes (SANs) dos certificados, inclusive curingas como *.exemplo.com; sem SNI
+// ou sem nome correspondente vale o primeiro. Arquivos alterados são recarregados sem reiniciar.
+type TLSSpec struct {
+	Certificates []CertificateSpec `json:"certificates"`
+	// MinVersion é "1.0", "1.1", "1.2" (padrão) ou "1.3"
+	MinVersion string `json:"min_version"`
+	// CipherSuites restringe as suítes de TLS 1.0-1.2 pelos nomes do crypto/tls (ex:
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); vazio = padrão do Go. TLS 1.3 não é afetado
+	CipherSuites []string `json:"cipher_suites"`
+	// ReloadInterval é o intervalo de verificação dos arquivos dos certificados (padrão 1m)
+	ReloadInterval time.Duration `json:"reload_interval"`
+	// ACME obtém e renova certificados automaticamente, somados aos de Certificates
+	ACME *ACMESpec `json:"acme"`
+	// ClientAuth pede (ou exige) certificados de cliente nas conexões do listener
+	ClientAuth *ClientAuthSpec `json:"client_auth"`
+}
+
+// ClientAuthSpec configura a autenticação de clientes por certificado. Os certificados enviados
+// são verificados com as CAs de CA; as rotas com client_cert aceitam apenas clientes com um
+// certificado verificado que atenda às suas regras.
+type ClientAuthSpec struct {
+	// Mode é "require" (padrão: conexões sem certificado válido são recusadas no handshake) ou
+	// "request" (o certificado é opcional, mas verificado quando enviado)
+	Mode string `json:"mode"`
+	// CA é um arquivo PEM com as CAs que assinam os certificados dos clientes
+	CA string `json:"ca"`
+	// Headers envia campos do certificado verificado aos backends, no formato campo: cabeçalho.
+	// Campos: subject, issuer, serial, fingerprint (SHA-256), dns, email, uri (SANs separados
+	// por vírgula), not_after e cert (PEM codificado para URL). Cabeçalhos com esses nomes vindos
+	// dos clientes são sempre descartados, em todos os listeners
+	Headers map[string]string `json:"headers"`
+}
+
+// ClientCertFields são os campos do certificado de cliente aceitos em client_auth.headers.
+var ClientCertFields = []string{"subject", "issuer", "serial", "fingerprint", "dns", "email", "uri", "not_after", "cert"}
+
+// ACMESpec obtém certificados de uma CA ACME (RFC 8555) com o desafio HTTP-01, respondido pelos
+// listeners sem TLS (que precisam receber a porta 80 dos domínios). Vazios usam o diretório de
+// produção do Let's Encrypt, o cache em "acme-cache" e renovação 30 dias antes de expirar.
+type ACMESpec struct {
+	// Domains recebem um certificado cada; curingas não são aceitos pelo HTTP-01
+	Domains []string `json:"domains"`
+	// Email é o contato da conta na CA
+	Email string `json:"email"`
+	// DirectoryURL é o diretório da CA (ex: https://localhost:14000/dir para o Pebble)
+	DirectoryURL string `json:"directory_url"`
+	// DirectoryCA é um arquivo PEM com a CA que assina o HTTPS do diretório, para CAs de teste
+	DirectoryCA string `json:"directory_ca"`
+	// CacheDir guarda a chave da conta e os certificados obtidos
+	CacheDir    string        `json:"cache_dir"`
+	RenewBefore time.Duration `json:"renew_before"`
+}
+
+// CertificateSpec é um par de arquivos PEM: certificado (com a cadeia) e chave privada.
+type CertificateSpec struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// StatsSpec configura o endpoint de estatísticas.
+type StatsSpec struct {
+	Enabled *bool  `json:"enabled"`
+	Path    string `json:"path"`
+}
+
+// ServerSpec limita as conexões aceitas pelos listeners (e pela API administrativa). Campos
+// vazios usam SERVER_* ou os padrões: 10s para ler os cabeçalhos, 120s de conexão ociosa e
+// 1 MiB de cabeçalhos; leitura e escrita completas não têm limite por padrão.
+type ServerSpec struct {
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int           `json:"max_header_bytes"`
+	// ReadyPath é o endpoint de prontidão (padrão /ready): 200 enquanto a instância recebe
+	// tráfego, 503 durante o desligamento
+	ReadyPath string `json:"ready_path"`
+	// DrainTimeout é quanto o desligamento espera as requisições em andamento (padrão 30s)
+	DrainTimeout time.Duration `json:"drain_timeout"`
+}
+
+// MetricsSpec configura o endpoint de métricas no formato do Prometheus.
+type MetricsSpec struct {
+	Enabled *bool  `json:"enabled"`
+	Path    string `json:"path"`
+	// Buckets são os limites dos buckets do histograma de latência, em ordem crescente
+	Buckets []time.Duration `json:"buckets"`
+}
+
+// AdminSpec configura a API administrativa, servida em um listener separado.
+type AdminSpec struct {
+	// Address vazio desativa a API
+	Address string `json:"address"`
+	// Token, se definido, é exigido no cabeçalho "Authorization: Bearer <token>"
+	Token string `json:"token"`
+}
+
+// PoolSpec descreve um pool de backends.
+type PoolSpec struct {
+	Name         string           `json:"name"`
+	Algorithm    string           `json:"algorithm"`
+	HashKey      string           `json:"hash_key"`
+	IPHashHeader string           `json:"ip_hash_header"`
+	Sticky       *StickySpec      `json:"sticky"`
+	HealthCheck  *HealthCheckSpec `json:"health_check"`
+	// OutlierDetection habilita o health check passivo do pool
+	OutlierDetection *OutlierSpec `json:"outlier_detection"`
+	// CircuitBreaker habilita o circuit breaker dos backends do pool
+	CircuitBreaker *CircuitBreakerSpec `json:"circuit_breaker"`
+	// Retry habilita novas tentativas em outro backend
+	Retry *RetrySpec `json:"retry"`
+	// Timeouts limita as requisições enviadas aos backends do pool
+	Timeouts *TimeoutSpec `json:"timeouts"`
+	// UpstreamTLS configura o TLS das conexões aos backends https do pool
+	UpstreamTLS *UpstreamTLSSpec `json:"upstream_tls"`
+	// Protocol é o protocolo usado com os backends: "auto" (padrão: HTTP/2 com backends https que
+	// o oferecem, senão HTTP/1.1), "http1", "h2" (HTTP/2 com TLS, só https) ou "h2c" (HTTP/2 sem
+	// TLS, só http)
+	Protocol string        `json:"protocol"`
+	Backends []BackendSpec `json:"backends"`
+}
+
+// BackendSpec descreve um backend com atributos nomeados.
+type BackendSpec struct {
+	URL string `json:"url"`
+	// Weight ausente = 1; 0 drena o backend
+	Weight *int `json:"weight"`
+	// RateLimit ausente usa RATE_LIMIT_RPS/RATE_LIMIT_BURST
+	RateLimit *RateLimitSpec `json:"rate_limit"`
+	// HealthCheck sobrescreve campos do health check do pool para este backend
+	HealthCheck *HealthCheckSpec `json:"health_check"`
+	// Timeouts sobrescreve campos dos timeouts do pool para este backend
+	Timeouts *TimeoutSpec `json:"timeouts"`
+	// UpstreamTLS sobrescreve campos do TLS do pool para este backend
+	UpstreamTLS *UpstreamTLSSpec `json:"upstream_tls"`
+	// Protocol sobrescreve o protocolo do pool para este backend
+	Protocol string `json:"protocol"`
+}
+
+// UpstreamTLSSpec configura o TLS das conexões aos backends https, nos proxies e nos health
+// checks. Os arquivos são lidos a cada (re)carga da configuração.
+type UpstreamTLSSpec struct {
+	// CA é um arquivo PEM com as CAs que assinam os certificados dos backends; vazio = CAs do
+	// sistema
+	CA string `json:"ca"`
+	// InsecureSkipVerify aceita qualquer certificado (apenas para desenvolvimento)
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// ServerName troca o nome enviado no SNI e verificado no certificado; vazio = host da URL
+	ServerName string `json:"server_name"`
+	// Cert e Key são os arquivos PEM do certificado de cliente e da chave apresentados no mTLS
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// TimeoutSpec configura os timeouts das requisições aos backends. Vazios usam 30s para conectar,
+// 10s de handshake TLS e 90s de conexão ociosa; cabeçalhos da resposta e requisição completa não
+// têm limite por padrão. Um timeout responde 504.
+type TimeoutSpec struct {
+	Connect        time.Duration `json:"connect"`
+	TLSHandshake   time.Duration `json:"tls_handshake"`
+	ResponseHeader time.Duration `json:"response_header"`
+	Request        time.Duration `json:"request"`
+	Idle           time.Duration `json:"idle"`
+}
+
+// RateLimitSpec é um limite em requisições por segundo (0 = sem limite) com burst.
+type RateLimitSpec struct {
+	RPS   int `json:"rps"`
+	Burst int `json:"burst"`
+}
+
+// HealthCheckSpec configura o health check ativo. Campos vazios usam os padrões: GET na raiz
+// do backend esperando 2xx/3xx, timeout de 2s, intervalo de 20s e rise/fall 1.
+type HealthCheckSpec struct {
+	Path    string            `json:"path"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// ExpectedStatus é uma lista de códigos, faixas e classes (ex: "200-299,304" ou "2xx")
+	ExpectedStatus string `json:"expected_status"`
+	// BodyContains e BodyRegex, se definidos, precisam casar com o corpo da resposta
+	BodyContains string        `json:"body_contains"`
+	BodyRegex    string        `json:"body_regex"`
+	Interval     time.Duration `json:"interval"`
+	// Jitter soma um atraso aleatório em [0, jitter) a cada intervalo
+	Jitter  time.Duration `json:"jitter"`
+	Timeout time.Duration `json:"timeout"`
+	// Rise é o número de sucessos seguidos para um backend voltar e Fall o de falhas seguidas
+	// para ele sair
+	Rise int `json:"rise"`
+	Fall int `json:"fall"`
+}
+
+// OutlierSpec configura a ejeção de backends por erros no tráfego real. Limites zerados
+// desativam o detector correspondente; tempos vazios usam 30s (janela e ejeção base), 5m
+// (ejeção máxima), 10 requisições mínimas e 50% do pool.
+type OutlierSpec struct {
+	Consecutive5xx           int           `json:"consecutive_5xx"`
+	ConsecutiveGatewayErrors int           `json:"consecutive_gateway_errors"`
+	FailureRatePct           float64       `json:"failure_rate_pct"`
+	MinRequests              int           `json:"min_requests"`
+	Window                   time.Duration `json:"window"`
+	BaseEjectionTime         time.Duration `json:"base_ejection_time"`
+	MaxEjectionTime          time.Duration `json:"max_ejection_time"`
+	MaxEjectionPercent       int           `json:"max_ejection_percent"`
+}
+
+// CircuitBreakerSpec configura o circuit breaker por backend. Taxas zeradas desativam o gatilho
+// correspondente; vazios usam janela de 30s, 10 requisições mínimas, chamadas lentas a partir de
+// 5s, 30s aberto e 1 requisição de teste em half-open.
+type CircuitBreakerSpec struct {
+	FailureRatePct   float64       `json:"failure_rate_pct"`
+	SlowCallRatePct  float64       `json:"slow_call_rate_pct"`
+	SlowCallDuration time.Duration `json:"slow_call_duration"`
+	MinRequests      int           `json:"min_requests"`
+	Window           time.Duration `json:"window"`
+	OpenDuration     time.Duration `json:"open_duration"`
+	HalfOpenRequests int           `json:"half_open_requests"`
+}
+
+// RetrySpec configura novas tentativas em outro backend após erro de conexão ou um dos status de
+// RetryOn (ex: "502,503,504"). Vazios usam 2 tentativas, métodos idempotentes, corpo de até
+// 64 KiB e orçamento de 20% das requisições em 10s, com no mínimo 3 novas tentativas por janela.
+type RetrySpec struct {
+	Attempts     int           `json:"attempts"`
+	Methods      []string      `json:"methods"`
+	RetryOn      string        `json:"retry_on"`
+	MaxBodyBytes int64         `json:"max_body_bytes"`
+	BudgetPct    float64       `json:"budget_pct"`
+	MinRetries   int           `json:"min_retries"`
+	BudgetWindow time.Duration `json:"budget_window"`
+}
+
+// StickySpec configura sessões sticky por cookie.
+type StickySpec struct {
+	Cookie   string        `json:"cookie"`
+	TTL      time.Duration `json:"ttl"`
+	Path     string        `json:"path"`
+	Secure   bool          `json:"secure"`
+	HTTPOnly *bool         `json:"http_only"`
+	SameSite string        `json:"same_site"`
+	Secret   string        `json:"secret"`
+}
+
+// RouteSpec descreve uma regra de roteamento.
+type RouteSpec struct {
+	Name       string            `json:"name"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	PathPrefix string            `json:"path_prefix"`
+	PathRegex  string            `json:"path_regex"`
+	Methods    []string          `json:"methods"`
+	Headers    map[string]string `json:"headers"`
+	Pool       string            `json:"pool"`
+	// Hedge habilita requisições hedged nesta rota
+	Hedge *HedgeSpec `json:"hedge"`
+	// ClientCert restringe a rota a clientes com certificado verificado (veja client_auth)
+	ClientCert *ClientCertSpec `json:"client_cert"`
+}
+
+// ClientCertSpec são as regras de certificado de cliente de uma rota. Sem regras basta um
+// certificado verificado; com várias, todas devem ser atendidas (e, em cada lista, um item).
+// Requisições que não atendem recebem 403.
+type ClientCertSpec struct {
+	// CommonNames aceita os certificados cujo CN do subject esteja na lista
+	CommonNames []string `json:"common_names"`
+	// SANs aceita os certificados com algum SAN (DNS, email ou URI) na lista; "*.exemplo.com"
+	// aceita os subdomínios
+	SANs []string `json:"sans"`
+	// SubjectRegex é comparada ao subject completo, ex: "CN=billing,OU=pagamentos,O=Acme"
+	SubjectRegex string `json:"subject_regex"`
+}
+
+// HedgeSpec configura requisições hedged: se o backend não responder em Delay (ou, sem Delay, no
+// percentil Percentile das latências recentes do pool, padrão 95), a requisição também é enviada
+// a outro backend e vale a primeira resposta. Vazios usam GET e HEAD e orçamento de 10% das
+// requisições da rota em 10s.
+type HedgeSpec struct {
+	Delay        time.Duration `json:"delay"`
+	Percentile   float64       `json:"percentile"`
+	Methods      []string      `json:"methods"`
+	BudgetPct    float64       `json:"budget_pct"`
+	BudgetWindow time.Duration `json:"budget_window"`
+}
+
+// Load lê um arquivo de configuração YAML (.yaml/.yml) ou JSON (.json). Referências ${VAR} e
+// ${VAR:-padrão} nos valores são substituídas pelas variáveis de ambiente depois da leitura
+// ($$ gera um $), então o conteúdo das variáveis nunca é interpretado como sintaxe.
+// Tudo o que o arquivo não define vem das variáveis de ambiente (FromEnv). Erros de sintaxe,
+// campos desconhecidos e valores inválidos são reportados como "arquivo:linha: mensagem".
+func Load(path string) (*File, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root *node
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		root, err = parseJSON(raw)
+	} else {
+		root, err = parseYAML(string(raw))
+	}
+	if err != nil {
+		return nil, fileError(path, err)
+	}
+	interpolateNode(root)
+	f := &File{}
+	if err := decodeNode(root, reflect.ValueOf(f).Elem(), ""); err != nil {
+		return nil, fileError(path, err)
+	}
+
+	env := envBase()
+	if len(f.Pools) == 0 {
+		// pools e rotas do ambiente só são usados quando o arquivo não declara pools
+		if env.Routes, err = GetRoutes(); err != nil {
+			return nil, err
+		}
+	}
+	f.applyDefaults(env)
+	if err := f.Validate(); err != nil {
+		return nil, validationError(path, root, err)
+	}
+	return f, nil
+}
+
+// fileError prefixa err com o arquivo e, quando conhecida, a linha.
+func fileError(path string, err error) error {
+	var se *syntaxError
+	if errors.As(err, &se) {
+		return fmt.Errorf("%s:%d: %s", path, se.line, se.msg)
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// validationError prefixa o erro de Validate com o arquivo e, quando o campo citado no início
+// da mensagem foi definido no arquivo, com a linha dele.
+func validationError(path string, root *node, err error) error {
+	field, _, _ := strings.Cut(err.Error(), ": ")
+	if n := nodeAt(root, field); n != nil {
+		return fmt.Errorf("%s:%d: %w", path, n.line, err)
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// interpolateNode aplica Interpolate a todos os valores de n. Um valor sem aspas que fica
+// vazio vira nulo, como se a chave não tivesse valor, para que o padrão do ambiente valha.
+func interpolateNode(n *node) {
+	switch n.kind {
+	case scalarNode:
+		if n.null || !strings.Contains(n.value, "$") {
+			return
+		}
+		n.value = Interpolate(n.value)
+		n.null = n.value == "" && !n.quoted
+	case mapNode:
+		for _, v := range n.vals {
+			interpolateNode(v)
+		}
+	case seqNode:
+		for _, item := range n.items {
+			interpolateNode(item)
+		}
+	}
+}
+
+// Interpolate substitui ${VAR} e ${VAR:-padrão} pelo valor das variáveis de ambiente;
+// variáveis não definidas sem padrão viram texto vazio e $$ vira $.
+func Interpolate(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if s[i+1] != '{' || end < 0 || strings.ContainsRune(s[i:i+end], '\n') {
+			b.WriteByte(s[i])
+			continue
+		}
+		expr := s[i+2 : i+end]
+		name, def, hasDef := strings.Cut(expr, ":-")
+		if v, ok := os.LookupEnv(name); ok && (v != "" || !hasDef) {
+			b.WriteString(v)
+		} else {
+			b.WriteString(def)
+		}
+		i += end
+	}
+	return b.String()
+}
+
+// FromEnv monta a configuração a partir das variáveis de ambiente: o pool sem nome vem de
+// BACKEND_URLS e os pools nomeados e rotas de POOLS e ROUTES.
+func FromEnv() (*File, error) {
+	f := envBase()
+	routes, err := GetRoutes()
+	if err != nil {
+		return nil, err
+	}
+	f.Routes = routes
+	return f, nil
+}
+
+// envBase monta a configuração do ambiente sem as rotas.
+func envBase() *File {
+	enabled := true
+	f := &File{
+		Listeners:  envListeners(),
+		RouteOrder: GetRouteOrder(),
+		Stats:      StatsSpec{Enabled: &enabled, Path: "/stats"},
+		Metrics:    GetMetrics(),
+		Admin:      AdminSpec{Address: GetAdminAddr(), Token: GetAdminToken()},
+		Server:     GetServer(),
+	}
+	backends := GetBackends()
+	f.Pools = append(f.Pools, PoolSpec{
+		Algorithm:        GetLBAlgorithm(),
+		HashKey:          GetHashKey(),
+		IPHashHeader:     GetIPHashHeader(),
+		Sticky:           envSticky(),
+		HealthCheck:      GetHealthCheck(),
+		OutlierDetection: GetOutlierDetection(),
+		CircuitBreaker:   GetCircuitBreaker(),
+		Retry:            GetRetry(),
+		Timeouts:         GetTimeouts(),
+		UpstreamTLS:      GetUpstreamTLS(),
+		Protocol:         GetUpstreamProtocol(),
+		Backends:         backendSpecs(backends, GetPerBackendRateLimits(len(backends)), GetPerBackendWeights(len(backends))),
+	})
+	f.Pools = append(f.Pools, GetPools()...)
+	return f
+}
+
+// envListeners devolve o listener de APP_PORT e, com TLS_PORT, o listener HTTPS.
+func envListeners() []ListenerSpec {
+	ls := []ListenerSpec{{Address: ":" + GetAppPort(), H2C: GetH2C()}}
+	if t := GetTLS(); t != nil {
+		ls[0].RedirectHTTPS = GetTLSRedirect()
+		http2 := GetTLSHTTP2()
+		ls = append(ls, ListenerSpec{Address: ":" + GetTLSPort(), TLS: t, HTTP2: &http2})
+	}
+	return ls
+}
+
+func backendSpecs(urls []string, limits [][2]int, weights []int) []BackendSpec {
+	out := make([]BackendSpec, 0, len(urls))
+	for i, u := range urls {
+		w := weights[i]
+		out = append(out, BackendSpec{URL: u, Weight: &w, RateLimit: &RateLimitSpec{RPS: limits[i][0], Burst: limits[i][1]}})
+	}
+	return out
+}
+
+func envSticky() *StickySpec {
+	name := GetStickyCookie()
+	if name == "" {
+		return nil
+	}
+	httpOnly := GetStickyHTTPOnly()
+	return &StickySpec{
+		Cookie:   name,
+		TTL:      GetStickyTTL(),
+		Secure:   GetStickySecure(),
+		HTTPOnly: &httpOnly,
+		SameSite: GetStickySameSite(),
+		Secret:   GetStickySecret(),
+	}
+}
+
+// applyDefaults preenche o que o arquivo não define com os valores do ambiente.
+func (f *File) applyDefaults(env *File) {
+	if len(f.Listeners) == 0 {
+		f.Listeners = env.Listeners
+	}
+	if f.RouteOrder == "" {
+		f.RouteOrder = env.RouteOrder
+	}
+	if f.Stats.Enabled == nil {
+		f.Stats.Enabled = env.Stats.Enabled
+	}
+	if f.Stats.Path == "" {
+		f.Stats.Path = env.Stats.Path
+	}
+	if f.Metrics.Enabled == nil {
+		f.Metrics.Enabled = env.Metrics.Enabled
+	}
+	if f.Metrics.Path == "" {
+		f.Metrics.Path = env.Metrics.Path
+	}
+	if len(f.Metrics.Buckets) == 0 {
+		f.Metrics.Buckets = env.Metrics.Buckets
+	}
+	if f.Admin.Address == "" {
+		f.Admin.Address = env.Admin.Address
+	}
+	if f.Admin.Token == "" {
+		f.Admin.Token = env.Admin.Token
+	}
+	f.Server.applyDefaults(env.Server)
+	if len(f.Pools) == 0 {
+		f.Pools = env.Pools
+		if len(f.Routes) == 0 {
+			f.Routes = env.Routes
+		}
+	}
+	sticky := envSticky()
+	health := GetHealthCheck()
+	outlier := GetOutlierDetection()
+	breaker := GetCircuitBreaker()
+	retry := GetRetry()
+	timeouts := GetTimeouts()
+	upstreamTLS := GetUpstreamTLS()
+	for i := range f.Pools {
+		p := &f.Pools[i]
+		if p.HealthCheck == nil {
+			p.HealthCheck = health
+		}
+		if p.OutlierDetection == nil {
+			p.OutlierDetection = outlier
+		}
+		if p.CircuitBreaker == nil {
+			p.CircuitBreaker = breaker
+		}
+		if p.Retry == nil {
+			p.Retry = retry
+		}
+		if p.Timeouts == nil {
+			p.Timeouts = timeouts
+		}
+		if p.UpstreamTLS == nil {
+			p.UpstreamTLS = upstreamTLS
+		}
+		if p.Protocol == "" {
+			p.Protocol = GetUpstreamProtocol()
+		}
+		if p.Algorithm == "" {
+			p.Algorithm = GetLBAlgorithm()
+		}
+		p.Algorithm = strings.ToLower(p.Algorithm)
+		if p.HashKey == "" {
+			p.HashKey = GetHashKey()
+		}
+		if p.IPHashHeader == "" {
+			p.IPHashHeader = GetIPHashHeader()
+		}
+		if p.Sticky == nil {
+			p.Sticky = sticky
+		}
+		for j := range p.Backends {
+			b := &p.Backends[j]
+			if b.Weight == nil {
+				w := 1
+				b.Weight = &w
+			}
+			if b.RateLimit == nil {
+				b.RateLimit = &RateLimitSpec{RPS: GetRateLimitRPS(), Burst: GetRateLimitBurst()}
+			}
+		}
+	}
+}
+
+// Validate verifica a consistência da configuração: pools únicos, URLs válidas e rotas
+// apontando para pools declarados.
+func (f *File) Validate() error {
+	if f.RouteOrder != "first_match" && f.RouteOrder != "most_specific" {
+		return fmt.Errorf("route_order: valor desconhecido %q", f.RouteOrder)
+	}
+	secure, plain, clientAuth := false, false, false
+	for i, l := range f.Listeners {
+		if l.Address == "" {
+			return fmt.Errorf("listeners[%d].address: obrigatório", i)
+		}
+		if l.Address == f.Admin.Address {
+			return fmt.Errorf("admin.address: %q já é usado por listeners[%d]", l.Address, i)
+		}
+		if err := l.TLS.validate(); err != nil {
+			return fmt.Errorf("listeners[%d].tls.%v", i, err)
+		}
+		if l.TLS != nil && l.RedirectHTTPS {
+			return fmt.Errorf("listeners[%d].redirect_https: só vale para listeners sem tls", i)
+		}
+		if l.TLS != nil && l.H2C {
+			return fmt.Errorf("listeners[%d].h2c: só vale para listeners sem tls (com tls, use http2)", i)
+		}
+		if l.TLS == nil && l.HTTP2 != nil {
+			return fmt.Errorf("listeners[%d].http2: só vale para listeners com tls (sem tls, use h2c)", i)
+		}
+		if l.TLS != nil && (l.HTTP2 == nil || *l.HTTP2) && l.TLS.MinVersion != "1.3" && !http2Ciphers(l.TLS.CipherSuites) {
+			return fmt.Errorf("listeners[%d].tls.cipher_suites: o HTTP/2 exige TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ou TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (ou use http2: false)", i)
+		}
+		secure = secure || l.TLS != nil
+		plain = plain || l.TLS == nil
+		clientAuth = clientAuth || (l.TLS != nil && l.TLS.ClientAuth != nil)
+	}
+	for i, l := range f.Listeners {
+		if l.RedirectHTTPS && !secure {
+			return fmt.Errorf("listeners[%d].redirect_https: nenhum listener com tls", i)
+		}
+		if l.TLS != nil && l.TLS.ACME != nil && !plain {
+			return fmt.Errorf("listeners[%d].tls.acme: o desafio HTTP-01 precisa de um listener sem tls", i)
+		}
+	}
+	if err := f.Server.validate(); err != nil {
+		return fmt.Errorf("server.%v", err)
+	}
+	if *f.Stats.Enabled && f.Stats.Path == f.Server.ReadyPath {
+		return fmt.Errorf("server.ready_path: %q já é usado por stats.path", f.Server.ReadyPath)
+	}
+	if err := f.Metrics.validate(); err != nil {
+		return fmt.Errorf("metrics.%v", err)
+	}
+	if *f.Metrics.Enabled && (f.Metrics.Path == f.Server.ReadyPath || (*f.Stats.Enabled && f.Metrics.Path == f.Stats.Path)) {
+		return fmt.Errorf("metrics.path: %q já é usado por stats.path ou server.ready_path", f.Metrics.Path)
+	}
+	names := map[string]bool{}
+	for i, p := range f.Pools {
+		if names[p.Name] {
+			if p.Name == "" {
+				return fmt.Errorf("pools[%d]: apenas um pool pode ficar sem nome", i)
+			}
+			return fmt.Errorf("pools[%d]: pool %q declarado mais de uma vez", i, p.Name)
+		}
+		names[p.Name] = true
+		for j, b := range p.Backends {
+			u, err := url.Parse(b.URL)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("pools[%d].backends[%d].url: URL inválida %q", i, j, b.URL)
+			}
+			if *b.Weight < 0 {
+				return fmt.Errorf("pools[%d].backends[%d].weight: não pode ser negativo", i, j)
+			}
+			if err := b.HealthCheck.validate(); err != nil {
+				return fmt.Errorf("pools[%d].backends[%d].health_check.%v", i, j, err)
+			}
+			if err := b.Timeouts.validate(); err != nil {
+				return fmt.Errorf("pools[%d].backends[%d].timeouts.%v", i, j, err)
+			}
+			if err := b.UpstreamTLS.validate(); err != nil {
+				return fmt.Errorf("pools[%d].backends[%d].upstream_tls.%v", i, j, err)
+			}
+			proto := p.Protocol
+			if b.Protocol != "" {
+				proto = b.Protocol
+			}
+			if err := validateProtocol(proto, u.Scheme); err != nil {
+				return fmt.Errorf("pools[%d].backends[%d].protocol: %v", i, j, err)
+			}
+		}
+		if err := p.HealthCheck.validate(); err != nil {
+			return fmt.Errorf("pools[%d].health_check.%v", i, err)
+		}
+		if err := p.OutlierDetection.validate(); err != nil {
+			return fmt.Errorf("pools[%d].outlier_detection.%v", i, err)
+		}
+		if err := p.CircuitBreaker.validate(); err != nil {
+			return fmt.Errorf("pools[%d].circuit_breaker.%v", i, err)
+		}
+		if err := p.Sticky.validate(); err != nil {
+			return fmt.Errorf("pools[%d].sticky.%v", i, err)
+		}
+		if err := p.Retry.validate(); err != nil {
+			return fmt.Errorf("pools[%d].retry.%v", i, err)
+		}
+		if err := p.Timeouts.validate(); err != nil {
+			return fmt.Errorf("pools[%d].timeouts.%v", i, err)
+		}
+		if err := p.UpstreamTLS.validate(); err != nil {
+			return fmt.Errorf("pools[%d].upstream_tls.%v", i, err)
+		}
+		if err := validateProtocol(p.Protocol, ""); err != nil {
+			return fmt.Errorf("pools[%d].protocol: %v", i, err)
+		}
+	}
+	if f.DefaultPool != "" && !names[f.DefaultPool] {
+		return fmt.Errorf("default_pool: pool %q não declarado", f.DefaultPool)
+	}
+	for i, r := range f.Routes {
+		if r.Pool == "" {
+			return fmt.Errorf("routes[%d].pool: obrigatório", i)
+		}
+		if !names[r.Pool] {
+			return fmt.Errorf("routes[%d].pool: pool %q não declarado", i, r.Pool)
+		}
+		if err := r.Hedge.validate(); err != nil {
+			return fmt.Errorf("routes[%d].hedge.%v", i, err)
+		}
+		if err := r.ClientCert.validate(); err != nil {
+			return fmt.Errorf("routes[%d].client_cert.%v", i, err)
+		}
+		if r.ClientCert != nil && !clientAuth {
+			return fmt.Errorf("routes[%d].client_cert: nenhum listener com tls.client_auth", i)
+		}
+	}
+	return nil
+}
+
+func (h *HedgeSpec) validate() error {
+	if h == nil {
+		return nil
+	}
+	if h.Percentile < 0 || h.Percentile > 100 {
+		return fmt.Errorf("percentile: deve estar entre 0 e 100")
+	}
+	if h.BudgetPct < 0 || h.BudgetPct > 100 {
+		return fmt.Errorf("budget_pct: deve estar entre 0 e 100")
+	}
+	if h.Delay < 0 || h.BudgetWindow < 0 {
+		return fmt.Errorf("delay/budget_window: não podem ser negativos")
+	}
+	return nil
+}
+
+// validate verifica os campos do health check que não são checados pela leitura.
+func (h *HealthCheckSpec) validate() error {
+	if h == nil {
+		return nil
+	}
+	if h.BodyRegex != "" {
+		if _, err := regexp.Compile(h.BodyRegex); err != nil {
+			return fmt.Errorf("body_regex: %v", err)
+		}
+	}
+	if h.Rise < 0 || h.Fall < 0 {
+		return fmt.Errorf("rise/fall: não podem ser negativos")
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.Jitter < 0 {
+		return fmt.Errorf("interval/timeout/jitter: não podem ser negativos")
+	}
+	return nil
+}
+
+func (o *OutlierSpec) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.FailureRatePct < 0 || o.FailureRatePct > 100 {
+		return fmt.Errorf("failure_rate_pct: deve estar entre 0 e 100")
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return fmt.Errorf("max_ejection_percent: deve estar entre 0 e 100")
+	}
+	if o.Consecutive5xx < 0 || o.ConsecutiveGatewayErrors < 0 || o.MinRequests < 0 {
+		return fmt.Errorf("consecutive_5xx/consecutive_gateway_errors/min_requests: não podem ser negativos")
+	}
+	if o.Window < 0 || o.BaseEjectionTime < 0 || o.MaxEjectionTime < 0 {
+		return fmt.Errorf("window/base_ejection_time/max_ejection_time: não podem ser negativos")
+	}
+	return nil
+}
+
+func (s *StickySpec) validate() error {
+	if s == nil {
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(s.SameSite)) {
+	case "", "lax", "strict", "none":
+		return nil
+	}
+	return fmt.Errorf("same_site: valor desconhecido %q (use lax, strict ou none)", s.SameSite)
+}
+
+func (c *CircuitBreakerSpec) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.FailureRatePct < 0 || c.FailureRatePct > 100 {
+		return fmt.Errorf("failure_rate_pct: deve estar entre 0 e 100")
+	}
+	if c.SlowCallRatePct < 0 || c.SlowCallRatePct > 100 {
+		return fmt.Errorf("slow_call_rate_pct: deve estar entre 0 e 100")
+	}
+	if c.MinRequests < 0 || c.HalfOpenRequests < 0 {
+		return fmt.Errorf("min_requests/half_open_requests: não podem ser negativos")
+	}
+	if c.SlowCallDuration < 0 || c.Window < 0 || c.OpenDuration < 0 {
+		return fmt.Errorf("slow_call_duration/window/open_duration: não podem ser negativos")
+	}
+	return nil
+}
+
+func (s *ServerSpec) applyDefaults(env ServerSpec) {
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = env.ReadTimeout
+	}
+	if s.ReadHeaderTimeout == 0 {
+		s.ReadHeaderTimeout = env.ReadHeaderTimeout
+	}
+	if s.WriteTimeout == 0 {
+		s.WriteTimeout = env.WriteTimeout
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = env.IdleTimeout
+	}
+	if s.MaxHeaderBytes == 0 {
+		s.MaxHeaderBytes = env.MaxHeaderBytes
+	}
+	if s.ReadyPath == "" {
+		s.ReadyPath = env.ReadyPath
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = env.DrainTimeout
+	}
+}
+
+func (s ServerSpec) validate() error {
+	if s.ReadTimeout < 0 || s.ReadHeaderTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 {
+		return fmt.Errorf("read_timeout/read_header_timeout/write_timeout/idle_timeout: não podem ser negativos")
+	}
+	if s.MaxHeaderBytes < 0 {
+		return fmt.Errorf("max_header_bytes: não pode ser negativo")
+	}
+	if !strings.HasPrefix(s.ReadyPath, "/") {
+		return fmt.Errorf("ready_path: deve começar com /")
+	}
+	if s.DrainTimeout < 0 {
+		return fmt.Errorf("drain_timeout: não pode ser negativo")
+	}
+	return nil
+}
+
+func (t *TLSSpec) validate() error {
+	if t == nil {
+		return nil
+	}
+	if len(t.Certificates) == 0 && t.ACME == nil {
+		return fmt.Errorf("certificates: ao menos um certificado (ou acme) é obrigatório")
+	}
+	for i, c := range t.Certificates {
+		if c.Cert == "" || c.Key == "" {
+			return fmt.Errorf("certificates[%d]: cert e key são obrigatórios", i)
+		}
+	}
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("min_version: valor desconhecido %q (use 1.0, 1.1, 1.2 ou 1.3)", t.MinVersion)
+	}
+	if t.ReloadInterval < 0 {
+		return fmt.Errorf("reload_interval: não pode ser negativo")
+	}
+	if err := t.ACME.validate(); err != nil {
+		return fmt.Errorf("acme.%v", err)
+	}
+	if err := t.ClientAuth.validate(); err != nil {
+		return fmt.Errorf("client_auth.%v", err)
+	}
+	return nil
+}
+
+// validateProtocol verifica o protocolo dos backends; com scheme, também se ele vale para
+// backends com esse esquema.
+func validateProtocol(proto, scheme string) error {
+	switch {
+	case proto == "" || proto == "auto" || proto == "http1":
+	case proto != "h2" && proto != "h2c":
+		return fmt.Errorf("valor desconhecido %q (use auto, http1, h2 ou h2c)", proto)
+	case proto == "h2" && scheme == "http":
+		return fmt.Errorf("h2 exige um backend https (sem TLS, use h2c)")
+	case proto == "h2c" && scheme == "https":
+		return fmt.Errorf("h2c exige um backend http (com TLS, use h2)")
+	}
+	return nil
+}
+
+// http2Ciphers indica se as suítes permitem o HTTP/2, que exige uma das suítes
+// ECDHE com AES-128-GCM; vazio = padrão do Go.
+func http2Ciphers(suites []string) bool {
+	if len(suites) == 0 {
+		return true
+	}
+	for _, s := range suites {
+		switch strings.ToUpper(strings.TrimSpace(s)) {
+		case "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClientAuthSpec) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Mode {
+	case "", "request", "require":
+	default:
+		return fmt.Errorf("mode: valor desconhecido %q (use request ou require)", c.Mode)
+	}
+	if c.CA == "" {
+		return fmt.Errorf("ca: obrigatório")
+	}
+	for field, header := range c.Headers {
+		if !slices.Contains(ClientCertFields, field) {
+			return fmt.Errorf("headers: campo desconhecido %q (use %s)", field, strings.Join(ClientCertFields, ", "))
+		}
+		if header == "" || strings.ContainsAny(header, " :\t") {
+			return fmt.Errorf("headers.%s: nome de cabeçalho inválido %q", field, header)
+		}
+	}
+	return nil
+}
+
+func (c *ClientCertSpec) validate() error {
+	if c == nil || c.SubjectRegex == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(c.SubjectRegex); err != nil {
+		return fmt.Errorf("subject_regex: %v", err)
+	}
+	return nil
+}
+
+func (a *ACMESpec) validate() error {
+	if a == nil {
+		return nil
+	}
+	if len(a.Domains) == 0 {
+		return fmt.Errorf("domains: ao menos um domínio é obrigatório")
+	}
+	for i, d := range a.Domains {
+		if d == "" || strings.ContainsAny(d, "*/: ") {
+			return fmt.Errorf("domains[%d]: domínio inválido %q (curingas exigem o desafio DNS-01, não suportado)", i, d)
+		}
+	}
+	if a.DirectoryURL != "" {
+		u, err := url.Parse(a.DirectoryURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("directory_url: URL inválida %q", a.DirectoryURL)
+		}
+	}
+	if a.RenewBefore < 0 {
+		return fmt.Errorf("renew_before: não pode ser negativo")
+	}
+	return nil
+}
+
+func (m MetricsSpec) validate() error {
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("path: deve começar com /")
+	}
+	for i, b := range m.Buckets {
+		if b <= 0 || (i > 0 && b <= m.Buckets[i-1]) {
+			return fmt.Errorf("buckets: devem ser positivos e crescentes")
+		}
+	}
+	return nil
+}
+
+func (t *TimeoutSpec) validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.Connect < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Request < 0 || t.Idle < 0 {
+		return fmt.Errorf("connect/tls_handshake/response_header/request/idle: não podem ser negativos")
+	}
+	return nil
+}
+
+func (u *UpstreamTLSSpec) validate() error {
+	if u == nil {
+		return nil
+	}
+	if (u.Cert == "") != (u.Key == "") {
+		return fmt.Errorf("cert/key: devem ser definidos juntos")
+	}
+	return nil
+}
+
+func (r *RetrySpec) validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.BudgetPct < 0 || r.BudgetPct > 100 {
+		return fmt.Errorf("budget_pct: deve estar entre 0 e 100")
+	}
+	if r.Attempts < 0 || r.MinRetries < 0 || r.MaxBodyBytes < 0 {
+		return fmt.Errorf("attempts/min_retries/max_body_bytes: não podem ser negativos")
+	}
+	if r.BudgetWindow < 0 {
+		return fmt.Errorf("budget_window: não pode ser negativo")
+	}
+	return nil
+}
+
+// Pool retorna o pool com o nome dado, ou nil.
+func (f *File) Pool(name string) *PoolSpec {
+	for i := range f.Pools {
+		if f.Pools[i].Name == name {
+			return &f.Pools[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,714 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoad_YAML(t *testing.T) {
+	os.Setenv("API_HOST", "10.0.0.9")
+	os.Setenv("RATE_LIMIT_RPS", "7")
+	os.Setenv("LOAD_BALANCER_ALGO", "random")
+	defer os.Unsetenv("API_HOST")
+	defer os.Unsetenv("RATE_LIMIT_RPS")
+	defer os.Unsetenv("LOAD_BALANCER_ALGO")
+
+	path := writeConfig(t, "vortice.yaml", `
+listeners:
+  - address: ":9090"
+route_order: most_specific
+default_pool: web
+pools:
+  - name: api
+    algorithm: weighted_round_robin
+    health_check: {path: /health, interval: 5s, timeout: 500ms}
+    backends:
+      - url: http://${API_HOST}:8080
+        weight: 3
+        rate_limit: {rps: 10, burst: 5}
+      - url: http://${MISSING_HOST:-10.0.0.2}:8080
+        weight: 0
+  - name: web
+    backends:
+      - url: http://10.0.1.1:8080
+routes:
+  - host: api.example.com
+    path_prefix: /v1
+    methods: [GET, POST]
+    headers: {X-Env: canary}
+    pool: api
+`)
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if f.Listeners[0].Address != ":9090" || f.RouteOrder != "most_specific" || f.DefaultPool != "web" {
+		t.Fatalf("unexpected top-level settings: %+v", f)
+	}
+	api := f.Pool("api")
+	if api.HealthCheck.Interval != 5*time.Second || api.HealthCheck.Timeout != 500*time.Millisecond {
+		t.Fatalf("unexpected health check: %+v", api.HealthCheck)
+	}
+	if api.Backends[0].URL != "http://10.0.0.9:8080" || api.Backends[1].URL != "http://10.0.0.2:8080" {
+		t.Fatalf("interpolation failed: %+v", api.Backends)
+	}
+	if *api.Backends[0].Weight != 3 || *api.Backends[1].Weight != 0 {
+		t.Fatalf("unexpected weights")
+	}
+	// missing rate limit falls back to RATE_LIMIT_RPS
+	if api.Backends[1].RateLimit.RPS != 7 {
+		t.Fatalf("expected env fallback rps 7, got %d", api.Backends[1].RateLimit.RPS)
+	}
+	// missing algorithm falls back to LOAD_BALANCER_ALGO
+	if f.Pool("web").Algorithm != "random" {
+		t.Fatalf("expected env fallback algorithm, got %q", f.Pool("web").Algorithm)
+	}
+	if !*f.Stats.Enabled || f.Stats.Path != "/stats" {
+		t.Fatalf("expected stats defaults, got %+v", f.Stats)
+	}
+	r := f.Routes[0]
+	if r.Headers["X-Env"] != "canary" || len(r.Methods) != 2 {
+		t.Fatalf("unexpected route %+v", r)
+	}
+}
+
+func TestLoad_JSON(t *testing.T) {
+	path := writeConfig(t, "vortice.json", `{
+  "stats": {"enabled": false},
+  "pools": [
+    {"name": "", "backends": [{"url": "http://localhost:8081", "weight": 2}]}
+  ]
+}`)
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *f.Stats.Enabled {
+		t.Fatal("expected stats disabled")
+	}
+	if *f.Pools[0].Backends[0].Weight != 2 {
+		t.Fatalf("unexpected weight")
+	}
+}
+
+func TestLoad_ErrorsReportFileAndLine(t *testing.T) {
+	cases := []struct {
+		name, content, want string
+	}{
+		{"bad.yaml", "pools:\n  - name: api\n    backends:\n      - url: http://a:1\n        weight: heavy\n", "bad.yaml:5: pools[0].backends[0].weight"},
+		{"unknown.yaml", "pools:\n  - name: api\n    algoritm: p2c\n", "unknown.yaml:3: pools[0]: campo desconhecido \"algoritm\""},
+		{"dur.yaml", "pools:\n  - name: api\n    health_check:\n      interval: often\n", "dur.yaml:4:"},
+		{"syntax.json", "{\n  \"pools\": [\n    {\"name\": }\n  ]\n}", "syntax.json:3:"},
+		{"route.yaml", "pools:\n  - name: api\nroutes:\n  - pool: nope\n", "routes[0].pool"},
+		{"regex.yaml", "pools:\n  - name: api\n    health_check: {body_regex: \"(\"}\n", "pools[0].health_check.body_regex"},
+		{"samesite.yaml", "pools:\n  - name: api\n    sticky:\n      cookie: s\n      same_site: stric\n", "samesite.yaml:5: pools[0].sticky.same_site: valor desconhecido \"stric\""},
+		{"samesite.json", "{\"pools\": [\n  {\"name\": \"api\",\n   \"sticky\": {\"same_site\": \"Lux\"}}\n]}", "samesite.json:3: pools[0].sticky.same_site"},
+	}
+	for _, c := range cases {
+		_, err := Load(writeConfig(t, c.name, c.content))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("VORTICE_TEST_VAR", "x")
+	defer os.Unsetenv("VORTICE_TEST_VAR")
+	got := Interpolate("a=${VORTICE_TEST_VAR} b=${VORTICE_UNSET:-def} c=${VORTICE_UNSET} d=$$ e=$HOME")
+	if got != "a=x b=def c= d=$ e=$HOME" {
+		t.Fatalf("unexpected interpolation: %q", got)
+	}
+}
+
+func TestLoad_InterpolatesValuesOnly(t *testing.T) {
+	values := map[string]string{
+		"comment": "abc #def",
+		"newline": "abc\npools: []",
+		"colon":   "abc: def",
+		"quote":   `abc"def`,
+	}
+	for name, value := range values {
+		os.Setenv("VORTICE_TEST_TOKEN", value)
+		for file, content := range map[string]string{
+			"vortice.yaml": "admin:\n  token: ${VORTICE_TEST_TOKEN}\npools:\n  - name: api\n",
+			"quoted.yaml":  "admin:\n  token: \"${VORTICE_TEST_TOKEN}\"\npools:\n  - name: api\n",
+			"vortice.json": `{"admin": {"token": "${VORTICE_TEST_TOKEN}"}, "pools": [{"name": "api"}]}`,
+		} {
+			f, err := Load(writeConfig(t, file, content))
+			if err != nil {
+				t.Fatalf("%s/%s: Load: %v", name, file, err)
+			}
+			if f.Admin.Token != value || len(f.Pools) != 1 {
+				t.Errorf("%s/%s: expected token %q, got %q", name, file, value, f.Admin.Token)
+			}
+		}
+	}
+	os.Unsetenv("VORTICE_TEST_TOKEN")
+
+	// an unquoted value left empty is null, so the environment default applies
+	os.Setenv("HEALTH_CHECK_INTERVAL", "7s")
+	defer os.Unsetenv("HEALTH_CHECK_INTERVAL")
+	f, err := Load(writeConfig(t, "empty.yaml", "pools:\n  - name: api\n    health_check: ${VORTICE_UNSET}\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if f.Pools[0].HealthCheck.Interval != 7*time.Second {
+		t.Fatalf("expected the env interval, got %v", f.Pools[0].HealthCheck.Interval)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	os.Setenv("BACKEND_URLS", "http://a:1,http://b:2")
+	os.Setenv("BACKEND_WEIGHTS", "2")
+	os.Setenv("APP_PORT", "9999")
+	defer os.Unsetenv("BACKEND_URLS")
+	defer os.Unsetenv("BACKEND_WEIGHTS")
+	defer os.Unsetenv("APP_PORT")
+
+	f, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if f.Listeners[0].Address != ":9999" {
+		t.Fatalf("unexpected listener %q", f.Listeners[0].Address)
+	}
+	def := f.Pool("")
+	if def == nil || len(def.Backends) != 2 || *def.Backends[0].Weight != 2 || *def.Backends[1].Weight != 1 {
+		t.Fatalf("unexpected default pool %+v", def)
+	}
+}
+
+func TestLoad_ExampleFile(t *testing.T) {
+	f, err := Load(filepath.Join("..", "vortice.example.yaml"))
+	if err != nil {
+		t.Fatalf("example config should load: %v", err)
+	}
+	if len(f.Pools) != 2 || len(f.Routes) != 2 {
+		t.Fatalf("unexpected example contents: %d pools, %d routes", len(f.Pools), len(f.Routes))
+	}
+}
+
+func TestLoad_HealthCheck(t *testing.T) {
+	os.Setenv("HEALTH_CHECK_PATH", "/ready")
+	os.Setenv("HEALTH_CHECK_FALL", "3")
+	defer os.Unsetenv("HEALTH_CHECK_PATH")
+	defer os.Unsetenv("HEALTH_CHECK_FALL")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+pools:
+  - name: api
+    health_check:
+      path: /health
+      method: HEAD
+      headers: {Host: api.internal}
+      expected_status: "200-299,304"
+      body_contains: ok
+      body_regex: "v[0-9]+"
+      interval: 5s
+      jitter: 1s
+      rise: 2
+      fall: 4
+    backends:
+      - url: http://a:1
+  - name: web
+    backends:
+      - url: http://b:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	h := f.Pool("api").HealthCheck
+	if h.Method != "HEAD" || h.Headers["Host"] != "api.internal" || h.ExpectedStatus != "200-299,304" ||
+		h.BodyContains != "ok" || h.BodyRegex != "v[0-9]+" || h.Jitter != time.Second || h.Rise != 2 || h.Fall != 4 {
+		t.Fatalf("unexpected health check %+v", h)
+	}
+	// pools without health_check use the HEALTH_CHECK_* defaults
+	if h := f.Pool("web").HealthCheck; h == nil || h.Path != "/ready" || h.Fall != 3 {
+		t.Fatalf("expected env health check defaults, got %+v", h)
+	}
+}
+
+func TestLoad_OutlierDetection(t *testing.T) {
+	os.Setenv("OUTLIER_CONSECUTIVE_5XX", "5")
+	defer os.Unsetenv("OUTLIER_CONSECUTIVE_5XX")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+pools:
+  - name: api
+    outlier_detection:
+      consecutive_gateway_errors: 3
+      failure_rate_pct: 50
+      window: 10s
+      base_ejection_time: 15s
+      max_ejection_percent: 30
+    backends:
+      - url: http://a:1
+  - name: web
+    backends:
+      - url: http://b:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	o := f.Pool("api").OutlierDetection
+	if o.ConsecutiveGatewayErrors != 3 || o.FailureRatePct != 50 || o.Window != 10*time.Second || o.BaseEjectionTime != 15*time.Second || o.MaxEjectionPercent != 30 {
+		t.Fatalf("unexpected outlier detection %+v", o)
+	}
+	if o := f.Pool("web").OutlierDetection; o == nil || o.Consecutive5xx != 5 {
+		t.Fatalf("expected env outlier defaults, got %+v", o)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "pools:\n  - name: api\n    outlier_detection: {failure_rate_pct: 150}\n"))
+	if err == nil || !strings.Contains(err.Error(), "pools[0].outlier_detection.failure_rate_pct") {
+		t.Fatalf("expected failure_rate_pct error, got %v", err)
+	}
+}
+
+func TestLoad_CircuitBreaker(t *testing.T) {
+	os.Setenv("CIRCUIT_FAILURE_RATE_PCT", "60")
+	defer os.Unsetenv("CIRCUIT_FAILURE_RATE_PCT")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+pools:
+  - name: api
+    circuit_breaker:
+      slow_call_rate_pct: 80
+      slow_call_duration: 2s
+      open_duration: 10s
+      half_open_requests: 3
+    backends:
+      - url: http://a:1
+  - name: web
+    backends:
+      - url: http://b:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	c := f.Pool("api").CircuitBreaker
+	if c.SlowCallRatePct != 80 || c.SlowCallDuration != 2*time.Second || c.OpenDuration != 10*time.Second || c.HalfOpenRequests != 3 {
+		t.Fatalf("unexpected circuit breaker %+v", c)
+	}
+	if c := f.Pool("web").CircuitBreaker; c == nil || c.FailureRatePct != 60 {
+		t.Fatalf("expected env circuit breaker defaults, got %+v", c)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "pools:\n  - name: api\n    circuit_breaker: {slow_call_rate_pct: -1}\n"))
+	if err == nil || !strings.Contains(err.Error(), "pools[0].circuit_breaker.slow_call_rate_pct") {
+		t.Fatalf("expected slow_call_rate_pct error, got %v", err)
+	}
+}
+
+func TestLoad_Retry(t *testing.T) {
+	os.Setenv("RETRY_METHODS", "get, put")
+	defer os.Unsetenv("RETRY_METHODS")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+pools:
+  - name: api
+    retry:
+      attempts: 3
+      methods: [GET, POST]
+      retry_on: 502,503
+      max_body_bytes: 1024
+      budget_pct: 10
+      budget_window: 30s
+    backends:
+      - url: http://a:1
+  - name: web
+    backends:
+      - url: http://b:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	r := f.Pool("api").Retry
+	if r.Attempts != 3 || len(r.Methods) != 2 || r.Methods[1] != "POST" || r.RetryOn != "502,503" || r.MaxBodyBytes != 1024 || r.BudgetPct != 10 || r.BudgetWindow != 30*time.Second {
+		t.Fatalf("unexpected retry %+v", r)
+	}
+	if r := f.Pool("web").Retry; r == nil || len(r.Methods) != 2 || r.Methods[0] != "GET" || r.Methods[1] != "PUT" {
+		t.Fatalf("expected env retry defaults, got %+v", r)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "pools:\n  - name: api\n    retry: {budget_pct: 200}\n"))
+	if err == nil || !strings.Contains(err.Error(), "pools[0].retry.budget_pct") {
+		t.Fatalf("expected budget_pct error, got %v", err)
+	}
+}
+
+func TestLoad_RouteHedge(t *testing.T) {
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+pools:
+  - name: api
+    backends:
+      - url: http://a:1
+routes:
+  - path_prefix: /search
+    pool: api
+    hedge: {percentile: 90, budget_pct: 5}
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if h := f.Routes[0].Hedge; h == nil || h.Percentile != 90 || h.BudgetPct != 5 {
+		t.Fatalf("unexpected hedge %+v", h)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "pools:\n  - name: api\nroutes:\n  - pool: api\n    hedge: {percentile: 120}\n"))
+	if err == nil || !strings.Contains(err.Error(), "routes[0].hedge.percentile") {
+		t.Fatalf("expected percentile error, got %v", err)
+	}
+}
+
+func TestLoad_Timeouts(t *testing.T) {
+	os.Setenv("UPSTREAM_CONNECT_TIMEOUT", "3s")
+	os.Setenv("SERVER_WRITE_TIMEOUT", "1m")
+	defer os.Unsetenv("UPSTREAM_CONNECT_TIMEOUT")
+	defer os.Unsetenv("SERVER_WRITE_TIMEOUT")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+server:
+  read_header_timeout: 5s
+pools:
+  - name: api
+    timeouts: {response_header: 2s, request: 30s}
+    backends:
+      - url: http://a:1
+        timeouts: {request: 1m}
+  - name: web
+    backends:
+      - url: http://b:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if s := f.Server; s.ReadHeaderTimeout != 5*time.Second || s.WriteTimeout != time.Minute || s.IdleTimeout != 120*time.Second {
+		t.Fatalf("unexpected server limits %+v", s)
+	}
+	api := f.Pool("api")
+	if to := api.Timeouts; to.ResponseHeader != 2*time.Second || to.Request != 30*time.Second {
+		t.Fatalf("unexpected pool timeouts %+v", to)
+	}
+	if to := api.Backends[0].Timeouts; to == nil || to.Request != time.Minute {
+		t.Fatalf("unexpected backend timeouts %+v", to)
+	}
+	if to := f.Pool("web").Timeouts; to == nil || to.Connect != 3*time.Second {
+		t.Fatalf("expected env timeouts, got %+v", to)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "pools:\n  - name: api\n    backends:\n      - url: http://a:1\n        timeouts: {connect: -1s}\n"))
+	if err == nil || !strings.Contains(err.Error(), "pools[0].backends[0].timeouts") {
+		t.Fatalf("expected timeouts error, got %v", err)
+	}
+}
+
+func TestLoad_UpstreamTLS(t *testing.T) {
+	os.Setenv("UPSTREAM_TLS_CA", "/etc/vortice/ca.pem")
+	defer os.Unsetenv("UPSTREAM_TLS_CA")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+pools:
+  - name: api
+    upstream_tls: {ca: internal-ca.pem, server_name: api.internal}
+    backends:
+      - url: https://a:1
+        upstream_tls: {cert: client.crt, key: client.key}
+  - name: web
+    backends:
+      - url: https://b:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	api := f.Pool("api")
+	if u := api.UpstreamTLS; u.CA != "internal-ca.pem" || u.ServerName != "api.internal" {
+		t.Fatalf("unexpected pool upstream_tls %+v", u)
+	}
+	if u := api.Backends[0].UpstreamTLS; u == nil || u.Cert != "client.crt" || u.Key != "client.key" {
+		t.Fatalf("unexpected backend upstream_tls %+v", u)
+	}
+	if u := f.Pool("web").UpstreamTLS; u == nil || u.CA != "/etc/vortice/ca.pem" {
+		t.Fatalf("expected env upstream_tls, got %+v", u)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "pools:\n  - name: api\n    backends:\n      - url: https://a:1\n        upstream_tls: {cert: client.crt}\n"))
+	if err == nil || !strings.Contains(err.Error(), "pools[0].backends[0].upstream_tls") {
+		t.Fatalf("expected upstream_tls error, got %v", err)
+	}
+}
+
+func TestLoad_Shutdown(t *testing.T) {
+	os.Setenv("SERVER_DRAIN_TIMEOUT", "10s")
+	defer os.Unsetenv("SERVER_DRAIN_TIMEOUT")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", "server:\n  ready_path: /healthz/ready\npools:\n  - name: api\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if s := f.Server; s.ReadyPath != "/healthz/ready" || s.DrainTimeout != 10*time.Second {
+		t.Fatalf("unexpected shutdown settings %+v", s)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "server:\n  ready_path: ready\npools:\n  - name: api\n"))
+	if err == nil || !strings.Contains(err.Error(), "server.ready_path") {
+		t.Fatalf("expected ready_path error, got %v", err)
+	}
+}
+
+func TestLoad_Metrics(t *testing.T) {
+	os.Setenv("METRICS_BUCKETS", "10ms, 100ms,1s")
+	defer os.Unsetenv("METRICS_BUCKETS")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", "pools:\n  - name: api\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if m := f.Metrics; !*m.Enabled || m.Path != "/metrics" || len(m.Buckets) != 3 || m.Buckets[2] != time.Second {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	f, err = Load(writeConfig(t, "vortice.yaml", "metrics:\n  path: /prom\n  buckets: [50ms, 500ms]\npools:\n  - name: api\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if m := f.Metrics; m.Path != "/prom" || len(m.Buckets) != 2 || m.Buckets[0] != 50*time.Millisecond {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	_, err = Load(writeConfig(t, "bad.yaml", "metrics:\n  buckets: [1s, 500ms]\npools:\n  - name: api\n"))
+	if err == nil || !strings.Contains(err.Error(), "metrics.buckets") {
+		t.Fatalf("expected buckets error, got %v", err)
+	}
+	_, err = Load(writeConfig(t, "bad.yaml", "metrics:\n  path: /stats\npools:\n  - name: api\n"))
+	if err == nil || !strings.Contains(err.Error(), "metrics.path") {
+		t.Fatalf("expected path conflict error, got %v", err)
+	}
+}
+
+func TestLoad_TLS(t *testing.T) {
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+listeners:
+  - address: ":8080"
+    redirect_https: true
+  - address: ":8443"
+    tls:
+      min_version: "1.3"
+      cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]
+      reload_interval: 30s
+      certificates:
+        - cert: site.crt
+          key: site.key
+        - cert: wildcard.crt
+          key: wildcard.key
+pools:
+  - name: api
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	l := f.Listeners
+	if !l[0].RedirectHTTPS || l[0].TLS != nil || l[1].TLS == nil {
+		t.Fatalf("unexpected listeners %+v", l)
+	}
+	if tc := l[1].TLS; tc.MinVersion != "1.3" || len(tc.CipherSuites) != 1 || tc.ReloadInterval != 30*time.Second || len(tc.Certificates) != 2 || tc.Certificates[1].Key != "wildcard.key" {
+		t.Fatalf("unexpected tls %+v", tc)
+	}
+
+	f, err = Load(writeConfig(t, "vortice.yaml", `
+listeners:
+  - address: ":80"
+  - address: ":443"
+    tls:
+      acme:
+        domains: [a.test, b.test]
+        email: ops@a.test
+        directory_url: https://localhost:14000/dir
+        directory_ca: pebble.minica.pem
+        cache_dir: /var/lib/vortice/acme
+        renew_before: 240h
+pools:
+  - name: api
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if a := f.Listeners[1].TLS.ACME; a == nil || len(a.Domains) != 2 || a.DirectoryURL != "https://localhost:14000/dir" || a.DirectoryCA != "pebble.minica.pem" || a.RenewBefore != 240*time.Hour {
+		t.Fatalf("unexpected acme %+v", a)
+	}
+
+	bad := map[string]string{
+		"listeners:\n  - address: \":8443\"\n    tls:\n      min_version: \"1.4\"\n      certificates:\n        - {cert: a.crt, key: a.key}\npools:\n  - name: api\n":           "listeners[0].tls.min_version",
+		"listeners:\n  - address: \":8443\"\n    tls:\n      certificates:\n        - {cert: a.crt}\npools:\n  - name: api\n":                                                   "listeners[0].tls.certificates[0]",
+		"listeners:\n  - address: \":8443\"\n    tls:\n      min_version: \"1.2\"\npools:\n  - name: api\n":                                                                     "listeners[0].tls.certificates",
+		"listeners:\n  - address: \":8443\"\n    tls:\n      acme:\n        domains: [a.test]\npools:\n  - name: api\n":                                                         "listeners[0].tls.acme",
+		"listeners:\n  - address: \":80\"\n  - address: \":8443\"\n    tls:\n      acme:\n        domains: [\"*.a.test\"]\npools:\n  - name: api\n":                             "listeners[1].tls.acme.domains[0]",
+		"listeners:\n  - address: \":80\"\n  - address: \":8443\"\n    tls:\n      acme:\n        domains: [a.test]\n        directory_url: localhost\npools:\n  - name: api\n": "listeners[1].tls.acme.directory_url",
+		"listeners:\n  - address: \":8080\"\n    redirect_https: true\npools:\n  - name: api\n":                                                                                 "listeners[0].redirect_https",
+	}
+	for content, want := range bad {
+		if _, err := Load(writeConfig(t, "bad.yaml", content)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s error, got %v", want, err)
+		}
+	}
+}
+
+func TestFromEnv_TLS(t *testing.T) {
+	for k, v := range map[string]string{
+		"TLS_PORT":          "8443",
+		"TLS_CERT_FILES":    "a.crt, b.crt",
+		"TLS_KEY_FILES":     "a.key,b.key",
+		"TLS_MIN_VERSION":   "1.3",
+		"TLS_REDIRECT_HTTP": "true",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	f, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	l := f.Listeners
+	if len(l) != 2 || !l[0].RedirectHTTPS || l[1].Address != ":8443" || l[1].TLS.MinVersion != "1.3" || l[1].TLS.Certificates[1] != (CertificateSpec{Cert: "b.crt", Key: "b.key"}) {
+		t.Fatalf("unexpected listeners %+v", l)
+	}
+}
+
+func TestLoad_ClientAuth(t *testing.T) {
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+listeners:
+  - address: ":8443"
+    tls:
+      certificates: [{cert: site.crt, key: site.key}]
+      client_auth:
+        mode: request
+        ca: clients-ca.pem
+        headers: {subject: X-Client-Cert-Subject, fingerprint: X-Client-Cert-Fingerprint}
+pools:
+  - name: api
+routes:
+  - path_prefix: /billing
+    pool: api
+    client_cert: {common_names: [billing], subject_regex: "O=Acme"}
+  - path_prefix: /internal
+    pool: api
+    client_cert: {}
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if c := f.Listeners[0].TLS.ClientAuth; c == nil || c.Mode != "request" || c.CA != "clients-ca.pem" || c.Headers["fingerprint"] != "X-Client-Cert-Fingerprint" {
+		t.Fatalf("unexpected client_auth %+v", c)
+	}
+	if c := f.Routes[0].ClientCert; c == nil || c.CommonNames[0] != "billing" || c.SubjectRegex != "O=Acme" {
+		t.Fatalf("unexpected client_cert %+v", c)
+	}
+	if f.Routes[1].ClientCert == nil {
+		t.Fatal("expected an empty client_cert to require any verified certificate")
+	}
+
+	for _, c := range []struct{ yaml, want string }{
+		{"listeners:\n  - address: \":8443\"\n    tls:\n      certificates: [{cert: a, key: b}]\n      client_auth: {mode: optional, ca: ca.pem}\npools:\n  - name: api\n", "listeners[0].tls.client_auth.mode"},
+		{"listeners:\n  - address: \":8443\"\n    tls:\n      certificates: [{cert: a, key: b}]\n      client_auth: {mode: require}\npools:\n  - name: api\n", "listeners[0].tls.client_auth.ca"},
+		{"listeners:\n  - address: \":8443\"\n    tls:\n      certificates: [{cert: a, key: b}]\n      client_auth: {ca: ca.pem, headers: {cn: X-CN}}\npools:\n  - name: api\n", "listeners[0].tls.client_auth.headers"},
+		{"pools:\n  - name: api\nroutes:\n  - pool: api\n    client_cert: {common_names: [billing]}\n", "routes[0].client_cert: nenhum listener"},
+		{"listeners:\n  - address: \":8443\"\n    tls:\n      certificates: [{cert: a, key: b}]\n      client_auth: {ca: ca.pem}\npools:\n  - name: api\nroutes:\n  - pool: api\n    client_cert: {subject_regex: \"(\"}\n", "routes[0].client_cert.subject_regex"},
+	} {
+		_, err := Load(writeConfig(t, "bad.yaml", c.yaml))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("expected %s error, got %v", c.want, err)
+		}
+	}
+}
+
+func TestFromEnv_ClientAuth(t *testing.T) {
+	for k, v := range map[string]string{
+		"TLS_PORT":                "8443",
+		"TLS_CERT_FILES":          "a.crt",
+		"TLS_KEY_FILES":           "a.key",
+		"TLS_CLIENT_CA":           "clients-ca.pem",
+		"TLS_CLIENT_CERT_HEADERS": "subject=X-Client-Cert-Subject, dns=X-Client-Cert-DNS",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	f, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if c := f.Listeners[1].TLS.ClientAuth; c == nil || c.CA != "clients-ca.pem" || c.Headers["dns"] != "X-Client-Cert-DNS" || len(c.Headers) != 2 {
+		t.Fatalf("unexpected client_auth %+v", c)
+	}
+}
+
+func TestLoad_Protocols(t *testing.T) {
+	os.Setenv("UPSTREAM_PROTOCOL", "http1")
+	defer os.Unsetenv("UPSTREAM_PROTOCOL")
+
+	f, err := Load(writeConfig(t, "vortice.yaml", `
+listeners:
+  - address: ":8080"
+    h2c: true
+  - address: ":8443"
+    http2: false
+    tls:
+      certificates: [{cert: site.crt, key: site.key}]
+pools:
+  - name: api
+    protocol: h2c
+    backends:
+      - url: http://a:1
+      - url: https://b:1
+        protocol: h2
+  - name: web
+    backends:
+      - url: http://c:1
+`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if l := f.Listeners; !l[0].H2C || l[1].HTTP2 == nil || *l[1].HTTP2 {
+		t.Fatalf("unexpected listeners %+v", l)
+	}
+	if api := f.Pool("api"); api.Protocol != "h2c" || api.Backends[1].Protocol != "h2" {
+		t.Fatalf("unexpected protocols %+v", api)
+	}
+	if p := f.Pool("web").Protocol; p != "http1" {
+		t.Fatalf("expected env protocol, got %q", p)
+	}
+
+	for _, c := range []struct{ yaml, want string }{
+		{"pools:\n  - name: api\n    protocol: spdy\n", "pools[0].protocol"},
+		{"pools:\n  - name: api\n    protocol: h2\n    backends:\n      - url: http://a:1\n", "pools[0].backends[0].protocol"},
+		{"pools:\n  - name: api\n    backends:\n      - url: https://a:1\n        protocol: h2c\n", "pools[0].backends[0].protocol"},
+		{"listeners:\n  - address: \":8080\"\n    http2: true\npools:\n  - name: api\n", "listeners[0].http2"},
+		{"listeners:\n  - address: \":8443\"\n    h2c: true\n    tls:\n      certificates: [{cert: a, key: b}]\npools:\n  - name: api\n", "listeners[0].h2c"},
+		{"listeners:\n  - address: \":8443\"\n    tls:\n      cipher_suites: [TLS_RSA_WITH_AES_128_GCM_SHA256]\n      certificates: [{cert: a, key: b}]\npools:\n  - name: api\n", "listeners[0].tls.cipher_suites"},
+	} {
+		_, err := Load(writeConfig(t, "bad.yaml", c.yaml))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("expected %s error, got %v", c.want, err)
+		}
+	}
+}
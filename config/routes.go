@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// poolEnv lê a variável POOL_<NOME>_<KEY> de um pool nomeado.
+func poolEnv(pool, key string) string {
+	name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(pool))
+	return os.Getenv("POOL_" + name + "_" + key)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// GetPools retorna os pools nomeados listados em POOLS (vírgula separada). Cada pool lê
+// POOL_<NOME>_BACKEND_URLS, POOL_<NOME>_ALGO, POOL_<NOME>_RATE_LIMITS, POOL_<NOME>_WEIGHTS e
+// POOL_<NOME>_HASH_KEY; algoritmo e hash key ausentes herdam LOAD_BALANCER_ALGO e HASH_KEY.
+func GetPools() []PoolSpec {
+	var out []PoolSpec
+	for _, name := range splitList(os.Getenv("POOLS")) {
+		urls := splitList(poolEnv(name, "BACKEND_URLS"))
+		spec := PoolSpec{
+			Name:             name,
+			Algorithm:        strings.ToLower(poolEnv(name, "ALGO")),
+			HashKey:          strings.TrimSpace(poolEnv(name, "HASH_KEY")),
+			IPHashHeader:     GetIPHashHeader(),
+			Sticky:           envSticky(),
+			HealthCheck:      GetHealthCheck(),
+			OutlierDetection: GetOutlierDetection(),
+			CircuitBreaker:   GetCircuitBreaker(),
+			Retry:            GetRetry(),
+			Timeouts:         GetTimeouts(),
+			Backends:         backendSpecs(urls, parseRateLimits(poolEnv(name, "RATE_LIMITS"), len(urls)), parseWeights(poolEnv(name, "WEIGHTS"), len(urls))),
+		}
+		if spec.Algorithm == "" {
+			spec.Algorithm = GetLBAlgorithm()
+		}
+		if spec.HashKey == "" {
+			spec.HashKey = GetHashKey()
+		}
+		out = append(out, spec)
+	}
+	return out
+}
+
+// GetRouteOrder retorna a ordem de avaliação das rotas (ROUTE_ORDER): "first_match" (padrão) ou "most_specific".
+func GetRouteOrder() string {
+	if s := strings.ToLower(strings.TrimSpace(os.Getenv("ROUTE_ORDER"))); s != "" {
+		return s
+	}
+	return "first_match"
+}
+
+// GetRoutes parses ROUTES: regras separadas por ";", cada uma com pares chave=valor separados por
+// espaço. Chaves: name, host, path, path_prefix, path_regex, methods (GET,POST), header (Nome:valor,
+// pode repetir), hedge (percentil como p95 ou atraso fixo como 50ms), client_cn e client_san (regras
+// de certificado de cliente, listas separadas por vírgula) e pool (obrigatória). Ex:
+//
+//	ROUTES="host=api.example.com path_prefix=/v1 pool=api; host=*.static.example.com pool=static"
+func GetRoutes() ([]RouteSpec, error) {
+	var out []RouteSpec
+	for i, rule := range strings.Split(os.Getenv("ROUTES"), ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		spec := RouteSpec{}
+		for _, tok := range strings.Fields(rule) {
+			key, val, ok := strings.Cut(tok, "=")
+			if !ok || val == "" {
+				return nil, fmt.Errorf("ROUTES regra %d: token inválido %q (esperado chave=valor)", i+1, tok)
+			}
+			switch strings.ToLower(key) {
+			case "name":
+				spec.Name = val
+			case "host":
+				spec.Host = val
+			case "path":
+				spec.Path = val
+			case "path_prefix":
+				spec.PathPrefix = val
+			case "path_regex":
+				spec.PathRegex = val
+			case "methods":
+				spec.Methods = splitList(strings.ToUpper(val))
+			case "header":
+				if spec.Headers == nil {
+					spec.Headers = map[string]string{}
+				}
+				name, hv, _ := strings.Cut(val, ":")
+				spec.Headers[name] = hv
+			case "pool":
+				spec.Pool = val
+			case "hedge":
+				h, err := parseHedge(val)
+				if err != nil {
+					return nil, fmt.Errorf("ROUTES regra %d: hedge: %v", i+1, err)
+				}
+				spec.Hedge = h
+			case "client_cn", "client_san":
+				if spec.ClientCert == nil {
+					spec.ClientCert = &ClientCertSpec{}
+				}
+				if strings.ToLower(key) == "client_cn" {
+					spec.ClientCert.CommonNames = splitList(val)
+				} else {
+					spec.ClientCert.SANs = splitList(val)
+				}
+			default:
+				return nil, fmt.Errorf("ROUTES regra %d: chave desconhecida %q", i+1, key)
+			}
+		}
+		if spec.Pool == "" {
+			return nil, fmt.Errorf("ROUTES regra %d: pool é obrigatório", i+1)
+		}
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("route-%d", i+1)
+		}
+		out = append(out, spec)
+	}
+	return out, nil
+}
+
+// parseHedge converte o valor de hedge em ROUTES: um percentil ("p95", "p99.9") ou um atraso fixo
+// ("50ms").
+func parseHedge(val string) (*HedgeSpec, error) {
+	if p, ok := strings.CutPrefix(strings.ToLower(val), "p"); ok {
+		pct, err := strconv.ParseFloat(p, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("percentil inválido %q (ex: p95)", val)
+		}
+		return &HedgeSpec{Percentile: pct}, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("valor inválido %q (use p95 ou um atraso como 50ms)", val)
+	}
+	return &HedgeSpec{Delay: d}, nil
+}
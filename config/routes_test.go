@@ -0,0 +1,101 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetPools(t *testing.T) {
+	os.Setenv("POOLS", "api, static-files")
+	os.Setenv("POOL_API_BACKEND_URLS", "http://a:1,http://b:2")
+	os.Setenv("POOL_API_ALGO", "LEAST_CONN")
+	os.Setenv("POOL_API_WEIGHTS", "3,1")
+	os.Setenv("POOL_STATIC_FILES_BACKEND_URLS", "http://c:3")
+	os.Setenv("POOL_STATIC_FILES_RATE_LIMITS", "10/5")
+	defer func() {
+		for _, k := range []string{"POOLS", "POOL_API_BACKEND_URLS", "POOL_API_ALGO", "POOL_API_WEIGHTS", "POOL_STATIC_FILES_BACKEND_URLS", "POOL_STATIC_FILES_RATE_LIMITS"} {
+			os.Unsetenv(k)
+		}
+	}()
+
+	pools := GetPools()
+	if len(pools) != 2 {
+		t.Fatalf("expected 2 pools, got %d", len(pools))
+	}
+	api := pools[0]
+	if api.Name != "api" || api.Algorithm != "least_conn" || len(api.Backends) != 2 {
+		t.Fatalf("unexpected api pool: %+v", api)
+	}
+	if api.Backends[1].URL != "http://b:2" || *api.Backends[0].Weight != 3 || *api.Backends[1].Weight != 1 {
+		t.Fatalf("unexpected api backends: %+v", api.Backends)
+	}
+	static := pools[1]
+	if static.Algorithm != "round_robin" || !reflect.DeepEqual(static.Backends[0].RateLimit, &RateLimitSpec{RPS: 10, Burst: 5}) {
+		t.Fatalf("unexpected static pool: %+v", static)
+	}
+}
+
+func TestGetRoutes(t *testing.T) {
+	os.Setenv("ROUTES", "host=api.example.com path_prefix=/v1 methods=get,post header=X-Env:canary pool=api; host=*.cdn.example.com pool=static")
+	defer os.Unsetenv("ROUTES")
+
+	routes, err := GetRoutes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []RouteSpec{
+		{Name: "route-1", Host: "api.example.com", PathPrefix: "/v1", Methods: []string{"GET", "POST"}, Headers: map[string]string{"X-Env": "canary"}, Pool: "api"},
+		{Name: "route-2", Host: "*.cdn.example.com", Pool: "static"},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Fatalf("expected %+v got %+v", want, routes)
+	}
+
+	os.Setenv("ROUTES", "host=x.com")
+	if _, err := GetRoutes(); err == nil {
+		t.Fatal("expected error for route without pool")
+	}
+	os.Setenv("ROUTES", "hots=x.com pool=a")
+	if _, err := GetRoutes(); err == nil {
+		t.Fatal("expected error for unknown key")
+	}
+}
+
+func TestGetRoutes_Hedge(t *testing.T) {
+	os.Setenv("ROUTES", "path_prefix=/search hedge=p99 pool=api; path_prefix=/feed hedge=40ms pool=api")
+	defer os.Unsetenv("ROUTES")
+
+	routes, err := GetRoutes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h := routes[0].Hedge; h == nil || h.Percentile != 99 || h.Delay != 0 {
+		t.Fatalf("expected p99 hedge, got %+v", h)
+	}
+	if h := routes[1].Hedge; h == nil || h.Delay != 40*time.Millisecond {
+		t.Fatalf("expected 40ms hedge, got %+v", h)
+	}
+
+	os.Setenv("ROUTES", "hedge=p0 pool=api")
+	if _, err := GetRoutes(); err == nil {
+		t.Fatal("expected error for invalid hedge percentile")
+	}
+}
+
+func TestGetRoutes_ClientCert(t *testing.T) {
+	os.Setenv("ROUTES", "path_prefix=/billing client_cn=billing,reports client_san=*.svc.acme.test pool=api; pool=web")
+	defer os.Unsetenv("ROUTES")
+
+	routes, err := GetRoutes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := routes[0].ClientCert; c == nil || len(c.CommonNames) != 2 || c.CommonNames[1] != "reports" || len(c.SANs) != 1 || c.SANs[0] != "*.svc.acme.test" {
+		t.Fatalf("unexpected client_cert %+v", c)
+	}
+	if routes[1].ClientCert != nil {
+		t.Fatalf("expected no client_cert, got %+v", routes[1].ClientCert)
+	}
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML config files are read by gopkg.in/yaml.v3 into a yaml.Node tree and
+// converted to node, so YAML and JSON share the decoder and its line numbers.
+// Only the first document of the file is read.
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mapNode
+	seqNode
+)
+
+// node is a parsed value with the line it came from, shared by the YAML and
+// JSON readers so both report errors the same way.
+type node struct {
+	kind   nodeKind
+	line   int
+	value  string
+	quoted bool
+	null   bool
+	keys   []string
+	vals   []*node
+	items  []*node
+}
+
+func (n *node) get(key string) *node {
+	for i, k := range n.keys {
+		if k == key {
+			return n.vals[i]
+		}
+	}
+	return nil
+}
+
+// syntaxError is a parse error at a line of the config file.
+type syntaxError struct {
+	line int
+	msg  string
+}
+
+func (e *syntaxError) Error() string { return fmt.Sprintf("linha %d: %s", e.line, e.msg) }
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &syntaxError{line: line, msg: fmt.Sprintf(format, args...)}
+}
+
+// yamlErrorLine matches the "yaml: line N: msg" errors of yaml.v3.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func parseYAML(src string) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(src), &doc); err != nil {
+		var te *yaml.TypeError
+		if errors.As(err, &te) && len(te.Errors) > 0 {
+			err = errors.New("yaml: " + te.Errors[0])
+		}
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, errorf(line, "%s", m[2])
+		}
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if len(doc.Content) == 0 {
+		// arquivo vazio ou só com comentários
+		return &node{kind: mapNode, line: 1}, nil
+	}
+	return convertYAML(doc.Content[0])
+}
+
+// convertYAML turns a yaml.Node into a node, following aliases and merge
+// keys (<<) and rejecting duplicate keys and custom tags.
+func convertYAML(y *yaml.Node) (*node, error) {
+	if y.Kind == yaml.AliasNode {
+		return convertYAML(y.Alias)
+	}
+	if strings.HasPrefix(y.Tag, "!") && !strings.HasPrefix(y.Tag, "!!") {
+		return nil, errorf(y.Line, "tag %s não é suportada", y.Tag)
+	}
+	switch y.Kind {
+	case yaml.ScalarNode:
+		return &node{
+			kind:   scalarNode,
+			line:   y.Line,
+			value:  y.Value,
+			quoted: y.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) != 0,
+			null:   y.ShortTag() == "!!null",
+		}, nil
+	case yaml.SequenceNode:
+		n := &node{kind: seqNode, line: y.Line}
+		for _, c := range y.Content {
+			item, err := convertYAML(c)
+			if err != nil {
+				return nil, err
+			}
+			n.items = append(n.items, item)
+		}
+		return n, nil
+	case yaml.MappingNode:
+		n := &node{kind: mapNode, line: y.Line}
+		var merged []*node
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			k, v := y.Content[i], y.Content[i+1]
+			val, err := convertYAML(v)
+			if err != nil {
+				return nil, err
+			}
+			if k.Kind == yaml.ScalarNode && k.ShortTag() == "!!merge" {
+				switch val.kind {
+				case mapNode:
+					merged = append(merged, val)
+				case seqNode:
+					merged = append(merged, val.items...)
+				}
+				continue
+			}
+			if k.Kind != yaml.ScalarNode {
+				return nil, errorf(k.Line, "chaves devem ser texto")
+			}
+			if n.get(k.Value) != nil {
+				return nil, errorf(k.Line, "chave %q duplicada", k.Value)
+			}
+			n.keys = append(n.keys, k.Value)
+			n.vals = append(n.vals, val)
+		}
+		// chaves explícitas prevalecem sobre as herdadas por <<, e o primeiro mapa herdado
+		// prevalece sobre os seguintes
+		for _, m := range merged {
+			if m.kind != mapNode {
+				return nil, errorf(m.line, "<< espera um mapa ou uma lista de mapas")
+			}
+			for i, k := range m.keys {
+				if n.get(k) == nil {
+					n.keys = append(n.keys, k)
+					n.vals = append(n.vals, m.vals[i])
+				}
+			}
+		}
+		return n, nil
+	}
+	return nil, errorf(y.Line, "valor YAML não suportado")
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseYAML_Structures(t *testing.T) {
+	src := `
+# comentário
+listeners:
+  - address: ":8080"   # inline
+pools:
+- name: api
+  algorithm: least_conn
+  backends:
+    - url: http://10.0.0.1:8080
+      weight: 3
+      rate_limit: {rps: 10, burst: 5}
+    - url: 'http://10.0.0.2:8080'
+  tags: [a, "b c", 'd''e']
+empty:
+`
+	root, err := parseYAML(src)
+	if err != nil {
+		t.Fatalf("parseYAML: %v", err)
+	}
+	pools := root.get("pools")
+	if pools == nil || pools.kind != seqNode || len(pools.items) != 1 {
+		t.Fatalf("expected one pool, got %+v", pools)
+	}
+	api := pools.items[0]
+	if api.get("name").value != "api" || api.get("name").line != 6 {
+		t.Fatalf("unexpected name node %+v", api.get("name"))
+	}
+	backends := api.get("backends")
+	if len(backends.items) != 2 {
+		t.Fatalf("expected 2 backends, got %d", len(backends.items))
+	}
+	if rl := backends.items[0].get("rate_limit"); rl.get("burst").value != "5" {
+		t.Fatalf("flow mapping not parsed: %+v", rl)
+	}
+	if u := backends.items[1].get("url"); u.value != "http://10.0.0.2:8080" || !u.quoted {
+		t.Fatalf("quoted url not parsed: %+v", u)
+	}
+	tags := api.get("tags")
+	if len(tags.items) != 3 || tags.items[1].value != "b c" || tags.items[2].value != "d'e" {
+		t.Fatalf("flow sequence not parsed: %+v", tags.items)
+	}
+	if l := root.get("listeners").items[0].get("address"); l.value != ":8080" {
+		t.Fatalf("comment not stripped: %q", l.value)
+	}
+	if !root.get("empty").null {
+		t.Fatalf("expected empty value to be null")
+	}
+}
+
+func TestParseYAML_ErrorsCarryLine(t *testing.T) {
+	cases := map[string]string{
+		"a: 1\n  b: 2\n":   "linha 2",
+		"a: 1\na: 2\n":     "linha 2",
+		"a:\n  - x\n  y\n": "linha 3",
+		"a: [1, 2\n":       "linha 1",
+		"ok: 1\n\tb: 2\n":  "linha 2",
+		"a: \"sem fim\n":   "linha 2",
+		"a: !env X\n":      "linha 1",
+	}
+	for src, want := range cases {
+		_, err := parseYAML(src)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected error at %s, got %v", src, want, err)
+		}
+	}
+}
+
+func TestParseYAML_Syntax(t *testing.T) {
+	src := `---
+"a: b": 1
+hash: "x # y"
+plain: x#y
+escaped: "diz \"oi\""
+single: 'it''s'
+nested:
+  - - x
+    - y
+  - z
+text: |
+  linha 1
+  linha 2
+base: &base {weight: 2, url: http://a}
+merged:
+  <<: *base
+  url: http://b
+...
+ignored: 1
+`
+	root, err := parseYAML(src)
+	if err != nil {
+		t.Fatalf("parseYAML: %v", err)
+	}
+	for key, want := range map[string]string{
+		"a: b":    "1",
+		"hash":    "x # y",
+		"plain":   "x#y",
+		"escaped": `diz "oi"`,
+		"single":  "it's",
+		"text":    "linha 1\nlinha 2\n",
+	} {
+		if n := root.get(key); n == nil || n.value != want {
+			t.Errorf("%s: expected %q, got %+v", key, want, n)
+		}
+	}
+	nested := root.get("nested")
+	if len(nested.items) != 2 || len(nested.items[0].items) != 2 || nested.items[0].items[1].value != "y" || nested.items[1].value != "z" {
+		t.Errorf("nested sequence not parsed: %+v", nested)
+	}
+	merged := root.get("merged")
+	if merged.get("weight").value != "2" || merged.get("url").value != "http://b" {
+		t.Errorf("merge key not applied: %+v", merged)
+	}
+	if root.get("ignored") != nil {
+		t.Error("expected the document to end at ...")
+	}
+	if root, err := parseYAML("# só comentários\n"); err != nil || root.kind != mapNode {
+		t.Errorf("expected an empty mapping, got %+v, %v", root, err)
+	}
+}
+
+func TestParseJSON_Lines(t *testing.T) {
+	src := "{\n  \"pools\": [\n    {\"name\": \"api\",\n     \"backends\": []}\n  ]\n}"
+	root, err := parseJSON([]byte(src))
+	if err != nil {
+		t.Fatalf("parseJSON: %v", err)
+	}
+	api := root.get("pools").items[0]
+	if api.get("name").value != "api" || api.get("name").line != 3 {
+		t.Fatalf("unexpected name node %+v", api.get("name"))
+	}
+	if api.get("backends").line != 4 {
+		t.Fatalf("expected backends on line 4, got %d", api.get("backends").line)
+	}
+
+	if _, err := parseJSON([]byte("{\n  \"a\": 1,\n  \"b\": ]\n}")); err == nil || !strings.Contains(err.Error(), "linha 3") {
+		t.Fatalf("expected syntax error on line 3, got %v", err)
+	}
+}
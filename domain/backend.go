@@ -1,10 +1,16 @@
 package domain
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -18,16 +24,71 @@ type Backend struct {
 	Alive        bool
 	// ConnCount é o número de conexões ativas (para least_conn)
 	ConnCount int64
-	// Limiter aplica rate limiting por backend (nil = sem rate limit)
+	// Limiter aplica rate limiting por backend (nil = sem rate limit);
+	// em tempo de execução use SetRateLimit
 	Limiter *rate.Limiter
+	// Health, se definido, sobrescreve o health check do pool para este backend;
+	// em tempo de execução use SetHealth
+	Health *HealthCheckConfig
+	// weight é o peso relativo usado pelos algoritmos ponderados (0 = drenado)
+	weight int64
+	// state é o estado administrativo (BackendState)
+	state int32
+	// resultados consecutivos do health check ativo (protegidos por Mux);
+	// checked fica false até o primeiro resultado, que define Alive direto
+	checked    bool
+	checkOKs   int
+	checkFails int
+	// estado do health check passivo (outlier detection)
+	outlier outlierState
+	// circuit breaker (configurado no pool)
+	breaker circuitBreaker
+	// timeouts, TLS, protocolo e o transporte construído a partir deles (nil =
+	// http.DefaultTransport); em tempo de execução use SetTimeouts, SetUpstreamTLS e SetProtocol
+	timeouts    atomic.Pointer[Timeouts]
+	upstreamTLS atomic.Pointer[UpstreamTLS]
+	transportMu sync.Mutex
+	tlsConfig   *tls.Config
+	protocol    string
+	transport   atomic.Pointer[http.Transport]
+
+	// latência observada (peak EWMA) usada por peak_ewma
+	ewmaMu    sync.Mutex
+	ewmaNs    float64
+	ewmaStamp time.Time
 }
 
+// ewmaDecay is the time constant of the latency EWMA: an observation's
+// influence drops to 1/e after this long.
+const ewmaDecay = 10 * time.Second
+
 // NewBackend creates a new backend instance
 func NewBackend(serverUrl string, rateRPS int, burst int) *Backend {
 	u, _ := url.Parse(serverUrl)
 	proxy := httputil.NewSingleHostReverseProxy(u)
 
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+		if errors.Is(e, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+			// the client went away (or another hedged attempt won): not a
+			// backend failure
+			if rec, ok := w.(*statusRecorder); ok {
+				rec.cancelled = true
+			}
+			w.WriteHeader(StatusClientClosed)
+			return
+		}
+		timeout := isTimeout(e)
+		// let the pool tell transport errors from 5xx sent by the backend
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.gatewayErr = true
+			rec.connectErr = isConnectErr(e)
+			rec.timeout = timeout
+		}
+		if timeout {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte(TimeoutBody))
+			return
+		}
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("Backend indisponível"))
 	}
@@ -37,17 +98,92 @@ func NewBackend(serverUrl string, rateRPS int, burst int) *Backend {
 		limiter = rate.NewLimiter(rate.Limit(rateRPS), burst)
 	}
 
-	return &Backend{
+	b := &Backend{
 		URL:          u,
 		ReverseProxy: proxy,
 		Alive:        true,
 		Limiter:      limiter,
+		weight:       1,
+	}
+	proxy.Transport = backendTransport{b}
+	return b
+}
+
+// StatusClientClosed is recorded for requests whose client hung up before the
+// backend answered (the status nginx logs as 499).
+const StatusClientClosed = 499
+
+// TimeoutBody is the body of the 504 sent when a backend times out.
+const TimeoutBody = "Tempo limite do backend excedido"
+
+// Weight returns the backend weight used by the weighted strategies.
+func (b *Backend) Weight() int {
+	return int(atomic.LoadInt64(&b.weight))
+}
+
+// SetWeight changes the backend weight at runtime. A weight of 0 drains the
+// backend: weighted strategies stop sending it new requests. Negative values
+// are treated as 0.
+func (b *Backend) SetWeight(w int) {
+	if w < 0 {
+		w = 0
+	}
+	atomic.StoreInt64(&b.weight, int64(w))
+}
+
+// BackendState is the administrative state of a backend, set by operators
+// independently of its health.
+type BackendState int32
+
+const (
+	// StateEnabled backends receive traffic while healthy.
+	StateEnabled BackendState = iota
+	// StateDraining backends receive no new sessions; clients already bound
+	// to them by a sticky cookie keep being served.
+	StateDraining
+	// StateDisabled backends receive no traffic at all.
+	StateDisabled
+)
+
+func (s BackendState) String() string {
+	switch s {
+	case StateDraining:
+		return "draining"
+	case StateDisabled:
+		return "disabled"
+	default:
+		return "enabled"
+	}
+}
+
+// ParseBackendState converts "enabled", "draining" (or "drain") and
+// "disabled" to a BackendState.
+func ParseBackendState(s string) (BackendState, error) {
+	switch s {
+	case "enabled", "enable":
+		return StateEnabled, nil
+	case "draining", "drain":
+		return StateDraining, nil
+	case "disabled", "disable":
+		return StateDisabled, nil
 	}
+	return StateEnabled, fmt.Errorf("estado desconhecido %q", s)
+}
+
+// State returns the administrative state of the backend.
+func (b *Backend) State() BackendState {
+	return BackendState(atomic.LoadInt32(&b.state))
+}
+
+// SetState changes the administrative state of the backend at runtime.
+func (b *Backend) SetState(s BackendState) {
+	atomic.StoreInt32(&b.state, int32(s))
 }
 
 func (b *Backend) SetAlive(alive bool) {
 	b.Mux.Lock()
 	b.Alive = alive
+	b.checked = true
 	b.Mux.Unlock()
 }
 
@@ -58,14 +194,93 @@ func (b *Backend) IsAlive() bool {
 	return alive
 }
 
+// Checked reports whether the status of b came from a health check or
+// SetAlive; before that the backend is alive only by default.
+func (b *Backend) Checked() bool {
+	b.Mux.RLock()
+	defer b.Mux.RUnlock()
+	return b.checked
+}
+
+// RateLimiter returns the backend's limiter, or nil when it is not limited.
+func (b *Backend) RateLimiter() *rate.Limiter {
+	b.Mux.RLock()
+	l := b.Limiter
+	b.Mux.RUnlock()
+	return l
+}
+
+// reserveToken takes a token of the backend's rate limiter for a request sent
+// at now, reporting false when none is available. undo gives the token back
+// when the request ends up not being sent.
+func (b *Backend) reserveToken(now time.Time) (undo func(), ok bool) {
+	l := b.RateLimiter()
+	if l == nil {
+		return func() {}, true
+	}
+	res := l.ReserveN(now, 1)
+	if !res.OK() || res.DelayFrom(now) > 0 {
+		res.CancelAt(now)
+		return nil, false
+	}
+	return func() { res.CancelAt(now) }, true
+}
+
+// SetRateLimit changes the backend rate limit at runtime; rps <= 0 removes it.
+func (b *Backend) SetRateLimit(rps int, burst int) {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+	switch {
+	case rps <= 0:
+		b.Limiter = nil
+	case b.Limiter != nil:
+		b.Limiter.SetLimit(rate.Limit(rps))
+		b.Limiter.SetBurst(burst)
+	default:
+		b.Limiter = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+}
+
+// SetHealth replaces the backend's health check override at runtime.
+func (b *Backend) SetHealth(c *HealthCheckConfig) {
+	b.Mux.Lock()
+	b.Health = c
+	b.Mux.Unlock()
+}
+
+// ObserveLatency feeds a request duration into the backend's peak EWMA. A
+// value above the current average replaces it immediately, so a backend that
+// slows down is penalised at once and only recovers gradually.
+func (b *Backend) ObserveLatency(d time.Duration) {
+	now := time.Now()
+	rtt := float64(d)
+	b.ewmaMu.Lock()
+	switch {
+	case b.ewmaStamp.IsZero() || rtt > b.ewmaNs:
+		b.ewmaNs = rtt
+	default:
+		w := math.Exp(-float64(now.Sub(b.ewmaStamp)) / float64(ewmaDecay))
+		b.ewmaNs = b.ewmaNs*w + rtt*(1-w)
+	}
+	b.ewmaStamp = now
+	b.ewmaMu.Unlock()
+}
+
+// EWMALatency returns the current peak EWMA latency (0 until the first
+// observation). It decays toward zero while no new samples arrive, so a
+// backend that stopped getting traffic after a slow response is tried again.
+func (b *Backend) EWMALatency() time.Duration {
+	b.ewmaMu.Lock()
+	ns, stamp := b.ewmaNs, b.ewmaStamp
+	b.ewmaMu.Unlock()
+	if stamp.IsZero() {
+		return 0
+	}
+	return time.Duration(ns * math.Exp(-float64(time.Since(stamp))/float64(ewmaDecay)))
+}
+
 // CheckHealth attempts to dial the server to see if it responds
 func (b *Backend) CheckHealth() bool {
-	client := http.Client{Timeout: 2 * time.Second}
-	resp, err := client.Get(b.URL.String())
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-	// consider healthy any 2xx or 3xx response
-	return resp.StatusCode >= 200 && resp.StatusCode < 400
+	ok, _ := b.probe(b.healthConfig(nil))
+	return ok
 }
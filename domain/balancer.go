@@ -0,0 +1,131 @@
+package domain
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer picks a peer among the alive backends of a pool for a request.
+// The alive slice is never empty and must not be modified. Implementations
+// must be safe for concurrent use; r may be nil.
+type Balancer interface {
+	Next(alive []*Backend, r *http.Request) *Backend
+}
+
+// BalancerFunc adapts an ordinary function to the Balancer interface.
+type BalancerFunc func(alive []*Backend, r *http.Request) *Backend
+
+func (f BalancerFunc) Next(alive []*Backend, r *http.Request) *Backend {
+	return f(alive, r)
+}
+
+// BalancerFactory builds a Balancer for a pool. It is called once per pool
+// (and again whenever the pool's Algorithm changes), so per-pool state such
+// as round-robin counters should live in the returned value.
+type BalancerFactory func(pool *ServerPool) Balancer
+
+var (
+	balancersMu sync.RWMutex
+	balancers   = map[string]BalancerFactory{}
+)
+
+func init() {
+	RegisterBalancer("round_robin", func(*ServerPool) Balancer { return &roundRobin{} })
+	RegisterBalancer("least_conn", func(*ServerPool) Balancer { return BalancerFunc(leastConn) })
+	RegisterBalancer("random", func(*ServerPool) Balancer { return BalancerFunc(randomPick) })
+	RegisterBalancer("ip_hash", func(p *ServerPool) Balancer {
+		return &hashBalancer{key: HashKey{Source: "ip", Name: p.IPHashHeader}, build: buildRing}
+	})
+	RegisterBalancer("p2c", func(*ServerPool) Balancer { return BalancerFunc(p2cLeastLoaded) })
+	RegisterBalancer("peak_ewma", func(*ServerPool) Balancer { return BalancerFunc(p2cPeakEWMA) })
+	RegisterBalancer("ring_hash", func(p *ServerPool) Balancer { return &hashBalancer{key: poolHashKey(p), build: buildRing} })
+	RegisterBalancer("maglev", func(p *ServerPool) Balancer { return &hashBalancer{key: poolHashKey(p), build: buildMaglev} })
+	RegisterBalancer("weighted_round_robin", func(*ServerPool) Balancer { return &weightedRoundRobin{} })
+	RegisterBalancer("weighted_random", func(*ServerPool) Balancer { return BalancerFunc(weightedRandom) })
+}
+
+// RegisterBalancer makes a balancing strategy available under name, the same
+// value accepted by ServerPool.Algorithm and LOAD_BALANCER_ALGO. Names are
+// case-insensitive; registering an existing name replaces it.
+func RegisterBalancer(name string, factory BalancerFactory) {
+	if factory == nil {
+		panic("domain: RegisterBalancer with nil factory")
+	}
+	balancersMu.Lock()
+	balancers[strings.ToLower(name)] = factory
+	balancersMu.Unlock()
+}
+
+// LookupBalancer returns the factory registered under name.
+func LookupBalancer(name string) (BalancerFactory, bool) {
+	balancersMu.RLock()
+	f, ok := balancers[strings.ToLower(name)]
+	balancersMu.RUnlock()
+	return f, ok
+}
+
+// BalancerNames returns the registered strategy names in sorted order.
+func BalancerNames() []string {
+	balancersMu.RLock()
+	out := make([]string, 0, len(balancers))
+	for name := range balancers {
+		out = append(out, name)
+	}
+	balancersMu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// roundRobin rotates over the alive backends.
+type roundRobin struct {
+	current uint64
+}
+
+func (rr *roundRobin) Next(alive []*Backend, _ *http.Request) *Backend {
+	n := atomic.AddUint64(&rr.current, 1)
+	return alive[(n-1)%uint64(len(alive))]
+}
+
+// leastConn picks the backend with the fewest active connections.
+func leastConn(alive []*Backend, _ *http.Request) *Backend {
+	chosen := alive[0]
+	min := atomic.LoadInt64(&chosen.ConnCount)
+	for _, be := range alive[1:] {
+		if cnt := atomic.LoadInt64(&be.ConnCount); cnt < min {
+			chosen = be
+			min = cnt
+		}
+	}
+	return chosen
+}
+
+// randomPick picks a uniformly random backend.
+func randomPick(alive []*Backend, _ *http.Request) *Backend {
+	return alive[rand.Intn(len(alive))]
+}
+
+// clientKey extracts the client address from header (or RemoteAddr when header
+// is empty), keeping only the first entry of lists such as X-Forwarded-For and
+// dropping the port.
+func clientKey(r *http.Request, header string) string {
+	if r == nil {
+		return ""
+	}
+	key := r.RemoteAddr
+	if header != "" {
+		key = r.Header.Get(header)
+	}
+	// if header contains multiple ips (X-Forwarded-For), take first
+	if idxc := strings.Index(key, ","); idxc != -1 {
+		key = strings.TrimSpace(key[:idxc])
+	}
+	// remove port if present
+	if idx := strings.LastIndex(key, ":"); idx != -1 {
+		key = key[:idx]
+	}
+	return key
+}
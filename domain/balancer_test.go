@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRegisterBalancer_CustomStrategy(t *testing.T) {
+	RegisterBalancer("always_last", func(*ServerPool) Balancer {
+		return BalancerFunc(func(alive []*Backend, _ *http.Request) *Backend {
+			return alive[len(alive)-1]
+		})
+	})
+
+	pool := &ServerPool{Algorithm: "ALWAYS_LAST"}
+	b1 := NewBackend("http://localhost:8081", 0, 1)
+	b2 := NewBackend("http://localhost:8082", 0, 1)
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	if peer := pool.GetNextPeer(nil); peer != b2 {
+		t.Fatalf("expected custom strategy to pick b2, got %v", peer)
+	}
+
+	found := false
+	for _, name := range BalancerNames() {
+		if name == "always_last" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected always_last in %v", BalancerNames())
+	}
+}
+
+func TestRoundRobin_Rotates(t *testing.T) {
+	pool := &ServerPool{Algorithm: "round_robin"}
+	b1 := NewBackend("http://localhost:8081", 0, 1)
+	b2 := NewBackend("http://localhost:8082", 0, 1)
+	b3 := NewBackend("http://localhost:8083", 0, 1)
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+	pool.AddBackend(b3)
+
+	want := []*Backend{b1, b2, b3, b1}
+	for i, w := range want {
+		if got := pool.GetNextPeer(nil); got != w {
+			t.Fatalf("step %d: expected %s, got %s", i, w.URL, got.URL)
+		}
+	}
+}
+
+func TestServerPool_BalancerOverridesAlgorithm(t *testing.T) {
+	b1 := NewBackend("http://localhost:8081", 0, 1)
+	b2 := NewBackend("http://localhost:8082", 0, 1)
+	pool := &ServerPool{
+		Algorithm: "round_robin",
+		Balancer: BalancerFunc(func(alive []*Backend, _ *http.Request) *Backend {
+			return alive[1]
+		}),
+	}
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	for i := 0; i < 3; i++ {
+		if got := pool.GetNextPeer(nil); got != b2 {
+			t.Fatalf("expected Balancer field to be used, got %s", got.URL)
+		}
+	}
+}
+
+func TestServerPool_UnknownAlgorithmFallsBack(t *testing.T) {
+	pool := &ServerPool{Algorithm: "does_not_exist"}
+	pool.AddBackend(NewBackend("http://localhost:8081", 0, 1))
+	if pool.GetNextPeer(nil) == nil {
+		t.Fatal("expected fallback to round robin for unknown algorithm")
+	}
+}
@@ -0,0 +1,239 @@
+package domain
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+// Circuit breaker defaults, used when a setting is left empty.
+const (
+	DefaultBreakerWindow      = 30 * time.Second
+	DefaultBreakerMinRequests = 10
+	DefaultBreakerOpenTime    = 30 * time.Second
+	DefaultSlowCallDuration   = 5 * time.Second
+	DefaultHalfOpenRequests   = 1
+)
+
+// CircuitState is the state of a backend's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects requests until the open duration is over.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of trial requests through; they
+	// decide whether the circuit closes or opens again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig configures the circuit breaker of the backends of a
+// pool. The circuit opens when, over Window and after MinRequests, the
+// percentage of failed requests (5xx or transport errors) reaches
+// FailureRatePct or the percentage of requests slower than SlowCallDuration
+// reaches SlowCallRatePct. Zero rates disable the corresponding trigger.
+type CircuitBreakerConfig struct {
+	FailureRatePct   float64
+	SlowCallRatePct  float64
+	SlowCallDuration time.Duration
+	MinRequests      int
+	Window           time.Duration
+	// OpenDuration is how long the circuit stays open before half-open.
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of trial requests in half-open; all of
+	// them must succeed to close the circuit.
+	HalfOpenRequests int
+}
+
+func (c *CircuitBreakerConfig) window() time.Duration {
+	if c.Window > 0 {
+		return c.Window
+	}
+	return DefaultBreakerWindow
+}
+
+func (c *CircuitBreakerConfig) minRequests() int {
+	if c.MinRequests > 0 {
+		return c.MinRequests
+	}
+	return DefaultBreakerMinRequests
+}
+
+func (c *CircuitBreakerConfig) openDuration() time.Duration {
+	if c.OpenDuration > 0 {
+		return c.OpenDuration
+	}
+	return DefaultBreakerOpenTime
+}
+
+func (c *CircuitBreakerConfig) slowCallDuration() time.Duration {
+	if c.SlowCallDuration > 0 {
+		return c.SlowCallDuration
+	}
+	return DefaultSlowCallDuration
+}
+
+func (c *CircuitBreakerConfig) halfOpenRequests() int {
+	if c.HalfOpenRequests > 0 {
+		return c.HalfOpenRequests
+	}
+	return DefaultHalfOpenRequests
+}
+
+// circuitBreaker is the per-backend breaker state.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    CircuitState
+	openedAt time.Time
+	window   rollingWindow
+	// trials in flight and succeeded in the current half-open period
+	trials, passed int
+}
+
+// Circuit returns the state of the backend's circuit breaker.
+func (b *Backend) Circuit() CircuitState {
+	b.breaker.mu.Lock()
+	defer b.breaker.mu.Unlock()
+	return b.breaker.state
+}
+
+// allows reports whether the circuit would let a request through at now,
+// without reserving a half-open trial.
+func (cb *circuitBreaker) allows(c *CircuitBreakerConfig, now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		return now.Sub(cb.openedAt) >= c.openDuration()
+	case CircuitHalfOpen:
+		return cb.trials < c.halfOpenRequests()
+	}
+	return true
+}
+
+// circuitAllows is allows for a backend of s; pools without a breaker
+// allow everything.
+func (s *ServerPool) circuitAllows(b *Backend, now time.Time) bool {
+	return s.Breaker == nil || b.breaker.allows(s.Breaker, now)
+}
+
+// acquire lets a request through the circuit of b, moving an expired open
+// circuit to half-open. It returns false when the request must not be sent,
+// and whether it is a half-open trial.
+func (s *ServerPool) acquire(b *Backend, now time.Time) (ok, trial bool) {
+	c := s.Breaker
+	if c == nil {
+		return true, false
+	}
+	cb := &b.breaker
+	cb.mu.Lock()
+	halfOpened := false
+	if cb.state == CircuitOpen && now.Sub(cb.openedAt) >= c.openDuration() {
+		cb.state, cb.trials, cb.passed = CircuitHalfOpen, 0, 0
+		halfOpened = true
+	}
+	switch cb.state {
+	case CircuitOpen:
+	case CircuitHalfOpen:
+		if cb.trials < c.halfOpenRequests() {
+			cb.trials++
+			ok, trial = true, true
+		}
+	default:
+		ok = true
+	}
+	cb.mu.Unlock()
+	if halfOpened {
+		s.circuitChanged(b, CircuitHalfOpen, "")
+	}
+	return ok, trial
+}
+
+// record feeds the result of a request sent through acquire into the
+// circuit of b.
+func (s *ServerPool) record(b *Backend, trial, fail bool, d time.Duration, now time.Time) {
+	c := s.Breaker
+	if c == nil {
+		return
+	}
+	slow := d >= c.slowCallDuration()
+	cb := &b.breaker
+	cb.mu.Lock()
+	next, reason := cb.state, ""
+	switch {
+	case trial && cb.state == CircuitHalfOpen:
+		cb.trials--
+		if fail || slow {
+			next, reason = CircuitOpen, "requisição de teste falhou"
+			break
+		}
+		cb.passed++
+		if cb.passed >= c.halfOpenRequests() {
+			next = CircuitClosed
+		}
+	case cb.state == CircuitClosed:
+		cb.window.add(c.window(), now, fail, slow)
+		reqs, fails, slows := cb.window.totals(c.window(), now)
+		if reqs < c.minRequests() {
+			break
+		}
+		failRate := float64(fails) / float64(reqs) * 100
+		slowRate := float64(slows) / float64(reqs) * 100
+		switch {
+		case c.FailureRatePct > 0 && failRate >= c.FailureRatePct:
+			next, reason = CircuitOpen, "taxa de falhas acima do limite"
+		case c.SlowCallRatePct > 0 && slowRate >= c.SlowCallRatePct:
+			next, reason = CircuitOpen, "taxa de chamadas lentas acima do limite"
+		}
+	}
+	changed := next != cb.state
+	if changed {
+		cb.state = next
+		cb.window.reset()
+		if next == CircuitOpen {
+			cb.openedAt = now
+		}
+	}
+	cb.mu.Unlock()
+	if changed {
+		s.circuitChanged(b, next, reason)
+	}
+}
+
+// release gives back a half-open trial taken by acquire for a request whose
+// result must not count, such as a cancelled hedged attempt or a request
+// whose client hung up.
+func (s *ServerPool) release(b *Backend, trial bool) {
+	if s.Breaker == nil || !trial {
+		return
+	}
+	cb := &b.breaker
+	cb.mu.Lock()
+	if cb.state == CircuitHalfOpen && cb.trials > 0 {
+		cb.trials--
+	}
+	cb.mu.Unlock()
+}
+
+func (s *ServerPool) circuitChanged(b *Backend, state CircuitState, reason string) {
+	if reason != "" {
+		log.Printf("circuit breaker: %s%s -> %s (%s)", poolPrefix(s.Name), b.URL, state, reason)
+	} else {
+		log.Printf("circuit breaker: %s%s -> %s", poolPrefix(s.Name), b.URL, state)
+	}
+	stats.RecordCircuit(s.Name, b.URL.String(), state.String())
+}
@@ -0,0 +1,156 @@
+package domain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func TestBreaker_OpensOnFailureRate(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "breaker-rate", Breaker: &CircuitBreakerConfig{FailureRatePct: 50, MinRequests: 4, OpenDuration: 30 * time.Millisecond}}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+
+	for i := 0; i < 3; i++ {
+		serveOnce(pool)
+	}
+	if b.Circuit() != CircuitClosed {
+		t.Fatal("circuit should stay closed before min_requests")
+	}
+	serveOnce(pool)
+	if b.Circuit() != CircuitOpen {
+		t.Fatalf("expected open circuit, got %s", b.Circuit())
+	}
+	if code := serveOnce(pool); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the circuit is open, got %d", code)
+	}
+	snap := stats.SnapshotAll()[stats.Key("breaker-rate", srv.URL)]
+	if snap.Circuit != "open" || snap.CircuitOpens != 1 {
+		t.Fatalf("circuit not recorded in stats: %+v", snap)
+	}
+
+	// after the open duration one trial goes through and closes the circuit
+	time.Sleep(40 * time.Millisecond)
+	failing.Store(false)
+	if code := serveOnce(pool); code != http.StatusOK {
+		t.Fatalf("expected trial request to pass, got %d", code)
+	}
+	if b.Circuit() != CircuitClosed {
+		t.Fatalf("expected closed circuit after successful trial, got %s", b.Circuit())
+	}
+}
+
+func TestBreaker_OpensOnSlowCalls(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "breaker-slow", Breaker: &CircuitBreakerConfig{SlowCallRatePct: 100, SlowCallDuration: 10 * time.Millisecond, MinRequests: 2, OpenDuration: time.Hour}}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+
+	serveOnce(pool)
+	serveOnce(pool)
+	if b.Circuit() != CircuitOpen {
+		t.Fatalf("expected open circuit on slow calls, got %s", b.Circuit())
+	}
+}
+
+func TestBreaker_SkipsOpenCircuit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "breaker-skip", Breaker: &CircuitBreakerConfig{FailureRatePct: 50}}
+	open := NewBackend(srv.URL+"/open", 0, 1)
+	closed := NewBackend(srv.URL+"/closed", 0, 1)
+	pool.AddBackend(open)
+	pool.AddBackend(closed)
+	open.breaker.state, open.breaker.openedAt = CircuitOpen, time.Now()
+
+	for i := 0; i < 4; i++ {
+		if p := pool.GetNextPeer(httptest.NewRequest("GET", "/", nil)); p != closed {
+			t.Fatalf("expected only the closed backend, got %v", p.URL)
+		}
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	pool := &ServerPool{Name: "breaker-half", Breaker: &CircuitBreakerConfig{HalfOpenRequests: 2, OpenDuration: time.Second}}
+	b := NewBackend("http://127.0.0.1:1", 0, 1)
+	pool.AddBackend(b)
+	now := time.Now()
+	b.breaker.state, b.breaker.openedAt = CircuitOpen, now.Add(-2*time.Second)
+
+	ok1, t1 := pool.acquire(b, now)
+	ok2, t2 := pool.acquire(b, now)
+	ok3, _ := pool.acquire(b, now)
+	if !ok1 || !t1 || !ok2 || !t2 || ok3 {
+		t.Fatal("expected exactly two half-open trials")
+	}
+	if b.Circuit() != CircuitHalfOpen {
+		t.Fatalf("expected half_open, got %s", b.Circuit())
+	}
+
+	pool.record(b, true, false, time.Millisecond, now)
+	if b.Circuit() != CircuitHalfOpen {
+		t.Fatal("circuit should close only after all trials pass")
+	}
+	pool.record(b, true, true, time.Millisecond, now)
+	if b.Circuit() != CircuitOpen {
+		t.Fatalf("expected failed trial to reopen the circuit, got %s", b.Circuit())
+	}
+	if ok, _ := pool.acquire(b, now.Add(500*time.Millisecond)); ok {
+		t.Fatal("reopened circuit should reject requests")
+	}
+}
+
+func TestBreaker_ClientCancelIsNotAFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "breaker-cancel", Breaker: &CircuitBreakerConfig{FailureRatePct: 50, MinRequests: 2, OpenDuration: time.Second}}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+	cancelled := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	}
+
+	for i := 0; i < 3; i++ {
+		cancelled()
+	}
+	if b.Circuit() != CircuitClosed {
+		t.Fatalf("client cancellations opened the circuit: %s", b.Circuit())
+	}
+
+	// a cancelled half-open trial gives its slot back without a verdict
+	b.breaker.state, b.breaker.openedAt = CircuitOpen, time.Now().Add(-2*time.Second)
+	cancelled()
+	if b.Circuit() != CircuitHalfOpen {
+		t.Fatalf("expected the circuit to stay half_open, got %s", b.Circuit())
+	}
+	if ok, trial := pool.acquire(b, time.Now()); !ok || !trial {
+		t.Fatal("expected the trial slot to be released")
+	}
+}
@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"crypto/x509"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ClientCertForbiddenBody is the body of the 403 sent when a request does
+// not satisfy the client certificate rule of its route.
+const ClientCertForbiddenBody = "Certificado de cliente não autorizado"
+
+// ClientCertRule restricts a route to clients that presented a certificate
+// verified by the listener. With no conditions any verified certificate is
+// accepted; otherwise every non-empty condition must hold.
+type ClientCertRule struct {
+	// CommonNames accepts certificates whose subject common name is listed.
+	CommonNames []string
+	// SANs accepts certificates with any DNS, email or URI SAN listed; a
+	// leading "*." matches subdomains of a DNS name, as in Route.Host.
+	SANs []string
+	// SubjectRegex matches the full subject, e.g. "CN=billing,O=Acme".
+	SubjectRegex string
+
+	subjectRe *regexp.Regexp
+}
+
+// ClientCert returns the client certificate of r verified by the listener,
+// or nil when the client sent none or the connection is not TLS.
+func ClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Allows reports whether the client certificate of r satisfies the rule.
+func (c *ClientCertRule) Allows(r *http.Request) bool {
+	cert := ClientCert(r)
+	if cert == nil {
+		return false
+	}
+	if len(c.CommonNames) > 0 && !slices.Contains(c.CommonNames, cert.Subject.CommonName) {
+		return false
+	}
+	if len(c.SANs) > 0 && !c.matchSAN(cert) {
+		return false
+	}
+	if c.subjectRe != nil && !c.subjectRe.MatchString(cert.Subject.String()) {
+		return false
+	}
+	return true
+}
+
+func (c *ClientCertRule) matchSAN(cert *x509.Certificate) bool {
+	for _, want := range c.SANs {
+		for _, name := range cert.DNSNames {
+			if matchHost(want, name) {
+				return true
+			}
+		}
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(want, email) {
+				return true
+			}
+		}
+		for _, u := range cert.URIs {
+			if want == u.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package domain
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func requestWithCert(cert *x509.Certificate) *http.Request {
+	r := httptest.NewRequest("GET", "/billing", nil)
+	if cert != nil {
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	return r
+}
+
+func TestClientCertRule_Allows(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://acme/billing")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing", Organization: []string{"Acme"}},
+		DNSNames:       []string{"billing.svc.acme.test"},
+		EmailAddresses: []string{"ops@acme.test"},
+		URIs:           []*url.URL{spiffe},
+	}
+	cases := []struct {
+		name string
+		rule ClientCertRule
+		want bool
+	}{
+		{"any", ClientCertRule{}, true},
+		{"cn", ClientCertRule{CommonNames: []string{"reports", "billing"}}, true},
+		{"other cn", ClientCertRule{CommonNames: []string{"reports"}}, false},
+		{"dns wildcard", ClientCertRule{SANs: []string{"*.svc.acme.test"}}, true},
+		{"email", ClientCertRule{SANs: []string{"OPS@acme.test"}}, true},
+		{"uri", ClientCertRule{SANs: []string{"spiffe://acme/billing"}}, true},
+		{"other san", ClientCertRule{SANs: []string{"*.other.test"}}, false},
+		{"subject", ClientCertRule{SubjectRegex: `^CN=billing,O=Acme$`}, true},
+		{"cn and other san", ClientCertRule{CommonNames: []string{"billing"}, SANs: []string{"x.test"}}, false},
+	}
+	for _, c := range cases {
+		rt := &Router{}
+		route := &Route{Name: c.name, Pool: &ServerPool{}, ClientCert: &c.rule}
+		if err := rt.AddRoute(route); err != nil {
+			t.Fatalf("%s: AddRoute: %v", c.name, err)
+		}
+		if got := route.ClientCert.Allows(requestWithCert(cert)); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+		if route.ClientCert.Allows(requestWithCert(nil)) {
+			t.Errorf("%s: expected a request without certificate to be rejected", c.name)
+		}
+	}
+}
+
+func TestRouter_ClientCertForbidden(t *testing.T) {
+	rt := &Router{Default: &ServerPool{Name: "web"}}
+	err := rt.AddRoute(&Route{
+		Name:       "billing",
+		PathPrefix: "/billing",
+		Pool:       &ServerPool{Name: "billing"},
+		ClientCert: &ClientCertRule{CommonNames: []string{"billing"}},
+	})
+	if err != nil {
+		t.Fatalf("AddRoute: %v", err)
+	}
+	for _, cert := range []*x509.Certificate{nil, {Subject: pkix.Name{CommonName: "reports"}}} {
+		rr := httptest.NewRecorder()
+		rt.ServeHTTP(rr, requestWithCert(cert))
+		if rr.Code != http.StatusForbidden || rr.Body.String() != ClientCertForbiddenBody+"\n" {
+			t.Fatalf("expected 403 %q, got %d %q", ClientCertForbiddenBody, rr.Code, rr.Body.String())
+		}
+	}
+	// an allowed client reaches the pool (503: it has no backends)
+	rr := httptest.NewRecorder()
+	rt.ServeHTTP(rr, requestWithCert(&x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}))
+	if rr.Code == http.StatusForbidden {
+		t.Fatal("expected the allowed certificate to pass")
+	}
+
+	if err := rt.AddRoute(&Route{Name: "bad", Pool: &ServerPool{}, ClientCert: &ClientCertRule{SubjectRegex: "("}}); err == nil {
+		t.Fatal("expected an error for an invalid subject regex")
+	}
+}
@@ -0,0 +1,289 @@
+package domain
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ringReplicas is the number of virtual nodes per unit of weight on the
+// ring, the same density used by ketama.
+const ringReplicas = 160
+
+// maglevTableSize is the Maglev lookup table size; it must be prime and much
+// larger than the number of backends.
+const maglevTableSize = 65537
+
+// HashKey tells the hashing strategies where to read the affinity key from.
+type HashKey struct {
+	// Source is one of "ip", "header", "cookie", "path" or "query".
+	Source string
+	// Name is the header, cookie or query parameter name (or, for "ip", an
+	// optional header such as X-Forwarded-For holding the client address).
+	Name string
+}
+
+// ParseHashKey parses a key spec such as "ip", "header:X-User-Id",
+// "cookie:session", "path" or "query:tenant". An empty spec means "ip".
+func ParseHashKey(spec string) (HashKey, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return HashKey{Source: "ip"}, nil
+	}
+	source, name, _ := strings.Cut(spec, ":")
+	k := HashKey{Source: strings.ToLower(strings.TrimSpace(source)), Name: strings.TrimSpace(name)}
+	switch k.Source {
+	case "ip", "path":
+	case "header", "cookie", "query":
+		if k.Name == "" {
+			return HashKey{}, fmt.Errorf("hash key %q: %s requires a name", spec, k.Source)
+		}
+	default:
+		return HashKey{}, fmt.Errorf("hash key %q: unknown source %q", spec, k.Source)
+	}
+	return k, nil
+}
+
+// Extract returns the key for r, or "" when the request does not carry it.
+func (k HashKey) Extract(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	switch k.Source {
+	case "header":
+		return r.Header.Get(k.Name)
+	case "cookie":
+		if c, err := r.Cookie(k.Name); err == nil {
+			return c.Value
+		}
+		return ""
+	case "path":
+		if r.URL != nil {
+			return r.URL.Path
+		}
+		return ""
+	case "query":
+		if r.URL != nil {
+			return r.URL.Query().Get(k.Name)
+		}
+		return ""
+	default:
+		return clientKey(r, k.Name)
+	}
+}
+
+// poolHashKey resolves the key used by the hashing strategies of a pool:
+// HashKey when set, otherwise the client ip (read from IPHashHeader if set).
+func poolHashKey(p *ServerPool) HashKey {
+	if p.HashKey != "" {
+		k, err := ParseHashKey(p.HashKey)
+		if err == nil {
+			return k
+		}
+		log.Printf("Aviso: %v; usando ip", err)
+	}
+	return HashKey{Source: "ip", Name: p.IPHashHeader}
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv alone clusters on short, similar inputs; finish with a mixer so
+	// virtual node labels like "url#1", "url#2" spread over the ring
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashTable is a lookup structure built for a specific alive set. lookup
+// skips the backends in exclude by walking forward from the key's position,
+// so retries and hedges reuse the table of the whole set.
+type hashTable interface {
+	lookup(h uint64, exclude []*Backend) *Backend
+}
+
+// hashBalancer routes requests by the hash of a key using a table that is
+// rebuilt only when the alive set or the weights change. Requests without a
+// key fall back to round robin.
+type hashBalancer struct {
+	key   HashKey
+	build func(alive []*Backend) hashTable
+	rr    roundRobin
+
+	mu    sync.RWMutex
+	sig   []backendSig
+	table hashTable
+}
+
+type backendSig struct {
+	b      *Backend
+	weight int
+}
+
+func (h *hashBalancer) Next(alive []*Backend, r *http.Request) *Backend {
+	return h.nextExcluding(alive, nil, r)
+}
+
+// nextExcluding picks from alive minus exclude using the table built for
+// all of alive, which stays cached for the requests without exclusions.
+func (h *hashBalancer) nextExcluding(alive, exclude []*Backend, r *http.Request) *Backend {
+	rest := alive
+	if len(exclude) > 0 {
+		rest = make([]*Backend, 0, len(alive))
+		for _, be := range alive {
+			if !slices.Contains(exclude, be) {
+				rest = append(rest, be)
+			}
+		}
+		if len(rest) == 0 {
+			return nil
+		}
+	}
+	key := h.key.Extract(r)
+	if key == "" {
+		return h.rr.Next(rest, r)
+	}
+	table := h.tableFor(alive)
+	if table == nil {
+		return nil
+	}
+	return table.lookup(hash64(key), exclude)
+}
+
+func (h *hashBalancer) tableFor(alive []*Backend) hashTable {
+	h.mu.RLock()
+	same := len(h.sig) == len(alive)
+	for i := 0; same && i < len(alive); i++ {
+		same = h.sig[i].b == alive[i] && h.sig[i].weight == alive[i].Weight()
+	}
+	table := h.table
+	h.mu.RUnlock()
+	if same {
+		return table
+	}
+
+	sig := make([]backendSig, len(alive))
+	for i, be := range alive {
+		sig[i] = backendSig{b: be, weight: be.Weight()}
+	}
+	table = h.build(alive)
+	h.mu.Lock()
+	h.sig = sig
+	h.table = table
+	h.mu.Unlock()
+	return table
+}
+
+// ring is a ketama-style consistent hash ring: each backend owns
+// ringReplicas*weight points and a key maps to the first point clockwise.
+// Removing a backend only moves the keys it owned, spread over the others.
+type ring struct {
+	points []uint64
+	owners []*Backend
+}
+
+func buildRing(alive []*Backend) hashTable {
+	type point struct {
+		h uint64
+		b *Backend
+	}
+	var pts []point
+	for _, be := range alive {
+		n := ringReplicas * be.Weight()
+		id := be.URL.String()
+		for i := 0; i < n; i++ {
+			pts = append(pts, point{h: hash64(id + "#" + strconv.Itoa(i)), b: be})
+		}
+	}
+	if len(pts) == 0 {
+		return nil
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].h < pts[j].h })
+	rg := &ring{points: make([]uint64, len(pts)), owners: make([]*Backend, len(pts))}
+	for i, p := range pts {
+		rg.points[i] = p.h
+		rg.owners[i] = p.b
+	}
+	return rg
+}
+
+func (rg *ring) lookup(h uint64, exclude []*Backend) *Backend {
+	i := sort.Search(len(rg.points), func(i int) bool { return rg.points[i] >= h })
+	for n := range rg.owners {
+		if b := rg.owners[(i+n)%len(rg.owners)]; !slices.Contains(exclude, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// maglev is a Maglev lookup table (Eisenbud et al., 2016): backends take
+// turns claiming slots following their own permutation, which gives an even
+// spread and minimal disruption when the set changes. Heavier backends take
+// more turns per round.
+type maglev struct {
+	slots []*Backend
+}
+
+func buildMaglev(alive []*Backend) hashTable {
+	const m = maglevTableSize
+	type perm struct {
+		b            *Backend
+		offset, skip uint64
+		next         uint64
+		turns        int
+	}
+	perms := make([]*perm, 0, len(alive))
+	for _, be := range alive {
+		if be.Weight() <= 0 {
+			continue
+		}
+		id := be.URL.String()
+		perms = append(perms, &perm{
+			b:      be,
+			offset: hash64(id+"#offset") % m,
+			skip:   hash64(id+"#skip")%(m-1) + 1,
+			turns:  be.Weight(),
+		})
+	}
+	if len(perms) == 0 {
+		return nil
+	}
+	slots := make([]*Backend, m)
+	filled := 0
+	for filled < m {
+		for _, p := range perms {
+			for t := 0; t < p.turns && filled < m; t++ {
+				c := (p.offset + p.next*p.skip) % m
+				for slots[c] != nil {
+					p.next++
+					c = (p.offset + p.next*p.skip) % m
+				}
+				slots[c] = p.b
+				p.next++
+				filled++
+			}
+		}
+	}
+	return &maglev{slots: slots}
+}
+
+func (mg *maglev) lookup(h uint64, exclude []*Backend) *Backend {
+	i := int(h % uint64(len(mg.slots)))
+	for n := range mg.slots {
+		if b := mg.slots[(i+n)%len(mg.slots)]; !slices.Contains(exclude, b) {
+			return b
+		}
+	}
+	return nil
+}
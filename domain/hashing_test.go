@@ -0,0 +1,158 @@
+package domain
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newHashPool(algo string, n int) (*ServerPool, []*Backend) {
+	pool := &ServerPool{Algorithm: algo, HashKey: "header:X-User"}
+	out := make([]*Backend, 0, n)
+	for i := 0; i < n; i++ {
+		b := NewBackend(fmt.Sprintf("http://10.0.0.%d:8080", i+1), 0, 1)
+		pool.AddBackend(b)
+		out = append(out, b)
+	}
+	return pool, out
+}
+
+func userRequest(id int) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", fmt.Sprintf("user-%d", id))
+	return r
+}
+
+func TestConsistentHash_MinimalRemapOnDeadBackend(t *testing.T) {
+	for _, algo := range []string{"ring_hash", "maglev"} {
+		t.Run(algo, func(t *testing.T) {
+			pool, backends := newHashPool(algo, 5)
+			const keys = 2000
+			before := make([]*Backend, keys)
+			for i := 0; i < keys; i++ {
+				before[i] = pool.GetNextPeer(userRequest(i))
+			}
+
+			dead := backends[2]
+			dead.SetAlive(false)
+			moved := 0
+			for i := 0; i < keys; i++ {
+				after := pool.GetNextPeer(userRequest(i))
+				if after == dead {
+					t.Fatalf("key %d routed to dead backend", i)
+				}
+				if before[i] != dead && after != before[i] {
+					moved++
+				}
+			}
+			// only keys owned by the dead backend may move; allow a little
+			// slack for maglev, which is not perfectly stable
+			if moved > keys/50 {
+				t.Fatalf("%d keys not owned by the dead backend were remapped", moved)
+			}
+		})
+	}
+}
+
+func TestConsistentHash_Spread(t *testing.T) {
+	for _, algo := range []string{"ring_hash", "maglev"} {
+		t.Run(algo, func(t *testing.T) {
+			pool, backends := newHashPool(algo, 4)
+			counts := map[*Backend]int{}
+			for i := 0; i < 8000; i++ {
+				counts[pool.GetNextPeer(userRequest(i))]++
+			}
+			for _, b := range backends {
+				// ideal is 2000 each
+				if counts[b] < 1400 || counts[b] > 2600 {
+					t.Fatalf("uneven spread for %s: %v", b.URL, counts[b])
+				}
+			}
+		})
+	}
+}
+
+func TestHashKey_Extract(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users/42?tenant=acme", nil)
+	r.RemoteAddr = "203.0.113.5:54321"
+	r.Header.Set("X-User", "u1")
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	r.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+
+	cases := map[string]string{
+		"":                     "203.0.113.5",
+		"ip":                   "203.0.113.5",
+		"ip:X-Forwarded-For":   "198.51.100.7",
+		"header:X-User":        "u1",
+		"cookie:sid":           "abc",
+		"path":                 "/users/42",
+		"query:tenant":         "acme",
+		"query:missing":        "",
+		"cookie:not-there-too": "",
+	}
+	for spec, want := range cases {
+		k, err := ParseHashKey(spec)
+		if err != nil {
+			t.Fatalf("ParseHashKey(%q): %v", spec, err)
+		}
+		if got := k.Extract(r); got != want {
+			t.Errorf("%q: expected %q, got %q", spec, want, got)
+		}
+	}
+
+	for _, bad := range []string{"header", "cookie:", "body:x"} {
+		if _, err := ParseHashKey(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestConsistentHash_MissingKeyFallsBack(t *testing.T) {
+	pool, _ := newHashPool("ring_hash", 3)
+	if pool.GetNextPeer(httptest.NewRequest("GET", "/", nil)) == nil {
+		t.Fatal("expected round robin fallback when the key is missing")
+	}
+}
+
+func TestConsistentHash_ExcludeReusesTable(t *testing.T) {
+	for name, build := range map[string]func([]*Backend) hashTable{"ring_hash": buildRing, "maglev": buildMaglev} {
+		t.Run(name, func(t *testing.T) {
+			builds := 0
+			h := &hashBalancer{key: HashKey{Source: "header", Name: "X-User"}, build: func(alive []*Backend) hashTable {
+				builds++
+				return build(alive)
+			}}
+			_, alive := newHashPool(name, 4)
+			for i := 0; i < 200; i++ {
+				r := userRequest(i)
+				first := h.Next(alive, r)
+				next := h.nextExcluding(alive, []*Backend{first}, r)
+				if next == nil || next == first {
+					t.Fatalf("expected another backend than %s, got %v", first.URL, next)
+				}
+				if h.Next(alive, r) != first {
+					t.Fatal("expected the same backend for the same key")
+				}
+			}
+			if builds != 1 {
+				t.Fatalf("expected the table to be built once, got %d builds", builds)
+			}
+			if h.nextExcluding(alive, alive, userRequest(1)) != nil {
+				t.Fatal("expected nil when every backend is excluded")
+			}
+		})
+	}
+}
+
+func TestRing_ExcludeMatchesRebuiltRing(t *testing.T) {
+	_, alive := newHashPool("ring_hash", 5)
+	full := buildRing(alive)
+	without := buildRing(append(append([]*Backend{}, alive[:2]...), alive[3:]...))
+	for i := 0; i < 2000; i++ {
+		h := hash64(fmt.Sprintf("user-%d", i))
+		if full.lookup(h, alive[2:3]) != without.lookup(h, nil) {
+			t.Fatalf("key %d: skipping a backend should match the ring without it", i)
+		}
+	}
+}
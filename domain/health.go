@@ -0,0 +1,278 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Health check defaults, used when a setting is left empty.
+const (
+	DefaultHealthInterval = 20 * time.Second
+	DefaultHealthTimeout  = 2 * time.Second
+)
+
+// maxHealthBody bounds how much of a health check response is read for body
+// matching.
+const maxHealthBody = 64 << 10
+
+// HealthCheckConfig configures active health checks. Zero fields use the
+// defaults: a GET on the backend root expecting a 2xx or 3xx status, with
+// DefaultHealthTimeout and DefaultHealthInterval, and a single result
+// enough to change the backend status.
+type HealthCheckConfig struct {
+	// Path is requested relative to the backend URL (ex: "/health").
+	Path string
+	// Method defaults to GET.
+	Method string
+	// Headers are added to the request; "Host" overrides the request host.
+	Headers map[string]string
+	// ExpectedStatus is the set of healthy status codes (default 200-399).
+	ExpectedStatus StatusSet
+	// BodyContains, when set, must appear in the response body.
+	BodyContains string
+	// BodyRegex, when set, must match the response body.
+	BodyRegex *regexp.Regexp
+	// Interval between checks; only used at pool level.
+	Interval time.Duration
+	// Jitter adds a random delay in [0, Jitter) to every interval so checks
+	// of many pools do not line up; only used at pool level.
+	Jitter time.Duration
+	// Timeout of each check.
+	Timeout time.Duration
+	// Rise is the number of consecutive successes that bring a down backend
+	// up, and Fall the number of consecutive failures that take an up
+	// backend down (both default to 1). The first check of a backend sets
+	// its status directly, so one that is down at startup gets no traffic.
+	Rise int
+	Fall int
+}
+
+// merge returns c with its empty fields taken from base.
+func (c HealthCheckConfig) merge(base *HealthCheckConfig) HealthCheckConfig {
+	if base == nil {
+		return c
+	}
+	if c.Path == "" {
+		c.Path = base.Path
+	}
+	if c.Method == "" {
+		c.Method = base.Method
+	}
+	if c.Headers == nil {
+		c.Headers = base.Headers
+	}
+	if c.ExpectedStatus == nil {
+		c.ExpectedStatus = base.ExpectedStatus
+	}
+	if c.BodyContains == "" {
+		c.BodyContains = base.BodyContains
+	}
+	if c.BodyRegex == nil {
+		c.BodyRegex = base.BodyRegex
+	}
+	if c.Interval == 0 {
+		c.Interval = base.Interval
+	}
+	if c.Jitter == 0 {
+		c.Jitter = base.Jitter
+	}
+	if c.Timeout == 0 {
+		c.Timeout = base.Timeout
+	}
+	if c.Rise == 0 {
+		c.Rise = base.Rise
+	}
+	if c.Fall == 0 {
+		c.Fall = base.Fall
+	}
+	return c
+}
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min, Max int
+}
+
+// StatusSet is a set of HTTP status codes; the empty set means 200-399.
+type StatusSet []StatusRange
+
+// ParseStatusSet parses a comma separated list of codes ("200"), ranges
+// ("200-299") and classes ("2xx").
+func ParseStatusSet(s string) (StatusSet, error) {
+	var out StatusSet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		var r StatusRange
+		var err1, err2 error
+		switch {
+		case len(part) == 3 && strings.HasSuffix(part, "xx"):
+			var class int
+			class, err1 = strconv.Atoi(part[:1])
+			r = StatusRange{class * 100, class*100 + 99}
+		case strings.Contains(part, "-"):
+			lo, hi, _ := strings.Cut(part, "-")
+			r.Min, err1 = strconv.Atoi(strings.TrimSpace(lo))
+			r.Max, err2 = strconv.Atoi(strings.TrimSpace(hi))
+		default:
+			r.Min, err1 = strconv.Atoi(part)
+			r.Max = r.Min
+		}
+		if err1 != nil || err2 != nil || r.Min < 100 || r.Max > 599 || r.Min > r.Max {
+			return nil, fmt.Errorf("status inválido %q (use 200, 200-299 ou 2xx)", part)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Contains reports whether code belongs to the set.
+func (ss StatusSet) Contains(code int) bool {
+	if len(ss) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, r := range ss {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// healthConfig resolves the backend's settings over the pool's ones.
+func (b *Backend) healthConfig(pool *HealthCheckConfig) HealthCheckConfig {
+	var c HealthCheckConfig
+	b.Mux.RLock()
+	if b.Health != nil {
+		c = *b.Health
+	}
+	b.Mux.RUnlock()
+	c = c.merge(pool)
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultHealthTimeout
+	}
+	if c.Method == "" {
+		c.Method = http.MethodGet
+	}
+	return c
+}
+
+// healthURL returns the URL probed by the health check.
+func (b *Backend) healthURL(path string) string {
+	if path == "" {
+		return b.URL.String()
+	}
+	u := *b.URL
+	p, q, _ := strings.Cut(path, "?")
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(p, "/")
+	u.RawPath = ""
+	u.RawQuery = q
+	u.Fragment = ""
+	return u.String()
+}
+
+// probe runs one health check with c. When it fails, reason says why
+// (timeout, connection refused, unexpected status...).
+func (b *Backend) probe(c HealthCheckConfig) (ok bool, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, c.Method, b.healthURL(c.Path), nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	for k, v := range c.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	resp, err := b.healthClient().Do(req)
+	if err != nil {
+		return false, probeError(err)
+	}
+	defer resp.Body.Close()
+	if !c.ExpectedStatus.Contains(resp.StatusCode) {
+		return false, fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	if c.BodyContains == "" && c.BodyRegex == nil {
+		return true, ""
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return false, probeError(err)
+	}
+	if c.BodyContains != "" && !strings.Contains(string(body), c.BodyContains) {
+		return false, "corpo não confere"
+	}
+	if c.BodyRegex != nil && !c.BodyRegex.Match(body) {
+		return false, "corpo não confere"
+	}
+	return true, ""
+}
+
+// probeError describes why a health check request failed.
+func probeError(err error) string {
+	var op *net.OpError
+	switch {
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "conexão recusada"
+	case errors.As(err, &op):
+		return op.Err.Error()
+	}
+	return err.Error()
+}
+
+// recordCheck applies one check result to the backend status: it goes down
+// after fall consecutive failures and back up after rise consecutive
+// successes. The first result of a backend whose status was never checked
+// or set applies right away. It returns the resulting status.
+func (b *Backend) recordCheck(ok bool, rise, fall int) bool {
+	b.Mux.Lock()
+	defer b.Mux.Unlock()
+	if !b.checked {
+		b.checked = true
+		b.Alive = ok
+	}
+	if ok {
+		b.checkFails = 0
+		b.checkOKs++
+		if !b.Alive && b.checkOKs >= max(rise, 1) {
+			b.Alive = true
+		}
+	} else {
+		b.checkOKs = 0
+		b.checkFails++
+		if b.Alive && b.checkFails >= max(fall, 1) {
+			b.Alive = false
+		}
+	}
+	return b.Alive
+}
+
+// healthInterval returns the pool's delay until the next check, including
+// jitter.
+func (s *ServerPool) healthInterval() time.Duration {
+	d := DefaultHealthInterval
+	if s.Health != nil && s.Health.Interval > 0 {
+		d = s.Health.Interval
+	}
+	if s.Health != nil && s.Health.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.Health.Jitter)))
+	}
+	return d
+}
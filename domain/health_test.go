@@ -0,0 +1,260 @@
+package domain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func TestHealthCheck_PathAndOverride(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health", "/api/ready":
+			w.WriteHeader(200)
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	pool := &ServerPool{Health: &HealthCheckConfig{Path: "/health", Interval: time.Second}}
+	b1 := NewBackend(server.URL, 0, 1)
+	b2 := NewBackend(server.URL+"/api", 0, 1)
+	b2.Health = &HealthCheckConfig{Path: "ready"}
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	// the backend root answers 500, only the configured paths are healthy
+	if b1.CheckHealth() {
+		t.Fatal("expected root check without pool settings to fail")
+	}
+	pool.HealthCheck()
+	if !b1.IsAlive() {
+		t.Fatal("expected pool health path to be used")
+	}
+	if !b2.IsAlive() {
+		t.Fatal("expected backend override path to be used")
+	}
+	if pool.healthInterval() != time.Second {
+		t.Fatalf("unexpected interval %v", pool.healthInterval())
+	}
+}
+
+func TestHealthCheck_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	b := NewBackend(server.URL, 0, 1)
+	b.Health = &HealthCheckConfig{Timeout: 20 * time.Millisecond}
+	if b.CheckHealth() {
+		t.Fatal("expected slow backend to fail the health check timeout")
+	}
+}
+
+func TestHealthCheck_MethodHeadersStatusAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead && r.Method != http.MethodPost {
+			w.WriteHeader(405)
+			return
+		}
+		if r.Host != "svc.internal" || r.Header.Get("X-Check") != "1" {
+			w.WriteHeader(400)
+			return
+		}
+		w.WriteHeader(202)
+		_, _ = w.Write([]byte(`{"status":"ok","version":"1.2"}`))
+	}))
+	defer server.Close()
+
+	b := NewBackend(server.URL, 0, 1)
+	headers := map[string]string{"Host": "svc.internal", "X-Check": "1"}
+	cases := []struct {
+		name string
+		c    HealthCheckConfig
+		want bool
+	}{
+		{"default GET is rejected", HealthCheckConfig{Headers: headers}, false},
+		{"method and headers", HealthCheckConfig{Method: "HEAD", Headers: headers}, true},
+		{"missing header", HealthCheckConfig{Method: "HEAD"}, false},
+		{"unexpected status", HealthCheckConfig{Method: "HEAD", Headers: headers, ExpectedStatus: StatusSet{{200, 200}}}, false},
+		{"expected status", HealthCheckConfig{Method: "HEAD", Headers: headers, ExpectedStatus: StatusSet{{202, 202}}}, true},
+		{"body contains", HealthCheckConfig{Method: "POST", Headers: headers, BodyContains: `"status":"ok"`}, true},
+		{"body missing", HealthCheckConfig{Method: "POST", Headers: headers, BodyContains: "degraded"}, false},
+		{"body regex", HealthCheckConfig{Method: "POST", Headers: headers, BodyRegex: regexp.MustCompile(`"version":"1\.\d+"`)}, true},
+		{"body regex mismatch", HealthCheckConfig{Method: "POST", Headers: headers, BodyRegex: regexp.MustCompile(`"version":"2`)}, false},
+	}
+	for _, tc := range cases {
+		b.Health = &tc.c
+		if got := b.CheckHealth(); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHealthCheck_RiseFall(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	pool := &ServerPool{Health: &HealthCheckConfig{Rise: 2, Fall: 3}}
+	b := NewBackend(server.URL, 0, 1)
+	pool.AddBackend(b)
+	pool.HealthCheck()
+
+	healthy = false
+	for i := 1; i <= 3; i++ {
+		pool.HealthCheck()
+		if want := i < 3; b.IsAlive() != want {
+			t.Fatalf("after %d failures alive=%v, want %v", i, b.IsAlive(), want)
+		}
+	}
+
+	healthy = true
+	pool.HealthCheck()
+	if b.IsAlive() {
+		t.Fatal("a single success should not bring the backend back with rise=2")
+	}
+	pool.HealthCheck()
+	if !b.IsAlive() {
+		t.Fatal("expected backend up after 2 successes")
+	}
+
+	// a blip shorter than fall does not eject the backend
+	healthy = false
+	pool.HealthCheck()
+	healthy = true
+	pool.HealthCheck()
+	healthy = false
+	pool.HealthCheck()
+	pool.HealthCheck()
+	if !b.IsAlive() {
+		t.Fatal("non-consecutive failures should not reach the fall threshold")
+	}
+}
+
+func TestHealthCheck_FirstCheckSetsStatus(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	pool := &ServerPool{Health: &HealthCheckConfig{Rise: 3, Fall: 3}}
+	dead, alive := NewBackend(down.URL, 0, 1), NewBackend(up.URL, 0, 1)
+	pool.AddBackend(dead)
+	pool.AddBackend(alive)
+	if dead.Checked() {
+		t.Fatal("expected a new backend to be unchecked")
+	}
+	pool.HealthCheck()
+	if dead.IsAlive() || !dead.Checked() {
+		t.Fatal("expected a backend down from the start to be ejected by the first check despite fall=3")
+	}
+	if !alive.IsAlive() {
+		t.Fatal("expected a healthy backend to stay up")
+	}
+	for i := 0; i < 5; i++ {
+		if code := serveOnce(pool); code != http.StatusOK {
+			t.Fatalf("expected traffic to reach only the healthy backend, got %d", code)
+		}
+	}
+
+	// a status set explicitly (e.g. restored on upgrade) keeps the thresholds
+	restored := NewBackend(down.URL, 0, 1)
+	restored.SetAlive(true)
+	pool.CheckBackend(restored)
+	if !restored.IsAlive() {
+		t.Fatal("expected a single failure not to reach fall=3 after SetAlive")
+	}
+}
+
+func TestParseStatusSet(t *testing.T) {
+	ss, err := ParseStatusSet("200-299, 304,4xx")
+	if err != nil {
+		t.Fatalf("ParseStatusSet: %v", err)
+	}
+	for code, want := range map[int]bool{200: true, 250: true, 301: false, 304: true, 404: true, 500: false} {
+		if ss.Contains(code) != want {
+			t.Errorf("Contains(%d) = %v, want %v", code, !want, want)
+		}
+	}
+	if !StatusSet(nil).Contains(302) || StatusSet(nil).Contains(404) {
+		t.Error("empty set should mean 200-399")
+	}
+	for _, bad := range []string{"abc", "300-200", "99", "6xx", "200-"} {
+		if _, err := ParseStatusSet(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestHealthInterval_Jitter(t *testing.T) {
+	pool := &ServerPool{Health: &HealthCheckConfig{Interval: time.Second, Jitter: 100 * time.Millisecond}}
+	for i := 0; i < 20; i++ {
+		if d := pool.healthInterval(); d < time.Second || d >= 1100*time.Millisecond {
+			t.Fatalf("interval %v outside [1s, 1.1s)", d)
+		}
+	}
+}
+
+func TestStartHealthCheck_StopsOnContext(t *testing.T) {
+	pool := &ServerPool{Health: &HealthCheckConfig{Interval: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pool.StartHealthCheck(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("StartHealthCheck did not return after the context was cancelled")
+	}
+}
+
+func TestHealthCheck_RecordsStats(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	pool := &ServerPool{Name: "healthstats"}
+	b := NewBackend(server.URL, 0, 1)
+	pool.AddBackend(b)
+	key := stats.Key(pool.Name, server.URL)
+
+	pool.HealthCheck()
+	healthy = false
+	pool.HealthCheck()
+	h := stats.SnapshotAll()[key].Health
+	if h == nil || h.Up || h.LastCheckOK || h.LastCheckError != "status 503" {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	if n := len(h.Transitions); n != 2 || !h.Transitions[0].Up || h.Transitions[1].Up || h.Transitions[1].Reason != "status 503" {
+		t.Fatalf("unexpected transitions %+v", h.Transitions)
+	}
+
+	// an unchanged status adds no transition; a refused connection says so
+	server.Close()
+	pool.HealthCheck()
+	h = stats.SnapshotHealth()[key].HealthStatus
+	if len(h.Transitions) != 2 || h.LastCheckError != "conexão recusada" {
+		t.Fatalf("unexpected health after the backend went away %+v", h)
+	}
+}
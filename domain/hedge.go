@@ -0,0 +1,288 @@
+package domain
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+// Hedging defaults, used when a setting is left empty.
+const (
+	DefaultHedgePercentile   = 95
+	DefaultHedgeBudgetPct    = 10
+	DefaultHedgeBudgetWindow = 10 * time.Second
+)
+
+// hedgeMethods are hedged when HedgePolicy.Methods is empty.
+var hedgeMethods = []string{"GET", "HEAD"}
+
+// HedgePolicy enables hedged requests on a route: when the backend chosen
+// for a request has not answered within the hedging delay, the request is
+// also sent to another backend of the pool. The first response wins and the
+// other attempt is cancelled. Only requests without a body are hedged, and
+// pools with sticky sessions are never hedged.
+type HedgePolicy struct {
+	// Delay is a fixed hedging delay; zero uses the Percentile of the
+	// latencies recently observed by the pool, and no request is hedged
+	// until the pool has seen enough of them.
+	Delay      time.Duration
+	Percentile float64
+	// Methods lists the hedged methods; empty means GET and HEAD.
+	Methods []string
+	// BudgetPct caps the hedged requests at this percentage of the route's
+	// requests over BudgetWindow.
+	BudgetPct    float64
+	BudgetWindow time.Duration
+}
+
+func (h *HedgePolicy) percentile() float64 {
+	if h.Percentile > 0 {
+		return h.Percentile
+	}
+	return DefaultHedgePercentile
+}
+
+func (h *HedgePolicy) budgetPct() float64 {
+	if h.BudgetPct > 0 {
+		return h.BudgetPct
+	}
+	return DefaultHedgeBudgetPct
+}
+
+func (h *HedgePolicy) budgetWindow() time.Duration {
+	if h.BudgetWindow > 0 {
+		return h.BudgetWindow
+	}
+	return DefaultHedgeBudgetWindow
+}
+
+func (h *HedgePolicy) allowsMethod(method string) bool {
+	methods := h.Methods
+	if len(methods) == 0 {
+		methods = hedgeMethods
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the hedging delay for pool s, or 0 when it is not known yet.
+func (h *HedgePolicy) delay(s *ServerPool, now time.Time) time.Duration {
+	if h.Delay > 0 {
+		return h.Delay
+	}
+	return s.latency.quantile(h.percentile()/100, now)
+}
+
+// latencySamples is the number of recent request latencies a pool keeps;
+// minLatencySamples are needed before they are used as hedging delay.
+const (
+	latencySamples    = 256
+	minLatencySamples = 20
+)
+
+// latencyRing keeps the latest request latencies of a pool.
+type latencyRing struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	n, next int
+	// last computed quantile, reused for a second
+	q        float64
+	value    time.Duration
+	computed time.Time
+}
+
+// copyFrom replaces the samples of l with those of prev.
+func (l *latencyRing) copyFrom(prev *latencyRing) {
+	prev.mu.Lock()
+	samples, n, next := prev.samples, prev.n, prev.next
+	prev.mu.Unlock()
+	l.mu.Lock()
+	l.samples, l.n, l.next = samples, n, next
+	l.computed = time.Time{}
+	l.mu.Unlock()
+}
+
+func (l *latencyRing) add(d time.Duration) {
+	l.mu.Lock()
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+	if l.n < latencySamples {
+		l.n++
+	}
+	l.mu.Unlock()
+}
+
+// quantile returns the q-quantile (0-1) of the recent latencies, or 0 while
+// there are fewer than minLatencySamples of them.
+func (l *latencyRing) quantile(q float64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n < minLatencySamples {
+		return 0
+	}
+	if q == l.q && now.Sub(l.computed) < time.Second {
+		return l.value
+	}
+	sorted := make([]time.Duration, l.n)
+	copy(sorted, l.samples[:l.n])
+	slices.Sort(sorted)
+	i := min(max(int(math.Ceil(q*float64(l.n)))-1, 0), l.n-1)
+	l.q, l.value, l.computed = q, sorted[i], now
+	return l.value
+}
+
+// hedgeState follows the attempts of one hedged request.
+type hedgeState struct {
+	mu       sync.Mutex
+	attempts []*hedgeAttempt
+	winner   *hedgeAttempt
+	// pending counts the attempts that may still answer
+	pending int
+}
+
+type hedgeAttempt struct {
+	state   *hedgeState
+	peer    *Backend
+	rec     *statusRecorder
+	cancel  context.CancelFunc
+	settled bool
+}
+
+// claim is called when the attempt is about to answer and reports whether
+// its response goes to the client. Transport errors give way to another
+// attempt still running; the first other answer wins and cancels the rest.
+func (a *hedgeAttempt) claim() bool {
+	hs := a.state
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.winner != nil {
+		a.rec.lost = true
+		return false
+	}
+	if a.rec.gatewayErr && hs.pending > 1 {
+		a.settled = true
+		hs.pending--
+		return false
+	}
+	hs.winner = a
+	for _, o := range hs.attempts {
+		if o != a {
+			o.cancel()
+		}
+	}
+	return true
+}
+
+func (hs *hedgeState) settle(a *hedgeAttempt) {
+	hs.mu.Lock()
+	if !a.settled {
+		a.settled = true
+		hs.pending--
+	}
+	hs.mu.Unlock()
+}
+
+func (hs *hedgeState) decided() bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.winner != nil
+}
+
+// launch starts an attempt of r on peer, signalling done when it is over.
+func (hs *hedgeState) launch(s *ServerPool, w http.ResponseWriter, r *http.Request, peer *Backend, trial bool, done chan<- struct{}) {
+	ctx, cancel := context.WithCancel(r.Context())
+	a := &hedgeAttempt{state: hs, peer: peer, cancel: cancel}
+	a.rec = &statusRecorder{ResponseWriter: w, header: http.Header{}, hedge: a}
+	hs.mu.Lock()
+	hs.attempts = append(hs.attempts, a)
+	hs.pending++
+	hs.mu.Unlock()
+	go func() {
+		s.forward(a.rec, r.WithContext(ctx), peer, trial)
+		hs.settle(a)
+		done <- struct{}{}
+	}()
+}
+
+// serveHedged serves r like ServeHTTP, sending it to a second backend when
+// the first has not answered within the hedging delay of h and the budget
+// b allows it. Requests h does not apply to are served by ServeHTTP.
+func (s *ServerPool) serveHedged(w http.ResponseWriter, r *http.Request, h *HedgePolicy, b *budget) {
+	now := time.Now()
+	delay := h.delay(s, now)
+	if delay <= 0 || s.Sticky != nil || !h.allowsMethod(r.Method) || (r.Body != nil && r.Body != http.NoBody) {
+		s.ServeHTTP(w, r)
+		return
+	}
+	b.request(h.budgetWindow(), now)
+	peer, trial, _ := s.pick(w, r)
+	if peer == nil {
+		return
+	}
+
+	hs := &hedgeState{}
+	done := make(chan struct{}, 2)
+	hs.launch(s, w, r, peer, trial, done)
+	running := 1
+	timer := time.NewTimer(delay)
+	select {
+	case <-done:
+		running--
+	case <-timer.C:
+		if second, trial, ok := s.hedgePeer(r, peer, h, b, hs); ok {
+			stats.RecordHedge(s.Name, second.URL.String())
+			hs.launch(s, w, r, second, trial, done)
+			running++
+		}
+	}
+	timer.Stop()
+	for ; running > 0; running-- {
+		<-done
+	}
+	for _, a := range hs.attempts {
+		a.cancel()
+	}
+	if win := hs.winner; win != nil && win != hs.attempts[0] {
+		stats.RecordHedgeWin(s.Name, win.peer.URL.String())
+	}
+}
+
+// hedgePeer picks the backend for the hedged attempt of a request first sent
+// to first, taking it from the budget once the backend's rate limiter and
+// circuit let it through.
+func (s *ServerPool) hedgePeer(r *http.Request, first *Backend, h *HedgePolicy, b *budget, hs *hedgeState) (*Backend, bool, bool) {
+	if hs.decided() {
+		return nil, false, false
+	}
+	peer := s.nextPeer(r, []*Backend{first})
+	if peer == nil {
+		return nil, false, false
+	}
+	// as for retries, the budget is spent only once the peer admits the request
+	now := time.Now()
+	undo, ok := peer.reserveToken(now)
+	if !ok {
+		return nil, false, false
+	}
+	ok, trial := s.acquire(peer, now)
+	if !ok {
+		undo()
+		return nil, false, false
+	}
+	if !b.allow(h.budgetWindow(), h.budgetPct(), 0, now) {
+		undo()
+		s.release(peer, trial)
+		return nil, false, false
+	}
+	return peer, trial, true
+}
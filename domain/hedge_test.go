@@ -0,0 +1,184 @@
+package domain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func TestHedge_FirstAnswerWins(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	pool := &ServerPool{Name: "hedge-win", Balancer: BalancerFunc(func(backends []*Backend, r *http.Request) *Backend { return backends[0] })}
+	pool.AddBackend(NewBackend(slow.URL, 0, 1))
+	pool.AddBackend(NewBackend(fast.URL, 0, 1))
+	rt := &Router{}
+	if err := rt.AddRoute(&Route{PathPrefix: "/", Pool: pool, Hedge: &HedgePolicy{Delay: 20 * time.Millisecond, BudgetPct: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	rt.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "fast" {
+		t.Fatalf("expected the hedged backend to answer, got %d %q", rr.Code, rr.Body.String())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("hedged request took %v", d)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow attempt was not cancelled")
+	}
+	snap := stats.SnapshotAll()[stats.Key("hedge-win", fast.URL)]
+	if snap.Hedges == 0 || snap.HedgeWins == 0 {
+		t.Fatalf("hedge not recorded in stats: %+v", snap)
+	}
+}
+
+func TestHedge_OnlyOptedInRoutes(t *testing.T) {
+	hits := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- r.URL.Path
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{}
+	pool.AddBackend(NewBackend(srv.URL+"/a", 0, 1))
+	pool.AddBackend(NewBackend(srv.URL+"/b", 0, 1))
+	rt := &Router{}
+	rt.AddRoute(&Route{PathPrefix: "/hedged", Pool: pool, Hedge: &HedgePolicy{Delay: 10 * time.Millisecond, BudgetPct: 100}})
+	rt.AddRoute(&Route{PathPrefix: "/", Pool: pool})
+
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/plain", nil))
+	if len(hits) != 1 {
+		t.Fatalf("expected a single attempt without opt-in, got %d", len(hits))
+	}
+	<-hits
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hedged", nil))
+	if len(hits) != 1 {
+		t.Fatalf("expected POST not to be hedged, got %d attempts", len(hits))
+	}
+	<-hits
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hedged", nil))
+	time.Sleep(20 * time.Millisecond)
+	if len(hits) != 2 {
+		t.Fatalf("expected a hedged attempt, got %d attempts", len(hits))
+	}
+}
+
+func TestHedge_Budget(t *testing.T) {
+	pool := &ServerPool{}
+	h := &HedgePolicy{BudgetPct: 50}
+	var b budget
+	now := time.Now()
+	b.request(h.budgetWindow(), now)
+	if b.allow(h.budgetWindow(), h.budgetPct(), 0, now) {
+		t.Fatal("50% of one request should not allow a hedge")
+	}
+	b.request(h.budgetWindow(), now)
+	if !b.allow(h.budgetWindow(), h.budgetPct(), 0, now) {
+		t.Fatal("50% of two requests should allow one hedge")
+	}
+	if b.allow(h.budgetWindow(), h.budgetPct(), 0, now) {
+		t.Fatal("budget should be spent")
+	}
+
+	// without a fixed delay, nothing is hedged until the pool has latencies
+	if d := h.delay(pool, now); d != 0 {
+		t.Fatalf("expected no delay without samples, got %v", d)
+	}
+	for i := 1; i <= 100; i++ {
+		pool.latency.add(time.Duration(i) * time.Millisecond)
+	}
+	if d := h.delay(pool, now); d != 95*time.Millisecond {
+		t.Fatalf("expected p95 of 95ms, got %v", d)
+	}
+}
+
+func TestInheritState(t *testing.T) {
+	now := time.Now()
+	prev := &ServerPool{Name: "api", Retry: &RetryPolicy{}}
+	for i := 1; i <= 100; i++ {
+		prev.latency.add(time.Duration(i) * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		prev.retries.request(prev.Retry.budgetWindow(), now)
+	}
+
+	h := &HedgePolicy{}
+	next := &ServerPool{Name: "api", Retry: &RetryPolicy{Attempts: 3}}
+	next.InheritState(prev)
+	if d := h.delay(next, now); d != 95*time.Millisecond {
+		t.Fatalf("expected the latencies of the previous pool, got %v", d)
+	}
+	if !next.retries.allow(next.Retry.budgetWindow(), 20, 0, now) {
+		t.Fatal("expected the requests counted by the previous pool to fund a retry")
+	}
+	// counts of another window length do not carry over
+	other := &ServerPool{Name: "api", Retry: &RetryPolicy{BudgetWindow: time.Minute}}
+	other.InheritState(prev)
+	if other.retries.allow(time.Minute, 20, 0, now) {
+		t.Fatal("expected the retry budget to start over with a new window")
+	}
+
+	oldRoute := &Route{Hedge: &HedgePolicy{}}
+	for i := 0; i < 10; i++ {
+		oldRoute.hedges.request(h.budgetWindow(), now)
+	}
+	route := &Route{Hedge: &HedgePolicy{Percentile: 99}}
+	route.InheritState(oldRoute)
+	if !route.hedges.allow(h.budgetWindow(), h.budgetPct(), 0, now) {
+		t.Fatal("expected the hedge budget of the previous route")
+	}
+}
+
+func TestHedge_RefusedHedgeKeepsBudget(t *testing.T) {
+	pool := &ServerPool{Name: "hedge-refused"}
+	first := NewBackend("http://127.0.0.1:1/a", 0, 1)
+	second := NewBackend("http://127.0.0.1:1/b", 1, 1)
+	pool.AddBackend(first)
+	pool.AddBackend(second)
+	h := &HedgePolicy{BudgetPct: 10}
+	var b budget
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		b.request(h.budgetWindow(), now)
+	}
+
+	second.RateLimiter().Allow()
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, _, ok := pool.hedgePeer(r, first, h, &b, &hedgeState{}); ok {
+		t.Fatal("expected the rate limiter to refuse the hedge")
+	}
+	if !b.allow(h.budgetWindow(), h.budgetPct(), 0, now) {
+		t.Fatal("a hedge refused by the rate limiter spent the budget")
+	}
+
+	// the budget is now spent: the peer keeps its token
+	second.SetRateLimit(0, 0)
+	second.SetRateLimit(1, 1)
+	if _, _, ok := pool.hedgePeer(r, first, h, &b, &hedgeState{}); ok {
+		t.Fatal("expected the budget to refuse the hedge")
+	}
+	if !second.RateLimiter().Allow() {
+		t.Fatal("a hedge refused by the budget took a rate limit token")
+	}
+}
@@ -0,0 +1,225 @@
+package domain
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+// Outlier detection defaults, used when a setting is left empty.
+const (
+	DefaultOutlierWindow      = 30 * time.Second
+	DefaultOutlierMinRequests = 10
+	DefaultBaseEjectionTime   = 30 * time.Second
+	DefaultMaxEjectionTime    = 5 * time.Minute
+	DefaultMaxEjectionPercent = 50
+)
+
+// OutlierDetection configures passive health checking: backends are ejected
+// from the pool based on the results of the requests they serve, without
+// waiting for the next active health check. An ejected backend gets no
+// traffic for BaseEjectionTime, doubled on every new ejection up to
+// MaxEjectionTime, and then returns automatically. Zero thresholds disable
+// the corresponding detector.
+type OutlierDetection struct {
+	// Consecutive5xx ejects after this many 5xx responses in a row
+	// (transport errors included).
+	Consecutive5xx int
+	// ConsecutiveGatewayErrors ejects after this many transport errors in a
+	// row (connection refused or reset, upstream timeouts).
+	ConsecutiveGatewayErrors int
+	// FailureRatePct ejects when the percentage of 5xx and transport errors
+	// over Window reaches this value, once MinRequests were seen.
+	FailureRatePct float64
+	MinRequests    int
+	Window         time.Duration
+	// BaseEjectionTime and MaxEjectionTime bound the ejection duration.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent is the largest share of the pool that may be
+	// ejected at once; at least one backend can always be ejected.
+	MaxEjectionPercent int
+}
+
+func (o *OutlierDetection) window() time.Duration {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return DefaultOutlierWindow
+}
+
+func (o *OutlierDetection) minRequests() int {
+	if o.MinRequests > 0 {
+		return o.MinRequests
+	}
+	return DefaultOutlierMinRequests
+}
+
+func (o *OutlierDetection) baseEjection() time.Duration {
+	if o.BaseEjectionTime > 0 {
+		return o.BaseEjectionTime
+	}
+	return DefaultBaseEjectionTime
+}
+
+func (o *OutlierDetection) maxEjection() time.Duration {
+	if o.MaxEjectionTime > 0 {
+		return o.MaxEjectionTime
+	}
+	return DefaultMaxEjectionTime
+}
+
+func (o *OutlierDetection) maxEjectionPercent() int {
+	if o.MaxEjectionPercent > 0 {
+		return o.MaxEjectionPercent
+	}
+	return DefaultMaxEjectionPercent
+}
+
+// outlierState is the per-backend passive health state.
+type outlierState struct {
+	mu         sync.Mutex
+	consec5xx  int
+	consecErrs int
+	// window feeds the failure rate detector
+	window rollingWindow
+	// ejections drives the exponential ejection time; it is reset once the
+	// backend stays in for MaxEjectionTime
+	ejections int
+	lastEnd   time.Time
+	// until is the end of the current ejection in unix nanoseconds, 0 when
+	// the backend is not ejected
+	until atomic.Int64
+}
+
+// reset clears the failure counters, so a backend is judged afresh after an
+// ejection (or a refused one).
+func (st *outlierState) reset() {
+	st.consec5xx, st.consecErrs = 0, 0
+	st.window.reset()
+}
+
+// EjectedUntil returns the end of the backend's current ejection, or the
+// zero time when it is not ejected.
+func (b *Backend) EjectedUntil() time.Time {
+	if u := b.outlier.until.Load(); u > 0 && time.Now().UnixNano() < u {
+		return time.Unix(0, u)
+	}
+	return time.Time{}
+}
+
+// ejected reports whether b is ejected at now, restoring it (and recording
+// the event) when its ejection time is over.
+func (s *ServerPool) ejected(b *Backend, now time.Time) bool {
+	u := b.outlier.until.Load()
+	if u == 0 {
+		return false
+	}
+	if now.UnixNano() < u {
+		return true
+	}
+	if b.outlier.until.CompareAndSwap(u, 0) {
+		b.outlier.mu.Lock()
+		b.outlier.lastEnd = now
+		b.outlier.mu.Unlock()
+		log.Printf("outlier: %s%s restaurado", poolPrefix(s.Name), b.URL)
+		stats.RecordRestore(s.Name, b.URL.String())
+	}
+	return false
+}
+
+// observe feeds the result of a proxied request into outlier detection.
+// status is the response status and gatewayErr tells whether the request
+// failed in transport.
+func (s *ServerPool) observe(b *Backend, status int, gatewayErr bool, now time.Time) {
+	o := s.Outlier
+	if o == nil {
+		return
+	}
+	fail := gatewayErr || status >= 500
+	st := &b.outlier
+	st.mu.Lock()
+	if fail {
+		st.consec5xx++
+	} else {
+		st.consec5xx = 0
+	}
+	if gatewayErr {
+		st.consecErrs++
+	} else {
+		st.consecErrs = 0
+	}
+
+	st.window.add(o.window(), now, fail, false)
+
+	var reason string
+	switch {
+	case o.ConsecutiveGatewayErrors > 0 && st.consecErrs >= o.ConsecutiveGatewayErrors:
+		reason = fmt.Sprintf("%d erros de transporte seguidos", st.consecErrs)
+	case o.Consecutive5xx > 0 && st.consec5xx >= o.Consecutive5xx:
+		reason = fmt.Sprintf("%d respostas 5xx seguidas", st.consec5xx)
+	case o.FailureRatePct > 0:
+		reqs, fails, _ := st.window.totals(o.window(), now)
+		if rate := float64(fails) / float64(reqs) * 100; reqs >= o.minRequests() && rate >= o.FailureRatePct {
+			reason = fmt.Sprintf("taxa de falhas de %.0f%% em %d requisições", rate, reqs)
+		}
+	}
+	st.mu.Unlock()
+	if reason != "" {
+		s.eject(b, reason, now)
+	}
+}
+
+// eject takes b out of the pool unless the max ejection percentage would be
+// exceeded.
+func (s *ServerPool) eject(b *Backend, reason string, now time.Time) {
+	o := s.Outlier
+	backends := s.list()
+	ejected := 0
+	for _, be := range backends {
+		if be != b && s.ejected(be, now) {
+			ejected++
+		}
+	}
+	st := &b.outlier
+	if limit := max(1, len(backends)*o.maxEjectionPercent()/100); ejected+1 > limit {
+		st.mu.Lock()
+		st.reset()
+		st.mu.Unlock()
+		log.Printf("outlier: %s%s não ejetado (%s): limite de %d%% do pool atingido", poolPrefix(s.Name), b.URL, reason, o.maxEjectionPercent())
+		return
+	}
+
+	st.mu.Lock()
+	if st.until.Load() > now.UnixNano() {
+		// already ejected by a concurrent request
+		st.mu.Unlock()
+		return
+	}
+	if !st.lastEnd.IsZero() && now.Sub(st.lastEnd) > o.maxEjection() {
+		st.ejections = 0
+	}
+	d := o.baseEjection() << min(st.ejections, 30)
+	if d <= 0 || d > o.maxEjection() {
+		d = o.maxEjection()
+	}
+	st.ejections++
+	st.reset()
+	until := now.Add(d)
+	st.until.Store(until.UnixNano())
+	st.mu.Unlock()
+
+	log.Printf("outlier: %s%s ejetado por %v (%s)", poolPrefix(s.Name), b.URL, d, reason)
+	stats.RecordEjection(s.Name, b.URL.String(), reason, until)
+}
+
+func poolPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "[" + name + "] "
+}
@@ -0,0 +1,172 @@
+package domain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func serveOnce(pool *ServerPool) int {
+	rr := httptest.NewRecorder()
+	pool.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	return rr.Code
+}
+
+func TestOutlier_ConsecutiveGatewayErrors(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadURL := dead.URL
+	dead.Close()
+
+	pool := &ServerPool{Name: "outlier-gw", Outlier: &OutlierDetection{ConsecutiveGatewayErrors: 2, BaseEjectionTime: time.Hour}}
+	good := NewBackend(ok.URL, 0, 1)
+	bad := NewBackend(deadURL, 0, 1)
+	pool.AddBackend(good)
+	pool.AddBackend(bad)
+
+	// round robin alternates; two failures on the dead backend eject it
+	for i := 0; i < 4; i++ {
+		serveOnce(pool)
+	}
+	if bad.EjectedUntil().IsZero() {
+		t.Fatal("expected dead backend to be ejected")
+	}
+	for i := 0; i < 5; i++ {
+		if code := serveOnce(pool); code != http.StatusOK {
+			t.Fatalf("expected only the healthy backend after ejection, got %d", code)
+		}
+	}
+	snap := stats.SnapshotAll()[stats.Key("outlier-gw", deadURL)]
+	if !snap.Ejected || snap.Ejections != 1 || snap.EjectionReason == "" {
+		t.Fatalf("ejection not recorded in stats: %+v", snap)
+	}
+}
+
+func TestOutlier_Consecutive5xxAndRestore(t *testing.T) {
+	failing := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "outlier-5xx", Outlier: &OutlierDetection{Consecutive5xx: 3, BaseEjectionTime: 30 * time.Millisecond, MaxEjectionTime: time.Second}}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+
+	for i := 0; i < 3; i++ {
+		serveOnce(pool)
+	}
+	until := b.EjectedUntil()
+	if until.IsZero() {
+		t.Fatal("expected ejection after 3 consecutive 5xx")
+	}
+	if code := serveOnce(pool); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the only backend is ejected, got %d", code)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	failing = false
+	if code := serveOnce(pool); code != http.StatusOK {
+		t.Fatalf("expected backend restored after ejection time, got %d", code)
+	}
+	if snap := stats.SnapshotAll()[stats.Key("outlier-5xx", srv.URL)]; snap.Ejected {
+		t.Fatal("restore not recorded in stats")
+	}
+
+	// a second ejection lasts twice as long
+	failing = true
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		serveOnce(pool)
+	}
+	if d := b.EjectedUntil().Sub(start); d < 50*time.Millisecond || d > 70*time.Millisecond {
+		t.Fatalf("expected ~60ms second ejection, got %v", d)
+	}
+}
+
+func TestOutlier_FailureRate(t *testing.T) {
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n%2 == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "outlier-rate", Outlier: &OutlierDetection{FailureRatePct: 50, MinRequests: 6, BaseEjectionTime: time.Hour}}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+
+	for i := 0; i < 5; i++ {
+		serveOnce(pool)
+	}
+	if !b.EjectedUntil().IsZero() {
+		t.Fatal("should not eject before min_requests")
+	}
+	serveOnce(pool)
+	if b.EjectedUntil().IsZero() {
+		t.Fatal("expected ejection at 50% failure rate")
+	}
+}
+
+func TestOutlier_MaxEjectionPercent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "outlier-max", Outlier: &OutlierDetection{Consecutive5xx: 1, MaxEjectionPercent: 50, BaseEjectionTime: time.Hour}}
+	var backends []*Backend
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		b := NewBackend(srv.URL+path, 0, 1)
+		pool.AddBackend(b)
+		backends = append(backends, b)
+	}
+	for i := 0; i < 8; i++ {
+		serveOnce(pool)
+	}
+	ejected := 0
+	for _, b := range backends {
+		if !b.EjectedUntil().IsZero() {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("expected max 50%% (2 of 4) ejected, got %d", ejected)
+	}
+}
+
+func TestOutlier_ClientCancelIsNotAFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "outlier-cancel", Outlier: &OutlierDetection{ConsecutiveGatewayErrors: 1, Consecutive5xx: 1, BaseEjectionTime: time.Hour}}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		rr := httptest.NewRecorder()
+		pool.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		if rr.Code != StatusClientClosed {
+			t.Fatalf("expected %d for a client that hung up, got %d", StatusClientClosed, rr.Code)
+		}
+	}
+	if !b.EjectedUntil().IsZero() {
+		t.Fatal("client cancellations ejected a healthy backend")
+	}
+}
@@ -0,0 +1,56 @@
+package domain
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+// pickTwo returns two distinct random backends from alive (the same one
+// twice when there is only one).
+func pickTwo(alive []*Backend) (*Backend, *Backend) {
+	n := len(alive)
+	if n == 1 {
+		return alive[0], alive[0]
+	}
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	return alive[i], alive[j]
+}
+
+// p2cLeastLoaded implements power of two choices: of two random backends,
+// take the one with fewer active connections relative to its weight. It
+// approaches least_conn's balance while reading only two counters.
+func p2cLeastLoaded(alive []*Backend, _ *http.Request) *Backend {
+	a, b := pickTwo(alive)
+	if connLoad(b) < connLoad(a) {
+		return b
+	}
+	return a
+}
+
+func connLoad(b *Backend) float64 {
+	w := b.Weight()
+	if w <= 0 {
+		w = 1
+	}
+	return float64(atomic.LoadInt64(&b.ConnCount)) / float64(w)
+}
+
+// p2cPeakEWMA compares two random backends by peak EWMA latency times
+// outstanding requests, so slow or busy backends receive less traffic.
+// Backends without observations score 0 and are tried first.
+func p2cPeakEWMA(alive []*Backend, _ *http.Request) *Backend {
+	a, b := pickTwo(alive)
+	if ewmaScore(b) < ewmaScore(a) {
+		return b
+	}
+	return a
+}
+
+func ewmaScore(b *Backend) float64 {
+	return float64(b.EWMALatency()) * float64(atomic.LoadInt64(&b.ConnCount)+1)
+}
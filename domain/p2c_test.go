@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestP2C_AvoidsLoadedBackend(t *testing.T) {
+	pool := &ServerPool{Algorithm: "p2c"}
+	busy := NewBackend("http://localhost:8081", 0, 1)
+	idle := NewBackend("http://localhost:8082", 0, 1)
+	atomic.StoreInt64(&busy.ConnCount, 50)
+	pool.AddBackend(busy)
+	pool.AddBackend(idle)
+
+	// with two backends both are always compared, so the idle one must win
+	for i := 0; i < 20; i++ {
+		if got := pool.GetNextPeer(nil); got != idle {
+			t.Fatalf("expected idle backend, got %s", got.URL)
+		}
+	}
+}
+
+func TestP2C_SingleBackend(t *testing.T) {
+	pool := &ServerPool{Algorithm: "p2c"}
+	b := NewBackend("http://localhost:8081", 0, 1)
+	pool.AddBackend(b)
+	if pool.GetNextPeer(nil) != b {
+		t.Fatal("expected the only backend")
+	}
+}
+
+func TestPeakEWMA_PrefersFasterBackend(t *testing.T) {
+	pool := &ServerPool{Algorithm: "peak_ewma"}
+	slow := NewBackend("http://localhost:8081", 0, 1)
+	fast := NewBackend("http://localhost:8082", 0, 1)
+	slow.ObserveLatency(200 * time.Millisecond)
+	fast.ObserveLatency(5 * time.Millisecond)
+	pool.AddBackend(slow)
+	pool.AddBackend(fast)
+
+	for i := 0; i < 20; i++ {
+		if got := pool.GetNextPeer(nil); got != fast {
+			t.Fatalf("expected fast backend, got %s", got.URL)
+		}
+	}
+
+	// enough in-flight requests outweigh the latency advantage
+	atomic.StoreInt64(&fast.ConnCount, 100)
+	if got := pool.GetNextPeer(nil); got != slow {
+		t.Fatalf("expected slow backend once fast one is saturated, got %s", got.URL)
+	}
+}
+
+func TestObserveLatency_PeakThenDecay(t *testing.T) {
+	b := NewBackend("http://localhost:8081", 0, 1)
+	b.ObserveLatency(10 * time.Millisecond)
+	b.ObserveLatency(100 * time.Millisecond)
+	if got := b.EWMALatency(); got < 99*time.Millisecond || got > 100*time.Millisecond {
+		t.Fatalf("expected peak to be taken immediately, got %v", got)
+	}
+	b.ObserveLatency(10 * time.Millisecond)
+	if got := b.EWMALatency(); got <= 10*time.Millisecond || got > 100*time.Millisecond {
+		t.Fatalf("expected gradual decay between 10ms and 100ms, got %v", got)
+	}
+}
+
+func TestEWMALatency_DecaysWithoutSamples(t *testing.T) {
+	pool := &ServerPool{Algorithm: "peak_ewma"}
+	slow := NewBackend("http://localhost:8081", 0, 1)
+	fast := NewBackend("http://localhost:8082", 0, 1)
+	slow.ObserveLatency(time.Second)
+	fast.ObserveLatency(20 * time.Millisecond)
+	pool.AddBackend(slow)
+	pool.AddBackend(fast)
+
+	// one slow response a minute ago no longer outweighs a recent 20ms
+	slow.ewmaMu.Lock()
+	slow.ewmaStamp = slow.ewmaStamp.Add(-time.Minute)
+	slow.ewmaMu.Unlock()
+	if got := slow.EWMALatency(); got > 5*time.Millisecond {
+		t.Fatalf("expected the latency to decay, got %v", got)
+	}
+	if got := pool.GetNextPeer(nil); got != slow {
+		t.Fatalf("expected the idle backend to be tried again, got %s", got.URL)
+	}
+}
+
+func TestForward_SkipsLatencyOfTransportErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	pool := &ServerPool{Name: "ewma-refused"}
+	b := NewBackend(url, 0, 1)
+	pool.AddBackend(b)
+	serveOnce(pool)
+	if got := b.EWMALatency(); got != 0 {
+		t.Fatalf("expected a refused connection not to count as latency, got %v", got)
+	}
+}
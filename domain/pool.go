@@ -1,11 +1,12 @@
 package domain
 
 import (
-	"hash/fnv"
+	"context"
 	"log"
-	"math/rand"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,192 +14,460 @@ import (
 )
 
 type ServerPool struct {
+	// Name identifica o pool no roteador e nas estatísticas (vazio = pool sem nome)
+	Name string
+	// backends é substituído (nunca alterado no lugar) sob mu, então leitores
+	// podem iterar a fatia obtida com list() sem segurar o lock
+	mu       sync.RWMutex
 	backends []*Backend
 	current  uint64
-	// Algorithm pode ser: "round_robin", "least_conn", "random", "ip_hash"
+	// Algorithm é o nome de uma estratégia registrada com RegisterBalancer:
+	// "round_robin" (padrão), "least_conn", "random", "ip_hash"
 	Algorithm string
 	// IPHashHeader, se não vazio, indica o header a ser usado para ip_hash (ex: X-Forwarded-For)
 	IPHashHeader string
+	// HashKey define a chave usada por ring_hash e maglev (veja ParseHashKey); vazio = ip
+	HashKey string
+	// Balancer, se definido, é usado no lugar da estratégia indicada por Algorithm
+	Balancer Balancer
+	// Sticky, se definido, habilita afinidade de sessão por cookie
+	Sticky *StickySession
+	// Health configura o health check ativo dos backends (nil = padrões)
+	Health *HealthCheckConfig
+	// Outlier habilita o health check passivo (ejeção por erros no tráfego real); nil = desabilitado
+	Outlier *OutlierDetection
+	// Breaker habilita o circuit breaker de cada backend; nil = desabilitado
+	Breaker *CircuitBreakerConfig
+	// Retry habilita novas tentativas em outro backend; nil = desabilitado
+	Retry *RetryPolicy
+	// Timeouts, UpstreamTLS e Protocol são os padrões do pool para seus backends; backends
+	// criados em tempo de execução os recebem com ConfigureBackend
+	Timeouts    *Timeouts
+	UpstreamTLS *UpstreamTLS
+	Protocol    string
+
+	resolved atomic.Pointer[resolvedBalancer]
+	retries  budget
+	latency  latencyRing
+	stopMu   sync.Mutex
+	stop     chan struct{}
+}
+
+// resolvedBalancer caches the Balancer built for an Algorithm name.
+type resolvedBalancer struct {
+	name string
+	b    Balancer
+}
+
+// ConfigureBackend applies the pool's Timeouts, UpstreamTLS and Protocol to
+// b. It is meant for backends created at run time, which have no settings of
+// their own.
+func (s *ServerPool) ConfigureBackend(b *Backend) error {
+	if err := b.SetProtocol(s.Protocol); err != nil {
+		return err
+	}
+	if err := b.SetUpstreamTLS(s.UpstreamTLS); err != nil {
+		return err
+	}
+	b.SetTimeouts(s.Timeouts)
+	return nil
 }
 
 func (s *ServerPool) AddBackend(b *Backend) {
-	s.backends = append(s.backends, b)
+	s.mu.Lock()
+	next := make([]*Backend, len(s.backends), len(s.backends)+1)
+	copy(next, s.backends)
+	s.backends = append(next, b)
+	s.mu.Unlock()
 	// register backend for stats collection
-	stats.RegisterBackend(b.URL.String())
+	stats.RegisterPoolBackend(s.Name, b.URL.String())
+	if s.Breaker != nil {
+		stats.RecordCircuit(s.Name, b.URL.String(), b.Circuit().String())
+	}
 }
 
-func (s *ServerPool) GetNextPeer(r *http.Request) *Backend {
-	if len(s.backends) == 0 {
-		return nil
+// RemoveBackend removes the backend with the given URL and returns it, or nil
+// when the pool has no such backend. Requests already being served by it are
+// not interrupted, and its stats are dropped.
+func (s *ServerPool) RemoveBackend(url string) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.backends {
+		if b.URL.String() == url {
+			next := make([]*Backend, 0, len(s.backends)-1)
+			next = append(next, s.backends[:i]...)
+			s.backends = append(next, s.backends[i+1:]...)
+			stats.UnregisterPoolBackend(s.Name, url)
+			return b
+		}
 	}
+	return nil
+}
 
-	switch strings.ToLower(s.Algorithm) {
-	case "least_conn":
-		// find alive backend with minimum ConnCount
-		var chosen *Backend
-		var min int64 = -1
-		for _, be := range s.backends {
-			if !be.IsAlive() {
-				continue
-			}
-			cnt := atomic.LoadInt64(&be.ConnCount)
-			if chosen == nil || cnt < min {
-				chosen = be
-				min = cnt
-			}
-		}
-		return chosen
-	case "random":
-		// pick a random alive backend
-		alive := make([]*Backend, 0, len(s.backends))
-		for _, be := range s.backends {
-			if be.IsAlive() {
-				alive = append(alive, be)
-			}
-		}
-		if len(alive) == 0 {
-			return nil
+// GetBackend returns the backend with the given URL, or nil.
+func (s *ServerPool) GetBackend(url string) *Backend {
+	for _, b := range s.list() {
+		if b.URL.String() == url {
+			return b
 		}
-		return alive[rand.Intn(len(alive))]
-	case "ip_hash":
-		// hash remote ip or header to pick backend
-		var key string
-		if s.IPHashHeader != "" {
-			if r != nil {
-				key = r.Header.Get(s.IPHashHeader)
-			}
-		} else if r != nil {
-			key = r.RemoteAddr
-		}
-		if key == "" {
-			// fallback to round-robin when no key available
-			next := s.NextIndex()
-			l := len(s.backends) + s.NextIndex()
-			for i := next; i < l; i++ {
-				idx := i % len(s.backends)
-				if s.backends[idx].IsAlive() {
-					if i != next {
-						atomic.StoreUint64(&s.current, uint64(idx))
-					}
-					return s.backends[idx]
-				}
-			}
-			return nil
-		}
-		// if header contains multiple ips (X-Forwarded-For), take first
-		if idxc := strings.Index(key, ","); idxc != -1 {
-			key = strings.TrimSpace(key[:idxc])
-		}
-		// remove port if present
-		if idx := strings.LastIndex(key, ":"); idx != -1 {
-			key = key[:idx]
-		}
-		h := fnv.New32a()
-		h.Write([]byte(key))
-		idx := int(h.Sum32()) % len(s.backends)
-		// find next alive starting from idx
-		for i := 0; i < len(s.backends); i++ {
-			j := (idx + i) % len(s.backends)
-			if s.backends[j].IsAlive() {
-				return s.backends[j]
-			}
-		}
-		return nil
-	default:
-		// round_robin (default)
-		next := s.NextIndex()
-		l := len(s.backends) + s.NextIndex()
-		for i := next; i < l; i++ {
-			idx := i % len(s.backends)
-			if s.backends[idx].IsAlive() {
-				if i != next {
-					atomic.StoreUint64(&s.current, uint64(idx))
-				}
-				return s.backends[idx]
-			}
+	}
+	return nil
+}
+
+// InheritState carries over the traffic state of prev, the pool s replaces on
+// a reload: the recent latencies that set the hedging delay and, when the
+// budget window is unchanged, the retry budget. Backends are reused on their
+// own and keep their state.
+func (s *ServerPool) InheritState(prev *ServerPool) {
+	s.latency.copyFrom(&prev.latency)
+	if s.Retry != nil && prev.Retry != nil && s.Retry.budgetWindow() == prev.Retry.budgetWindow() {
+		s.retries.copyFrom(&prev.retries)
+	}
+}
+
+// list returns the current backend slice; callers must not modify it.
+func (s *ServerPool) list() []*Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends
+}
+
+// GetNextPeer returns the backend that should serve r, or nil when no backend
+// is alive, enabled, not ejected and with its circuit letting requests through.
+func (s *ServerPool) GetNextPeer(r *http.Request) *Backend {
+	return s.nextPeer(r, nil)
+}
+
+// nextPeer is GetNextPeer leaving out the backends in exclude.
+func (s *ServerPool) nextPeer(r *http.Request, exclude []*Backend) *Backend {
+	backends := s.list()
+	alive := make([]*Backend, 0, len(backends))
+	now := time.Now()
+	balancer := s.balancer()
+	eb, excluding := balancer.(excludingBalancer)
+	for _, be := range backends {
+		if be.IsAlive() && be.State() == StateEnabled && (excluding || !slices.Contains(exclude, be)) && !s.ejected(be, now) && s.circuitAllows(be, now) {
+			alive = append(alive, be)
 		}
+	}
+	if len(alive) == 0 {
 		return nil
 	}
+	if excluding {
+		return eb.nextExcluding(alive, exclude, r)
+	}
+	return balancer.Next(alive, r)
+}
+
+// excludingBalancer is implemented by balancers that should see the whole
+// alive set even when some backends are ruled out, such as the hashing ones,
+// whose tables are costly to build for every retry or hedge.
+type excludingBalancer interface {
+	nextExcluding(alive, exclude []*Backend, r *http.Request) *Backend
+}
+
+// balancer returns the pool's Balancer, building it from Algorithm on first
+// use or after Algorithm changes. Unknown names fall back to round robin.
+func (s *ServerPool) balancer() Balancer {
+	if s.Balancer != nil {
+		return s.Balancer
+	}
+	name := strings.ToLower(s.Algorithm)
+	if name == "" {
+		name = "round_robin"
+	}
+	if cur := s.resolved.Load(); cur != nil && cur.name == name {
+		return cur.b
+	}
+	factory, ok := LookupBalancer(name)
+	if !ok {
+		factory, _ = LookupBalancer("round_robin")
+	}
+	rb := &resolvedBalancer{name: name, b: factory(s)}
+	s.resolved.Store(rb)
+	return rb.b
 }
 
 func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.list())))
 }
 
 func (s *ServerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	peer := s.GetNextPeer(r)
+	peer, trial, setCookie := s.pick(w, r)
+	if peer == nil {
+		return
+	}
+	rs := s.startRetry(r, peer)
+	for s.proxy(w, r, peer, trial, setCookie, rs) {
+		stats.RecordRetry(s.Name, peer.URL.String())
+		peer, trial = rs.next, rs.nextTrial
+		if s.Sticky != nil {
+			setCookie = s.Sticky.Cookie(peer)
+		}
+		rs.rewind()
+	}
+}
+
+// pick chooses the backend for r (sticky first), applying its rate limit and
+// circuit breaker. It answers the request itself and returns nil when no
+// backend can take it; otherwise it also returns whether the request is a
+// half-open trial and the affinity cookie to set, if any.
+func (s *ServerPool) pick(w http.ResponseWriter, r *http.Request) (*Backend, bool, *http.Cookie) {
+	var peer *Backend
+	var setCookie *http.Cookie
+	if s.Sticky != nil {
+		peer = s.stickyPeer(r)
+	}
+	if peer == nil {
+		peer = s.GetNextPeer(r)
+		if peer != nil && s.Sticky != nil {
+			setCookie = s.Sticky.Cookie(peer)
+		}
+	}
 
 	if peer == nil {
 		http.Error(w, "Serviço não disponível", http.StatusServiceUnavailable)
-		return
+		return nil, false, nil
 	}
 
 	// rate limiting per backend
-	if peer.Limiter != nil {
-		if !peer.Limiter.Allow() {
+	if limiter := peer.RateLimiter(); limiter != nil {
+		if !limiter.Allow() {
+			stats.RecordRateLimited(s.Name, peer.URL.String())
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			return
+			return nil, false, nil
 		}
 	}
 
+	ok, trial := s.acquire(peer, time.Now())
+	if !ok {
+		// the circuit opened (or ran out of half-open trials) since GetNextPeer
+		http.Error(w, "Serviço não disponível", http.StatusServiceUnavailable)
+		return nil, false, nil
+	}
+	return peer, trial, setCookie
+}
+
+// proxy sends r to peer and reports whether the response was dropped so the
+// request is retried on rs.next.
+func (s *ServerPool) proxy(w http.ResponseWriter, r *http.Request, peer *Backend, trial bool, setCookie *http.Cookie, rs *retryState) bool {
+	rw := &statusRecorder{ResponseWriter: w, status: 0, cookie: setCookie}
+	if rs.canRetry() {
+		rw.retry, rw.header = rs, http.Header{}
+	}
+	s.forward(rw, r, peer, trial)
+	if rs != nil && rs.denied {
+		rs.denied = false
+		stats.RecordRetryDenied(s.Name, peer.URL.String())
+	}
+	return rw.discarded
+}
+
+// forward sends r to peer through rw and feeds the result into the latency
+// trackers, outlier detection, the circuit breaker and the stats.
+func (s *ServerPool) forward(rw *statusRecorder, r *http.Request, peer *Backend, trial bool) {
 	// increment active connections and ensure decrement after serving
 	atomic.AddInt64(&peer.ConnCount, 1)
 	defer atomic.AddInt64(&peer.ConnCount, -1)
 
+	r, cancel := peer.withRequestTimeout(r.WithContext(context.WithValue(r.Context(), recorderKey{}, rw)))
+	defer cancel()
+
 	// record start time and capture status
 	start := time.Now()
-	rw := &statusRecorder{ResponseWriter: w, status: 0}
 	peer.ReverseProxy.ServeHTTP(rw, r)
 	duration := time.Since(start)
+	if rw.lost || rw.cancelled {
+		// cancelled because a hedged attempt answered first or the client
+		// hung up: says nothing about the backend
+		s.release(peer, trial)
+		return
+	}
+	if !rw.gatewayErr || rw.timeout {
+		// a refused or reset connection fails fast and would make the
+		// backend look quick; a timeout is at least that slow
+		peer.ObserveLatency(duration)
+		s.latency.add(duration)
+	}
 	status := rw.status
 	if status == 0 {
 		status = http.StatusOK
 	}
+	now := time.Now()
+	s.observe(peer, status, rw.gatewayErr, now)
+	s.record(peer, trial, rw.gatewayErr || status >= 500, duration, now)
 	// record stats
-	stats.Record(peer.URL.String(), duration, status)
+	stats.RecordRequest(s.Name, peer.URL.String(), r.Method, duration, status)
+	stats.RecordProtocol(s.Name, peer.URL.String(), r.Proto, rw.upstreamProto)
+	if rw.timeout {
+		stats.RecordTimeout(s.Name, peer.URL.String())
+	}
 }
 
-// statusRecorder wraps ResponseWriter to capture status code
+// statusRecorder wraps ResponseWriter to capture status code and, when
+// cookie is set, to add it to the response headers
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
+	cookie *http.Cookie
+	// gatewayErr is set by the backend's ErrorHandler on transport errors,
+	// connectErr when the connection could not be established and timeout
+	// when the backend did not answer in time
+	gatewayErr bool
+	connectErr bool
+	timeout    bool
+	// cancelled is set instead of gatewayErr when the request failed because
+	// its context was cancelled, usually by the client hanging up
+	cancelled bool
+	// upstreamProto is the protocol the backend answered with ("HTTP/2.0")
+	upstreamProto string
+	// retry, when set, decides on WriteHeader whether the response is
+	// dropped and the request retried; until then the response headers are
+	// kept in header
+	retry     *retryState
+	header    http.Header
+	discarded bool
+	// hedge, when set, makes the response go to the client only if this
+	// attempt answers first; lost is set when another one did
+	hedge *hedgeAttempt
+	lost  bool
+}
+
+func (s *statusRecorder) Header() http.Header {
+	if s.header != nil {
+		return s.header
+	}
+	return s.ResponseWriter.Header()
 }
 
 func (s *statusRecorder) WriteHeader(code int) {
+	if s.status != 0 {
+		return
+	}
 	s.status = code
+	if s.retry != nil && !s.cancelled && s.retry.retry(code, s.connectErr) {
+		s.discarded = true
+		return
+	}
+	if s.hedge != nil && !s.hedge.claim() {
+		s.discarded = true
+		return
+	}
+	if s.header != nil {
+		dst := s.ResponseWriter.Header()
+		for k, v := range s.header {
+			dst[k] = v
+		}
+		s.header = nil
+	}
+	if s.cookie != nil {
+		http.SetCookie(s.ResponseWriter, s.cookie)
+	}
 	s.ResponseWriter.WriteHeader(code)
 }
 
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.discarded {
+		return len(p), nil
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming responses through the recorder.
+func (s *statusRecorder) Flush() {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.discarded {
+		return
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // HealthCheck loops through all backends and updates their status
 func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
+	for _, b := range s.list() {
 		status := "ativo"
-		alive := b.CheckHealth()
-		b.SetAlive(alive)
-		if !alive {
+		if !s.CheckBackend(b) {
 			status = "inativo"
 		}
 		log.Printf("%s [%s]", b.URL, status)
 	}
 }
 
-// StartHealthCheck starts a ticker to run the check every 20 seconds
-func (s *ServerPool) StartHealthCheck() {
-	t := time.NewTicker(time.Second * 20)
+// CheckBackend runs the pool's health check against b right away, updates
+// its status according to the rise/fall thresholds and reports whether it is
+// alive. The result is recorded in the stats.
+func (s *ServerPool) CheckBackend(b *Backend) bool {
+	c := b.healthConfig(s.Health)
+	start := time.Now()
+	ok, reason := b.probe(c)
+	latency := time.Since(start)
+	alive := b.recordCheck(ok, c.Rise, c.Fall)
+	stats.RecordHealthCheck(s.Name, b.URL.String(), alive, ok, reason, latency)
+	return alive
+}
+
+// StartHealthCheck runs the check every Health.Interval (20 seconds by
+// default, plus Health.Jitter) until ctx is done or StopHealthCheck is called
+func (s *ServerPool) StartHealthCheck(ctx context.Context) {
+	t := time.NewTimer(s.healthInterval())
+	defer t.Stop()
+	stop := s.stopChan()
 	for {
 		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
 		case <-t.C:
 			log.Println("Iniciando verificação de saúde...")
 			s.HealthCheck()
 			log.Println("Verificação de saúde concluída")
+			t.Reset(s.healthInterval())
 		}
 	}
 }
 
+// StopHealthCheck stops the loop started by StartHealthCheck.
+func (s *ServerPool) StopHealthCheck() {
+	stop := s.stopChan()
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+}
+
+func (s *ServerPool) stopChan() chan struct{} {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	return s.stop
+}
+
+// Backends returns a copy of the pool's backend list.
+func (s *ServerPool) Backends() []*Backend {
+	backends := s.list()
+	out := make([]*Backend, len(backends))
+	copy(out, backends)
+	return out
+}
+
 // BackendURLs returns the list of backend URLs (string form).
 func (s *ServerPool) BackendURLs() []string {
-	out := make([]string, 0, len(s.backends))
-	for _, b := range s.backends {
+	backends := s.list()
+	out := make([]string, 0, len(backends))
+	for _, b := range backends {
 		out = append(out, b.URL.String())
 	}
 	return out
@@ -2,6 +2,8 @@ package domain
 
 import (
 	"testing"
+
+	"github.com/Vime-Sistemas/vortice/stats"
 )
 
 func TestServerPool_GetNextPeer(t *testing.T) {
@@ -67,3 +69,51 @@ func TestServerPool_AllDead(t *testing.T) {
 		t.Error("Deveria retornar nil quando todos os backends estiverem inativos")
 	}
 }
+
+func TestServerPool_SkipDrainingAndDisabled(t *testing.T) {
+	pool := &ServerPool{}
+	b1 := NewBackend("http://localhost:8081", 0, 1)
+	b2 := NewBackend("http://localhost:8082", 0, 1)
+	b3 := NewBackend("http://localhost:8083", 0, 1)
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+	pool.AddBackend(b3)
+
+	b1.SetState(StateDraining)
+	b2.SetState(StateDisabled)
+	for i := 0; i < 10; i++ {
+		if peer := pool.GetNextPeer(nil); peer != b3 {
+			t.Fatalf("expected only the enabled backend, got %v", peer.URL)
+		}
+	}
+
+	b3.SetState(StateDisabled)
+	if peer := pool.GetNextPeer(nil); peer != nil {
+		t.Fatalf("expected nil with no enabled backends, got %v", peer.URL)
+	}
+}
+
+func TestServerPool_RemoveBackend(t *testing.T) {
+	pool := &ServerPool{Name: "remove"}
+	b1 := NewBackend("http://localhost:8081", 0, 1)
+	b2 := NewBackend("http://localhost:8082", 0, 1)
+	pool.AddBackend(b1)
+	pool.AddBackend(b2)
+
+	if got := pool.RemoveBackend("http://localhost:8081"); got != b1 {
+		t.Fatalf("expected removed backend to be returned")
+	}
+	if pool.RemoveBackend("http://localhost:8081") != nil {
+		t.Fatalf("removing twice should return nil")
+	}
+	if urls := pool.BackendURLs(); len(urls) != 1 || urls[0] != "http://localhost:8082" {
+		t.Fatalf("unexpected backends after removal: %v", urls)
+	}
+	snap := stats.SnapshotAll()
+	if _, ok := snap[stats.Key("remove", "http://localhost:8081")]; ok {
+		t.Fatal("expected the removed backend to leave the stats")
+	}
+	if _, ok := snap[stats.Key("remove", "http://localhost:8082")]; !ok {
+		t.Fatal("expected the remaining backend to keep its stats")
+	}
+}
@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Upstream protocols for Backend.SetProtocol.
+const (
+	// ProtocolAuto uses HTTP/2 with https backends that offer it (ALPN) and
+	// HTTP/1.1 otherwise. It is the default.
+	ProtocolAuto = "auto"
+	// ProtocolHTTP1 always uses HTTP/1.1.
+	ProtocolHTTP1 = "http1"
+	// ProtocolH2 requires HTTP/2 over TLS; only for https backends.
+	ProtocolH2 = "h2"
+	// ProtocolH2C uses cleartext HTTP/2 with prior knowledge; only for http
+	// backends.
+	ProtocolH2C = "h2c"
+)
+
+// Protocol returns the backend's upstream protocol ("" means ProtocolAuto).
+func (b *Backend) Protocol() string {
+	b.transportMu.Lock()
+	defer b.transportMu.Unlock()
+	return b.protocol
+}
+
+// SetProtocol changes the protocol used to reach the backend, for proxied
+// requests and health checks alike. New requests use a fresh transport;
+// idle connections of the previous one are closed. On error the current
+// protocol is kept.
+func (b *Backend) SetProtocol(p string) error {
+	if err := ValidateProtocol(p, b.URL.Scheme); err != nil {
+		return err
+	}
+	if p == ProtocolAuto {
+		p = ""
+	}
+	b.transportMu.Lock()
+	defer b.transportMu.Unlock()
+	b.protocol = p
+	b.swapTransport()
+	return nil
+}
+
+// ValidateProtocol reports whether protocol p can reach backends with the
+// given URL scheme ("" stands for ProtocolAuto).
+func ValidateProtocol(p, scheme string) error {
+	switch {
+	case p == "" || p == ProtocolAuto || p == ProtocolHTTP1:
+	case p == ProtocolH2 && scheme == "https":
+	case p == ProtocolH2C && scheme == "http":
+	case p == ProtocolH2 || p == ProtocolH2C:
+		return fmt.Errorf("protocolo %s não vale para backends %s", p, scheme)
+	default:
+		return fmt.Errorf("protocolo desconhecido %q", p)
+	}
+	return nil
+}
+
+// protocols returns the transport protocols for p, or nil for the default
+// of http.DefaultTransport (HTTP/2 negotiated over TLS, else HTTP/1.1).
+func protocols(p string) *http.Protocols {
+	var out http.Protocols
+	switch p {
+	case ProtocolHTTP1:
+		out.SetHTTP1(true)
+	case ProtocolH2:
+		out.SetHTTP2(true)
+	case ProtocolH2C:
+		out.SetUnencryptedHTTP2(true)
+	default:
+		return nil
+	}
+	return &out
+}
+
+// recorderKey carries the statusRecorder of an attempt in the request
+// context, so the transport can report the protocol the backend answered
+// with.
+type recorderKey struct{}
@@ -0,0 +1,102 @@
+package domain
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+// protoServer answers with the protocol of the request it got.
+var protoServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Proto))
+})
+
+func proxiedProto(t *testing.T, pool *ServerPool) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	pool.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %q", rr.Code, rr.Body.String())
+	}
+	return rr.Body.String()
+}
+
+func TestProtocol_H2C(t *testing.T) {
+	// a backend that only speaks cleartext HTTP/2
+	srv := httptest.NewUnstartedServer(protoServer)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	pool := &ServerPool{Name: "protocol-h2c"}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+	if b.CheckHealth() {
+		t.Fatal("expected HTTP/1.1 to fail against an h2c-only backend")
+	}
+	if err := b.SetProtocol(ProtocolH2C); err != nil {
+		t.Fatalf("SetProtocol: %v", err)
+	}
+	if !b.CheckHealth() {
+		t.Fatal("expected the health check to use h2c")
+	}
+	b.SetAlive(true)
+	if got := proxiedProto(t, pool); got != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2.0 upstream, got %s", got)
+	}
+	snap := stats.SnapshotAll()[stats.Key(pool.Name, srv.URL)]
+	if snap.Protocols["HTTP/2.0"] != 1 || snap.ClientProtocols["HTTP/1.1"] != 1 {
+		t.Fatalf("expected the protocols in stats, got %v / %v", snap.Protocols, snap.ClientProtocols)
+	}
+}
+
+func TestProtocol_TLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(protoServer)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	pool := &ServerPool{Name: "protocol-tls"}
+	b := NewBackend(srv.URL, 0, 1)
+	pool.AddBackend(b)
+	if err := b.SetUpstreamTLS(&UpstreamTLS{CA: ca}); err != nil {
+		t.Fatalf("SetUpstreamTLS: %v", err)
+	}
+	for _, c := range []struct{ protocol, want string }{
+		{ProtocolAuto, "HTTP/2.0"},
+		{ProtocolHTTP1, "HTTP/1.1"},
+		{ProtocolH2, "HTTP/2.0"},
+	} {
+		if err := b.SetProtocol(c.protocol); err != nil {
+			t.Fatalf("SetProtocol(%s): %v", c.protocol, err)
+		}
+		if got := proxiedProto(t, pool); got != c.want {
+			t.Errorf("%s: expected %s, got %s", c.protocol, c.want, got)
+		}
+	}
+	if b.SetProtocol(ProtocolAuto); b.Protocol() != "" {
+		t.Fatalf("expected auto to be stored as the default, got %q", b.Protocol())
+	}
+}
+
+func TestProtocol_Invalid(t *testing.T) {
+	plain, secure := NewBackend("http://a:1", 0, 1), NewBackend("https://a:1", 0, 1)
+	plain.SetProtocol(ProtocolHTTP1)
+	if err := plain.SetProtocol(ProtocolH2); err == nil {
+		t.Fatal("expected h2 to be rejected for an http backend")
+	}
+	if err := secure.SetProtocol(ProtocolH2C); err == nil {
+		t.Fatal("expected h2c to be rejected for an https backend")
+	}
+	if err := plain.SetProtocol("spdy"); err == nil {
+		t.Fatal("expected an unknown protocol to be rejected")
+	}
+	if plain.Protocol() != ProtocolHTTP1 {
+		t.Fatalf("expected the previous protocol to be kept, got %q", plain.Protocol())
+	}
+}
@@ -0,0 +1,203 @@
+package domain
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Retry defaults, used when a setting is left empty.
+const (
+	DefaultRetryAttempts     = 2
+	DefaultRetryMaxBodyBytes = 64 << 10
+	DefaultRetryBudgetPct    = 20
+	DefaultRetryMinRetries   = 3
+	DefaultRetryBudgetWindow = 10 * time.Second
+)
+
+// idempotentMethods are retried when RetryPolicy.Methods is empty.
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// RetryPolicy configures retries of failed requests on another backend of
+// the pool. A request is retried when the connection to its backend could
+// not be established, or when the backend answered with one of Statuses,
+// and only while the pool's retry budget allows it.
+type RetryPolicy struct {
+	// Attempts is the maximum number of tries, the first one included.
+	Attempts int
+	// Methods lists the retried methods; empty means the idempotent ones.
+	Methods []string
+	// Statuses are the response codes retried besides connect errors; empty
+	// retries connect errors only.
+	Statuses StatusSet
+	// MaxBodyBytes bounds the request body buffered for replay; requests
+	// with larger bodies are not retried.
+	MaxBodyBytes int64
+	// BudgetPct caps the retries at this percentage of the requests seen
+	// over BudgetWindow; MinRetries retries per window are always allowed so
+	// pools with little traffic can still retry.
+	BudgetPct    float64
+	MinRetries   int
+	BudgetWindow time.Duration
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.Attempts > 0 {
+		return p.Attempts
+	}
+	return DefaultRetryAttempts
+}
+
+func (p *RetryPolicy) maxBodyBytes() int64 {
+	if p.MaxBodyBytes > 0 {
+		return p.MaxBodyBytes
+	}
+	return DefaultRetryMaxBodyBytes
+}
+
+func (p *RetryPolicy) budgetPct() float64 {
+	if p.BudgetPct > 0 {
+		return p.BudgetPct
+	}
+	return DefaultRetryBudgetPct
+}
+
+func (p *RetryPolicy) minRetries() int {
+	if p.MinRetries > 0 {
+		return p.MinRetries
+	}
+	return DefaultRetryMinRetries
+}
+
+func (p *RetryPolicy) budgetWindow() time.Duration {
+	if p.BudgetWindow > 0 {
+		return p.BudgetWindow
+	}
+	return DefaultRetryBudgetWindow
+}
+
+func (p *RetryPolicy) allowsMethod(method string) bool {
+	methods := p.Methods
+	if len(methods) == 0 {
+		methods = idempotentMethods
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether an attempt that ended with status (or with a
+// connect error) may be retried.
+func (p *RetryPolicy) retryable(status int, connectErr bool) bool {
+	return connectErr || (len(p.Statuses) > 0 && p.Statuses.Contains(status))
+}
+
+// retryState follows the attempts of one request.
+type retryState struct {
+	pool  *ServerPool
+	req   *http.Request
+	body  []byte
+	tried []*Backend
+	// next is the backend (and whether it is a half-open trial) chosen for
+	// the following attempt
+	next      *Backend
+	nextTrial bool
+	// denied is set when a retryable failure was not retried because the
+	// budget ran out
+	denied bool
+}
+
+// startRetry returns the retry state of r, or nil when r cannot be retried
+// (no policy, method not allowed or body over the limit). The body of r is
+// buffered so it can be replayed.
+func (s *ServerPool) startRetry(r *http.Request, first *Backend) *retryState {
+	p := s.Retry
+	if p == nil {
+		return nil
+	}
+	s.retries.request(p.budgetWindow(), time.Now())
+	if !p.allowsMethod(r.Method) || p.attempts() < 2 {
+		return nil
+	}
+	rs := &retryState{pool: s, req: r, tried: []*Backend{first}}
+	if r.Body == nil || r.Body == http.NoBody {
+		return rs
+	}
+	if r.ContentLength > p.maxBodyBytes() {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, p.maxBodyBytes()+1))
+	if err != nil || int64(len(buf)) > p.maxBodyBytes() {
+		// hand the proxy what was read followed by the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	rs.body = buf
+	rs.rewind()
+	return rs
+}
+
+// rewind resets the request body for a new attempt.
+func (rs *retryState) rewind() {
+	if rs.body != nil {
+		rs.req.Body = io.NopCloser(bytes.NewReader(rs.body))
+	}
+}
+
+// canRetry reports whether another attempt is left after the current one.
+func (rs *retryState) canRetry() bool {
+	return rs != nil && len(rs.tried) < rs.pool.Retry.attempts()
+}
+
+// retry decides, when an attempt ends with status or a connect error,
+// whether to drop its response and try another backend, which is then
+// stored in next.
+func (rs *retryState) retry(status int, connectErr bool) bool {
+	s, p := rs.pool, rs.pool.Retry
+	if !p.retryable(status, connectErr) {
+		return false
+	}
+	peer := s.nextPeer(rs.req, rs.tried)
+	if peer == nil {
+		return false
+	}
+	// the budget is spent last, so a retry refused by the rate limiter or
+	// the circuit breaker costs nothing
+	now := time.Now()
+	undo, ok := peer.reserveToken(now)
+	if !ok {
+		return false
+	}
+	ok, trial := s.acquire(peer, now)
+	if !ok {
+		undo()
+		return false
+	}
+	if !s.retries.allow(p.budgetWindow(), p.budgetPct(), p.minRetries(), now) {
+		undo()
+		s.release(peer, trial)
+		rs.denied = true
+		return false
+	}
+	rs.tried = append(rs.tried, peer)
+	rs.next, rs.nextTrial = peer, trial
+	return true
+}
+
+// isConnectErr reports whether a transport error happened while dialing the
+// backend, i.e. before the request was sent.
+func isConnectErr(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
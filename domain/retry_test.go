@@ -0,0 +1,162 @@
+package domain
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func TestRetry_ConnectError(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadURL := dead.URL
+	dead.Close()
+
+	pool := &ServerPool{Name: "retry-connect", Retry: &RetryPolicy{BudgetPct: 100}}
+	pool.AddBackend(NewBackend(deadURL, 0, 1))
+	pool.AddBackend(NewBackend(ok.URL, 0, 1))
+	before := stats.SnapshotAll()[stats.Key("retry-connect", deadURL)].Retries
+
+	for i := 0; i < 4; i++ {
+		if code := serveOnce(pool); code != http.StatusOK {
+			t.Fatalf("request %d: expected retry on the healthy backend, got %d", i, code)
+		}
+	}
+	if n := stats.SnapshotAll()[stats.Key("retry-connect", deadURL)].Retries - before; n == 0 {
+		t.Fatal("expected retries recorded for the dead backend")
+	}
+}
+
+func TestRetry_StatusReplaysBody(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-From", "failing")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("down"))
+	}))
+	defer failing.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	statuses, _ := ParseStatusSet("503")
+	newPool := func(methods ...string) *ServerPool {
+		pool := &ServerPool{Retry: &RetryPolicy{Statuses: statuses, Methods: methods}}
+		pool.AddBackend(NewBackend(failing.URL, 0, 1))
+		pool.AddBackend(NewBackend(echo.URL, 0, 1))
+		return pool
+	}
+
+	// POST is not idempotent: not retried by default
+	rr := httptest.NewRecorder()
+	newPool().ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected POST not to be retried, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	newPool("POST").ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+	if rr.Code != http.StatusOK || rr.Body.String() != "payload" {
+		t.Fatalf("expected body replayed on the second backend, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("X-From") != "" {
+		t.Fatal("headers of the dropped response leaked to the client")
+	}
+}
+
+func TestRetry_BodyOverLimit(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	statuses, _ := ParseStatusSet("5xx")
+	pool := &ServerPool{Retry: &RetryPolicy{Statuses: statuses, MaxBodyBytes: 4}}
+	pool.AddBackend(NewBackend(failing.URL, 0, 1))
+	pool.AddBackend(NewBackend(echo.URL, 0, 1))
+
+	rr := httptest.NewRecorder()
+	pool.ServeHTTP(rr, httptest.NewRequest("PUT", "/", io.NopCloser(strings.NewReader("too large"))))
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected no retry for a body over the limit, got %d", rr.Code)
+	}
+	// the body still reaches the backend in full
+	rr = httptest.NewRecorder()
+	pool.ServeHTTP(rr, httptest.NewRequest("PUT", "/", io.NopCloser(strings.NewReader("too large"))))
+	if rr.Body.String() != "too large" {
+		t.Fatalf("expected full body forwarded, got %q", rr.Body.String())
+	}
+}
+
+func TestRetry_Budget(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	statuses, _ := ParseStatusSet("502")
+	pool := &ServerPool{Name: "retry-budget", Retry: &RetryPolicy{Statuses: statuses, Attempts: 2, BudgetPct: 1, MinRetries: 1}}
+	pool.AddBackend(NewBackend(failing.URL+"/a", 0, 1))
+	pool.AddBackend(NewBackend(failing.URL+"/b", 0, 1))
+
+	count := func() (retries, denied int64) {
+		for _, snap := range stats.SnapshotByPool()["retry-budget"] {
+			retries += snap.Retries
+			denied += snap.RetriesDenied
+		}
+		return retries, denied
+	}
+	retries0, denied0 := count()
+	for i := 0; i < 3; i++ {
+		serveOnce(pool)
+	}
+	retries, denied := count()
+	retries, denied = retries-retries0, denied-denied0
+	if retries != 1 || denied != 2 {
+		t.Fatalf("expected 1 retry and 2 denied by the budget, got %d and %d", retries, denied)
+	}
+}
+
+func TestRetry_RefusedRetryKeepsBudget(t *testing.T) {
+	statuses, _ := ParseStatusSet("502")
+	pool := &ServerPool{Name: "retry-refused", Retry: &RetryPolicy{Statuses: statuses, BudgetPct: 1, MinRetries: 1}}
+	a := NewBackend("http://127.0.0.1:1/a", 0, 1)
+	b := NewBackend("http://127.0.0.1:1/b", 1, 1)
+	pool.AddBackend(a)
+	pool.AddBackend(b)
+	p := pool.Retry
+	newState := func() *retryState {
+		return &retryState{pool: pool, req: httptest.NewRequest("GET", "/", nil), tried: []*Backend{a}}
+	}
+
+	// the limiter of b is empty: the retry is refused without spending budget
+	b.RateLimiter().Allow()
+	if newState().retry(http.StatusBadGateway, false) {
+		t.Fatal("expected the rate limiter to refuse the retry")
+	}
+	if !pool.retries.allow(p.budgetWindow(), p.budgetPct(), p.minRetries(), time.Now()) {
+		t.Fatal("a retry refused by the rate limiter spent the budget")
+	}
+
+	// the budget is now spent: the retry is denied and b keeps its token
+	b.SetRateLimit(0, 0)
+	b.SetRateLimit(1, 1)
+	rs := newState()
+	if rs.retry(http.StatusBadGateway, false) || !rs.denied {
+		t.Fatal("expected the budget to deny the retry")
+	}
+	if !b.RateLimiter().Allow() {
+		t.Fatal("a retry denied by the budget took a rate limit token")
+	}
+}
@@ -0,0 +1,266 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Route ordering modes for Router.Order.
+const (
+	// OrderFirstMatch tries routes in the order they were added.
+	OrderFirstMatch = "first_match"
+	// OrderMostSpecific tries the most specific routes first: exact hosts
+	// before wildcards, exact paths before regexes before longer prefixes,
+	// and routes with more method/header conditions first.
+	OrderMostSpecific = "most_specific"
+)
+
+// Route sends requests matching every non-empty condition to Pool.
+type Route struct {
+	// Name is used in logs; optional.
+	Name string
+	// Host matches the request host (port ignored, case-insensitive).
+	// A leading "*." matches any subdomain: "*.example.com" matches
+	// "api.example.com" and "a.b.example.com" but not "example.com".
+	Host string
+	// Path matches the request path exactly.
+	Path string
+	// PathPrefix matches paths starting with it.
+	PathPrefix string
+	// PathRegex matches paths against a regular expression.
+	PathRegex string
+	// Methods restricts the HTTP methods (case-insensitive).
+	Methods []string
+	// Headers requires each header to be present; a non-empty value must
+	// also match exactly.
+	Headers map[string]string
+	Pool    *ServerPool
+	// Hedge, when set, enables hedged requests for the route's traffic.
+	Hedge *HedgePolicy
+	// ClientCert, when set, answers 403 to matching requests whose client
+	// certificate does not satisfy it. It does not take part in matching.
+	ClientCert *ClientCertRule
+
+	pathRe *regexp.Regexp
+	seq    int
+	hedges budget
+}
+
+// InheritState carries over the hedge budget of prev, the route r replaces on
+// a reload, when both routes hedge with the same budget window.
+func (r *Route) InheritState(prev *Route) {
+	if r.Hedge != nil && prev.Hedge != nil && r.Hedge.budgetWindow() == prev.Hedge.budgetWindow() {
+		r.hedges.copyFrom(&prev.hedges)
+	}
+}
+
+// Router dispatches requests to named pools according to its routes.
+// Requests matching no route go to Default, or get a 404 when it is nil.
+// Routes must be added before the router starts serving.
+type Router struct {
+	// Order is OrderFirstMatch (default) or OrderMostSpecific.
+	Order   string
+	Default *ServerPool
+
+	routes []*Route
+	extra  []*ServerPool
+}
+
+// AddRoute validates route and appends it to the router.
+func (rt *Router) AddRoute(route *Route) error {
+	if route.Pool == nil {
+		return fmt.Errorf("route %q: pool is required", route.Name)
+	}
+	if route.PathRegex != "" {
+		re, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			return fmt.Errorf("route %q: invalid path regex: %w", route.Name, err)
+		}
+		route.pathRe = re
+	}
+	if route.ClientCert != nil && route.ClientCert.SubjectRegex != "" {
+		re, err := regexp.Compile(route.ClientCert.SubjectRegex)
+		if err != nil {
+			return fmt.Errorf("route %q: invalid client cert subject regex: %w", route.Name, err)
+		}
+		route.ClientCert.subjectRe = re
+	}
+	if route.Path != "" && route.PathPrefix != "" {
+		return fmt.Errorf("route %q: path and path_prefix are mutually exclusive", route.Name)
+	}
+	route.seq = len(rt.routes)
+	rt.routes = append(rt.routes, route)
+	if rt.Order == OrderMostSpecific {
+		sort.SliceStable(rt.routes, func(i, j int) bool {
+			si, sj := rt.routes[i].specificity(), rt.routes[j].specificity()
+			for k := range si {
+				if si[k] != sj[k] {
+					return si[k] > sj[k]
+				}
+			}
+			return rt.routes[i].seq < rt.routes[j].seq
+		})
+	}
+	return nil
+}
+
+// Routes returns the routes in matching order.
+func (rt *Router) Routes() []*Route {
+	out := make([]*Route, len(rt.routes))
+	copy(out, rt.routes)
+	return out
+}
+
+// AddPool registers a pool that no route references yet, so it is still
+// listed by Pools (for health checks and management).
+func (rt *Router) AddPool(pool *ServerPool) {
+	rt.extra = append(rt.extra, pool)
+}
+
+// Pools returns every distinct pool known to the router, the default pool
+// first.
+func (rt *Router) Pools() []*ServerPool {
+	seen := map[*ServerPool]bool{}
+	var out []*ServerPool
+	add := func(p *ServerPool) {
+		if p != nil && !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	add(rt.Default)
+	for _, r := range rt.routes {
+		add(r.Pool)
+	}
+	for _, p := range rt.extra {
+		add(p)
+	}
+	return out
+}
+
+// Match returns the pool that should serve r, or nil.
+func (rt *Router) Match(r *http.Request) *ServerPool {
+	if route := rt.matchRoute(r); route != nil {
+		return route.Pool
+	}
+	return rt.Default
+}
+
+// matchRoute returns the first route matching r, or nil.
+func (rt *Router) matchRoute(r *http.Request) *Route {
+	for _, route := range rt.routes {
+		if route.Matches(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := rt.matchRoute(r)
+	if route != nil && route.ClientCert != nil && !route.ClientCert.Allows(r) {
+		http.Error(w, ClientCertForbiddenBody, http.StatusForbidden)
+		return
+	}
+	if route != nil && route.Hedge != nil {
+		route.Pool.serveHedged(w, r, route.Hedge, &route.hedges)
+		return
+	}
+	pool := rt.Default
+	if route != nil {
+		pool = route.Pool
+	}
+	if pool == nil {
+		http.Error(w, "Nenhuma rota encontrada", http.StatusNotFound)
+		return
+	}
+	pool.ServeHTTP(w, r)
+}
+
+// Matches reports whether r satisfies every condition of the route.
+func (route *Route) Matches(r *http.Request) bool {
+	if route.Host != "" && !matchHost(route.Host, r.Host) {
+		return false
+	}
+	path := r.URL.Path
+	if route.Path != "" && path != route.Path {
+		return false
+	}
+	if route.PathPrefix != "" && !strings.HasPrefix(path, route.PathPrefix) {
+		return false
+	}
+	if route.pathRe != nil && !route.pathRe.MatchString(path) {
+		return false
+	}
+	if len(route.Methods) > 0 {
+		ok := false
+		for _, m := range route.Methods {
+			if strings.EqualFold(m, r.Method) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for name, want := range route.Headers {
+		vals, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "" && !contains(vals, want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity ranks a route for OrderMostSpecific; compared lexicographically.
+func (route *Route) specificity() [5]int {
+	var s [5]int
+	switch {
+	case route.Host == "":
+	case strings.HasPrefix(route.Host, "*."):
+		s[0] = 1
+	default:
+		s[0] = 2
+	}
+	switch {
+	case route.Path != "":
+		s[1] = 3
+	case route.PathRegex != "":
+		s[1] = 2
+	case route.PathPrefix != "":
+		s[1] = 1
+	}
+	s[2] = len(route.PathPrefix)
+	s[3] = len(route.Headers)
+	if len(route.Methods) > 0 {
+		s[4] = 1
+	}
+	return s
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+func contains(vals []string, want string) bool {
+	for _, v := range vals {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
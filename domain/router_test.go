@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter_Matching(t *testing.T) {
+	api := &ServerPool{Name: "api"}
+	static := &ServerPool{Name: "static"}
+	admin := &ServerPool{Name: "admin"}
+	web := &ServerPool{Name: "web"}
+
+	rt := &Router{Default: web}
+	routes := []*Route{
+		{Name: "admin", Host: "admin.example.com", Methods: []string{"GET", "post"}, Pool: admin},
+		{Name: "static", Host: "*.cdn.example.com", Pool: static},
+		{Name: "api-v2", PathRegex: `^/v2/users/\d+$`, Headers: map[string]string{"X-Canary": ""}, Pool: api},
+		{Name: "api", PathPrefix: "/api/", Pool: api},
+	}
+	for _, r := range routes {
+		if err := rt.AddRoute(r); err != nil {
+			t.Fatalf("AddRoute: %v", err)
+		}
+	}
+
+	cases := []struct {
+		method, host, path string
+		headers            map[string]string
+		want               *ServerPool
+	}{
+		{"GET", "admin.example.com:8080", "/", nil, admin},
+		{"DELETE", "admin.example.com", "/", nil, web},
+		{"GET", "img.cdn.example.com", "/a.png", nil, static},
+		{"GET", "cdn.example.com", "/a.png", nil, web},
+		{"GET", "example.com", "/api/users", nil, api},
+		{"GET", "example.com", "/v2/users/42", map[string]string{"X-Canary": "1"}, api},
+		{"GET", "example.com", "/v2/users/42", nil, web},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "http://"+c.host+c.path, nil)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		if got := rt.Match(req); got != c.want {
+			t.Errorf("%s %s%s: expected pool %s, got %v", c.method, c.host, c.path, c.want.Name, got)
+		}
+	}
+}
+
+func TestRouter_MostSpecificOrder(t *testing.T) {
+	broad := &ServerPool{Name: "broad"}
+	narrow := &ServerPool{Name: "narrow"}
+	exact := &ServerPool{Name: "exact"}
+
+	rt := &Router{Order: OrderMostSpecific}
+	_ = rt.AddRoute(&Route{PathPrefix: "/", Pool: broad})
+	_ = rt.AddRoute(&Route{PathPrefix: "/api/v1/", Pool: narrow})
+	_ = rt.AddRoute(&Route{Host: "*.example.com", PathPrefix: "/", Pool: broad})
+	_ = rt.AddRoute(&Route{Host: "api.example.com", Path: "/api/v1/health", Pool: exact})
+
+	if got := rt.Match(httptest.NewRequest("GET", "http://x.org/api/v1/users", nil)); got != narrow {
+		t.Fatalf("expected longer prefix to win, got %v", got.Name)
+	}
+	if got := rt.Match(httptest.NewRequest("GET", "http://api.example.com/api/v1/health", nil)); got != exact {
+		t.Fatalf("expected exact host+path to win, got %v", got.Name)
+	}
+
+	// first_match keeps insertion order
+	fm := &Router{}
+	_ = fm.AddRoute(&Route{PathPrefix: "/", Pool: broad})
+	_ = fm.AddRoute(&Route{PathPrefix: "/api/v1/", Pool: narrow})
+	if got := fm.Match(httptest.NewRequest("GET", "/api/v1/users", nil)); got != broad {
+		t.Fatalf("expected first route to win in first_match, got %v", got.Name)
+	}
+}
+
+func TestRouter_NoMatch404AndValidation(t *testing.T) {
+	rt := &Router{}
+	if err := rt.AddRoute(&Route{PathRegex: "("}); err == nil {
+		t.Fatal("expected error for route without pool")
+	}
+	if err := rt.AddRoute(&Route{PathRegex: "(", Pool: &ServerPool{}}); err == nil {
+		t.Fatal("expected error for invalid regex")
+	}
+
+	rr := httptest.NewRecorder()
+	rt.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without routes or default, got %d", rr.Code)
+	}
+}
+
+func TestRouter_PoolsDistinct(t *testing.T) {
+	a := &ServerPool{Name: "a"}
+	b := &ServerPool{Name: "b"}
+	rt := &Router{Default: a}
+	_ = rt.AddRoute(&Route{PathPrefix: "/x", Pool: b})
+	_ = rt.AddRoute(&Route{PathPrefix: "/y", Pool: b})
+	if pools := rt.Pools(); len(pools) != 2 || pools[0] != a || pools[1] != b {
+		t.Fatalf("unexpected pools: %v", pools)
+	}
+}
@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStickyCookie is the affinity cookie name used when none is set.
+const DefaultStickyCookie = "VORTICE_AFFINITY"
+
+// StickySession configures cookie-based session affinity. The first response
+// to a client carries a cookie identifying the backend that served it; later
+// requests with that cookie go to the same backend while it is alive and in
+// the pool, and are balanced normally (and re-issued a cookie) otherwise.
+type StickySession struct {
+	// CookieName defaults to DefaultStickyCookie.
+	CookieName string
+	// TTL is the cookie lifetime; 0 issues a session cookie.
+	TTL      time.Duration
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+	// Secret, when set, signs the cookie with HMAC-SHA256 so clients cannot
+	// forge affinity to a backend of their choice.
+	Secret []byte
+}
+
+// ParseSameSite converts "lax", "strict" or "none" to an http.SameSite;
+// anything else yields http.SameSiteDefaultMode.
+func ParseSameSite(s string) http.SameSite {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteDefaultMode
+	}
+}
+
+func (ss *StickySession) cookieName() string {
+	if ss.CookieName != "" {
+		return ss.CookieName
+	}
+	return DefaultStickyCookie
+}
+
+// stickyID is the opaque id stored in the cookie; it avoids exposing
+// backend URLs to clients.
+func stickyID(b *Backend) string {
+	return strconv.FormatUint(hash64(b.URL.String()), 36)
+}
+
+func (ss *StickySession) sign(id string) string {
+	if len(ss.Secret) == 0 {
+		return id
+	}
+	mac := hmac.New(sha256.New, ss.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the backend id carried by a cookie value, or "" when the
+// signature does not match.
+func (ss *StickySession) verify(value string) string {
+	if len(ss.Secret) == 0 {
+		return value
+	}
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(ss.sign(id)), []byte(value)) {
+		return ""
+	}
+	return id
+}
+
+// Cookie builds the affinity cookie pointing at b.
+func (ss *StickySession) Cookie(b *Backend) *http.Cookie {
+	c := &http.Cookie{
+		Name:     ss.cookieName(),
+		Value:    ss.sign(stickyID(b)),
+		Path:     ss.Path,
+		Secure:   ss.Secure,
+		HttpOnly: ss.HttpOnly,
+		SameSite: ss.SameSite,
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if ss.TTL > 0 {
+		c.MaxAge = int(ss.TTL / time.Second)
+		c.Expires = time.Now().Add(ss.TTL)
+	}
+	return c
+}
+
+// stickyPeer returns the alive backend referenced by the request's affinity
+// cookie, or nil when there is no valid cookie or its backend is gone,
+// disabled, ejected or behind an open circuit. Draining backends keep
+// serving their sticky clients.
+func (s *ServerPool) stickyPeer(r *http.Request) *Backend {
+	c, err := r.Cookie(s.Sticky.cookieName())
+	if err != nil {
+		return nil
+	}
+	id := s.Sticky.verify(c.Value)
+	if id == "" {
+		return nil
+	}
+	for _, be := range s.list() {
+		if stickyID(be) == id {
+			now := time.Now()
+			if be.IsAlive() && be.State() != StateDisabled && !s.ejected(be, now) && s.circuitAllows(be, now) {
+				return be
+			}
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStickyPool returns a pool of three backends that answer with their
+// name, and the backends indexed by that name.
+func newStickyPool(t *testing.T, ss *StickySession) (*ServerPool, map[string]*Backend) {
+	t.Helper()
+	pool := &ServerPool{Algorithm: "round_robin", Sticky: ss}
+	byName := map[string]*Backend{}
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		t.Cleanup(srv.Close)
+		byName[name] = NewBackend(srv.URL, 0, 1)
+		pool.AddBackend(byName[name])
+	}
+	return pool, byName
+}
+
+func doRequest(pool *ServerPool, cookie *http.Cookie) (string, *http.Cookie) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	pool.ServeHTTP(rr, req)
+	body, _ := io.ReadAll(rr.Body)
+	var issued *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		issued = c
+	}
+	return string(body), issued
+}
+
+func TestSticky_RoutesToSameBackend(t *testing.T) {
+	pool, _ := newStickyPool(t, &StickySession{HttpOnly: true, TTL: time.Hour, SameSite: ParseSameSite("lax")})
+
+	first, cookie := doRequest(pool, nil)
+	if cookie == nil {
+		t.Fatal("expected affinity cookie on first response")
+	}
+	if cookie.Name != DefaultStickyCookie || !cookie.HttpOnly || cookie.MaxAge != 3600 || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected cookie attributes: %+v", cookie)
+	}
+	if strings.Contains(cookie.Value, "127.0.0.1") {
+		t.Fatalf("cookie should not expose backend url: %q", cookie.Value)
+	}
+
+	for i := 0; i < 5; i++ {
+		body, again := doRequest(pool, cookie)
+		if body != first {
+			t.Fatalf("expected sticky backend %q, got %q", first, body)
+		}
+		if again != nil {
+			t.Fatalf("cookie should not be re-issued for a valid affinity")
+		}
+	}
+}
+
+func TestSticky_FallbackWhenBackendDead(t *testing.T) {
+	pool, byName := newStickyPool(t, &StickySession{})
+	first, cookie := doRequest(pool, nil)
+	byName[first].SetAlive(false)
+
+	body, reissued := doRequest(pool, cookie)
+	if body == first {
+		t.Fatalf("dead backend %q should not receive sticky traffic", first)
+	}
+	if reissued == nil {
+		t.Fatal("expected a new affinity cookie after fallback")
+	}
+}
+
+func TestSticky_RejectsForgedSignature(t *testing.T) {
+	ss := &StickySession{Secret: []byte("s3cret")}
+	pool, _ := newStickyPool(t, ss)
+	_, cookie := doRequest(pool, nil)
+	if !strings.Contains(cookie.Value, ".") {
+		t.Fatalf("expected signed cookie value, got %q", cookie.Value)
+	}
+
+	forged := &http.Cookie{Name: cookie.Name, Value: strings.Split(cookie.Value, ".")[0] + ".bogus"}
+	if _, reissued := doRequest(pool, forged); reissued == nil {
+		t.Fatal("forged cookie should be ignored and a fresh one issued")
+	}
+	if _, reissued := doRequest(pool, cookie); reissued != nil {
+		t.Fatal("valid signed cookie should be honoured")
+	}
+}
+
+func TestSticky_DrainingKeepsSessions(t *testing.T) {
+	pool, byName := newStickyPool(t, &StickySession{})
+	first, cookie := doRequest(pool, nil)
+	byName[first].SetState(StateDraining)
+
+	if body, _ := doRequest(pool, cookie); body != first {
+		t.Fatalf("draining backend %q should keep its sticky clients, got %q", first, body)
+	}
+	for i := 0; i < 6; i++ {
+		if body, _ := doRequest(pool, nil); body == first {
+			t.Fatalf("draining backend %q should not receive new sessions", first)
+		}
+	}
+
+	byName[first].SetState(StateDisabled)
+	if body, _ := doRequest(pool, cookie); body == first {
+		t.Fatalf("disabled backend %q should not receive sticky traffic", first)
+	}
+}
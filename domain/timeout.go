@@ -0,0 +1,142 @@
+package domain
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts bounds the requests proxied to a backend. Zero fields keep the
+// defaults of http.DefaultTransport (30s to connect, 10s for the TLS
+// handshake, 90s for idle connections) or, for ResponseHeader and Request,
+// no limit.
+type Timeouts struct {
+	// Connect bounds establishing the TCP connection.
+	Connect time.Duration
+	// TLSHandshake bounds the TLS handshake with https backends.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds the wait for the response headers once the
+	// request was written.
+	ResponseHeader time.Duration
+	// Request bounds a whole attempt, response body included.
+	Request time.Duration
+	// Idle is how long an unused upstream connection is kept open.
+	Idle time.Duration
+}
+
+// Merge returns t with the non-zero fields of over applied on top; either
+// may be nil.
+func (t *Timeouts) Merge(over *Timeouts) *Timeouts {
+	switch {
+	case t == nil:
+		return over
+	case over == nil:
+		return t
+	}
+	out := *t
+	for _, f := range []struct{ dst, src *time.Duration }{
+		{&out.Connect, &over.Connect},
+		{&out.TLSHandshake, &over.TLSHandshake},
+		{&out.ResponseHeader, &over.ResponseHeader},
+		{&out.Request, &over.Request},
+		{&out.Idle, &over.Idle},
+	} {
+		if *f.src > 0 {
+			*f.dst = *f.src
+		}
+	}
+	return &out
+}
+
+// newTransport builds the upstream transport for t, tc and the protocol p;
+// t and tc may be nil and p empty.
+func newTransport(t *Timeouts, tc *tls.Config, p string) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if tc != nil {
+		// the transport adds its ALPN protocols to the config it is given
+		tr.TLSClientConfig = tc.Clone()
+	}
+	tr.Protocols = protocols(p)
+	if t == nil {
+		return tr
+	}
+	if t.Connect > 0 {
+		tr.DialContext = (&net.Dialer{Timeout: t.Connect, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if t.TLSHandshake > 0 {
+		tr.TLSHandshakeTimeout = t.TLSHandshake
+	}
+	if t.ResponseHeader > 0 {
+		tr.ResponseHeaderTimeout = t.ResponseHeader
+	}
+	if t.Idle > 0 {
+		tr.IdleConnTimeout = t.Idle
+	}
+	return tr
+}
+
+// Timeouts returns the backend's timeouts, or nil when none are set.
+func (b *Backend) Timeouts() *Timeouts {
+	return b.timeouts.Load()
+}
+
+// SetTimeouts changes the backend's timeouts at runtime. New requests use a
+// fresh transport; idle connections of the previous one are closed.
+func (b *Backend) SetTimeouts(t *Timeouts) {
+	b.transportMu.Lock()
+	defer b.transportMu.Unlock()
+	b.timeouts.Store(t)
+	b.swapTransport()
+}
+
+// swapTransport replaces the transport with one built from the current
+// timeouts, TLS settings and protocol (none = http.DefaultTransport).
+// Callers hold transportMu.
+func (b *Backend) swapTransport() {
+	var tr *http.Transport
+	if t := b.timeouts.Load(); t != nil || b.tlsConfig != nil || b.protocol != "" {
+		tr = newTransport(t, b.tlsConfig, b.protocol)
+	}
+	if old := b.transport.Swap(tr); old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// backendTransport sends the proxied requests of a backend through its
+// current transport, so it can be replaced while requests are in flight.
+type backendTransport struct {
+	b *Backend
+}
+
+func (bt backendTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var rt http.RoundTripper = http.DefaultTransport
+	if tr := bt.b.transport.Load(); tr != nil {
+		rt = tr
+	}
+	resp, err := rt.RoundTrip(r)
+	if rec, ok := r.Context().Value(recorderKey{}).(*statusRecorder); ok && err == nil {
+		rec.upstreamProto = resp.Proto
+	}
+	return resp, err
+}
+
+// withRequestTimeout bounds r by the backend's request timeout; the returned
+// function releases the timer.
+func (b *Backend) withRequestTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	t := b.Timeouts()
+	if t == nil || t.Request <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), t.Request)
+	return r.WithContext(ctx), cancel
+}
+
+// isTimeout reports whether a transport error is a timeout (connect, TLS
+// handshake, response header or request deadline).
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vime-Sistemas/vortice/stats"
+)
+
+func TestTimeouts_GatewayTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name string
+		t    *Timeouts
+	}{
+		{"response-header", &Timeouts{ResponseHeader: 20 * time.Millisecond}},
+		{"request", &Timeouts{Request: 20 * time.Millisecond}},
+	} {
+		pool := &ServerPool{Name: "timeout-" + tc.name}
+		b := NewBackend(srv.URL, 0, 1)
+		b.SetTimeouts(tc.t)
+		pool.AddBackend(b)
+
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		pool.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != http.StatusGatewayTimeout || rr.Body.String() != TimeoutBody {
+			t.Fatalf("%s: expected 504 %q, got %d %q", tc.name, TimeoutBody, rr.Code, rr.Body.String())
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("%s: timeout took %v", tc.name, d)
+		}
+		if snap := stats.SnapshotAll()[stats.Key(pool.Name, srv.URL)]; snap.Timeouts == 0 {
+			t.Fatalf("%s: timeout not recorded in stats: %+v", tc.name, snap)
+		}
+	}
+}
+
+func TestTimeouts_Unset(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{}
+	b := NewBackend(srv.URL, 0, 1)
+	b.SetTimeouts(&Timeouts{Request: time.Millisecond})
+	b.SetTimeouts(nil)
+	pool.AddBackend(b)
+	if code := serveOnce(pool); code != http.StatusOK {
+		t.Fatalf("expected no timeout after clearing it, got %d", code)
+	}
+}
+
+func TestTimeouts_Merge(t *testing.T) {
+	pool := &Timeouts{Connect: time.Second, Request: 10 * time.Second}
+	got := pool.Merge(&Timeouts{Request: 2 * time.Second, Idle: time.Minute})
+	want := Timeouts{Connect: time.Second, Request: 2 * time.Second, Idle: time.Minute}
+	if *got != want {
+		t.Fatalf("expected %+v, got %+v", want, *got)
+	}
+	if pool.Request != 10*time.Second {
+		t.Fatal("Merge must not modify the receiver")
+	}
+	if (*Timeouts)(nil).Merge(pool) != pool || pool.Merge(nil) != pool {
+		t.Fatal("Merge with nil should return the other side")
+	}
+}
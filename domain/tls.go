@@ -0,0 +1,105 @@
+package domain
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// UpstreamTLS configures the TLS connections to https backends. The PEM
+// fields hold the contents of the files, so two configurations built from
+// the same files compare equal.
+type UpstreamTLS struct {
+	// CA is the PEM bundle trusted to verify the backend certificates; empty
+	// uses the system roots.
+	CA []byte
+	// InsecureSkipVerify accepts any backend certificate (development only).
+	InsecureSkipVerify bool
+	// ServerName overrides the name sent in SNI and verified in the backend
+	// certificate; empty uses the host of the backend URL.
+	ServerName string
+	// Cert (with its chain) and Key are the PEM client certificate and
+	// private key presented for mutual TLS.
+	Cert []byte
+	Key  []byte
+}
+
+// Merge returns t with the set fields of over applied on top; either may be
+// nil. The client certificate and key are replaced together.
+func (t *UpstreamTLS) Merge(over *UpstreamTLS) *UpstreamTLS {
+	switch {
+	case t == nil:
+		return over
+	case over == nil:
+		return t
+	}
+	out := *t
+	if len(over.CA) > 0 {
+		out.CA = over.CA
+	}
+	if over.InsecureSkipVerify {
+		out.InsecureSkipVerify = true
+	}
+	if over.ServerName != "" {
+		out.ServerName = over.ServerName
+	}
+	if len(over.Cert) > 0 {
+		out.Cert, out.Key = over.Cert, over.Key
+	}
+	return &out
+}
+
+// Config builds the client TLS configuration for t.
+func (t *UpstreamTLS) Config() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ServerName:         t.ServerName,
+	}
+	if len(t.CA) > 0 {
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(t.CA) {
+			return nil, errors.New("ca: nenhum certificado PEM válido")
+		}
+	}
+	if len(t.Cert) > 0 || len(t.Key) > 0 {
+		cert, err := tls.X509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cert/key: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// UpstreamTLS returns the backend's TLS settings, or nil when none are set.
+func (b *Backend) UpstreamTLS() *UpstreamTLS {
+	return b.upstreamTLS.Load()
+}
+
+// SetUpstreamTLS changes the TLS settings of the connections to the backend
+// at runtime, for proxied requests and health checks alike. New requests use
+// a fresh transport; idle connections of the previous one are closed. On
+// error the current settings are kept.
+func (b *Backend) SetUpstreamTLS(t *UpstreamTLS) error {
+	var tc *tls.Config
+	if t != nil {
+		var err error
+		if tc, err = t.Config(); err != nil {
+			return err
+		}
+	}
+	b.transportMu.Lock()
+	defer b.transportMu.Unlock()
+	b.upstreamTLS.Store(t)
+	b.tlsConfig = tc
+	b.swapTransport()
+	return nil
+}
+
+// healthClient sends the health checks through the backend's transport, so
+// they use the same TLS settings and timeouts as the proxied requests.
+func (b *Backend) healthClient() *http.Client {
+	return &http.Client{Transport: backendTransport{b}}
+}
@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testClientCert returns a PEM client certificate for cn, signed by itself,
+// and its key.
+func testClientCert(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestUpstreamTLS_MutualTLS(t *testing.T) {
+	clientCert, clientKey := testClientCert(t, "vortice")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	b := NewBackend(srv.URL, 0, 1)
+	pool := &ServerPool{Name: "upstream-tls"}
+	pool.AddBackend(b)
+
+	// the test server certificate is not trusted by the system roots
+	if code := serveOnce(pool); code == http.StatusOK {
+		t.Fatal("expected an unknown CA to be rejected")
+	}
+	if b.CheckHealth() {
+		t.Fatal("expected the health check to reject an unknown CA")
+	}
+
+	// trusted, but without a client certificate
+	if err := b.SetUpstreamTLS(&UpstreamTLS{CA: ca}); err != nil {
+		t.Fatalf("SetUpstreamTLS: %v", err)
+	}
+	if code := serveOnce(pool); code == http.StatusOK {
+		t.Fatal("expected the backend to require a client certificate")
+	}
+
+	if err := b.SetUpstreamTLS(&UpstreamTLS{CA: ca, Cert: clientCert, Key: clientKey}); err != nil {
+		t.Fatalf("SetUpstreamTLS: %v", err)
+	}
+	b.SetAlive(true)
+	rr := httptest.NewRecorder()
+	pool.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "vortice" {
+		t.Fatalf("expected 200 with the client certificate, got %d %q", rr.Code, rr.Body.String())
+	}
+	if !b.CheckHealth() {
+		t.Fatal("expected the health check to use the client certificate")
+	}
+}
+
+func TestUpstreamTLS_ServerName(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	// the test certificate is valid for example.com, not for other.test
+	b := NewBackend(srv.URL, 0, 1)
+	b.SetUpstreamTLS(&UpstreamTLS{CA: ca, ServerName: "other.test"})
+	if b.CheckHealth() {
+		t.Fatal("expected a server name mismatch")
+	}
+	b.SetUpstreamTLS(&UpstreamTLS{CA: ca, ServerName: "example.com"})
+	if !b.CheckHealth() {
+		t.Fatal("expected the overridden server name to verify")
+	}
+	b.SetUpstreamTLS(&UpstreamTLS{InsecureSkipVerify: true})
+	if !b.CheckHealth() {
+		t.Fatal("expected insecure_skip_verify to accept the certificate")
+	}
+}
+
+func TestUpstreamTLS_Invalid(t *testing.T) {
+	b := NewBackend("https://localhost:1", 0, 1)
+	want := &UpstreamTLS{InsecureSkipVerify: true}
+	b.SetUpstreamTLS(want)
+	if err := b.SetUpstreamTLS(&UpstreamTLS{CA: []byte("not pem")}); err == nil {
+		t.Fatal("expected an error for an invalid CA")
+	}
+	cert, _ := testClientCert(t, "vortice")
+	if err := b.SetUpstreamTLS(&UpstreamTLS{Cert: cert}); err == nil {
+		t.Fatal("expected an error for a certificate without its key")
+	}
+	if b.UpstreamTLS() != want {
+		t.Fatal("expected the previous settings to be kept on error")
+	}
+}
+
+func TestUpstreamTLS_Merge(t *testing.T) {
+	pool := &UpstreamTLS{CA: []byte("ca"), Cert: []byte("c1"), Key: []byte("k1")}
+	got := pool.Merge(&UpstreamTLS{ServerName: "api.internal", Cert: []byte("c2"), Key: []byte("k2")})
+	if string(got.CA) != "ca" || got.ServerName != "api.internal" || string(got.Cert) != "c2" || string(got.Key) != "k2" {
+		t.Fatalf("unexpected merge %+v", got)
+	}
+	if string(pool.Cert) != "c1" {
+		t.Fatal("Merge must not modify the receiver")
+	}
+	if (*UpstreamTLS)(nil).Merge(pool) != pool || pool.Merge(nil) != pool {
+		t.Fatal("Merge with nil should return the other side")
+	}
+}
@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// weightedRoundRobin implements nginx's smooth weighted round robin: every
+// pick adds each backend's weight to its current score, the highest score
+// wins and is lowered by the total weight. Heavier backends are chosen more
+// often without being chosen in long bursts.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Backend]int64
+}
+
+func (w *weightedRoundRobin) Next(alive []*Backend, _ *http.Request) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current == nil || len(w.current) > len(alive) {
+		// drop scores of backends that left the alive set
+		prev := w.current
+		w.current = make(map[*Backend]int64, len(alive))
+		for _, be := range alive {
+			w.current[be] = prev[be]
+		}
+	}
+
+	var total int64
+	var best *Backend
+	for _, be := range alive {
+		weight := int64(be.Weight())
+		if weight <= 0 {
+			continue
+		}
+		w.current[be] += weight
+		total += weight
+		if best == nil || w.current[be] > w.current[best] {
+			best = be
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	w.current[best] -= total
+	return best
+}
+
+// weightedRandom picks a backend with probability proportional to its weight.
+// Weights are read once, so a weight changed meanwhile cannot make the pick
+// fall through.
+func weightedRandom(alive []*Backend, _ *http.Request) *Backend {
+	weights := make([]int64, len(alive))
+	var total int64
+	for i, be := range alive {
+		if weight := int64(be.Weight()); weight > 0 {
+			weights[i] = weight
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Int63n(total)
+	for i, weight := range weights {
+		if n < weight {
+			return alive[i]
+		}
+		n -= weight
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestWeightedRoundRobin_SmoothDistribution(t *testing.T) {
+	pool := &ServerPool{Algorithm: "weighted_round_robin"}
+	a := NewBackend("http://localhost:8081", 0, 1)
+	b := NewBackend("http://localhost:8082", 0, 1)
+	c := NewBackend("http://localhost:8083", 0, 1)
+	a.SetWeight(5)
+	pool.AddBackend(a)
+	pool.AddBackend(b)
+	pool.AddBackend(c)
+
+	// nginx sequence for weights 5,1,1 is a a b a c a a
+	want := []*Backend{a, a, b, a, c, a, a}
+	for i, w := range want {
+		if got := pool.GetNextPeer(nil); got != w {
+			t.Fatalf("step %d: expected %s, got %s", i, w.URL, got.URL)
+		}
+	}
+}
+
+func TestWeightedRoundRobin_ZeroWeightDrains(t *testing.T) {
+	pool := &ServerPool{Algorithm: "weighted_round_robin"}
+	a := NewBackend("http://localhost:8081", 0, 1)
+	b := NewBackend("http://localhost:8082", 0, 1)
+	pool.AddBackend(a)
+	pool.AddBackend(b)
+
+	b.SetWeight(0)
+	for i := 0; i < 10; i++ {
+		if got := pool.GetNextPeer(nil); got != a {
+			t.Fatalf("drained backend should not be picked, got %s", got.URL)
+		}
+	}
+
+	a.SetWeight(0)
+	if got := pool.GetNextPeer(nil); got != nil {
+		t.Fatalf("expected nil when every backend is drained, got %s", got.URL)
+	}
+}
+
+func TestWeightedRandom_Proportional(t *testing.T) {
+	pool := &ServerPool{Algorithm: "weighted_random"}
+	a := NewBackend("http://localhost:8081", 0, 1)
+	b := NewBackend("http://localhost:8082", 0, 1)
+	a.SetWeight(9)
+	pool.AddBackend(a)
+	pool.AddBackend(b)
+
+	counts := map[*Backend]int{}
+	for i := 0; i < 10000; i++ {
+		counts[pool.GetNextPeer(nil)]++
+	}
+	// expect ~90% on a; allow a wide margin to keep the test stable
+	if counts[a] < 8500 || counts[a] > 9500 {
+		t.Fatalf("expected ~9000 picks for a, got %d (b=%d)", counts[a], counts[b])
+	}
+}
+
+func TestBackend_SetWeightClampsNegative(t *testing.T) {
+	b := NewBackend("http://localhost:8081", 0, 1)
+	if b.Weight() != 1 {
+		t.Fatalf("expected default weight 1, got %d", b.Weight())
+	}
+	b.SetWeight(-3)
+	if b.Weight() != 0 {
+		t.Fatalf("expected negative weight clamped to 0, got %d", b.Weight())
+	}
+}
+
+func TestWeightedRandom_ConcurrentWeightChange(t *testing.T) {
+	a := NewBackend("http://localhost:8081", 0, 1)
+	b := NewBackend("http://localhost:8082", 0, 1)
+	alive := []*Backend{a, b}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for w := 1; ; w = 1001 - w {
+			select {
+			case <-stop:
+				return
+			default:
+				b.SetWeight(w)
+			}
+		}
+	}()
+	for i := 0; i < 20000; i++ {
+		if weightedRandom(alive, nil) == nil {
+			t.Fatal("a weight change made the pick fall through")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// windowBuckets is the number of slots a rollingWindow is split into.
+const windowBuckets = 10
+
+// rollingWindow counts requests, failures and slow calls over a sliding time
+// window split into windowBuckets slots. It is not safe for concurrent use.
+type rollingWindow struct {
+	buckets [windowBuckets]windowBucket
+}
+
+// windowBucket counts the requests of the slot that began at start (unix
+// nanoseconds).
+type windowBucket struct {
+	start             int64
+	reqs, fails, slow int
+}
+
+func slotStart(span time.Duration, now time.Time) (start, slot int64) {
+	slot = int64(span / windowBuckets)
+	if slot <= 0 {
+		slot = 1
+	}
+	return now.UnixNano() - now.UnixNano()%slot, slot
+}
+
+// add records one request finished at now in a window of length span.
+func (w *rollingWindow) add(span time.Duration, now time.Time, fail, slow bool) {
+	start, slot := slotStart(span, now)
+	b := &w.buckets[(start/slot)%windowBuckets]
+	if b.start != start {
+		*b = windowBucket{start: start}
+	}
+	b.reqs++
+	if fail {
+		b.fails++
+	}
+	if slow {
+		b.slow++
+	}
+}
+
+// totals sums the slots of the window of length span ending at now.
+func (w *rollingWindow) totals(span time.Duration, now time.Time) (reqs, fails, slow int) {
+	start, slot := slotStart(span, now)
+	oldest := start - slot*(windowBuckets-1)
+	for _, b := range w.buckets {
+		if b.start >= oldest {
+			reqs += b.reqs
+			fails += b.fails
+			slow += b.slow
+		}
+	}
+	return reqs, fails, slow
+}
+
+func (w *rollingWindow) reset() {
+	w.buckets = [windowBuckets]windowBucket{}
+}
+
+// budget caps extra requests (retries, hedges) at a percentage of the
+// requests seen over a window.
+type budget struct {
+	mu    sync.Mutex
+	reqs  rollingWindow
+	extra rollingWindow
+}
+
+// request counts one request in the window of length span.
+func (b *budget) request(span time.Duration, now time.Time) {
+	b.mu.Lock()
+	b.reqs.add(span, now, false, false)
+	b.mu.Unlock()
+}
+
+// allow takes an extra request from the budget, reporting false when pct of
+// the requests in the window (and at least min) were already spent.
+func (b *budget) allow(span time.Duration, pct float64, min int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	reqs, _, _ := b.reqs.totals(span, now)
+	extra, _, _ := b.extra.totals(span, now)
+	if extra >= max(min, int(float64(reqs)*pct/100)) {
+		return false
+	}
+	b.extra.add(span, now, false, false)
+	return true
+}
+
+// copyFrom replaces the counts of b with those of prev.
+func (b *budget) copyFrom(prev *budget) {
+	prev.mu.Lock()
+	reqs, extra := prev.reqs, prev.extra
+	prev.mu.Unlock()
+	b.mu.Lock()
+	b.reqs, b.extra = reqs, extra
+	b.mu.Unlock()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 
@@ -13,8 +14,8 @@ func main() {
 	b := domain.NewBackend("http://localhost:8081", 0, 1)
 	pool.AddBackend(b)
 
-	// start background health checks
-	go pool.StartHealthCheck()
+	// start background health checks; cancel the context to stop them
+	go pool.StartHealthCheck(context.Background())
 
 	// serve the proxy on :8080
 	log.Println("Starting example proxy on :8080")
@@ -4,4 +4,8 @@ go 1.24.0
 
 toolchain go1.24.4
 
-require golang.org/x/time v0.14.0
+require (
+	golang.org/x/crypto v0.48.0
+	golang.org/x/time v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -36,11 +36,13 @@ DEFAULTS = {
     'RATE_LIMIT_RPS': '0',
     'RATE_LIMIT_BURST': '1',
     'BACKEND_RATE_LIMITS': '',
+    'BACKEND_WEIGHTS': '',
     'IP_HASH_HEADER': '',
+    'HASH_KEY': '',
     'INTERACTIVE': 'true'
 }
 
-ALGOS = ['round_robin', 'least_conn', 'random', 'ip_hash']
+ALGOS = ['round_robin', 'least_conn', 'random', 'ip_hash', 'weighted_round_robin', 'weighted_random', 'ring_hash', 'maglev', 'p2c', 'peak_ewma']
 
 
 def ask(prompt, default=None, yes=False):
@@ -128,7 +130,9 @@ def main():
     rate_rps = ask('RATE_LIMIT_RPS global (0 = desabilitado)', DEFAULTS['RATE_LIMIT_RPS'], yes)
     rate_burst = ask('RATE_LIMIT_BURST global', DEFAULTS['RATE_LIMIT_BURST'], yes)
     backend_rates = ask('Limites por backend como CSV (rps:burst;...) na ordem de BACKEND_URLS', DEFAULTS['BACKEND_RATE_LIMITS'], yes)
+    backend_weights = ask('Pesos por backend (w,w,...) na ordem de BACKEND_URLS', DEFAULTS['BACKEND_WEIGHTS'], yes)
     ip_hash_header = ask('Header para IP hash (deixe vazio para usar RemoteAddr)', DEFAULTS['IP_HASH_HEADER'], yes)
+    hash_key = ask('Chave para ring_hash/maglev (ip, header:X, cookie:X, path, query:X)', DEFAULTS['HASH_KEY'], yes)
     interactive = 'true' if confirm('Ativar console interativo (INTERACTIVE)?', DEFAULTS['INTERACTIVE'].lower()=='true', yes) else 'false'
 
     values = {
@@ -142,7 +146,9 @@ def main():
         'RATE_LIMIT_RPS': rate_rps,
         'RATE_LIMIT_BURST': rate_burst,
         'BACKEND_RATE_LIMITS': backend_rates,
+        'BACKEND_WEIGHTS': backend_weights,
         'IP_HASH_HEADER': ip_hash_header,
+        'HASH_KEY': hash_key,
         'INTERACTIVE': interactive,
     }
 
@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxHealthTransitions bounds the up/down history kept per backend.
+const maxHealthTransitions = 20
+
+// HealthTransition is a change of a backend's health check status.
+type HealthTransition struct {
+	At time.Time `json:"at"`
+	Up bool      `json:"up"`
+	// Reason is the failure of the check that took the backend down
+	// (timeout, "status 503", "conexão recusada"...); empty when it came up.
+	Reason string `json:"reason,omitempty"`
+}
+
+// HealthStatus is the active health check state of a backend.
+type HealthStatus struct {
+	Up                 bool      `json:"up"`
+	LastCheck          time.Time `json:"last_check"`
+	LastCheckOK        bool      `json:"last_check_ok"`
+	LastCheckLatencyMs float64   `json:"last_check_latency_ms"`
+	LastCheckError     string    `json:"last_check_error,omitempty"`
+	// Transitions lists the latest status changes, oldest first; the first
+	// check of a backend always counts as one.
+	Transitions []HealthTransition `json:"transitions"`
+}
+
+// healthState is kept in backendStats (guarded by its mutex).
+type healthState struct {
+	checked     bool
+	up          bool
+	last        time.Time
+	lastOK      bool
+	lastLatency time.Duration
+	lastError   string
+	transitions []HealthTransition
+}
+
+func (h *healthState) status() *HealthStatus {
+	if !h.checked {
+		return nil
+	}
+	return &HealthStatus{
+		Up:                 h.up,
+		LastCheck:          h.last,
+		LastCheckOK:        h.lastOK,
+		LastCheckLatencyMs: ms(h.lastLatency),
+		LastCheckError:     h.lastError,
+		Transitions:        slices.Clone(h.transitions),
+	}
+}
+
+// RecordHealthCheck records an active health check of a backend: ok and
+// reason are the result of the check itself, alive the backend status after
+// the rise/fall thresholds were applied. It updates the uptime and records a
+// transition when the status changed.
+func RecordHealthCheck(pool, url string, alive, ok bool, reason string, latency time.Duration) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	now := time.Now()
+	bs.recordHealth(alive, now)
+	h := &bs.health
+	if !h.checked || h.up != alive {
+		t := HealthTransition{At: now, Up: alive}
+		if !alive {
+			t.Reason = reason
+		}
+		h.transitions = append(h.transitions, t)
+		if len(h.transitions) > maxHealthTransitions {
+			h.transitions = slices.Delete(h.transitions, 0, len(h.transitions)-maxHealthTransitions)
+		}
+	}
+	h.checked, h.up = true, alive
+	h.last, h.lastOK, h.lastLatency, h.lastError = now, ok, latency, reason
+}
+
+// HealthSnapshot is the health of a backend served by HealthHandler.
+type HealthSnapshot struct {
+	Pool      string  `json:"pool,omitempty"`
+	URL       string  `json:"url"`
+	UptimePct float64 `json:"uptime_pct"`
+	*HealthStatus
+}
+
+// SnapshotHealth returns the health of the backends checked so far, keyed
+// like SnapshotAll.
+func SnapshotHealth() map[string]HealthSnapshot {
+	out := map[string]HealthSnapshot{}
+	for k, s := range SnapshotAll() {
+		if s.Health != nil {
+			out[k] = HealthSnapshot{Pool: s.Pool, URL: s.URL, UptimePct: s.UptimePct, HealthStatus: s.Health}
+		}
+	}
+	return out
+}
+
+// HealthHandler returns an http.Handler that serves SnapshotHealth as JSON.
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(SnapshotHealth())
+	})
+}
@@ -0,0 +1,253 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histogram
+// buckets used until SetBuckets is called.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// buckets are the histogram bounds of new backends (guarded by mu).
+var buckets = DefaultBuckets
+
+// SetBuckets changes the upper bounds of the latency histogram buckets;
+// bounds must be increasing, and empty bounds restore DefaultBuckets. The
+// histograms recorded so far are reset.
+func SetBuckets(bounds []time.Duration) {
+	secs := DefaultBuckets
+	if len(bounds) > 0 {
+		secs = make([]float64, len(bounds))
+		for i, b := range bounds {
+			secs[i] = b.Seconds()
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	buckets = secs
+	for _, bs := range stats {
+		bs.mutex.Lock()
+		bs.bounds, bs.latency, bs.latencySum = secs, make([]int64, len(secs)+1), 0
+		bs.mutex.Unlock()
+	}
+}
+
+// observe adds a request latency to the histogram; bs.mutex must be held.
+func (bs *backendStats) observe(d time.Duration) {
+	secs := d.Seconds()
+	i, _ := slices.BinarySearch(bs.bounds, secs)
+	bs.latency[i]++
+	bs.latencySum += secs
+}
+
+// methodClass labels the request counters.
+type methodClass struct {
+	method string
+	class  string
+}
+
+// protocolPair labels the protocol counters.
+type protocolPair struct {
+	client   string
+	upstream string
+}
+
+// knownMethods keep their name in the metrics; others are counted as OTHER.
+var knownMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE"}
+
+func normalizeMethod(m string) string {
+	switch {
+	case m == "":
+		return ""
+	case slices.Contains(knownMethods, m):
+		return m
+	}
+	return "OTHER"
+}
+
+// statusClass returns "2xx" for 200-299 and so on.
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// BackendGauge is the live state of a backend exposed by the metrics.
+type BackendGauge struct {
+	Pool     string
+	URL      string
+	InFlight int64
+	Up       bool
+}
+
+// MetricsHandler returns an http.Handler that serves the stats in the
+// Prometheus text format. live, when set, lists the backends currently
+// configured with their requests in flight and health.
+func MetricsHandler(live func() []BackendGauge) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		var gauges []BackendGauge
+		if live != nil {
+			gauges = live()
+		}
+		writeMetrics(w, gauges)
+	})
+}
+
+// series is a copy of a backend's stats taken for the metrics.
+type series struct {
+	labels     string
+	methods    map[methodClass]int64
+	protocols  map[protocolPair]int64
+	bounds     []float64
+	latency    []int64
+	latencySum float64
+	counters   [7]int64
+	ejected    bool
+}
+
+// counterMetrics are the per-backend counters, in the order of
+// series.counters.
+var counterMetrics = [...]struct{ name, help string }{
+	{"vortice_rate_limited_total", "Requests rejected by the backend's rate limit."},
+	{"vortice_retries_total", "Failed attempts on the backend retried on another one."},
+	{"vortice_retries_denied_total", "Failed attempts on the backend not retried because the retry budget was exhausted."},
+	{"vortice_ejections_total", "Ejections of the backend by outlier detection."},
+	{"vortice_circuit_opens_total", "Openings of the backend's circuit breaker."},
+	{"vortice_hedges_total", "Hedged attempts sent to the backend."},
+	{"vortice_timeouts_total", "Requests to the backend that timed out."},
+}
+
+func collect() []series {
+	mu.RLock()
+	defer mu.RUnlock()
+	now := time.Now()
+	out := make([]series, 0, len(stats))
+	for _, v := range stats {
+		v.mutex.Lock()
+		s := series{
+			labels:     labels("pool", v.Pool, "backend", v.URL),
+			methods:    make(map[methodClass]int64, len(v.methods)),
+			protocols:  make(map[protocolPair]int64, len(v.protocols)),
+			bounds:     v.bounds,
+			latency:    slices.Clone(v.latency),
+			latencySum: v.latencySum,
+			counters:   [7]int64{v.RateLimited, v.Retries, v.RetriesDenied, v.Ejections, v.CircuitOpens, v.Hedges, v.Timeouts},
+			ejected:    now.Before(v.EjectedUntil),
+		}
+		for k, n := range v.methods {
+			s.methods[k] = n
+		}
+		for k, n := range v.protocols {
+			s.protocols[k] = n
+		}
+		v.mutex.Unlock()
+		out = append(out, s)
+	}
+	slices.SortFunc(out, func(a, b series) int { return strings.Compare(a.labels, b.labels) })
+	return out
+}
+
+func writeMetrics(w io.Writer, gauges []BackendGauge) {
+	all := collect()
+
+	header(w, "vortice_requests_total", "counter", "Requests proxied to the backend by method and status class.")
+	for _, s := range all {
+		keys := make([]methodClass, 0, len(s.methods))
+		for k := range s.methods {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b methodClass) int {
+			return strings.Compare(a.method+" "+a.class, b.method+" "+b.class)
+		})
+		for _, k := range keys {
+			fmt.Fprintf(w, "vortice_requests_total{%s,%s} %d\n", s.labels, labels("method", k.method, "code", k.class), s.methods[k])
+		}
+	}
+
+	header(w, "vortice_requests_by_protocol_total", "counter", "Requests proxied to the backend by the protocol of the client and the one the backend answered with (empty when it did not answer).")
+	for _, s := range all {
+		keys := make([]protocolPair, 0, len(s.protocols))
+		for k := range s.protocols {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, func(a, b protocolPair) int {
+			return strings.Compare(a.client+" "+a.upstream, b.client+" "+b.upstream)
+		})
+		for _, k := range keys {
+			fmt.Fprintf(w, "vortice_requests_by_protocol_total{%s,%s} %d\n", s.labels, labels("client", k.client, "upstream", k.upstream), s.protocols[k])
+		}
+	}
+
+	header(w, "vortice_request_duration_seconds", "histogram", "Latency of the requests proxied to the backend.")
+	for _, s := range all {
+		var cum int64
+		for i, b := range s.bounds {
+			cum += s.latency[i]
+			fmt.Fprintf(w, "vortice_request_duration_seconds_bucket{%s,le=%q} %d\n", s.labels, strconv.FormatFloat(b, 'g', -1, 64), cum)
+		}
+		cum += s.latency[len(s.bounds)]
+		fmt.Fprintf(w, "vortice_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", s.labels, cum)
+		fmt.Fprintf(w, "vortice_request_duration_seconds_sum{%s} %s\n", s.labels, strconv.FormatFloat(s.latencySum, 'g', -1, 64))
+		fmt.Fprintf(w, "vortice_request_duration_seconds_count{%s} %d\n", s.labels, cum)
+	}
+
+	for i, m := range counterMetrics {
+		header(w, m.name, "counter", m.help)
+		for _, s := range all {
+			fmt.Fprintf(w, "%s{%s} %d\n", m.name, s.labels, s.counters[i])
+		}
+	}
+
+	header(w, "vortice_backend_ejected", "gauge", "Whether outlier detection keeps the backend out of the pool (1) or not (0).")
+	for _, s := range all {
+		fmt.Fprintf(w, "vortice_backend_ejected{%s} %d\n", s.labels, boolValue(s.ejected))
+	}
+
+	if gauges == nil {
+		return
+	}
+	slices.SortFunc(gauges, func(a, b BackendGauge) int {
+		return strings.Compare(a.Pool+"|"+a.URL, b.Pool+"|"+b.URL)
+	})
+	header(w, "vortice_backend_in_flight", "gauge", "Requests in flight to the backend.")
+	for _, g := range gauges {
+		fmt.Fprintf(w, "vortice_backend_in_flight{%s} %d\n", labels("pool", g.Pool, "backend", g.URL), g.InFlight)
+	}
+	header(w, "vortice_backend_up", "gauge", "Whether the backend passes its health check (1) or not (0).")
+	for _, g := range gauges {
+		fmt.Fprintf(w, "vortice_backend_up{%s} %d\n", labels("pool", g.Pool, "backend", g.URL), boolValue(g.Up))
+	}
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labels formats name/value pairs as Prometheus labels.
+func labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kv[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(kv[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
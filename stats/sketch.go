@@ -0,0 +1,158 @@
+package stats
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// sketchAccuracy is the relative error of the latency quantiles.
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// sketch is a mergeable quantile sketch of latencies (in the manner of
+// DDSketch): a latency v is counted in the logarithmic bucket
+// ceil(log_gamma(v)), so any quantile is known within sketchAccuracy and
+// sketches merge by adding their buckets.
+type sketch struct {
+	counts map[int32]int64
+	count  int64
+	max    time.Duration
+}
+
+func newSketch() *sketch {
+	return &sketch{counts: map[int32]int64{}}
+}
+
+func sketchIndex(d time.Duration) int32 {
+	return int32(math.Ceil(math.Log(float64(max(d, 1))) / sketchLogGamma))
+}
+
+func (s *sketch) add(d time.Duration) {
+	s.counts[sketchIndex(d)]++
+	s.count++
+	s.max = max(s.max, d)
+}
+
+func (s *sketch) merge(o *sketch) {
+	for i, n := range o.counts {
+		s.counts[i] += n
+	}
+	s.count += o.count
+	s.max = max(s.max, o.max)
+}
+
+// quantile returns the q-quantile (0-1) of the latencies, or 0 when the
+// sketch is empty.
+func (s *sketch) quantile(q float64) time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	idx := make([]int32, 0, len(s.counts))
+	for i := range s.counts {
+		idx = append(idx, i)
+	}
+	slices.Sort(idx)
+	rank := int64(math.Ceil(q * float64(s.count)))
+	var seen int64
+	for _, i := range idx {
+		seen += s.counts[i]
+		if seen >= rank {
+			// the middle of the bucket, never above the largest value seen
+			v := 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+			return min(time.Duration(v), s.max)
+		}
+	}
+	return s.max
+}
+
+// Stats windows: the last 15 minutes are kept in slots of windowSlot, merged
+// on demand into the 1m, 5m and 15m windows.
+const (
+	windowSlot  = 10 * time.Second
+	windowSlots = int(15 * time.Minute / windowSlot)
+)
+
+// windowSpans are the rolling windows reported in Snapshot.Windows.
+var windowSpans = []struct {
+	Name string
+	Span time.Duration
+}{{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"15m", 15 * time.Minute}}
+
+// windowSlotStats counts the requests that ended within one slot.
+type windowSlotStats struct {
+	// id is the slot's start divided by windowSlot; slots with a stale id
+	// are reused
+	id       int64
+	requests int64
+	failures int64
+	latency  *sketch
+}
+
+// windows keeps the recent requests of a backend in a ring of slots.
+type windows struct {
+	slots [windowSlots]windowSlotStats
+}
+
+func (w *windows) record(now time.Time, d time.Duration, failed bool) {
+	id := now.UnixNano() / int64(windowSlot)
+	sl := &w.slots[id%int64(windowSlots)]
+	if sl.id != id || sl.latency == nil {
+		*sl = windowSlotStats{id: id, latency: newSketch()}
+	}
+	sl.requests++
+	if failed {
+		sl.failures++
+	}
+	sl.latency.add(d)
+}
+
+// WindowStats describes the requests of a backend over a rolling window.
+type WindowStats struct {
+	Requests       int64   `json:"requests"`
+	RatePerSec     float64 `json:"rate_per_sec"`
+	FailureRatePct float64 `json:"failure_rate_pct"`
+	P50LatencyMs   float64 `json:"p50_latency_ms"`
+	P90LatencyMs   float64 `json:"p90_latency_ms"`
+	P99LatencyMs   float64 `json:"p99_latency_ms"`
+}
+
+// window summarizes the last span; since is when the backend started being
+// tracked, so the rate of a younger backend is not diluted.
+func (w *windows) window(now time.Time, span time.Duration, since time.Time) WindowStats {
+	last := now.UnixNano() / int64(windowSlot)
+	first := last - int64(span/windowSlot) + 1
+	merged := newSketch()
+	var out WindowStats
+	var failures int64
+	for i := range w.slots {
+		sl := &w.slots[i]
+		if sl.latency == nil || sl.id < first || sl.id > last {
+			continue
+		}
+		out.Requests += sl.requests
+		failures += sl.failures
+		merged.merge(sl.latency)
+	}
+	if out.Requests == 0 {
+		return out
+	}
+	out.FailureRatePct = float64(failures) / float64(out.Requests) * 100
+	elapsed := span
+	if !since.IsZero() && now.Sub(since) < span {
+		elapsed = max(now.Sub(since), time.Second)
+	}
+	out.RatePerSec = float64(out.Requests) / elapsed.Seconds()
+	out.P50LatencyMs = ms(merged.quantile(0.50))
+	out.P90LatencyMs = ms(merged.quantile(0.90))
+	out.P99LatencyMs = ms(merged.quantile(0.99))
+	return out
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / 1e6
+}
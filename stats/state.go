@@ -0,0 +1,161 @@
+package stats
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Counters is the accumulated part of a backend's stats. Export and Import
+// carry it over to a new process so a binary upgrade does not reset them.
+type Counters struct {
+	Pool          string           `json:"pool,omitempty"`
+	URL           string           `json:"url"`
+	Requests      int64            `json:"requests"`
+	TotalLatency  int64            `json:"total_latency_ns"`
+	StatusCounts  map[int]int64    `json:"status_counts"`
+	PortCounts    map[string]int64 `json:"port_counts"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpDuration    int64            `json:"up_duration_ns"`
+	Alive         bool             `json:"alive"`
+	Ejections     int64            `json:"ejections"`
+	CircuitOpens  int64            `json:"circuit_opens"`
+	Retries       int64            `json:"retries"`
+	RetriesDenied int64            `json:"retries_denied"`
+	Hedges        int64            `json:"hedges"`
+	HedgeWins     int64            `json:"hedge_wins"`
+	Timeouts      int64            `json:"timeouts"`
+	RateLimited   int64            `json:"rate_limited"`
+	// Methods counts the requests by "METHOD class" (e.g. "GET 2xx")
+	Methods map[string]int64 `json:"methods"`
+	// Protocols counts the requests by "client upstream" protocols (e.g.
+	// "HTTP/2.0 HTTP/1.1"; upstream is empty when the backend did not answer)
+	Protocols map[string]int64 `json:"protocols"`
+	// latency histogram: bucket bounds in seconds, counts (one more than
+	// the bounds, for +Inf) and sum in seconds
+	LatencyBuckets []float64 `json:"latency_buckets"`
+	LatencyCounts  []int64   `json:"latency_counts"`
+	LatencySum     float64   `json:"latency_sum"`
+	// latency quantile sketch and maximum
+	Sketch     map[int32]int64 `json:"sketch"`
+	MaxLatency int64           `json:"max_latency_ns"`
+	// up/down history of the active health check
+	Transitions []HealthTransition `json:"transitions"`
+}
+
+// Export returns the counters of every backend. The time a live backend has
+// been up since its last check is folded into UpDuration.
+func Export() []Counters {
+	mu.RLock()
+	defer mu.RUnlock()
+	now := time.Now()
+	out := make([]Counters, 0, len(stats))
+	for _, v := range stats {
+		v.mutex.Lock()
+		c := Counters{
+			Pool:           v.Pool,
+			URL:            v.URL,
+			Requests:       v.Requests,
+			TotalLatency:   v.TotalLatency,
+			StatusCounts:   map[int]int64{},
+			PortCounts:     map[string]int64{},
+			CreatedAt:      v.CreatedAt,
+			UpDuration:     v.UpDuration,
+			Alive:          v.Alive,
+			Ejections:      v.Ejections,
+			CircuitOpens:   v.CircuitOpens,
+			Retries:        v.Retries,
+			RetriesDenied:  v.RetriesDenied,
+			Hedges:         v.Hedges,
+			HedgeWins:      v.HedgeWins,
+			Timeouts:       v.Timeouts,
+			RateLimited:    v.RateLimited,
+			Methods:        map[string]int64{},
+			Protocols:      map[string]int64{},
+			LatencyBuckets: v.bounds,
+			LatencyCounts:  slices.Clone(v.latency),
+			LatencySum:     v.latencySum,
+			Sketch:         maps.Clone(v.sketch.counts),
+			MaxLatency:     int64(v.sketch.max),
+			Transitions:    slices.Clone(v.health.transitions),
+		}
+		for k, n := range v.methods {
+			c.Methods[k.method+" "+k.class] = n
+		}
+		for k, n := range v.protocols {
+			c.Protocols[k.client+" "+k.upstream] = n
+		}
+		for s, n := range v.StatusCounts {
+			c.StatusCounts[s] = n
+		}
+		for p, n := range v.PortCounts {
+			c.PortCounts[p] = n
+		}
+		if v.Alive && !v.LastChecked.IsZero() {
+			c.UpDuration += int64(now.Sub(v.LastChecked))
+		}
+		v.mutex.Unlock()
+		out = append(out, c)
+	}
+	return out
+}
+
+// Import replaces the stats of the backends in cs with the exported counters,
+// registering the backends that are not known yet.
+func Import(cs []Counters) {
+	now := time.Now()
+	for _, c := range cs {
+		bs := lookup(c.Pool, c.URL)
+		bs.mutex.Lock()
+		bs.Requests = c.Requests
+		bs.TotalLatency = c.TotalLatency
+		bs.StatusCounts = map[int]int64{}
+		for s, n := range c.StatusCounts {
+			bs.StatusCounts[s] = n
+		}
+		bs.PortCounts = map[string]int64{}
+		for p, n := range c.PortCounts {
+			bs.PortCounts[p] = n
+		}
+		if !c.CreatedAt.IsZero() {
+			bs.CreatedAt = c.CreatedAt
+		}
+		bs.UpDuration = c.UpDuration
+		bs.Alive = c.Alive
+		bs.LastChecked = now
+		bs.Ejections = c.Ejections
+		bs.CircuitOpens = c.CircuitOpens
+		bs.Retries = c.Retries
+		bs.RetriesDenied = c.RetriesDenied
+		bs.Hedges = c.Hedges
+		bs.HedgeWins = c.HedgeWins
+		bs.Timeouts = c.Timeouts
+		bs.RateLimited = c.RateLimited
+		bs.methods = map[methodClass]int64{}
+		for k, n := range c.Methods {
+			method, class, _ := strings.Cut(k, " ")
+			bs.methods[methodClass{method, class}] = n
+		}
+		bs.protocols = map[protocolPair]int64{}
+		for k, n := range c.Protocols {
+			client, upstream, _ := strings.Cut(k, " ")
+			bs.protocols[protocolPair{client, upstream}] = n
+		}
+		if len(c.Transitions) > 0 {
+			bs.health = healthState{checked: true, up: c.Alive, transitions: slices.Clone(c.Transitions)}
+		}
+		bs.sketch = newSketch()
+		for i, n := range c.Sketch {
+			bs.sketch.counts[i] = n
+			bs.sketch.count += n
+		}
+		bs.sketch.max = time.Duration(c.MaxLatency)
+		// the histogram only carries over when the buckets did not change
+		if slices.Equal(c.LatencyBuckets, bs.bounds) && len(c.LatencyCounts) == len(bs.bounds)+1 {
+			bs.latency = slices.Clone(c.LatencyCounts)
+			bs.latencySum = c.LatencySum
+		}
+		bs.mutex.Unlock()
+	}
+}
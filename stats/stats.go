@@ -8,6 +8,7 @@ import (
 )
 
 type backendStats struct {
+	Pool         string           `json:"pool,omitempty"`
 	URL          string           `json:"url"`
 	Requests     int64            `json:"requests"`
 	TotalLatency int64            `json:"total_latency_ns"`
@@ -19,52 +20,190 @@ type backendStats struct {
 	LastChecked time.Time `json:"-"`
 	UpDuration  int64     `json:"up_duration_ns"`
 	Alive       bool      `json:"-"`
+	// outlier detection
+	Ejections      int64     `json:"ejections"`
+	EjectedUntil   time.Time `json:"-"`
+	EjectionReason string    `json:"-"`
+	// circuit breaker
+	Circuit      string `json:"-"`
+	CircuitOpens int64  `json:"-"`
+	// retries
+	Retries       int64 `json:"-"`
+	RetriesDenied int64 `json:"-"`
+	// hedging
+	Hedges    int64 `json:"-"`
+	HedgeWins int64 `json:"-"`
+	// upstream timeouts
+	Timeouts int64 `json:"-"`
+	// requests rejected by the backend's rate limit
+	RateLimited int64 `json:"-"`
+	// requests by method and status class, and the latency histogram
+	// (bucket counts for the current buckets plus +Inf, sum in seconds)
+	methods map[methodClass]int64
+	// requests by the protocol of the client and the one the backend
+	// answered with (empty on transport errors)
+	protocols map[protocolPair]int64
+	// last active health check and the up/down transitions
+	health healthState
+	// latency quantiles since start and the recent windows
+	sketch     *sketch
+	windows    windows
+	bounds     []float64
+	latency    []int64
+	latencySum float64
 }
 
 type Snapshot struct {
-	URL            string        `json:"url"`
-	Requests       int64         `json:"requests"`
-	AvgLatencyMs   float64       `json:"avg_latency_ms"`
+	Pool         string  `json:"pool,omitempty"`
+	URL          string  `json:"url"`
+	Requests     int64   `json:"requests"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	// latency percentiles (within 1%) and maximum since start
+	P50LatencyMs float64 `json:"p50_latency_ms"`
+	P90LatencyMs float64 `json:"p90_latency_ms"`
+	P99LatencyMs float64 `json:"p99_latency_ms"`
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+	// Windows summarizes the last minute, 5 minutes and 15 minutes, keyed
+	// "1m", "5m" and "15m".
+	Windows map[string]WindowStats `json:"windows"`
+	// Health is the active health check state, nil until the first check.
+	Health         *HealthStatus `json:"health,omitempty"`
 	StatusCounts   map[int]int64 `json:"status_counts"`
 	FailureRatePct float64       `json:"failure_rate_pct"`
 	UptimePct      float64       `json:"uptime_pct"`
+	// Ejected is true while outlier detection keeps the backend out of the
+	// pool; Ejections counts every ejection and EjectionReason is the last one.
+	Ejected        bool       `json:"ejected"`
+	EjectedUntil   *time.Time `json:"ejected_until,omitempty"`
+	Ejections      int64      `json:"ejections"`
+	EjectionReason string     `json:"ejection_reason,omitempty"`
+	// Circuit is the circuit breaker state ("closed", "open", "half_open"),
+	// empty when the pool has no breaker; CircuitOpens counts the openings.
+	Circuit      string `json:"circuit,omitempty"`
+	CircuitOpens int64  `json:"circuit_opens,omitempty"`
+	// Retries counts the attempts on the backend that failed and were
+	// retried on another one; RetriesDenied those left unretried because the
+	// pool's retry budget was exhausted.
+	Retries       int64 `json:"retries"`
+	RetriesDenied int64 `json:"retries_denied"`
+	// Hedges counts the hedged attempts sent to the backend and HedgeWins
+	// those that answered before the original attempt.
+	Hedges    int64 `json:"hedges"`
+	HedgeWins int64 `json:"hedge_wins"`
+	// Timeouts counts the requests answered with 504 because the backend did
+	// not answer in time.
+	Timeouts int64 `json:"timeouts"`
+	// RateLimited counts the requests rejected with 429 by the backend's
+	// rate limit.
+	RateLimited int64 `json:"rate_limited"`
+	// Protocols counts the responses of the backend by the protocol it
+	// answered with ("HTTP/1.1", "HTTP/2.0") and ClientProtocols the
+	// requests sent to it by the protocol of the client.
+	Protocols       map[string]int64 `json:"protocols,omitempty"`
+	ClientProtocols map[string]int64 `json:"client_protocols,omitempty"`
 }
 
 var (
 	mu    sync.RWMutex
 	stats = map[string]*backendStats{}
+	// removed holds the keys of the unregistered backends for removedTTL, so
+	// the requests still in flight when a backend is removed do not bring its
+	// entry back
+	removed = map[string]time.Time{}
 )
 
+const removedTTL = 10 * time.Minute
+
+// Key returns the key under which a backend of a pool is stored: the plain
+// URL for the unnamed pool, "pool|url" otherwise.
+func Key(pool, url string) string {
+	if pool == "" {
+		return url
+	}
+	return pool + "|" + url
+}
+
+func newBackendStats(pool, url string, now time.Time) *backendStats {
+	return &backendStats{Pool: pool, URL: url, StatusCounts: map[int]int64{}, PortCounts: map[string]int64{}, CreatedAt: now, LastChecked: now, Alive: false,
+		methods: map[methodClass]int64{}, protocols: map[protocolPair]int64{}, sketch: newSketch(), bounds: buckets, latency: make([]int64, len(buckets)+1)}
+}
+
 // RegisterBackend ensures a backend entry exists.
 func RegisterBackend(url string) {
+	RegisterPoolBackend("", url)
+}
+
+// RegisterPoolBackend ensures an entry exists for a backend of a named pool.
+func RegisterPoolBackend(pool, url string) {
 	mu.Lock()
 	defer mu.Unlock()
-	if _, ok := stats[url]; !ok {
-		now := time.Now()
-		stats[url] = &backendStats{URL: url, StatusCounts: map[int]int64{}, PortCounts: map[string]int64{}, CreatedAt: now, LastChecked: now, Alive: false}
+	key := Key(pool, url)
+	delete(removed, key)
+	if _, ok := stats[key]; !ok {
+		stats[key] = newBackendStats(pool, url, time.Now())
 	}
 }
 
-// RecordHealth updates uptime info for a backend based on a health check.
-func RecordHealth(url string, alive bool) {
+// UnregisterPoolBackend drops the entry of a backend removed from a named
+// pool, so it no longer shows in the stats and metrics. What is recorded for
+// it afterwards is discarded until it is registered again.
+func UnregisterPoolBackend(pool, url string) {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	for k, at := range removed {
+		if now.Sub(at) > removedTTL {
+			delete(removed, k)
+		}
+	}
+	key := Key(pool, url)
+	delete(stats, key)
+	removed[key] = now
+}
+
+// lookup returns the entry for a backend, registering it if needed. The
+// entry of a backend just unregistered is a detached one.
+func lookup(pool, url string) *backendStats {
+	key := Key(pool, url)
 	mu.RLock()
-	bs, ok := stats[url]
+	bs, ok := stats[key]
 	mu.RUnlock()
-	if !ok {
-		RegisterBackend(url)
-		mu.RLock()
-		bs = stats[url]
-		mu.RUnlock()
+	if ok {
+		return bs
 	}
+	mu.Lock()
+	defer mu.Unlock()
+	if bs, ok := stats[key]; ok {
+		return bs
+	}
+	bs = newBackendStats(pool, url, time.Now())
+	if _, ok := removed[key]; !ok {
+		stats[key] = bs
+	}
+	return bs
+}
+
+// RecordHealth updates uptime info for a backend based on a health check.
+func RecordHealth(url string, alive bool) {
+	RecordPoolHealth("", url, alive)
+}
+
+// RecordPoolHealth is RecordHealth for a backend of a named pool.
+func RecordPoolHealth(pool, url string, alive bool) {
+	bs := lookup(pool, url)
 	bs.mutex.Lock()
-	now := time.Now()
+	bs.recordHealth(alive, time.Now())
+	bs.mutex.Unlock()
+}
+
+// recordHealth updates the uptime; bs.mutex must be held.
+func (bs *backendStats) recordHealth(alive bool, now time.Time) {
 	if bs.CreatedAt.IsZero() {
 		bs.CreatedAt = now
 	}
 	if bs.LastChecked.IsZero() {
 		bs.LastChecked = now
 		bs.Alive = alive
-		bs.mutex.Unlock()
 		return
 	}
 	// time since last check
@@ -74,24 +213,111 @@ func RecordHealth(url string, alive bool) {
 	}
 	bs.LastChecked = now
 	bs.Alive = alive
+}
+
+// RecordEjection records that outlier detection ejected a backend until the
+// given time.
+func RecordEjection(pool, url, reason string, until time.Time) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.Ejections++
+	bs.EjectedUntil = until
+	bs.EjectionReason = reason
+	bs.mutex.Unlock()
+}
+
+// RecordRestore records that an ejected backend is back in the pool.
+func RecordRestore(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.EjectedUntil = time.Time{}
+	bs.mutex.Unlock()
+}
+
+// RecordCircuit records a circuit breaker state change of a backend.
+func RecordCircuit(pool, url, state string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.Circuit = state
+	if state == "open" {
+		bs.CircuitOpens++
+	}
+	bs.mutex.Unlock()
+}
+
+// RecordRetry records that a request that failed on a backend was retried on
+// another one.
+func RecordRetry(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.Retries++
+	bs.mutex.Unlock()
+}
+
+// RecordRetryDenied records that a request that failed on a backend was not
+// retried because the retry budget was exhausted.
+func RecordRetryDenied(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.RetriesDenied++
+	bs.mutex.Unlock()
+}
+
+// RecordHedge records a hedged attempt sent to a backend.
+func RecordHedge(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.Hedges++
+	bs.mutex.Unlock()
+}
+
+// RecordHedgeWin records that a hedged attempt sent to a backend answered
+// before the original one.
+func RecordHedgeWin(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.HedgeWins++
+	bs.mutex.Unlock()
+}
+
+// RecordTimeout records a request to a backend that timed out.
+func RecordTimeout(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.Timeouts++
+	bs.mutex.Unlock()
+}
+
+// RecordRateLimited records a request rejected by a backend's rate limit.
+func RecordRateLimited(pool, url string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.RateLimited++
 	bs.mutex.Unlock()
 }
 
 // Record records a completed request for a backend.
 func Record(url string, duration time.Duration, status int) {
-	mu.RLock()
-	bs, ok := stats[url]
-	mu.RUnlock()
-	if !ok {
-		RegisterBackend(url)
-		mu.RLock()
-		bs = stats[url]
-		mu.RUnlock()
-	}
+	RecordPool("", url, duration, status)
+}
+
+// RecordPool records a completed request for a backend of a named pool.
+func RecordPool(pool, url string, duration time.Duration, status int) {
+	RecordRequest(pool, url, "", duration, status)
+}
+
+// RecordRequest is RecordPool with the method of the request, used by the
+// metrics.
+func RecordRequest(pool, url, method string, duration time.Duration, status int) {
+	bs := lookup(pool, url)
 	bs.mutex.Lock()
 	bs.Requests++
 	bs.TotalLatency += int64(duration)
 	bs.StatusCounts[status]++
+	bs.methods[methodClass{normalizeMethod(method), statusClass(status)}]++
+	bs.observe(duration)
+	bs.sketch.add(duration)
+	bs.windows.record(time.Now(), duration, status >= 400)
 	// try to extract port from url; naive parse: look for :port at end
 	// we'll scan from the right for ':' and take substring
 	u := url
@@ -112,6 +338,16 @@ func Record(url string, duration time.Duration, status int) {
 	bs.mutex.Unlock()
 }
 
+// RecordProtocol records the protocol of a request proxied to a backend:
+// client is the one used by the client and upstream the one the backend
+// answered with, empty when it did not answer.
+func RecordProtocol(pool, url, client, upstream string) {
+	bs := lookup(pool, url)
+	bs.mutex.Lock()
+	bs.protocols[protocolPair{client, upstream}]++
+	bs.mutex.Unlock()
+}
+
 // SnapshotAll returns a snapshot copy of all backend stats.
 func SnapshotAll() map[string]Snapshot {
 	out := map[string]Snapshot{}
@@ -150,24 +386,77 @@ func SnapshotAll() map[string]Snapshot {
 		if v.Requests > 0 {
 			failurePct = float64(failures) / float64(v.Requests) * 100.0
 		}
-		out[k] = Snapshot{
+		snap := Snapshot{
+			Pool:           v.Pool,
 			URL:            v.URL,
 			Requests:       v.Requests,
 			AvgLatencyMs:   avg,
+			P50LatencyMs:   ms(v.sketch.quantile(0.50)),
+			P90LatencyMs:   ms(v.sketch.quantile(0.90)),
+			P99LatencyMs:   ms(v.sketch.quantile(0.99)),
+			MaxLatencyMs:   ms(v.sketch.max),
+			Windows:        map[string]WindowStats{},
 			StatusCounts:   scopy,
 			FailureRatePct: failurePct,
 			UptimePct:      uptimePct,
+			Ejections:      v.Ejections,
+			EjectionReason: v.EjectionReason,
+			Circuit:        v.Circuit,
+			CircuitOpens:   v.CircuitOpens,
+			Retries:        v.Retries,
+			RetriesDenied:  v.RetriesDenied,
+			Hedges:         v.Hedges,
+			HedgeWins:      v.HedgeWins,
+			Timeouts:       v.Timeouts,
+			RateLimited:    v.RateLimited,
+		}
+		snap.Health = v.health.status()
+		for p, n := range v.protocols {
+			if snap.ClientProtocols == nil {
+				snap.Protocols, snap.ClientProtocols = map[string]int64{}, map[string]int64{}
+			}
+			snap.ClientProtocols[p.client] += n
+			if p.upstream != "" {
+				snap.Protocols[p.upstream] += n
+			}
+		}
+		for _, win := range windowSpans {
+			snap.Windows[win.Name] = v.windows.window(now, win.Span, v.CreatedAt)
+		}
+		if now.Before(v.EjectedUntil) {
+			until := v.EjectedUntil
+			snap.Ejected = true
+			snap.EjectedUntil = &until
 		}
+		out[k] = snap
 		v.mutex.Unlock()
 	}
 	return out
 }
 
-// Handler returns an http.Handler that serves JSON stats.
+// SnapshotByPool returns the snapshots grouped by pool name and then by
+// backend URL. Backends of the unnamed pool are grouped under "".
+func SnapshotByPool() map[string]map[string]Snapshot {
+	out := map[string]map[string]Snapshot{}
+	for _, s := range SnapshotAll() {
+		if out[s.Pool] == nil {
+			out[s.Pool] = map[string]Snapshot{}
+		}
+		out[s.Pool][s.URL] = s
+	}
+	return out
+}
+
+// Handler returns an http.Handler that serves JSON stats. With ?group=pool
+// the output is grouped by pool (see SnapshotByPool).
 func Handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		snap := SnapshotAll()
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.URL != nil && r.URL.Query().Get("group") == "pool" {
+			_ = json.NewEncoder(w).Encode(SnapshotByPool())
+			return
+		}
+		snap := SnapshotAll()
 		_ = json.NewEncoder(w).Encode(snap)
 	})
 }
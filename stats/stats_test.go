@@ -2,8 +2,10 @@ package stats
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -59,3 +61,223 @@ func TestHandlerOutput(t *testing.T) {
 		t.Fatalf("unexpected failure rate: %.2f", bs.FailureRatePct)
 	}
 }
+
+func TestSnapshotByPool(t *testing.T) {
+	RegisterPoolBackend("api", "http://localhost:9101")
+	RegisterPoolBackend("web", "http://localhost:9101")
+	RecordPool("api", "http://localhost:9101", 5*time.Millisecond, 200)
+
+	snap := SnapshotAll()
+	if snap[Key("api", "http://localhost:9101")].Requests != 1 {
+		t.Fatalf("expected api entry with 1 request, got %+v", snap[Key("api", "http://localhost:9101")])
+	}
+	if snap[Key("web", "http://localhost:9101")].Requests != 0 {
+		t.Fatalf("same URL in another pool must be tracked separately")
+	}
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/stats?group=pool", nil))
+	var grouped map[string]map[string]Snapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &grouped); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if grouped["api"]["http://localhost:9101"].Requests != 1 {
+		t.Fatalf("expected grouped api stats, got %v", grouped["api"])
+	}
+	if _, ok := grouped["web"]["http://localhost:9101"]; !ok {
+		t.Fatalf("expected web pool in grouped output")
+	}
+}
+
+func TestRecordEjectionAndRestore(t *testing.T) {
+	RecordEjection("ej", "http://e:1", "3 respostas 5xx seguidas", time.Now().Add(time.Minute))
+	snap := SnapshotAll()[Key("ej", "http://e:1")]
+	if !snap.Ejected || snap.EjectedUntil == nil || snap.Ejections != 1 || snap.EjectionReason != "3 respostas 5xx seguidas" {
+		t.Fatalf("unexpected snapshot after ejection: %+v", snap)
+	}
+	RecordRestore("ej", "http://e:1")
+	snap = SnapshotAll()[Key("ej", "http://e:1")]
+	if snap.Ejected || snap.EjectedUntil != nil || snap.Ejections != 1 {
+		t.Fatalf("unexpected snapshot after restore: %+v", snap)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	mu.Lock()
+	delete(stats, Key("upgrade", "http://a:1"))
+	mu.Unlock()
+	RecordPool("upgrade", "http://a:1", 20*time.Millisecond, 200)
+	RecordPool("upgrade", "http://a:1", 40*time.Millisecond, 502)
+	RecordRetry("upgrade", "http://a:1")
+	RecordProtocol("upgrade", "http://a:1", "HTTP/2.0", "HTTP/1.1")
+	RecordProtocol("upgrade", "http://a:1", "HTTP/1.1", "")
+
+	var saved []Counters
+	for _, c := range Export() {
+		if c.Pool == "upgrade" {
+			saved = append(saved, c)
+		}
+	}
+	if len(saved) != 1 {
+		t.Fatalf("expected the exported backend, got %+v", saved)
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// a new process starts without the entry
+	mu.Lock()
+	delete(stats, Key("upgrade", "http://a:1"))
+	mu.Unlock()
+	var loaded []Counters
+	if err := json.Unmarshal(b, &loaded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	Import(loaded)
+
+	s := SnapshotAll()[Key("upgrade", "http://a:1")]
+	if s.Requests != 2 || s.StatusCounts[502] != 1 || s.Retries != 1 || s.AvgLatencyMs < 29 || s.AvgLatencyMs > 31 {
+		t.Fatalf("counters not restored: %+v", s)
+	}
+	if s.Protocols["HTTP/1.1"] != 1 || len(s.Protocols) != 1 || s.ClientProtocols["HTTP/2.0"] != 1 || s.ClientProtocols["HTTP/1.1"] != 1 {
+		t.Fatalf("protocols not restored: %v / %v", s.Protocols, s.ClientProtocols)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	SetBuckets([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+	defer SetBuckets(nil)
+	mu.Lock()
+	delete(stats, Key("metrics", "http://m:1"))
+	mu.Unlock()
+
+	RecordRequest("metrics", "http://m:1", "GET", 5*time.Millisecond, 200)
+	RecordRequest("metrics", "http://m:1", "GET", 50*time.Millisecond, 503)
+	RecordRequest("metrics", "http://m:1", "BREW", time.Second, 200)
+	RecordRateLimited("metrics", "http://m:1")
+	RecordProtocol("metrics", "http://m:1", "HTTP/2.0", "HTTP/1.1")
+
+	rr := httptest.NewRecorder()
+	live := func() []BackendGauge {
+		return []BackendGauge{{Pool: "metrics", URL: "http://m:1", InFlight: 3, Up: true}}
+	}
+	MetricsHandler(live).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, want := range []string{
+		`vortice_requests_total{pool="metrics",backend="http://m:1",method="GET",code="2xx"} 1`,
+		`vortice_requests_total{pool="metrics",backend="http://m:1",method="GET",code="5xx"} 1`,
+		`vortice_requests_total{pool="metrics",backend="http://m:1",method="OTHER",code="2xx"} 1`,
+		`vortice_request_duration_seconds_bucket{pool="metrics",backend="http://m:1",le="0.01"} 1`,
+		`vortice_request_duration_seconds_bucket{pool="metrics",backend="http://m:1",le="0.1"} 2`,
+		`vortice_request_duration_seconds_bucket{pool="metrics",backend="http://m:1",le="+Inf"} 3`,
+		`vortice_request_duration_seconds_count{pool="metrics",backend="http://m:1"} 3`,
+		`vortice_rate_limited_total{pool="metrics",backend="http://m:1"} 1`,
+		`vortice_requests_by_protocol_total{pool="metrics",backend="http://m:1",client="HTTP/2.0",upstream="HTTP/1.1"} 1`,
+		`vortice_backend_in_flight{pool="metrics",backend="http://m:1"} 3`,
+		`vortice_backend_up{pool="metrics",backend="http://m:1"} 1`,
+		"# TYPE vortice_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestUnregisterPoolBackend(t *testing.T) {
+	RegisterPoolBackend("gone", "http://g:1")
+	RecordRequest("gone", "http://g:1", "GET", time.Millisecond, 200)
+	UnregisterPoolBackend("gone", "http://g:1")
+	// a request still in flight when the backend was removed
+	RecordRequest("gone", "http://g:1", "GET", time.Millisecond, 200)
+	RecordPoolHealth("gone", "http://g:1", true)
+
+	if _, ok := SnapshotAll()[Key("gone", "http://g:1")]; ok {
+		t.Fatal("expected the unregistered backend to leave the snapshot")
+	}
+	rr := httptest.NewRecorder()
+	MetricsHandler(nil).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rr.Body.String(), `pool="gone"`) {
+		t.Fatalf("expected no series for the unregistered backend:\n%s", rr.Body.String())
+	}
+
+	// added back, it starts from scratch
+	RegisterPoolBackend("gone", "http://g:1")
+	RecordRequest("gone", "http://g:1", "GET", time.Millisecond, 200)
+	if got := SnapshotAll()[Key("gone", "http://g:1")].Requests; got != 1 {
+		t.Fatalf("expected 1 request after registering again, got %d", got)
+	}
+}
+
+func TestSketchQuantiles(t *testing.T) {
+	s, other := newSketch(), newSketch()
+	// 1ms..1000ms, split across two sketches that are then merged
+	for i := 1; i <= 1000; i++ {
+		if i%2 == 0 {
+			s.add(time.Duration(i) * time.Millisecond)
+		} else {
+			other.add(time.Duration(i) * time.Millisecond)
+		}
+	}
+	s.merge(other)
+	for q, want := range map[float64]time.Duration{0.5: 500 * time.Millisecond, 0.9: 900 * time.Millisecond, 0.99: 990 * time.Millisecond} {
+		got := s.quantile(q)
+		if diff := math.Abs(float64(got-want)) / float64(want); diff > sketchAccuracy {
+			t.Errorf("q%.2f: expected ~%v, got %v", q, want, got)
+		}
+	}
+	if s.max != time.Second || s.quantile(1) != time.Second {
+		t.Fatalf("expected max 1s, got %v / %v", s.max, s.quantile(1))
+	}
+}
+
+func TestWindows(t *testing.T) {
+	var w windows
+	now := time.Now()
+	start := now.Add(-20 * time.Minute)
+	// old traffic, outside every window
+	w.record(now.Add(-16*time.Minute), time.Second, true)
+	// 10 fast requests 3 minutes ago, 6 slow failures in the last minute
+	for i := 0; i < 10; i++ {
+		w.record(now.Add(-3*time.Minute), 10*time.Millisecond, false)
+	}
+	for i := 0; i < 6; i++ {
+		w.record(now.Add(-5*time.Second), 500*time.Millisecond, true)
+	}
+
+	m1 := w.window(now, time.Minute, start)
+	if m1.Requests != 6 || m1.FailureRatePct != 100 || m1.RatePerSec != 0.1 || m1.P50LatencyMs < 495 || m1.P50LatencyMs > 505 {
+		t.Fatalf("unexpected 1m window %+v", m1)
+	}
+	m5 := w.window(now, 5*time.Minute, start)
+	if m5.Requests != 16 || m5.FailureRatePct != 37.5 || m5.P50LatencyMs > 11 || m5.P99LatencyMs < 495 {
+		t.Fatalf("unexpected 5m window %+v", m5)
+	}
+	if m15 := w.window(now, 15*time.Minute, start); m15.Requests != 16 {
+		t.Fatalf("expected the 16min-old request outside the 15m window, got %+v", m15)
+	}
+	// a backend tracked for 30s: rate over 30s, not the whole window
+	if young := w.window(now, 5*time.Minute, now.Add(-30*time.Second)); young.RatePerSec < 0.53 || young.RatePerSec > 0.54 {
+		t.Fatalf("unexpected rate for a young backend %+v", young)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	RecordHealthCheck("hh", "http://h:1", true, true, "", 3*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	RecordHealthCheck("hh", "http://h:1", false, false, "timeout", 2*time.Second)
+
+	rr := httptest.NewRecorder()
+	HealthHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/stats/health", nil))
+	var out map[string]HealthSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	h, ok := out[Key("hh", "http://h:1")]
+	if !ok || h.HealthStatus == nil || h.Up || h.LastCheckError != "timeout" || h.LastCheckLatencyMs != 2000 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	if len(h.Transitions) != 2 || h.Transitions[1].Reason != "timeout" || h.UptimePct <= 0 {
+		t.Fatalf("expected up then down with uptime, got %+v (uptime %.2f)", h.Transitions, h.UptimePct)
+	}
+}